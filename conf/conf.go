@@ -6,48 +6,178 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type Profile struct {
-	Name             string `mapstructure:"name"`                // 服务器名称
-	Host             string `mapstructure:"host"`                // 服务器地址
-	Port             int    `mapstructure:"port"`                // 服务器监听端口号
-	TcpVersion       string `mapstructure:"tcp_version"`         // 服务器版本号
-	MaxConn          int    `mapstructure:"max_conn"`            // 最大连接数
-	MaxPacketSize    uint32 `mapstructure:"max_packet_size"`     // 一个客户端数据包的最大数据长度
-	WorkerPoolSize   int    `mapstructure:"worker_pool_size"`    // Worker 数量
-	MaxWorkerTaskLen int    `mapstructure:"max_worker_task_len"` // Worker 任务队列长度
-	MaxMsgChanLen    int    `mapstructure:"max_msg_chan_len"`    // 连接发送队列的缓冲区长度
-	LogFileName      string `mapstructure:"log_file_name"`       // 日志文件，为空则不保存
-	MaxHeartbeatTime int    `mapstructure:"max_heartbeat_time"`  // 心跳检测的最大时间间隔
-	CrtFileName      string `mapstructure:"crt_file_name"`
-	KeyFileName      string `mapstructure:"key_file_name"`
-	PrintBanner      bool   `mapstructure:"print_banner"`
+	Name              string   `mapstructure:"name"`                // 服务器名称
+	Host              string   `mapstructure:"host"`                // 服务器地址
+	Port              int      `mapstructure:"port"`                // 服务器监听端口号
+	TcpVersion        string   `mapstructure:"tcp_version"`         // 服务器版本号
+	MaxConn           int      `mapstructure:"max_conn"`            // 最大连接数
+	MaxConnPerIP      int      `mapstructure:"max_conn_per_ip"`     // 单个IP的最大连接数，为0则不限制
+	CIDRConnLimits    []string `mapstructure:"cidr_conn_limits"`    // 网段的最大连接数，格式为 <cidr>=<max>
+	MaxConnsPerUser   int      `mapstructure:"max_conns_per_user"`  // 绑定到同一个用户的最大连接数，为0则不限制
+	UserConnPolicy    string   `mapstructure:"user_conn_policy"`    // 用户的连接数超过限制时的处理策略 kick_oldest/reject_new
+	AcceptRate        float64  `mapstructure:"accept_rate"`         // 每秒最多接受的连接数，为0则不限制
+	AcceptBurst       int      `mapstructure:"accept_burst"`        // 接受连接的突发数量
+	SendRejectFrame   bool     `mapstructure:"send_reject_frame"`   // 拒绝连接时是否向客户端发送拒绝原因
+	AllowList         []string `mapstructure:"allow_list"`          // IP白名单，支持CIDR，为空则允许所有IP
+	DenyList          []string `mapstructure:"deny_list"`           // IP黑名单，支持CIDR，优先于白名单
+	MaxPacketSize     uint32   `mapstructure:"max_packet_size"`     // 一个客户端数据包的最大数据长度
+	MsgRateLimit      float64  `mapstructure:"msg_rate_limit"`      // 每个连接每秒最多处理的消息数，为0则不限制
+	MsgRateBurst      int      `mapstructure:"msg_rate_burst"`      // 每个连接消息数的突发数量
+	ByteRateLimit     float64  `mapstructure:"byte_rate_limit"`     // 每个连接每秒最多处理的字节数，为0则不限制
+	ByteRateBurst     int      `mapstructure:"byte_rate_burst"`     // 每个连接字节数的突发数量
+	RouteRateLimits   []string `mapstructure:"route_rate_limits"`   // 每个连接每个MsgID每秒最多处理的消息数，格式为 <msgID>=<rate>
+	RateLimitPolicy   string   `mapstructure:"rate_limit_policy"`   // 超过限流时的处理策略 drop/delay/reply/disconnect
+	WorkerPoolSize    int      `mapstructure:"worker_pool_size"`    // Worker 数量
+	MaxWorkerTaskLen  int      `mapstructure:"max_worker_task_len"` // Worker 任务队列长度
+	MaxMsgChanLen     int      `mapstructure:"max_msg_chan_len"`    // 连接发送队列的缓冲区长度
+	SendQueuePolicy   string   `mapstructure:"send_queue_policy"`   // 连接发送队列满时的溢出策略 block/drop_newest/drop_oldest/disconnect
+	WriteBatchSize    int      `mapstructure:"write_batch_size"`    // 一次写入连接的最大消息数
+	WriteFlushDelay   int      `mapstructure:"write_flush_delay"`   // 发送队列为空时等待更多消息合并写入的最长时间（微秒），为0则不等待
+	TaskQueuePolicy   string   `mapstructure:"task_queue_policy"`   // Worker 任务队列满时的溢出策略 block/drop_newest/drop_oldest/disconnect
+	NetworkMode       string   `mapstructure:"network_mode"`        // 网络模型 goroutine/epoll，epoll 仅支持 Linux
+	EventLoopNum      int      `mapstructure:"event_loop_num"`      // epoll 模式下事件循环的数量，为0则与CPU核数相同
+	LogFileName       string   `mapstructure:"log_file_name"`       // 日志文件，为空则不保存
+	LogMaxSize        int      `mapstructure:"log_max_size"`        // 单个日志文件的最大大小（MB），为0则不按大小切割
+	LogRotateTime     int      `mapstructure:"log_rotate_time"`     // 按时间切割日志文件的时间间隔（秒），为0则不按时间切割
+	LogMaxBackups     int      `mapstructure:"log_max_backups"`     // 最多保留的历史日志文件个数，为0则全部保留
+	LogCompress       bool     `mapstructure:"log_compress"`        // 是否使用gzip压缩历史日志文件
+	LogLevel          string   `mapstructure:"log_level"`           // 日志级别 debug/info/warn/error
+	MaxHeartbeatTime  int      `mapstructure:"max_heartbeat_time"`  // 心跳检测的最大时间间隔
+	ReaderIdleTime    int      `mapstructure:"reader_idle_time"`    // 多长时间没有读到数据视为读空闲（秒），为0则不检测
+	WriterIdleTime    int      `mapstructure:"writer_idle_time"`    // 多长时间没有写出数据视为写空闲（秒），为0则不检测
+	AllIdleTime       int      `mapstructure:"all_idle_time"`       // 多长时间没有读写数据视为读写空闲（秒），为0则不检测
+	AuthTimeout       int      `mapstructure:"auth_timeout"`        // 开启认证时，连接建立之后完成认证的最长时间（秒）
+	SessionGraceTime  int      `mapstructure:"session_grace_time"`  // 开启会话时，连接断开之后保留会话的时间（秒）
+	SessionMaxPending int      `mapstructure:"session_max_pending"` // 开启会话时，每个会话最多保留的未确认消息数
+	ReliableTimeout   int      `mapstructure:"reliable_timeout"`    // 可靠消息超过此时间没有收到确认时重发（毫秒）
+	ReliableRetries   int      `mapstructure:"reliable_retries"`    // 可靠消息超时重发的最大次数，为0则一直重发
+	ReliablePending   int      `mapstructure:"reliable_pending"`    // 每个连接最多等待确认的可靠消息数
+	TopicQueueSize    int      `mapstructure:"topic_queue_size"`    // 每个订阅者等待发送的主题消息数
+	TopicQueuePolicy  string   `mapstructure:"topic_queue_policy"`  // 订阅者队列满时的溢出策略 drop_newest/drop_oldest/disconnect
+	CrtFileName       string   `mapstructure:"crt_file_name"`
+	KeyFileName       string   `mapstructure:"key_file_name"`
+	PrintBanner       bool     `mapstructure:"print_banner"`
+	WatchConfig       bool     `mapstructure:"watch_config"` // 是否监听配置文件的变化，并在运行时应用
 }
 
 func (profile *Profile) GetMaxHeartbeatTime() time.Duration {
 	return time.Duration(profile.MaxHeartbeatTime) * time.Second
 }
 
+func (profile *Profile) GetReaderIdleTime() time.Duration {
+	return time.Duration(profile.ReaderIdleTime) * time.Second
+}
+
+func (profile *Profile) GetWriterIdleTime() time.Duration {
+	return time.Duration(profile.WriterIdleTime) * time.Second
+}
+
+func (profile *Profile) GetAllIdleTime() time.Duration {
+	return time.Duration(profile.AllIdleTime) * time.Second
+}
+
+func (profile *Profile) GetAuthTimeout() time.Duration {
+	return time.Duration(profile.AuthTimeout) * time.Second
+}
+
+func (profile *Profile) GetSessionGraceTime() time.Duration {
+	return time.Duration(profile.SessionGraceTime) * time.Second
+}
+
+func (profile *Profile) GetReliableTimeout() time.Duration {
+	return time.Duration(profile.ReliableTimeout) * time.Millisecond
+}
+
+func (profile *Profile) GetWriteFlushDelay() time.Duration {
+	return time.Duration(profile.WriteFlushDelay) * time.Microsecond
+}
+
+func (profile *Profile) GetLogRotateTime() time.Duration {
+	return time.Duration(profile.LogRotateTime) * time.Second
+}
+
+// GlobalProfile 启动时的配置，在启动服务器之前通过BindProfile和Load修改，运行时读取配置应该使用Current
 var GlobalProfile *Profile
 
+// current 当前生效的配置，热加载时整体替换，不会原地修改
+var current atomic.Pointer[Profile]
+
+// Current 获取当前生效的配置，返回的配置不能修改
+func Current() *Profile {
+	return current.Load()
+}
+
+// publish 将GlobalProfile的副本作为当前生效的配置
+func publish() {
+	profile := *GlobalProfile
+	current.Store(&profile)
+}
+
 func init() {
-	GlobalProfile = &Profile{
-		Name:             "DefaultName",
-		Host:             "127.0.0.1",
-		Port:             6177,
-		TcpVersion:       "tcp4",
-		MaxConn:          12000,
-		MaxPacketSize:    0,
-		WorkerPoolSize:   10,
-		MaxWorkerTaskLen: 1024,
-		MaxMsgChanLen:    1024,
-		LogFileName:      "",
-		MaxHeartbeatTime: 10,
-		CrtFileName:      "crt.pem",
-		KeyFileName:      "crt.pem",
-		PrintBanner:      true,
+	GlobalProfile = defaultProfile()
+	publish()
+}
+
+// defaultProfile 所有配置项的默认值
+func defaultProfile() *Profile {
+	return &Profile{
+		Name:              "DefaultName",
+		Host:              "127.0.0.1",
+		Port:              6177,
+		TcpVersion:        "tcp4",
+		MaxConn:           12000,
+		MaxConnPerIP:      0,
+		CIDRConnLimits:    nil,
+		MaxConnsPerUser:   0,
+		UserConnPolicy:    "kick_oldest",
+		AcceptRate:        0,
+		AcceptBurst:       0,
+		SendRejectFrame:   false,
+		AllowList:         nil,
+		DenyList:          nil,
+		MaxPacketSize:     0,
+		MsgRateLimit:      0,
+		MsgRateBurst:      0,
+		ByteRateLimit:     0,
+		ByteRateBurst:     0,
+		RouteRateLimits:   nil,
+		RateLimitPolicy:   "drop",
+		WorkerPoolSize:    10,
+		MaxWorkerTaskLen:  1024,
+		MaxMsgChanLen:     1024,
+		SendQueuePolicy:   "block",
+		WriteBatchSize:    64,
+		WriteFlushDelay:   0,
+		TaskQueuePolicy:   "block",
+		NetworkMode:       "goroutine",
+		EventLoopNum:      0,
+		LogFileName:       "",
+		LogMaxSize:        0,
+		LogRotateTime:     0,
+		LogMaxBackups:     0,
+		LogCompress:       false,
+		LogLevel:          "info",
+		MaxHeartbeatTime:  10,
+		ReaderIdleTime:    0,
+		WriterIdleTime:    0,
+		AllIdleTime:       0,
+		AuthTimeout:       10,
+		SessionGraceTime:  60,
+		SessionMaxPending: 1024,
+		ReliableTimeout:   5000,
+		ReliableRetries:   3,
+		ReliablePending:   1024,
+		TopicQueueSize:    256,
+		TopicQueuePolicy:  "drop_oldest",
+		CrtFileName:       "crt.pem",
+		KeyFileName:       "crt.pem",
+		PrintBanner:       true,
+		WatchConfig:       false,
 	}
 }
 
@@ -57,38 +187,82 @@ func setViperDefault() {
 	viper.SetDefault("port", 6177)
 	viper.SetDefault("tcp_version", "tcp4")
 	viper.SetDefault("max_conn", 12000)
+	viper.SetDefault("max_conn_per_ip", 0)
+	viper.SetDefault("cidr_conn_limits", []string{})
+	viper.SetDefault("max_conns_per_user", 0)
+	viper.SetDefault("user_conn_policy", "kick_oldest")
+	viper.SetDefault("accept_rate", 0)
+	viper.SetDefault("accept_burst", 0)
+	viper.SetDefault("send_reject_frame", false)
+	viper.SetDefault("allow_list", []string{})
+	viper.SetDefault("deny_list", []string{})
 	viper.SetDefault("max_packet_size", 0)
+	viper.SetDefault("msg_rate_limit", 0)
+	viper.SetDefault("msg_rate_burst", 0)
+	viper.SetDefault("byte_rate_limit", 0)
+	viper.SetDefault("byte_rate_burst", 0)
+	viper.SetDefault("route_rate_limits", []string{})
+	viper.SetDefault("rate_limit_policy", "drop")
 	viper.SetDefault("worker_pool_size", 10)
 	viper.SetDefault("max_worker_task_len", 1024)
 	viper.SetDefault("max_msg_chan_len", 1024)
+	viper.SetDefault("send_queue_policy", "block")
+	viper.SetDefault("write_batch_size", 64)
+	viper.SetDefault("write_flush_delay", 0)
+	viper.SetDefault("task_queue_policy", "block")
+	viper.SetDefault("network_mode", "goroutine")
+	viper.SetDefault("event_loop_num", 0)
 	viper.SetDefault("log_file_name", "")
+	viper.SetDefault("log_max_size", 0)
+	viper.SetDefault("log_rotate_time", 0)
+	viper.SetDefault("log_max_backups", 0)
+	viper.SetDefault("log_compress", false)
+	viper.SetDefault("log_level", "info")
 	viper.SetDefault("max_heartbeat_time", 10)
+	viper.SetDefault("reader_idle_time", 0)
+	viper.SetDefault("writer_idle_time", 0)
+	viper.SetDefault("all_idle_time", 0)
+	viper.SetDefault("auth_timeout", 10)
+	viper.SetDefault("session_grace_time", 60)
+	viper.SetDefault("session_max_pending", 1024)
+	viper.SetDefault("reliable_timeout", 5000)
+	viper.SetDefault("reliable_retries", 3)
+	viper.SetDefault("reliable_pending", 1024)
+	viper.SetDefault("topic_queue_size", 256)
+	viper.SetDefault("topic_queue_policy", "drop_oldest")
 	viper.SetDefault("crt_file_name", "crt.pem")
 	viper.SetDefault("key_file_name", "key.pem")
 	viper.SetDefault("print_banner", true)
+	viper.SetDefault("watch_config", false)
 }
 
-// Reload 重新加载配置文件
-func Reload() {
-	// 读取配置文件
-	setViperDefault()
-	viper.SetConfigFile("config.yaml")
-	viper.SetConfigType("yaml")
-	if err := viper.ReadInConfig(); err != nil {
-		fmt.Print(err)
-		os.Exit(1)
+// setModifiedDefault 将GlobalProfile中被修改过的配置项（例如通过BindProfile设置的配置项）作为默认值，
+// 配置文件、环境变量和命令行参数都没有设置时保留修改过的值
+func setModifiedDefault() {
+	modified := reflect.ValueOf(GlobalProfile).Elem()
+	defaults := reflect.ValueOf(defaultProfile()).Elem()
+
+	for i := 0; i < modified.NumField(); i++ {
+		key := modified.Type().Field(i).Tag.Get("mapstructure")
+		if key == "" || reflect.DeepEqual(modified.Field(i).Interface(), defaults.Field(i).Interface()) {
+			continue
+		}
+
+		viper.SetDefault(key, modified.Field(i).Interface())
 	}
+}
 
-	// 加载配置文件
-	if err := viper.Unmarshal(&GlobalProfile); err != nil {
+// Reload 重新加载配置文件，配置文件不合法时直接退出
+func Reload() {
+	if err := Load(""); err != nil {
 		fmt.Print(err)
 		os.Exit(1)
 	}
 }
 
 func PrintGlobalProfile() {
-	globalProfileValue := reflect.ValueOf(GlobalProfile).Elem()
-	globalProfileType := reflect.TypeOf(*GlobalProfile)
+	globalProfileValue := reflect.ValueOf(Current()).Elem()
+	globalProfileType := globalProfileValue.Type()
 
 	fmt.Println(`
 ======================================================
@@ -128,10 +302,70 @@ func BindProfile(profile *Profile) {
 		GlobalProfile.MaxConn = profile.MaxConn
 	}
 
+	if profile.MaxConnPerIP != 0 {
+		GlobalProfile.MaxConnPerIP = profile.MaxConnPerIP
+	}
+
+	if profile.CIDRConnLimits != nil {
+		GlobalProfile.CIDRConnLimits = profile.CIDRConnLimits
+	}
+
+	if profile.MaxConnsPerUser != 0 {
+		GlobalProfile.MaxConnsPerUser = profile.MaxConnsPerUser
+	}
+
+	if profile.UserConnPolicy != "" {
+		GlobalProfile.UserConnPolicy = profile.UserConnPolicy
+	}
+
+	if profile.AcceptRate != 0 {
+		GlobalProfile.AcceptRate = profile.AcceptRate
+	}
+
+	if profile.AcceptBurst != 0 {
+		GlobalProfile.AcceptBurst = profile.AcceptBurst
+	}
+
+	if profile.SendRejectFrame {
+		GlobalProfile.SendRejectFrame = profile.SendRejectFrame
+	}
+
+	if profile.AllowList != nil {
+		GlobalProfile.AllowList = profile.AllowList
+	}
+
+	if profile.DenyList != nil {
+		GlobalProfile.DenyList = profile.DenyList
+	}
+
 	if profile.MaxPacketSize != 0 {
 		GlobalProfile.MaxPacketSize = profile.MaxPacketSize
 	}
 
+	if profile.MsgRateLimit != 0 {
+		GlobalProfile.MsgRateLimit = profile.MsgRateLimit
+	}
+
+	if profile.MsgRateBurst != 0 {
+		GlobalProfile.MsgRateBurst = profile.MsgRateBurst
+	}
+
+	if profile.ByteRateLimit != 0 {
+		GlobalProfile.ByteRateLimit = profile.ByteRateLimit
+	}
+
+	if profile.ByteRateBurst != 0 {
+		GlobalProfile.ByteRateBurst = profile.ByteRateBurst
+	}
+
+	if profile.RouteRateLimits != nil {
+		GlobalProfile.RouteRateLimits = profile.RouteRateLimits
+	}
+
+	if profile.RateLimitPolicy != "" {
+		GlobalProfile.RateLimitPolicy = profile.RateLimitPolicy
+	}
+
 	if profile.WorkerPoolSize != 0 {
 		GlobalProfile.WorkerPoolSize = profile.WorkerPoolSize
 	}
@@ -144,14 +378,98 @@ func BindProfile(profile *Profile) {
 		GlobalProfile.MaxMsgChanLen = profile.MaxMsgChanLen
 	}
 
+	if profile.SendQueuePolicy != "" {
+		GlobalProfile.SendQueuePolicy = profile.SendQueuePolicy
+	}
+
+	if profile.WriteBatchSize != 0 {
+		GlobalProfile.WriteBatchSize = profile.WriteBatchSize
+	}
+
+	if profile.WriteFlushDelay != 0 {
+		GlobalProfile.WriteFlushDelay = profile.WriteFlushDelay
+	}
+
+	if profile.TaskQueuePolicy != "" {
+		GlobalProfile.TaskQueuePolicy = profile.TaskQueuePolicy
+	}
+
+	if profile.NetworkMode != "" {
+		GlobalProfile.NetworkMode = profile.NetworkMode
+	}
+
+	if profile.EventLoopNum != 0 {
+		GlobalProfile.EventLoopNum = profile.EventLoopNum
+	}
+
 	if profile.LogFileName != "" {
 		GlobalProfile.LogFileName = profile.LogFileName
 	}
 
+	if profile.LogMaxSize != 0 {
+		GlobalProfile.LogMaxSize = profile.LogMaxSize
+	}
+
+	if profile.LogRotateTime != 0 {
+		GlobalProfile.LogRotateTime = profile.LogRotateTime
+	}
+
+	if profile.LogMaxBackups != 0 {
+		GlobalProfile.LogMaxBackups = profile.LogMaxBackups
+	}
+
+	if profile.LogCompress {
+		GlobalProfile.LogCompress = profile.LogCompress
+	}
+
 	if profile.MaxHeartbeatTime != 0 {
 		GlobalProfile.MaxHeartbeatTime = profile.MaxHeartbeatTime
 	}
 
+	if profile.ReaderIdleTime != 0 {
+		GlobalProfile.ReaderIdleTime = profile.ReaderIdleTime
+	}
+
+	if profile.WriterIdleTime != 0 {
+		GlobalProfile.WriterIdleTime = profile.WriterIdleTime
+	}
+
+	if profile.AllIdleTime != 0 {
+		GlobalProfile.AllIdleTime = profile.AllIdleTime
+	}
+
+	if profile.AuthTimeout != 0 {
+		GlobalProfile.AuthTimeout = profile.AuthTimeout
+	}
+
+	if profile.SessionGraceTime != 0 {
+		GlobalProfile.SessionGraceTime = profile.SessionGraceTime
+	}
+
+	if profile.SessionMaxPending != 0 {
+		GlobalProfile.SessionMaxPending = profile.SessionMaxPending
+	}
+
+	if profile.ReliableTimeout != 0 {
+		GlobalProfile.ReliableTimeout = profile.ReliableTimeout
+	}
+
+	if profile.ReliableRetries != 0 {
+		GlobalProfile.ReliableRetries = profile.ReliableRetries
+	}
+
+	if profile.ReliablePending != 0 {
+		GlobalProfile.ReliablePending = profile.ReliablePending
+	}
+
+	if profile.TopicQueueSize != 0 {
+		GlobalProfile.TopicQueueSize = profile.TopicQueueSize
+	}
+
+	if profile.TopicQueuePolicy != "" {
+		GlobalProfile.TopicQueuePolicy = profile.TopicQueuePolicy
+	}
+
 	if profile.CrtFileName != "" {
 		GlobalProfile.CrtFileName = profile.CrtFileName
 	}
@@ -160,7 +478,17 @@ func BindProfile(profile *Profile) {
 		GlobalProfile.KeyFileName = profile.KeyFileName
 	}
 
+	if profile.LogLevel != "" {
+		GlobalProfile.LogLevel = profile.LogLevel
+	}
+
 	if profile.PrintBanner != GlobalProfile.PrintBanner {
 		GlobalProfile.PrintBanner = profile.PrintBanner
 	}
+
+	if profile.WatchConfig {
+		GlobalProfile.WatchConfig = profile.WatchConfig
+	}
+
+	publish()
 }
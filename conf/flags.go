@@ -0,0 +1,53 @@
+package conf
+
+import (
+	"fmt"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"reflect"
+	"strings"
+)
+
+var flagConfigFile string // --config 指定的配置文件路径
+
+// BindFlags 为Profile中的每一个配置项注册命令行参数，并添加 --config 参数指定配置文件路径。
+// 配置项 max_conn 对应的命令行参数为 --max-conn，只有显式传入的命令行参数才会覆盖配置文件
+func BindFlags(fs *pflag.FlagSet) error {
+	fs.StringVar(&flagConfigFile, "config", "", fmt.Sprintf("config file path (yaml/yml/json/toml), default %s", DefaultConfigFile))
+
+	profileValue := reflect.ValueOf(GlobalProfile).Elem()
+	profileType := profileValue.Type()
+
+	for i := 0; i < profileType.NumField(); i++ {
+		key := profileType.Field(i).Tag.Get("mapstructure")
+		if key == "" {
+			continue
+		}
+
+		name := strings.ReplaceAll(key, "_", "-")
+		usage := fmt.Sprintf("overrides %q in config file", key)
+
+		switch value := profileValue.Field(i).Interface().(type) {
+		case string:
+			fs.String(name, value, usage)
+		case int:
+			fs.Int(name, value, usage)
+		case uint32:
+			fs.Uint32(name, value, usage)
+		case float64:
+			fs.Float64(name, value, usage)
+		case bool:
+			fs.Bool(name, value, usage)
+		case []string:
+			fs.StringSlice(name, value, usage)
+		default:
+			return fmt.Errorf("unsupported flag type %T of config %s", value, key)
+		}
+
+		if err := viper.BindPFlag(key, fs.Lookup(name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
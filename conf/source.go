@@ -0,0 +1,107 @@
+package conf
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultConfigFile = "config.yaml" // 默认的配置文件路径
+	EnvPrefix         = "HAMBLE"      // 环境变量前缀，如 HAMBLE_MAX_CONN 会覆盖 max_conn
+	ConfigFileEnv     = "HAMBLE_CONFIG"
+)
+
+var (
+	configFile   string // 配置文件路径，为空时依次使用 --config、HAMBLE_CONFIG 和 DefaultConfigFile
+	configFileMu sync.Mutex
+)
+
+// SetConfigFile 设置配置文件路径，支持 yaml/yml/json/toml 格式
+func SetConfigFile(path string) {
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+
+	configFile = path
+}
+
+// ConfigFile 获取当前使用的配置文件路径
+func ConfigFile() string {
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+
+	if configFile != "" {
+		return configFile
+	}
+
+	if flagConfigFile != "" {
+		return flagConfigFile
+	}
+
+	if path := os.Getenv(ConfigFileEnv); path != "" {
+		return path
+	}
+
+	return DefaultConfigFile
+}
+
+// Load 从配置文件加载配置，path为空时使用ConfigFile()。
+// 配置的优先级从高到低依次为：命令行参数、HAMBLE_*环境变量、配置文件、加载之前通过BindProfile等方式修改的GlobalProfile、默认值。
+// 配置文件中出现未知的配置项时返回错误
+func Load(path string) error {
+	if path == "" {
+		path = ConfigFile()
+	} else {
+		SetConfigFile(path)
+	}
+
+	configType, err := configTypeOf(path)
+	if err != nil {
+		return err
+	}
+
+	setViperDefault()
+	setModifiedDefault()
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	viper.AutomaticEnv()
+
+	// 读取配置文件
+	viper.SetConfigFile(path)
+	viper.SetConfigType(configType)
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("read config file [%s] err: %w", path, err)
+	}
+
+	// 加载配置文件，严格解码以发现拼写错误的配置项
+	profile := &Profile{}
+	if err := viper.UnmarshalExact(profile); err != nil {
+		return fmt.Errorf("decode config file [%s] err: %w", path, err)
+	}
+
+	// 检查配置是否合法
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+
+	*GlobalProfile = *profile
+	publish()
+	configLoaded.Store(true)
+
+	return nil
+}
+
+func configTypeOf(path string) (string, error) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	switch ext {
+	case "yaml", "yml":
+		return "yaml", nil
+	case "json", "toml":
+		return ext, nil
+	default:
+		return "", fmt.Errorf("unsupported config file type %q, must be yaml/yml/json/toml", ext)
+	}
+}
@@ -0,0 +1,260 @@
+package conf
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ValidationError 配置校验错误，包含所有不合法的配置项
+type ValidationError struct {
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(e.Errors, "; "))
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Errors = append(e.Errors, fmt.Sprintf(format, args...))
+}
+
+// Validate 检查配置是否合法，不合法时返回*ValidationError
+func (profile *Profile) Validate() error {
+	e := &ValidationError{}
+
+	if profile.Port <= 0 || profile.Port > 65535 {
+		e.add("port must be in (0, 65535], got %d", profile.Port)
+	}
+
+	switch profile.TcpVersion {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		e.add("tcp_version must be one of tcp/tcp4/tcp6, got %q", profile.TcpVersion)
+	}
+
+	if profile.MaxConn <= 0 {
+		e.add("max_conn must be > 0, got %d", profile.MaxConn)
+	}
+
+	if profile.MaxConnPerIP < 0 {
+		e.add("max_conn_per_ip must be >= 0, got %d", profile.MaxConnPerIP)
+	}
+
+	for _, rule := range profile.CIDRConnLimits {
+		if err := validateCIDRLimit(rule); err != nil {
+			e.add("cidr_conn_limits: %v", err)
+		}
+	}
+
+	if profile.MaxConnsPerUser < 0 {
+		e.add("max_conns_per_user must be >= 0, got %d", profile.MaxConnsPerUser)
+	}
+
+	if profile.UserConnPolicy != "kick_oldest" && profile.UserConnPolicy != "reject_new" {
+		e.add("user_conn_policy must be one of kick_oldest/reject_new, got %q", profile.UserConnPolicy)
+	}
+
+	for _, item := range profile.AllowList {
+		if !isIPOrCIDR(item) {
+			e.add("allow_list: %q is not a valid ip or cidr", item)
+		}
+	}
+
+	for _, item := range profile.DenyList {
+		if !isIPOrCIDR(item) {
+			e.add("deny_list: %q is not a valid ip or cidr", item)
+		}
+	}
+
+	if profile.AcceptRate < 0 {
+		e.add("accept_rate must be >= 0, got %v", profile.AcceptRate)
+	}
+
+	if profile.AcceptBurst < 0 {
+		e.add("accept_burst must be >= 0, got %d", profile.AcceptBurst)
+	}
+
+	if profile.MsgRateLimit < 0 || profile.MsgRateBurst < 0 {
+		e.add("msg_rate_limit and msg_rate_burst must be >= 0, got %v and %d", profile.MsgRateLimit, profile.MsgRateBurst)
+	}
+
+	if profile.ByteRateLimit < 0 || profile.ByteRateBurst < 0 {
+		e.add("byte_rate_limit and byte_rate_burst must be >= 0, got %v and %d", profile.ByteRateLimit, profile.ByteRateBurst)
+	}
+
+	for _, rule := range profile.RouteRateLimits {
+		if err := validateRouteRateLimit(rule); err != nil {
+			e.add("route_rate_limits: %v", err)
+		}
+	}
+
+	switch profile.RateLimitPolicy {
+	case "drop", "delay", "reply", "disconnect":
+	default:
+		e.add("rate_limit_policy must be one of drop/delay/reply/disconnect, got %q", profile.RateLimitPolicy)
+	}
+
+	if profile.WorkerPoolSize < 0 {
+		e.add("worker_pool_size must be >= 0, got %d", profile.WorkerPoolSize)
+	}
+
+	if profile.WorkerPoolSize > 0 && profile.MaxWorkerTaskLen <= 0 {
+		e.add("max_worker_task_len must be > 0 when worker pool is enabled, got %d", profile.MaxWorkerTaskLen)
+	}
+
+	if profile.MaxMsgChanLen < 0 {
+		e.add("max_msg_chan_len must be >= 0, got %d", profile.MaxMsgChanLen)
+	}
+
+	if profile.WriteBatchSize <= 0 {
+		e.add("write_batch_size must be > 0, got %d", profile.WriteBatchSize)
+	}
+
+	if profile.WriteFlushDelay < 0 {
+		e.add("write_flush_delay must be >= 0, got %d", profile.WriteFlushDelay)
+	}
+
+	if !isOverflowPolicy(profile.SendQueuePolicy) {
+		e.add("send_queue_policy must be one of block/drop_newest/drop_oldest/disconnect, got %q", profile.SendQueuePolicy)
+	}
+
+	if !isOverflowPolicy(profile.TaskQueuePolicy) {
+		e.add("task_queue_policy must be one of block/drop_newest/drop_oldest/disconnect, got %q", profile.TaskQueuePolicy)
+	}
+
+	if profile.NetworkMode != "goroutine" && profile.NetworkMode != "epoll" {
+		e.add("network_mode must be one of goroutine/epoll, got %q", profile.NetworkMode)
+	}
+
+	if profile.EventLoopNum < 0 {
+		e.add("event_loop_num must be >= 0, got %d", profile.EventLoopNum)
+	}
+
+	if profile.MaxHeartbeatTime < 0 {
+		e.add("max_heartbeat_time must be >= 0, got %d", profile.MaxHeartbeatTime)
+	}
+
+	if profile.ReaderIdleTime < 0 {
+		e.add("reader_idle_time must be >= 0, got %d", profile.ReaderIdleTime)
+	}
+
+	if profile.WriterIdleTime < 0 {
+		e.add("writer_idle_time must be >= 0, got %d", profile.WriterIdleTime)
+	}
+
+	if profile.AllIdleTime < 0 {
+		e.add("all_idle_time must be >= 0, got %d", profile.AllIdleTime)
+	}
+
+	if profile.AuthTimeout <= 0 {
+		e.add("auth_timeout must be > 0, got %d", profile.AuthTimeout)
+	}
+
+	if profile.SessionGraceTime <= 0 {
+		e.add("session_grace_time must be > 0, got %d", profile.SessionGraceTime)
+	}
+
+	if profile.SessionMaxPending <= 0 {
+		e.add("session_max_pending must be > 0, got %d", profile.SessionMaxPending)
+	}
+
+	if profile.ReliableTimeout <= 0 {
+		e.add("reliable_timeout must be > 0, got %d", profile.ReliableTimeout)
+	}
+
+	if profile.ReliableRetries < 0 {
+		e.add("reliable_retries must be >= 0, got %d", profile.ReliableRetries)
+	}
+
+	if profile.ReliablePending <= 0 {
+		e.add("reliable_pending must be > 0, got %d", profile.ReliablePending)
+	}
+
+	if profile.TopicQueueSize <= 0 {
+		e.add("topic_queue_size must be > 0, got %d", profile.TopicQueueSize)
+	}
+
+	if profile.TopicQueuePolicy == "block" || !isOverflowPolicy(profile.TopicQueuePolicy) {
+		e.add("topic_queue_policy must be one of drop_newest/drop_oldest/disconnect, got %q", profile.TopicQueuePolicy)
+	}
+
+	if profile.LogMaxSize < 0 {
+		e.add("log_max_size must be >= 0, got %d", profile.LogMaxSize)
+	}
+
+	if profile.LogRotateTime < 0 {
+		e.add("log_rotate_time must be >= 0, got %d", profile.LogRotateTime)
+	}
+
+	if profile.LogMaxBackups < 0 {
+		e.add("log_max_backups must be >= 0, got %d", profile.LogMaxBackups)
+	}
+
+	if _, err := logrus.ParseLevel(profile.LogLevel); err != nil {
+		e.add("log_level must be one of debug/info/warn/error, got %q", profile.LogLevel)
+	}
+
+	if len(e.Errors) > 0 {
+		return e
+	}
+
+	return nil
+}
+
+// validateCIDRLimit 检查网段连接数限制的格式 <cidr>=<max>
+func validateCIDRLimit(rule string) error {
+	cidr, max, found := strings.Cut(rule, "=")
+	if !found {
+		return fmt.Errorf("%q must be in format <cidr>=<max>", rule)
+	}
+
+	if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+		return fmt.Errorf("%q has invalid cidr: %v", rule, err)
+	}
+
+	if n, err := strconv.Atoi(strings.TrimSpace(max)); err != nil || n <= 0 {
+		return fmt.Errorf("%q must have a positive max", rule)
+	}
+
+	return nil
+}
+
+func isIPOrCIDR(item string) bool {
+	item = strings.TrimSpace(item)
+	if strings.Contains(item, "/") {
+		_, _, err := net.ParseCIDR(item)
+		return err == nil
+	}
+
+	return net.ParseIP(item) != nil
+}
+
+// validateRouteRateLimit 检查MsgID限流规则的格式 <msgID>=<rate>
+func validateRouteRateLimit(rule string) error {
+	msgID, rate, found := strings.Cut(rule, "=")
+	if !found {
+		return fmt.Errorf("%q must be in format <msgID>=<rate>", rule)
+	}
+
+	if _, err := strconv.ParseUint(strings.TrimSpace(msgID), 10, 32); err != nil {
+		return fmt.Errorf("%q has invalid msgID", rule)
+	}
+
+	if r, err := strconv.ParseFloat(strings.TrimSpace(rate), 64); err != nil || r <= 0 {
+		return fmt.Errorf("%q must have a positive rate", rule)
+	}
+
+	return nil
+}
+
+func isOverflowPolicy(policy string) bool {
+	switch policy {
+	case "block", "drop_newest", "drop_oldest", "disconnect":
+		return true
+	default:
+		return false
+	}
+}
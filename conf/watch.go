@@ -0,0 +1,190 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// ConfigChangeFunc 配置发生变化时的回调函数，old和new分别为变化前后的配置
+type ConfigChangeFunc func(old, new *Profile)
+
+var ErrConfigNotLoaded = errors.New("config file not loaded")
+
+// runtimeFields 可以在运行时修改的配置项，其余配置项需要重启才能生效
+var runtimeFields = []string{
+	"MaxConn",
+	"MaxConnPerIP",
+	"CIDRConnLimits",
+	"MaxConnsPerUser",
+	"UserConnPolicy",
+	"AcceptRate",
+	"AcceptBurst",
+	"SendRejectFrame",
+	"AllowList",
+	"DenyList",
+	"MaxPacketSize",
+	"MsgRateLimit",
+	"MsgRateBurst",
+	"ByteRateLimit",
+	"ByteRateBurst",
+	"RouteRateLimits",
+	"RateLimitPolicy",
+	"SendQueuePolicy",
+	"WriteBatchSize",
+	"WriteFlushDelay",
+	"TaskQueuePolicy",
+	"TopicQueuePolicy",
+	"MaxHeartbeatTime",
+	"LogLevel",
+}
+
+var (
+	configLoaded atomic.Bool // 是否已经从配置文件中加载了配置
+	watchOnce    sync.Once
+
+	refreshMu sync.Mutex // 保证配置的更新串行执行
+
+	changeMu    sync.Mutex
+	changeSeq   uint64
+	changeFuncs []changeFunc // 按注册的先后顺序排列
+)
+
+type changeFunc struct {
+	id uint64
+	f  ConfigChangeFunc
+}
+
+// OnConfigChange 注册配置发生变化时的回调函数，返回取消注册的函数，可以多次调用
+func OnConfigChange(f ConfigChangeFunc) (unregister func()) {
+	if f == nil {
+		return func() {}
+	}
+
+	changeMu.Lock()
+	defer changeMu.Unlock()
+
+	changeSeq++
+	id := changeSeq
+	changeFuncs = append(changeFuncs, changeFunc{id: id, f: f})
+
+	return func() {
+		changeMu.Lock()
+		defer changeMu.Unlock()
+
+		for i, cf := range changeFuncs {
+			if cf.id == id {
+				changeFuncs = append(changeFuncs[:i:i], changeFuncs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Watch 监听配置文件，配置文件发生变化时调用Refresh应用新的配置
+func Watch() {
+	if !configLoaded.Load() {
+		logger.Warn("config file not loaded, skip watching")
+		return
+	}
+
+	watchOnce.Do(func() {
+		viper.OnConfigChange(func(e fsnotify.Event) {
+			if err := Refresh(); err != nil {
+				logger.Errorf("reload config file [%s] err: %v", e.Name, err)
+			}
+		})
+		viper.WatchConfig()
+	})
+}
+
+// Refresh 重新读取配置文件，校验通过后将可以在运行时修改的配置项应用到Current，
+// 校验不通过时保留之前的配置并返回错误。回调函数在应用新的配置之后调用，不持有任何锁
+func Refresh() error {
+	if !configLoaded.Load() {
+		return ErrConfigNotLoaded
+	}
+
+	oldProfile, appliedProfile, changed, err := refresh()
+	if err != nil || !changed {
+		return err
+	}
+
+	changeMu.Lock()
+	funcs := append([]changeFunc(nil), changeFuncs...)
+	changeMu.Unlock()
+
+	for _, cf := range funcs {
+		old, applied := *oldProfile, *appliedProfile
+		cf.f(&old, &applied)
+	}
+
+	return nil
+}
+
+// refresh 读取配置文件并替换当前生效的配置，返回替换前后的配置
+func refresh() (oldProfile, appliedProfile *Profile, changed bool, err error) {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, nil, false, fmt.Errorf("read config err: %w", err)
+	}
+
+	newProfile := &Profile{}
+	if err := viper.UnmarshalExact(newProfile); err != nil {
+		return nil, nil, false, fmt.Errorf("unmarshal config err: %w", err)
+	}
+
+	if err := newProfile.Validate(); err != nil {
+		return nil, nil, false, err
+	}
+
+	oldProfile = Current()
+	applied := *oldProfile
+
+	oldValue := reflect.ValueOf(oldProfile).Elem()
+	newValue := reflect.ValueOf(newProfile).Elem()
+	appliedValue := reflect.ValueOf(&applied).Elem()
+
+	// 只应用可以在运行时修改的配置项
+	for _, name := range runtimeFields {
+		appliedValue.FieldByName(name).Set(newValue.FieldByName(name))
+	}
+
+	// 其余配置项发生了变化，提示需要重启
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := oldValue.Type().Field(i).Name
+		if isRuntimeField(name) {
+			continue
+		}
+
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			logger.Warnf("config %s changed, restart required to take effect", name)
+		}
+	}
+
+	if reflect.DeepEqual(*oldProfile, applied) {
+		return oldProfile, oldProfile, false, nil
+	}
+
+	// 整体替换，正在读取旧配置的协程不受影响
+	current.Store(&applied)
+
+	return oldProfile, &applied, true, nil
+}
+
+func isRuntimeField(name string) bool {
+	for _, field := range runtimeFields {
+		if field == name {
+			return true
+		}
+	}
+
+	return false
+}
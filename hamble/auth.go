@@ -0,0 +1,235 @@
+package hamble
+
+import (
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"time"
+)
+
+const (
+	authResultOK     = byte(0)
+	authResultFailed = byte(1)
+
+	authRejectCloseDelay = 100 * time.Millisecond // 认证失败时等待拒绝原因发送给客户端之后再关闭连接
+
+	AuthReasonTimeout = "auth_timeout" // 认证超时
+	AuthReasonFailed  = "auth_failed"  // Authenticator没有给出原因的认证失败
+)
+
+var ErrInvalidAuthResult = errors.New("invalid auth result")
+
+// 通过认证之前总是允许处理的消息
+var authBuiltinMsgIDs = [...]uint32{
+	iface.AuthMsgID,
+	iface.DefaultHeartbeatMsgID,
+	iface.PingMsgID,
+	iface.PongMsgID,
+	iface.SessionResumeMsgID, // 会话令牌本身就是凭证
+	iface.ReliableAckMsgID,
+}
+
+func (cs *CSBase) SetAuthenticator(auth iface.Authenticator, option iface.AuthOption) {
+	cs.authenticator = auth
+	cs.authOption = option
+}
+
+func (cs *CSBase) GetAuthenticator() iface.Authenticator {
+	return cs.authenticator
+}
+
+func (cs *CSBase) GetAuthOption() iface.AuthOption {
+	return cs.authOption
+}
+
+func (cs *CSBase) SetOnAuthenticated(f iface.OnAuthenticated) {
+	cs.onAuthenticated = f
+}
+
+func (cs *CSBase) CallOnAuthenticated(conn iface.IConnection, principal *iface.Principal) {
+	if cs.onAuthenticated != nil {
+		cs.onAuthenticated(conn, principal)
+	}
+}
+
+// authAllowed 判断通过认证之前是否允许处理msgID
+func authAllowed(option iface.AuthOption, msgID uint32) bool {
+	for _, id := range authBuiltinMsgIDs {
+		if id == msgID {
+			return true
+		}
+	}
+
+	for _, id := range option.AllowedMsgIDs {
+		if id == msgID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func encodeAuthResult(ok bool, detail string) []byte {
+	status := authResultFailed
+	if ok {
+		status = authResultOK
+	}
+
+	data := make([]byte, 0, 1+len(detail))
+	data = append(data, status)
+
+	return append(data, detail...)
+}
+
+func decodeAuthResult(data []byte) (ok bool, detail string, err error) {
+	if len(data) == 0 {
+		return false, "", ErrInvalidAuthResult
+	}
+
+	return data[0] == authResultOK, string(data[1:]), nil
+}
+
+func (c *Connection) GetPrincipal() *iface.Principal {
+	return c.principal.Load()
+}
+
+func (c *Connection) IsAuthenticated() bool {
+	return c.cs.GetAuthenticator() == nil || c.principal.Load() != nil
+}
+
+// startAuth 开启认证阶段，向客户端发送hello，超时没有通过认证时关闭连接
+func (c *Connection) startAuth() {
+	auth := c.cs.GetAuthenticator()
+	if auth == nil {
+		return
+	}
+
+	timeout := c.cs.GetAuthOption().Timeout
+	if timeout <= 0 {
+		timeout = conf.Current().GetAuthTimeout()
+	}
+
+	c.authHello = auth.Hello(c)
+	c.authTimer = c.AfterFunc(timeout, func(_ iface.IConnection) {
+		if c.IsAuthenticated() {
+			return
+		}
+
+		logger.Warnf("connection from %s does not authenticate in %v, close it", c.RemoteAddr(), timeout)
+		c.cs.GetMetrics().Inc(iface.MetricAuthTimeout)
+		c.rejectAuth(AuthReasonTimeout)
+	})
+
+	_ = c.TrySend(iface.AuthHelloMsgID, c.authHello)
+}
+
+// checkAuth 检查未通过认证的连接能否处理该消息，认证消息在这里处理。返回false时不再交给Router处理
+func (c *Connection) checkAuth(msg iface.IMessage) bool {
+	if c.IsAuthenticated() {
+		return true
+	}
+
+	if msg.GetMsgID() == iface.AuthMsgID {
+		c.handleAuthMsg(append([]byte(nil), msg.GetData()...))
+		return false
+	}
+
+	if !authAllowed(c.cs.GetAuthOption(), msg.GetMsgID()) {
+		logger.Debugf("drop msgID=%v from unauthenticated connection %s", msg.GetMsgID(), c.RemoteAddr())
+		c.cs.GetMetrics().Inc(iface.MetricUnauthMsg)
+		return false
+	}
+
+	return true
+}
+
+// handleAuthMsg 校验客户端发送的凭证，每个连接只会校验一次
+func (c *Connection) handleAuthMsg(credentials []byte) {
+	if !c.authing.CompareAndSwap(false, true) {
+		return
+	}
+
+	// Authenticator可能需要访问外部服务，不能阻塞读取
+	go func() {
+		principal, err := c.cs.GetAuthenticator().Authenticate(c, c.authHello, credentials)
+		if err != nil || principal == nil {
+			reason := AuthReasonFailed
+			if err != nil {
+				reason = err.Error()
+			}
+
+			logger.Warnf("connection from %s authenticate failed: %s", c.RemoteAddr(), reason)
+			c.cs.GetMetrics().Inc(iface.MetricAuthFailed)
+			c.rejectAuth(reason)
+			return
+		}
+
+		if !c.principal.CompareAndSwap(nil, principal) {
+			// 认证期间恢复了会话，使用会话的身份
+			return
+		}
+		c.cs.GetMetrics().Inc(iface.MetricAuthSuccess)
+		logger.Infof("connection from %s authenticated as %s", c.RemoteAddr(), principal.ID)
+		c.authenticated(principal)
+	}()
+}
+
+// authenticated 连接通过认证或者恢复了已经认证的会话，告诉客户端认证结果之后调用Hook函数
+func (c *Connection) authenticated(principal *iface.Principal) {
+	if c.authTimer != nil {
+		c.authTimer.Stop()
+	}
+	_ = c.SendBufMsg(iface.AuthResultMsgID, encodeAuthResult(true, principal.ID))
+
+	c.cs.CallOnAuthenticated(c, principal)
+}
+
+// rejectAuth 告诉客户端认证失败的原因，之后关闭连接
+func (c *Connection) rejectAuth(reason string) {
+	_ = c.TrySend(iface.AuthResultMsgID, encodeAuthResult(false, reason))
+	c.AfterFunc(authRejectCloseDelay, func(conn iface.IConnection) {
+		conn.Stop()
+	})
+}
+
+// authHelloHandler 客户端收到服务器的hello之后发送凭证
+type authHelloHandler struct {
+	BaseHandler
+	credentials iface.CredentialsFunc
+}
+
+func (handler *authHelloHandler) Handle(request iface.IRequest) {
+	hello := append([]byte(nil), request.GetData()...)
+	request.Release()
+
+	credentials := handler.credentials(request.GetConnection(), hello)
+	if err := request.GetConnection().SendBufMsg(iface.AuthMsgID, credentials); err != nil {
+		logger.Errorf("send credentials to %s err: %v", request.GetConnection().RemoteAddr(), err)
+	}
+}
+
+// authResultHandler 客户端收到认证结果
+type authResultHandler struct {
+	BaseHandler
+	onAuthResult iface.OnAuthResult
+}
+
+func (handler *authResultHandler) Handle(request iface.IRequest) {
+	ok, detail, err := decodeAuthResult(request.GetData())
+	request.Release()
+	if err != nil {
+		logger.Warnf("receive auth result from %s err: %v", request.GetConnection().RemoteAddr(), err)
+		return
+	}
+
+	handler.onAuthResult(request.GetConnection(), ok, detail)
+}
+
+func (c *Client) SetCredentials(f iface.CredentialsFunc) {
+	c.RegisterHandler(iface.AuthHelloMsgID, &authHelloHandler{credentials: f})
+}
+
+func (c *Client) SetOnAuthResult(f iface.OnAuthResult) {
+	c.RegisterHandler(iface.AuthResultMsgID, &authResultHandler{onAuthResult: f})
+}
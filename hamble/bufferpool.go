@@ -0,0 +1,78 @@
+package hamble
+
+import "sync"
+
+const maxPooledWriteBufferSize = 64 * 1024 // 超过该大小的缓冲区不放回池中，避免长期占用内存
+
+var writeBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// getWriteBuffer 从池中获取一个长度为0的写缓冲区
+func getWriteBuffer() *[]byte {
+	buf := writeBufferPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+
+	return buf
+}
+
+func putWriteBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledWriteBufferSize {
+		return
+	}
+
+	writeBufferPool.Put(buf)
+}
+
+// payloadSizeClasses 读缓冲区的大小分级，超过最大分级的缓冲区不进行复用
+var payloadSizeClasses = [...]int{64, 256, 1024, 4096, 16 * 1024, 64 * 1024}
+
+var payloadPools [len(payloadSizeClasses)]sync.Pool
+
+func init() {
+	for i := range payloadPools {
+		size := payloadSizeClasses[i]
+		payloadPools[i].New = func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+}
+
+// payloadClass 获取能够容纳size字节的最小分级，没有时返回-1
+func payloadClass(size int) int {
+	for i, classSize := range payloadSizeClasses {
+		if size <= classSize {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// getPayloadBuffer 从池中获取一个长度为size的读缓冲区
+func getPayloadBuffer(size int) *[]byte {
+	class := payloadClass(size)
+	if class < 0 {
+		buf := make([]byte, size)
+		return &buf
+	}
+
+	buf := payloadPools[class].Get().(*[]byte)
+	*buf = (*buf)[:size]
+
+	return buf
+}
+
+// putPayloadBuffer 将读缓冲区放回池中，只接受由getPayloadBuffer分配的缓冲区
+func putPayloadBuffer(buf *[]byte) {
+	class := payloadClass(cap(*buf))
+	if class < 0 || payloadSizeClasses[class] != cap(*buf) {
+		return
+	}
+
+	payloadPools[class].Put(buf)
+}
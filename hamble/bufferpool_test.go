@@ -0,0 +1,69 @@
+package hamble
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestPayloadBuffer(t *testing.T) {
+	for _, size := range []int{0, 1, 64, 65, 4096, 64 * 1024, 64*1024 + 1} {
+		buf := getPayloadBuffer(size)
+		if len(*buf) != size {
+			t.Fatalf("getPayloadBuffer(%v) got len %v", size, len(*buf))
+		}
+		putPayloadBuffer(buf)
+	}
+
+	// 不是由getPayloadBuffer分配的缓冲区不会放回池中
+	foreign := make([]byte, 100)
+	putPayloadBuffer(&foreign)
+	if buf := getPayloadBuffer(100); cap(*buf) != 256 {
+		t.Fatalf("expect a pooled buffer with cap 256, got %v", cap(*buf))
+	}
+}
+
+// benchmarkReadPath 模拟读协程读取一个包并交给Handler处理的过程
+func benchmarkReadPath(b *testing.B, pooled bool) {
+	dp := NewDataPack()
+	packet, _ := dp.Pack(NewMessage(1, make([]byte, 512)))
+	reader := bytes.NewReader(packet)
+	head := make([]byte, dp.GetHeadLen())
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	for i := 0; i < b.N; i++ {
+		reader.Reset(packet)
+		if _, err := io.ReadFull(reader, head); err != nil {
+			b.Fatal(err)
+		}
+		dataLen, msgID, err := dp.UnpackHeader(head)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if !pooled {
+			data := make([]byte, dataLen)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				b.Fatal(err)
+			}
+			_ = NewRequest(nil, NewMessage(msgID, data))
+			continue
+		}
+
+		payload := getPayloadBuffer(int(dataLen))
+		if _, err := io.ReadFull(reader, *payload); err != nil {
+			b.Fatal(err)
+		}
+		newPooledRequest(nil, NewMessage(msgID, *payload), payload).Release()
+	}
+}
+
+func BenchmarkReadPathAlloc(b *testing.B) {
+	benchmarkReadPath(b, false)
+}
+
+// BenchmarkReadPathPooled Handler调用Release之后读缓冲区被复用
+func BenchmarkReadPathPooled(b *testing.B) {
+	benchmarkReadPath(b, true)
+}
@@ -0,0 +1,131 @@
+package hamble
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"sync"
+)
+
+var ErrInvalidCallMsg = errors.New("invalid call msg")
+
+// EncodeCall 编码请求和回复，数据为请求ID（8字节大端）+MsgID（4字节大端）+原始数据
+func EncodeCall(callID uint64, msgID uint32, data []byte) []byte {
+	buf := make([]byte, 12+len(data))
+	binary.BigEndian.PutUint64(buf, callID)
+	binary.BigEndian.PutUint32(buf[8:], msgID)
+	copy(buf[12:], data)
+
+	return buf
+}
+
+// DecodeCall 解码请求和回复，返回的data引用原始数据
+func DecodeCall(buf []byte) (callID uint64, msgID uint32, data []byte, err error) {
+	if len(buf) < 12 {
+		return 0, 0, nil, ErrInvalidCallMsg
+	}
+
+	callID = binary.BigEndian.Uint64(buf)
+	if callID == 0 {
+		return 0, 0, nil, ErrInvalidCallMsg
+	}
+
+	return callID, binary.BigEndian.Uint32(buf[8:]), buf[12:], nil
+}
+
+// newRequestOf 创建请求，由Call发送的请求解开之后记录请求ID
+func newRequestOf(conn iface.IConnection, msg iface.IMessage, payload *[]byte) (*Request, error) {
+	if msg.GetMsgID() != iface.CallMsgID {
+		return newPooledRequest(conn, msg, payload), nil
+	}
+
+	callID, msgID, data, err := DecodeCall(msg.GetData())
+	if err != nil {
+		return nil, err
+	}
+
+	request := newPooledRequest(conn, NewMessage(msgID, data), payload)
+	request.callID = callID
+
+	return request, nil
+}
+
+// callTable 客户端连接上等待回复的请求
+type callTable struct {
+	seq     uint64
+	pending map[uint64]chan iface.IMessage
+	mu      sync.Mutex
+}
+
+func newCallTable() *callTable {
+	return &callTable{pending: make(map[uint64]chan iface.IMessage)}
+}
+
+func (table *callTable) add() (uint64, chan iface.IMessage) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	table.seq++
+	ch := make(chan iface.IMessage, 1)
+	table.pending[table.seq] = ch
+
+	return table.seq, ch
+}
+
+func (table *callTable) remove(callID uint64) chan iface.IMessage {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	ch := table.pending[callID]
+	delete(table.pending, callID)
+
+	return ch
+}
+
+// checkReply 处理请求的回复，返回false时已经处理了该消息
+func (c *Connection) checkReply(msg iface.IMessage, payload *[]byte) bool {
+	if c.calls == nil || msg.GetMsgID() != iface.ReplyMsgID {
+		return true
+	}
+
+	callID, msgID, data, err := DecodeCall(msg.GetData())
+	if err != nil {
+		logger.Warnf("receive invalid reply from %s", c.RemoteAddr())
+		putPayloadBuffer(payload)
+		return false
+	}
+
+	if ch := c.calls.remove(callID); ch != nil {
+		ch <- NewMessage(msgID, append([]byte(nil), data...))
+	}
+	putPayloadBuffer(payload)
+
+	return false
+}
+
+// Call 发送请求并等待对端回复，连接关闭或者ctx结束时返回错误
+func (c *Client) Call(ctx context.Context, msgID uint32, data []byte) (iface.IMessage, error) {
+	connection, ok := c.connection.(*Connection)
+	if !ok || connection.calls == nil {
+		return nil, errors.New("unsupported connection type")
+	}
+
+	callID, ch := connection.calls.add()
+	if err := connection.SendWithTimeout(ctx, iface.CallMsgID, EncodeCall(callID, msgID, data)); err != nil {
+		connection.calls.remove(callID)
+		return nil, err
+	}
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-connection.closedChan:
+		connection.calls.remove(callID)
+		return nil, ErrConnClosed
+	case <-ctx.Done():
+		connection.calls.remove(callID)
+		return nil, ctx.Err()
+	}
+}
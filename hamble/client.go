@@ -1,13 +1,17 @@
 package hamble
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
-	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/hamble/heartbeat"
+	"github.com/dawnzzz/hamble-tcp-server/hamble/resolver"
+	"github.com/dawnzzz/hamble-tcp-server/hamble/timer"
 	"github.com/dawnzzz/hamble-tcp-server/iface"
 	"github.com/dawnzzz/hamble-tcp-server/logger"
 	"net"
-	"sync"
+	"strconv"
+	"time"
 )
 
 // Client 客户端
@@ -18,113 +22,229 @@ type Client struct {
 	IP         string // 客户端连接地址
 	Port       int    // 客户端连接端口号
 	connection iface.IConnection
+	useTLS     bool
 
-	exitChan chan struct{}
-	wg       sync.WaitGroup
+	session *clientSession // 会话状态，调用EnableSession之后才会记录
+	sender  *reliableQueue // 可靠消息队列，重连之后继续使用
+
+	resolver     iface.Resolver // 服务发现，不为nil时连接和重连之前重新解析服务器地址
+	nextEndpoint int            // 下一次优先尝试的地址
 }
 
 func NewClient(network string, ip string, port int) (iface.IClient, error) {
+	return newClient(network, ip, port, false, nil)
+}
+
+func NewTLSClient(network string, ip string, port int) (iface.IClient, error) {
+	return newClient(network, ip, port, true, nil)
+}
+
+// NewClientWithResolver 通过服务发现获取服务器地址，依次尝试连接直到成功，重连时重新解析
+func NewClientWithResolver(network string, resolver iface.Resolver) (iface.IClient, error) {
+	return newClient(network, "", 0, false, resolver)
+}
+
+func NewTLSClientWithResolver(network string, resolver iface.Resolver) (iface.IClient, error) {
+	return newClient(network, "", 0, true, resolver)
+}
 
-	router := newRouter()
+func newClient(network string, ip string, port int, useTLS bool, resolver iface.Resolver) (*Client, error) {
+
+	metrics := NewMetrics()
+	router := newRouter(metrics)
 
 	c := &Client{
 		CSBase: CSBase{
 			router:      router,
 			dataPack:    NewDataPack(),
 			connManager: NewConnManager(),
+			metrics:     metrics,
 		},
 		Version:    network,
 		IP:         ip,
 		Port:       port,
 		connection: nil,
-		exitChan:   make(chan struct{}, 1),
+		useTLS:     useTLS,
+		sender:     &reliableQueue{},
+		resolver:   resolver,
 	}
 
 	// 发起连接
-	addr, err := net.ResolveTCPAddr(network, fmt.Sprintf("%v:%v", ip, port))
+	conn, err := c.dial()
 	if err != nil {
-		logger.Errorf("resolve tcp addr err: %s", err.Error())
 		return nil, err
 	}
 
-	conn, err := net.DialTCP(network, nil, addr)
-	if err != nil {
-		logger.Errorf("dial tcp err: %s", err.Error())
-		return nil, err
-	}
+	// 连接成功之后才创建调度器，避免连接失败时泄露调度协程
+	c.scheduler = timer.NewScheduler()
 
 	// 创建新的连接
-	c.connection = newConnection(conn, c)
+	c.connection = c.newConnection(conn)
 
 	return c, nil
 }
 
-func NewTLSClient(network string, ip string, port int) (iface.IClient, error) {
+// newConnection 创建新的连接，重连之后仍然使用同一个可靠消息队列和会话状态
+func (c *Client) newConnection(conn net.Conn) *Connection {
+	connection := newConnection(conn, c)
+	connection.sender = c.sender
+	connection.keepUnacked = true
+	connection.clientSession = c.session
+	connection.calls = newCallTable()
+
+	return connection
+}
 
-	router := newRouter()
+// dial 连接服务器，使用服务发现时依次尝试解析到的地址
+func (c *Client) dial() (net.Conn, error) {
+	if c.resolver == nil {
+		return c.dialAddr(c.IP, c.Port)
+	}
 
-	c := &Client{
-		CSBase: CSBase{
-			router:      router,
-			dataPack:    NewDataPack(),
-			connManager: NewConnManager(),
-		},
-		Version:    network,
-		IP:         ip,
-		Port:       port,
-		connection: nil,
-		exitChan:   make(chan struct{}, 1),
+	endpoints, err := c.resolver.Resolve(context.Background())
+	if err != nil {
+		logger.Errorf("resolve server addr err: %s", err.Error())
+		return nil, err
+	}
+	if len(endpoints) == 0 {
+		return nil, resolver.ErrNoEndpoints
 	}
 
-	// 发起连接
-	config := &tls.Config{
-		InsecureSkipVerify: true, //这里是跳过证书验证，因为证书签发机构的CA证书是不被认证的
+	start := c.nextEndpoint
+	c.nextEndpoint++
+	for i := range endpoints {
+		endpoint := endpoints[(start+i)%len(endpoints)]
+		host, portStr, splitErr := net.SplitHostPort(endpoint.Addr)
+		if splitErr != nil {
+			err = splitErr
+			continue
+		}
+		port, atoiErr := strconv.Atoi(portStr)
+		if atoiErr != nil {
+			err = atoiErr
+			continue
+		}
+
+		var conn net.Conn
+		if conn, err = c.dialAddr(host, port); err == nil {
+			c.IP, c.Port = host, port
+			return conn, nil
+		}
 	}
 
-	conn, err := tls.Dial(network, fmt.Sprintf("%v:%v", ip, port), config)
+	return nil, err
+}
+
+// dialAddr 连接指定的地址
+func (c *Client) dialAddr(ip string, port int) (net.Conn, error) {
+	if c.useTLS {
+		config := &tls.Config{
+			InsecureSkipVerify: true, //这里是跳过证书验证，因为证书签发机构的CA证书是不被认证的
+		}
+
+		conn, err := tls.Dial(c.Version, fmt.Sprintf("%v:%v", ip, port), config)
+		if err != nil {
+			logger.Errorf("dial tls tcp err: %s", err.Error())
+			return nil, err
+		}
+
+		return conn, nil
+	}
+
+	addr, err := net.ResolveTCPAddr(c.Version, fmt.Sprintf("%v:%v", ip, port))
 	if err != nil {
-		logger.Errorf("dial tls tcp err: %s", err.Error())
+		logger.Errorf("resolve tcp addr err: %s", err.Error())
 		return nil, err
 	}
 
-	// 创建新的连接
-	c.connection = newConnection(conn, c)
+	conn, err := net.DialTCP(c.Version, nil, addr)
+	if err != nil {
+		logger.Errorf("dial tcp err: %s", err.Error())
+		return nil, err
+	}
 
-	return c, nil
+	return conn, nil
 }
 
-func (c *Client) Start() {
-	//客户端将协程池关闭
-	conf.GlobalProfile.WorkerPoolSize = 0
+// Reconnect 关闭当前连接之后重新连接服务器，开启会话时使用会话令牌恢复之前的会话。
+// 注册的Handler和Hook函数仍然有效，之后需要调用Start启动新的连接
+func (c *Client) Reconnect() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
 
-	logger.Infof("client start")
+	if c.connection != nil {
+		c.connection.Stop()
+	}
 
-	c.wg.Add(1)
-	go func() {
-		defer c.wg.Done()
+	connection := c.newConnection(conn)
+	resuming := false
+	if c.session != nil {
+		if request := c.session.resumeRequest(); request != nil {
+			// 在连接启动之前放入发送队列，保证恢复请求是第一条消息
+			_ = connection.TrySend(iface.SessionResumeMsgID, request)
+			resuming = true
+		}
+	}
+
+	if resuming {
+		// 重发还没有确认的可靠消息，服务器通过会话识别已经收到的消息
+		c.sender.replay(connection, 0)
+		if c.sender.len() > 0 {
+			connection.startRetransmit()
+		}
+	} else {
+		// 没有会话时服务器无法识别新的连接上重复的消息，不能重发
+		c.failUnacked(ErrNotResumed)
+	}
+	c.connection = connection
 
-		// 启动连接
-		c.connection.Start()
+	return nil
+}
 
-		// 启动一个线程检查退出信号
-		go func() {
-			select {
-			case <-c.exitChan:
-				// 停止连接
-				c.connection.Stop()
-			}
-		}()
-	}()
+func (c *Client) Start() {
+	logger.Infof("client start")
 
-	// 等待结束
-	c.wg.Wait()
+	// 启动连接，阻塞直到连接关闭
+	c.connection.Start()
 }
 
 func (c *Client) Stop() {
-	c.exitChan <- struct{}{}
+	// 停止连接
+	c.connection.Stop()
+	c.scheduler.Stop()
+
+	// 不会再重连，未确认的可靠消息全部发送失败
+	c.failUnacked(ErrConnClosed)
 	logger.Infof("client stop")
 }
 
+// failUnacked 未确认的可靠消息全部发送失败
+func (c *Client) failUnacked(err error) {
+	failed := c.sender.drain()
+	if len(failed) == 0 {
+		return
+	}
+
+	c.metrics.Add(iface.MetricReliableFail, uint64(len(failed)))
+	for _, msg := range failed {
+		c.CallOnSendFailed(c.connection, msg, err)
+	}
+}
+
+// StartHeartbeat 开始心跳检测，收到服务器通告的心跳参数时调整心跳检测器
+func (c *Client) StartHeartbeat(interval time.Duration) {
+	c.CSBase.StartHeartbeat(interval)
+	c.RegisterHandler(iface.HeartbeatConfigMsgID, &heartbeat.ConfigHandler{})
+}
+
+// StartHeartbeatWithOption 开始心跳检测，收到服务器通告的心跳参数时调整心跳检测器
+func (c *Client) StartHeartbeatWithOption(option iface.CheckerOption) {
+	c.CSBase.StartHeartbeatWithOption(option)
+	c.RegisterHandler(iface.HeartbeatConfigMsgID, &heartbeat.ConfigHandler{})
+}
+
 func (c *Client) GetConnection() iface.IConnection {
 	return c.connection
 }
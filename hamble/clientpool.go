@@ -0,0 +1,556 @@
+package hamble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dawnzzz/hamble-tcp-server/hamble/resolver"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultPoolCheckInterval = time.Second
+	hashRingReplicas         = 100 // 一致性哈希中每个地址的虚拟节点数
+)
+
+var (
+	ErrPoolClosed         = errors.New("client pool closed")
+	ErrNoAvailableClient  = errors.New("no available client in pool")
+	ErrInvalidPoolBalance = errors.New("invalid client pool balance")
+)
+
+// ClientPool 客户端连接池，实现了iface.IClientPool接口
+type ClientPool struct {
+	option iface.ClientPoolOption
+
+	addrs map[string]*poolAddr
+	ring  *hashRing
+	mu    sync.RWMutex
+
+	next     atomic.Uint64 // 轮询的计数
+	closed   atomic.Bool
+	stopChan chan struct{}
+
+	ctx    context.Context // 连接池关闭时结束，停止监听服务发现
+	cancel context.CancelFunc
+}
+
+// poolAddr 一个服务器地址上的连接
+type poolAddr struct {
+	addr    string
+	host    string
+	port    int
+	clients []*pooledClient // 由ClientPool.mu保护
+	dialing atomic.Bool     // 正在建立连接
+	removed atomic.Bool     // 地址已经被移除
+}
+
+// pooledClient 连接池中的一个连接
+type pooledClient struct {
+	client   iface.IClient
+	addr     *poolAddr
+	inflight atomic.Int64 // 正在处理的请求数，为-1时已经被回收
+	closed   atomic.Bool
+}
+
+// acquire 计入一个正在处理的请求，连接已经被回收或关闭时返回false
+func (pc *pooledClient) acquire() bool {
+	for {
+		n := pc.inflight.Load()
+		if n < 0 || pc.closed.Load() {
+			return false
+		}
+		if pc.inflight.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (pc *pooledClient) release() {
+	pc.inflight.Add(-1)
+}
+
+// retire 回收空闲的连接，连接正在处理请求时返回false
+func (pc *pooledClient) retire() bool {
+	return pc.inflight.CompareAndSwap(0, -1)
+}
+
+func NewClientPool(option iface.ClientPoolOption) (iface.IClientPool, error) {
+	if option.Network == "" {
+		option.Network = "tcp"
+	}
+	if option.Balance == "" {
+		option.Balance = iface.PoolBalanceRoundRobin
+	}
+	switch option.Balance {
+	case iface.PoolBalanceRoundRobin, iface.PoolBalanceLeastInflight, iface.PoolBalanceConsistentHash:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPoolBalance, option.Balance)
+	}
+	if option.MinIdle <= 0 {
+		option.MinIdle = 1
+	}
+	if option.MaxIdle > 0 && option.MaxIdle < option.MinIdle {
+		option.MaxIdle = option.MinIdle
+	}
+	if option.MaxConns > 0 && option.MaxConns < option.MinIdle {
+		option.MaxConns = option.MinIdle
+	}
+	if option.CheckInterval <= 0 {
+		option.CheckInterval = defaultPoolCheckInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &ClientPool{
+		option:   option,
+		addrs:    make(map[string]*poolAddr),
+		ring:     newHashRing(nil),
+		stopChan: make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	addrs := option.Addrs
+	if option.Resolver != nil {
+		endpoints, err := option.Resolver.Resolve(ctx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		addrs = resolver.Addrs(endpoints)
+	}
+
+	if err := p.setAddrs(addrs); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// 建立初始的连接
+	p.check(true)
+	go p.checkLoop()
+
+	if option.Resolver != nil {
+		err := option.Resolver.Watch(ctx, func(endpoints []iface.Endpoint) {
+			if err := p.SetAddrs(resolver.Addrs(endpoints)); err != nil && !errors.Is(err, ErrPoolClosed) {
+				logger.Warnf("client pool update addrs err: %v", err)
+			}
+		})
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *ClientPool) SetAddrs(addrs []string) error {
+	if err := p.setAddrs(addrs); err != nil {
+		return err
+	}
+
+	// 为新的地址建立连接
+	p.check(false)
+
+	return nil
+}
+
+func (p *ClientPool) setAddrs(addrs []string) error {
+	if p.closed.Load() {
+		return ErrPoolClosed
+	}
+
+	added := make(map[string]*poolAddr, len(addrs))
+	for _, addr := range addrs {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid addr %q: %w", addr, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return fmt.Errorf("invalid port of addr %q: %w", addr, err)
+		}
+
+		added[addr] = &poolAddr{addr: addr, host: host, port: port}
+	}
+
+	var removed []*pooledClient
+
+	p.mu.Lock()
+	for addr, pa := range p.addrs {
+		if _, exist := added[addr]; exist {
+			// 保留已经存在的地址
+			added[addr] = pa
+			continue
+		}
+
+		pa.removed.Store(true)
+		removed = append(removed, pa.clients...)
+		pa.clients = nil
+	}
+	p.addrs = added
+
+	ring := make([]string, 0, len(added))
+	for addr := range added {
+		ring = append(ring, addr)
+	}
+	p.ring = newHashRing(ring)
+	p.mu.Unlock()
+
+	for _, pc := range removed {
+		pc.client.Stop()
+	}
+
+	return nil
+}
+
+func (p *ClientPool) Addrs() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	addrs := make([]string, 0, len(p.addrs))
+	for addr := range p.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+func (p *ClientPool) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	n := 0
+	for _, pa := range p.addrs {
+		n += len(pa.clients)
+	}
+
+	return n
+}
+
+func (p *ClientPool) Close() {
+	if !p.closed.CompareAndSwap(false, true) {
+		return
+	}
+	close(p.stopChan)
+	p.cancel()
+
+	p.mu.Lock()
+	var clients []*pooledClient
+	for _, pa := range p.addrs {
+		pa.removed.Store(true)
+		clients = append(clients, pa.clients...)
+		pa.clients = nil
+	}
+	p.mu.Unlock()
+
+	for _, pc := range clients {
+		pc.client.Stop()
+	}
+}
+
+func (p *ClientPool) SendMsg(msgID uint32, data []byte) error {
+	return p.SendMsgByKey("", msgID, data)
+}
+
+func (p *ClientPool) SendBufMsg(msgID uint32, data []byte) error {
+	return p.Do("", func(client iface.IClient) error {
+		return client.GetConnection().SendBufMsg(msgID, data)
+	})
+}
+
+func (p *ClientPool) Call(ctx context.Context, msgID uint32, data []byte) (iface.IMessage, error) {
+	return p.CallByKey(ctx, "", msgID, data)
+}
+
+func (p *ClientPool) SendMsgByKey(key string, msgID uint32, data []byte) error {
+	return p.Do(key, func(client iface.IClient) error {
+		return client.GetConnection().SendMsg(msgID, data)
+	})
+}
+
+func (p *ClientPool) CallByKey(ctx context.Context, key string, msgID uint32, data []byte) (iface.IMessage, error) {
+	var reply iface.IMessage
+	err := p.Do(key, func(client iface.IClient) error {
+		var err error
+		reply, err = client.Call(ctx, msgID, data)
+		return err
+	})
+
+	return reply, err
+}
+
+func (p *ClientPool) Do(key string, f func(client iface.IClient) error) error {
+	if p.closed.Load() {
+		return ErrPoolClosed
+	}
+
+	pc := p.pick(key)
+	if pc == nil {
+		return ErrNoAvailableClient
+	}
+	defer pc.release()
+
+	return f(pc.client)
+}
+
+// pick 按照策略选择一个连接并计入正在处理的请求
+func (p *ClientPool) pick(key string) *pooledClient {
+	p.mu.RLock()
+	var candidates []*pooledClient
+	if p.option.Balance == iface.PoolBalanceConsistentHash && key != "" {
+		// 按照哈希环的顺序找到第一个有可用连接的地址
+		for _, addr := range p.ring.lookup(key) {
+			if pa := p.addrs[addr]; pa != nil && len(pa.clients) > 0 {
+				candidates = append(candidates, pa.clients...)
+				break
+			}
+		}
+	} else {
+		for _, pa := range p.addrs {
+			candidates = append(candidates, pa.clients...)
+		}
+	}
+	p.mu.RUnlock()
+
+	n := len(candidates)
+	if n == 0 {
+		return nil
+	}
+
+	// map的遍历顺序是随机的，按照地址排序之后轮询
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].addr.addr < candidates[j].addr.addr
+	})
+	start := int(p.next.Add(1) % uint64(n))
+
+	if p.option.Balance == iface.PoolBalanceRoundRobin {
+		for i := 0; i < n; i++ {
+			if pc := candidates[(start+i)%n]; pc.acquire() {
+				return pc
+			}
+		}
+		return nil
+	}
+
+	// 选择正在处理的请求最少的连接
+	for {
+		var best *pooledClient
+		for i := 0; i < n; i++ {
+			pc := candidates[(start+i)%n]
+			if pc.closed.Load() || pc.inflight.Load() < 0 {
+				continue
+			}
+			if best == nil || pc.inflight.Load() < best.inflight.Load() {
+				best = pc
+			}
+		}
+		if best == nil {
+			return nil
+		}
+		if best.acquire() {
+			return best
+		}
+	}
+}
+
+func (p *ClientPool) checkLoop() {
+	ticker := time.NewTicker(p.option.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.check(false)
+		case <-p.stopChan:
+			return
+		}
+	}
+}
+
+// check 保持每个地址的空闲连接数在MinIdle和MaxIdle之间，wait为false时在新的协程中建立连接
+func (p *ClientPool) check(wait bool) {
+	p.mu.RLock()
+	addrs := make([]*poolAddr, 0, len(p.addrs))
+	for _, pa := range p.addrs {
+		addrs = append(addrs, pa)
+	}
+	p.mu.RUnlock()
+
+	for _, pa := range addrs {
+		p.checkAddr(pa, wait)
+	}
+}
+
+func (p *ClientPool) checkAddr(pa *poolAddr, wait bool) {
+	p.mu.RLock()
+	total, idle := len(pa.clients), 0
+	var idleClients []*pooledClient
+	for _, pc := range pa.clients {
+		if pc.inflight.Load() == 0 {
+			idle++
+			idleClients = append(idleClients, pc)
+		}
+	}
+	p.mu.RUnlock()
+
+	// 关闭多余的空闲连接
+	if p.option.MaxIdle > 0 && idle > p.option.MaxIdle {
+		for _, pc := range idleClients[:idle-p.option.MaxIdle] {
+			if pc.retire() {
+				p.removeClient(pc)
+				pc.client.Stop()
+			}
+		}
+		return
+	}
+
+	need := p.option.MinIdle - idle
+	if p.option.MaxConns > 0 && total+need > p.option.MaxConns {
+		need = p.option.MaxConns - total
+	}
+	if need <= 0 || !pa.dialing.CompareAndSwap(false, true) {
+		return
+	}
+
+	fill := func() {
+		defer pa.dialing.Store(false)
+
+		for i := 0; i < need; i++ {
+			if p.closed.Load() || pa.removed.Load() {
+				return
+			}
+			if err := p.dial(pa); err != nil {
+				logger.Warnf("client pool dial %s err: %v", pa.addr, err)
+				return
+			}
+		}
+	}
+
+	if wait {
+		fill()
+	} else {
+		go fill()
+	}
+}
+
+// dial 建立一个到地址的连接并加入连接池
+func (p *ClientPool) dial(pa *poolAddr) error {
+	var (
+		client iface.IClient
+		err    error
+	)
+	if p.option.UseTLS {
+		client, err = NewTLSClient(p.option.Network, pa.host, pa.port)
+	} else {
+		client, err = NewClient(p.option.Network, pa.host, pa.port)
+	}
+	if err != nil {
+		return err
+	}
+
+	if p.option.OnNewClient != nil {
+		p.option.OnNewClient(client)
+	}
+	if p.option.HeartbeatInterval > 0 {
+		client.StartHeartbeat(p.option.HeartbeatInterval)
+	}
+
+	pc := &pooledClient{client: client, addr: pa}
+
+	p.mu.Lock()
+	if p.closed.Load() || pa.removed.Load() {
+		p.mu.Unlock()
+		client.Stop()
+		return nil
+	}
+	pa.clients = append(pa.clients, pc)
+	p.mu.Unlock()
+
+	go func() {
+		client.Start()
+
+		// 连接断开，从连接池中移除，之后由check重新建立
+		pc.closed.Store(true)
+		p.removeClient(pc)
+		client.Stop()
+	}()
+
+	return nil
+}
+
+func (p *ClientPool) removeClient(pc *pooledClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	clients := pc.addr.clients
+	for i, c := range clients {
+		if c == pc {
+			pc.addr.clients = append(clients[:i:i], clients[i+1:]...)
+			return
+		}
+	}
+}
+
+// hashRing 一致性哈希环
+type hashRing struct {
+	hashes []uint32
+	addrs  map[uint32]string
+	count  int // 地址数
+}
+
+func newHashRing(addrs []string) *hashRing {
+	ring := &hashRing{
+		addrs: make(map[uint32]string, len(addrs)*hashRingReplicas),
+		count: len(addrs),
+	}
+	for _, addr := range addrs {
+		for i := 0; i < hashRingReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(i)))
+			if _, exist := ring.addrs[hash]; exist {
+				continue
+			}
+			ring.addrs[hash] = addr
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool {
+		return ring.hashes[i] < ring.hashes[j]
+	})
+
+	return ring
+}
+
+// lookup 按照哈希环的顺序返回key对应的所有地址，第一个为key所在的地址
+func (ring *hashRing) lookup(key string) []string {
+	if len(ring.hashes) == 0 {
+		return nil
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(ring.hashes), func(i int) bool {
+		return ring.hashes[i] >= hash
+	})
+
+	seen := make(map[string]struct{})
+	var addrs []string
+	for i := 0; i < len(ring.hashes) && len(seen) < ring.count; i++ {
+		addr := ring.addrs[ring.hashes[(start+i)%len(ring.hashes)]]
+		if _, exist := seen[addr]; exist {
+			continue
+		}
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+
+	return addrs
+}
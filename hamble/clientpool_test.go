@@ -0,0 +1,204 @@
+package hamble
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/hamble/resolver"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// startTestServer 在本机空闲的端口上启动服务器，setup不为nil时在启动之前设置服务器，返回监听地址
+func startTestServer(t *testing.T, setup func(s *Server)) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	conf.GlobalProfile.Port = port
+	s := NewServerWithOption(conf.GlobalProfile).(*Server)
+	if setup != nil {
+		setup(s)
+	}
+	go s.Start()
+	t.Cleanup(s.Stop)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	waitUntil(t, "server "+addr+" started", func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	})
+
+	return addr
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// pickAddr 返回连接池为key选择的连接所连接的服务器地址
+func pickAddr(t *testing.T, pool iface.IClientPool, key string) string {
+	t.Helper()
+
+	var addr string
+	err := pool.Do(key, func(client iface.IClient) error {
+		addr = client.GetConnection().RemoteAddr()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("pool do err: %v", err)
+	}
+
+	return addr
+}
+
+func TestClientPoolFollowsResolver(t *testing.T) {
+	addr1, addr2 := startTestServer(t, nil), startTestServer(t, nil)
+
+	fake, err := resolver.NewFake(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewClientPool(iface.ClientPoolOption{Resolver: fake, CheckInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// 创建时同步建立初始的连接
+	if got := p.Addrs(); !reflect.DeepEqual(got, []string{addr1}) {
+		t.Fatalf("expect addrs [%s], got %v", addr1, got)
+	}
+	if got := pickAddr(t, p, ""); got != addr1 {
+		t.Fatalf("expect %s, got %s", addr1, got)
+	}
+
+	// 新增的地址建立连接之后参与轮询
+	if err = fake.Update(addr1, addr2); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "connection to the new addr", func() bool { return p.Len() == 2 })
+	picked := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		picked[pickAddr(t, p, "")] = true
+	}
+	if !picked[addr1] || !picked[addr2] {
+		t.Fatalf("expect round robin over both addrs, got %v", picked)
+	}
+
+	// 删除的地址上的连接被关闭
+	if err = fake.Update(addr2); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Addrs(); !reflect.DeepEqual(got, []string{addr2}) {
+		t.Fatalf("expect addrs [%s], got %v", addr2, got)
+	}
+	if p.Len() != 1 {
+		t.Fatalf("expect connections to removed addr closed, got %v connections", p.Len())
+	}
+	for i := 0; i < 4; i++ {
+		if got := pickAddr(t, p, ""); got != addr2 {
+			t.Fatalf("expect only %s after removing %s, got %s", addr2, addr1, got)
+		}
+	}
+}
+
+func TestClientPoolConsistentHash(t *testing.T) {
+	addrs := []string{startTestServer(t, nil), startTestServer(t, nil)}
+	sort.Strings(addrs)
+
+	fake, err := resolver.NewFake(addrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewClientPool(iface.ClientPoolOption{
+		Resolver:      fake,
+		Balance:       iface.PoolBalanceConsistentHash,
+		CheckInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// 同一个key总是选择同一个地址，不同的key分布在所有地址上
+	owners := make(map[string]string)
+	used := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		owners[key] = pickAddr(t, p, key)
+		used[owners[key]] = true
+		for j := 0; j < 3; j++ {
+			if got := pickAddr(t, p, key); got != owners[key] {
+				t.Fatalf("key %s moved from %s to %s", key, owners[key], got)
+			}
+		}
+	}
+	if len(used) != 2 {
+		t.Fatalf("expect keys spread over both addrs, got %v", used)
+	}
+
+	// 删除一个地址之后，只有该地址上的key被重新分配
+	if err = fake.Update(addrs[1]); err != nil {
+		t.Fatal(err)
+	}
+	for key, owner := range owners {
+		if got := pickAddr(t, p, key); got != addrs[1] {
+			t.Fatalf("key %s (owned by %s) should move to %s, got %s", key, owner, addrs[1], got)
+		}
+	}
+}
+
+func TestClientPoolResolveError(t *testing.T) {
+	fake, _ := resolver.NewFake("127.0.0.1:1")
+	resolveErr := errors.New("resolve failed")
+	fake.SetError(resolveErr)
+
+	if _, err := NewClientPool(iface.ClientPoolOption{Resolver: fake}); err != resolveErr {
+		t.Fatalf("expect %v, got %v", resolveErr, err)
+	}
+}
+
+func TestClientPoolClosed(t *testing.T) {
+	addr := startTestServer(t, nil)
+	fake, _ := resolver.NewFake(addr)
+	p, err := NewClientPool(iface.ClientPoolOption{Resolver: fake})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Close()
+	if err = p.Do("", func(iface.IClient) error { return nil }); err != ErrPoolClosed {
+		t.Fatalf("expect ErrPoolClosed, got %v", err)
+	}
+	if p.Len() != 0 {
+		t.Fatalf("expect all connections closed, got %v", p.Len())
+	}
+
+	// 关闭之后解析结果的变化被忽略
+	_ = fake.Update(addr, "127.0.0.1:2")
+	if got := p.Addrs(); !reflect.DeepEqual(got, []string{addr}) {
+		t.Fatalf("expect addrs unchanged after close, got %v", got)
+	}
+}
@@ -0,0 +1,314 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/hamble"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGossipInterval = time.Second
+	suspectIntervals      = 5 // 默认超过5个gossip间隔没有收到心跳时认为节点离线
+	dialTimeout           = 3 * time.Second
+)
+
+var ErrClusterClosed = errors.New("cluster closed")
+
+// Option 集群的选项
+type Option struct {
+	NodeID         string        // 节点的唯一标识，为空时使用Addr
+	Addr           string        // 节点间通信的监听地址 host:port，其他节点通过该地址连接
+	Seeds          []string      // 种子节点的地址，启动时连接种子节点加入集群
+	Secret         string        // 节点间握手的共享密钥，只用于计算HMAC，不一致的节点无法加入集群
+	GossipInterval time.Duration // 交换成员信息和用户位置的时间间隔，为0则使用1秒
+	SuspectTimeout time.Duration // 超过此时间没有收到节点的心跳时认为节点离线，为0则使用5倍的GossipInterval
+
+	// TLSConfig 节点间连接使用的TLS配置，为nil时不加密。同时用于监听和连接其他节点，
+	// 需要设置证书以及校验对端证书的方式（RootCAs、ClientCAs和ClientAuth）
+	TLSConfig *tls.Config
+}
+
+// Member 集群中的节点
+type Member struct {
+	ID    string
+	Addr  string
+	Alive bool
+}
+
+// OnMemberChange 节点加入或者离开集群时的Hook函数
+type OnMemberChange func(member Member)
+
+// member 节点的成员信息，version是节点自己维护的心跳计数，incarnation是节点启动的时间，
+// 节点重启之后心跳计数从0开始，incarnation更大的成员信息总是更新的
+type member struct {
+	Member
+	incarnation uint64
+	version     uint64
+	lastSeen    time.Time
+}
+
+// Cluster 多个hamble节点组成的集群，节点之间全连接，通过gossip交换成员信息和用户所在的节点，
+// 将发送给用户的消息、广播和主题消息转发给其他节点
+type Cluster struct {
+	server   iface.IServer
+	option   Option
+	dataPack iface.IDataPack
+	listener net.Listener
+
+	self    *member
+	members map[string]*member // 节点ID -> 成员信息，不包括自己
+	links   map[string]*link   // 节点ID -> 已经握手的连接
+	dialing map[string]bool    // 正在连接的地址
+
+	users      map[string]map[string]struct{} // 用户 -> 所在的其他节点
+	nodeUsers  map[string]map[string]struct{} // 其他节点 -> 节点上的用户
+	localUsers map[string]struct{}            // 已经同步给其他节点的本节点用户
+
+	onMemberChange OnMemberChange
+
+	closed bool
+	done   chan struct{}
+	mu     sync.Mutex
+}
+
+// New 创建集群节点，server为本节点的服务器
+func New(server iface.IServer, option Option) *Cluster {
+	if option.NodeID == "" {
+		option.NodeID = option.Addr
+	}
+	if option.GossipInterval <= 0 {
+		option.GossipInterval = defaultGossipInterval
+	}
+	if option.SuspectTimeout <= 0 {
+		option.SuspectTimeout = suspectIntervals * option.GossipInterval
+	}
+
+	return &Cluster{
+		server:   server,
+		option:   option,
+		dataPack: hamble.NewDataPack(),
+
+		self: &member{
+			Member:      Member{ID: option.NodeID, Addr: option.Addr, Alive: true},
+			incarnation: uint64(time.Now().UnixNano()),
+		},
+		members: make(map[string]*member),
+		links:   make(map[string]*link),
+		dialing: make(map[string]bool),
+
+		users:      make(map[string]map[string]struct{}),
+		nodeUsers:  make(map[string]map[string]struct{}),
+		localUsers: make(map[string]struct{}),
+
+		done: make(chan struct{}),
+	}
+}
+
+// Start 开始监听其他节点的连接，并连接种子节点
+func (c *Cluster) Start() error {
+	listener, err := net.Listen("tcp", c.option.Addr)
+	if err != nil {
+		return err
+	}
+	if c.option.TLSConfig != nil {
+		listener = tls.NewListener(listener, c.option.TLSConfig)
+	}
+	c.listener = listener
+
+	logger.Infof("cluster node %s listen on %s", c.option.NodeID, c.option.Addr)
+
+	go c.accept()
+	go c.gossipLoop()
+	c.dialSeeds()
+
+	return nil
+}
+
+// Stop 离开集群，关闭所有节点间的连接
+func (c *Cluster) Stop() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.done)
+	links := make([]*link, 0, len(c.links))
+	for _, l := range c.links {
+		links = append(links, l)
+	}
+	c.mu.Unlock()
+
+	if c.listener != nil {
+		_ = c.listener.Close()
+	}
+	for _, l := range links {
+		l.close()
+	}
+
+	logger.Infof("cluster node %s stopped", c.option.NodeID)
+}
+
+func (c *Cluster) SetOnMemberChange(f OnMemberChange) {
+	c.onMemberChange = f
+}
+
+// Members 获取集群中的所有节点，包括自己
+func (c *Cluster) Members() []Member {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members := make([]Member, 0, len(c.members)+1)
+	members = append(members, c.self.Member)
+	for _, m := range c.members {
+		members = append(members, m.Member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+
+	return members
+}
+
+// SendToUser 向用户的所有连接发送消息，包括其他节点上的连接。
+// 还没有同步到用户所在的节点时转发给所有节点
+func (c *Cluster) SendToUser(userID string, msgID uint32, data []byte) error {
+	localErr := c.server.GetConnManager().SendToUser(userID, msgID, data)
+
+	c.mu.Lock()
+	var targets []*link
+	if nodes := c.users[userID]; len(nodes) > 0 {
+		for node := range nodes {
+			if l := c.links[node]; l != nil {
+				targets = append(targets, l)
+			}
+		}
+	} else if localErr != nil {
+		targets = c.allLinks()
+	}
+	c.mu.Unlock()
+
+	if len(targets) > 0 {
+		c.forward(targets, msgSendUser, encodeSendUser(userID, msgID, data))
+		return nil
+	}
+
+	return localErr
+}
+
+// Broadcast 向集群中所有节点的所有连接发送消息
+func (c *Cluster) Broadcast(msgID uint32, data []byte) {
+	c.broadcastLocal(msgID, data)
+
+	c.mu.Lock()
+	targets := c.allLinks()
+	c.mu.Unlock()
+
+	c.forward(targets, msgBroadcast, encodeBroadcast(msgID, data))
+}
+
+// Publish 发布消息到集群中所有节点的主题
+func (c *Cluster) Publish(topic string, data []byte) {
+	c.server.Publish(topic, data)
+
+	c.mu.Lock()
+	targets := c.allLinks()
+	c.mu.Unlock()
+
+	c.forward(targets, msgPublish, encodePublish(topic, data))
+}
+
+func (c *Cluster) broadcastLocal(msgID uint32, data []byte) {
+	c.server.GetConnManager().Range(func(conn iface.IConnection) bool {
+		_ = conn.SendBufMsg(msgID, data)
+		return true
+	})
+}
+
+func (c *Cluster) forward(targets []*link, msgID uint32, payload []byte) {
+	for _, l := range targets {
+		if err := l.send(msgID, payload); err == nil {
+			c.server.GetMetrics().Inc(iface.MetricClusterForwarded)
+		}
+	}
+}
+
+// allLinks 获取所有已经握手的连接，调用时需持有c.mu
+func (c *Cluster) allLinks() []*link {
+	links := make([]*link, 0, len(c.links))
+	for _, l := range c.links {
+		links = append(links, l)
+	}
+
+	return links
+}
+
+func (c *Cluster) accept() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Warnf("cluster accept err: %v", err)
+			continue
+		}
+
+		newLink(c, conn, false).start()
+	}
+}
+
+// dial 连接其他节点，同一个地址同时只会有一个连接请求
+func (c *Cluster) dial(addr string) {
+	c.mu.Lock()
+	if c.closed || c.dialing[addr] {
+		c.mu.Unlock()
+		return
+	}
+	c.dialing[addr] = true
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.dialing, addr)
+			c.mu.Unlock()
+		}()
+
+		var conn net.Conn
+		var err error
+		if c.option.TLSConfig != nil {
+			conn, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", addr, c.option.TLSConfig)
+		} else {
+			conn, err = net.DialTimeout("tcp", addr, dialTimeout)
+		}
+		if err != nil {
+			logger.Debugf("cluster node %s dial %s err: %v", c.option.NodeID, addr, err)
+			return
+		}
+
+		newLink(c, conn, true).start()
+	}()
+}
+
+// dialSeeds 连接还没有建立连接的种子节点
+func (c *Cluster) dialSeeds() {
+	c.mu.Lock()
+	linked := make(map[string]bool, len(c.links))
+	for _, l := range c.links {
+		linked[l.addr] = true
+	}
+	c.mu.Unlock()
+
+	for _, seed := range c.option.Seeds {
+		if seed != c.option.Addr && !linked[seed] {
+			c.dial(seed)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package cluster
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/hamble"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+const testGossipInterval = 20 * time.Millisecond
+
+// freePort 获取本机一个空闲的端口
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func freeAddr(t *testing.T) string {
+	return (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: freePort(t)}).String()
+}
+
+// startNode 启动一个集群节点，测试结束时停止
+func startNode(t *testing.T, server iface.IServer, option Option) *Cluster {
+	t.Helper()
+
+	if server == nil {
+		server = hamble.NewServerWithOption(conf.GlobalProfile)
+	}
+	if option.Secret == "" {
+		option.Secret = "test-secret"
+	}
+	option.GossipInterval = testGossipInterval
+
+	c := New(server, option)
+	if err := c.Start(); err != nil {
+		t.Fatalf("start node %s err: %v", option.NodeID, err)
+	}
+	t.Cleanup(c.Stop)
+
+	return c
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// aliveMembers 返回节点看到的所有在线节点的ID
+func aliveMembers(c *Cluster) map[string]bool {
+	alive := make(map[string]bool)
+	for _, m := range c.Members() {
+		if m.Alive {
+			alive[m.ID] = true
+		}
+	}
+
+	return alive
+}
+
+func linked(c *Cluster, id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.links[id] != nil
+}
+
+func linkCount(c *Cluster) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.links)
+}
+
+func TestClusterJoin(t *testing.T) {
+	seed := freeAddr(t)
+	a := startNode(t, nil, Option{NodeID: "a", Addr: seed})
+	b := startNode(t, nil, Option{NodeID: "b", Addr: freeAddr(t), Seeds: []string{seed}})
+	c := startNode(t, nil, Option{NodeID: "c", Addr: freeAddr(t), Seeds: []string{seed}})
+
+	// b和c只知道种子节点，通过gossip发现对方并建立连接
+	for _, node := range []*Cluster{a, b, c} {
+		node := node
+		waitFor(t, "full mesh on "+node.option.NodeID, func() bool {
+			return len(aliveMembers(node)) == 3 && linkCount(node) == 2
+		})
+	}
+}
+
+func TestClusterRejectWrongSecret(t *testing.T) {
+	seed := freeAddr(t)
+	a := startNode(t, nil, Option{NodeID: "a", Addr: seed})
+	e := startNode(t, nil, Option{NodeID: "e", Addr: freeAddr(t), Seeds: []string{seed}, Secret: "wrong"})
+
+	time.Sleep(10 * testGossipInterval)
+	if linked(a, "e") || aliveMembers(a)["e"] {
+		t.Fatal("node with wrong secret should not join")
+	}
+	if linked(e, "a") || len(e.Members()) != 1 {
+		t.Fatalf("node with wrong secret should not learn any member, got %+v", e.Members())
+	}
+}
+
+func TestClusterHandshakeNeverSendsSecret(t *testing.T) {
+	seed := freeAddr(t)
+	startNode(t, nil, Option{NodeID: "a", Addr: seed, Secret: "very-secret-value"})
+
+	conn, err := net.Dial("tcp", seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 未知的节点只会收到随机数
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, _ := conn.Read(buf)
+	if n != 8+nonceLen {
+		t.Fatalf("expect only a challenge before hello, got %v bytes", n)
+	}
+}
+
+func TestClusterForwardToUser(t *testing.T) {
+	port := freePort(t)
+	conf.GlobalProfile.Port = port
+	server := hamble.NewServerWithOption(conf.GlobalProfile)
+	server.SetOnConnStart(func(conn iface.IConnection) {
+		_ = server.GetConnManager().Bind(conn, "alice")
+	})
+	go server.Start()
+	t.Cleanup(server.Stop)
+
+	seed := freeAddr(t)
+	a := startNode(t, nil, Option{NodeID: "a", Addr: seed})
+	b := startNode(t, server, Option{NodeID: "b", Addr: freeAddr(t), Seeds: []string{seed}})
+	waitFor(t, "nodes linked", func() bool { return linked(a, "b") && linked(b, "a") })
+
+	received := make(chan string, 4)
+	client := dialClient(t, port, received)
+	defer client.Stop()
+	waitFor(t, "alice bound on b", func() bool { return len(server.GetConnManager().Users()) == 1 })
+
+	// alice连接在b上，通过a发送
+	if err := a.SendToUser("alice", 500, []byte("hi")); err != nil {
+		t.Fatalf("send to user err: %v", err)
+	}
+	expectMsg(t, received, "hi")
+
+	// gossip同步用户位置之后只转发给用户所在的节点
+	waitFor(t, "alice located on b", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		_, ok := a.users["alice"]["b"]
+		return ok
+	})
+	if err := a.SendToUser("alice", 500, []byte("again")); err != nil {
+		t.Fatalf("send to user err: %v", err)
+	}
+	expectMsg(t, received, "again")
+
+	a.Broadcast(500, []byte("all"))
+	expectMsg(t, received, "all")
+}
+
+type recvHandler struct {
+	hamble.BaseHandler
+	received chan string
+}
+
+func (h *recvHandler) Handle(request iface.IRequest) {
+	h.received <- string(request.GetData())
+	request.Release()
+}
+
+func dialClient(t *testing.T, port int, received chan string) iface.IClient {
+	t.Helper()
+
+	var client iface.IClient
+	var err error
+	waitFor(t, "server started", func() bool {
+		client, err = hamble.NewClient("tcp", "127.0.0.1", port)
+		return err == nil
+	})
+	client.RegisterHandler(500, &recvHandler{received: received})
+	go client.Start()
+
+	return client
+}
+
+func expectMsg(t *testing.T, received chan string, want string) {
+	t.Helper()
+
+	select {
+	case got := <-received:
+		if got != want {
+			t.Fatalf("expect %q, got %q", want, got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout waiting for %q", want)
+	}
+}
+
+func TestClusterNodeLeave(t *testing.T) {
+	seed := freeAddr(t)
+	a := startNode(t, nil, Option{NodeID: "a", Addr: seed})
+
+	changes := make(chan Member, 8)
+	a.SetOnMemberChange(func(m Member) { changes <- m })
+
+	b := startNode(t, nil, Option{NodeID: "b", Addr: freeAddr(t), Seeds: []string{seed}})
+	select {
+	case m := <-changes:
+		if m.ID != "b" || !m.Alive {
+			t.Fatalf("expect b joined, got %+v", m)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for b to join")
+	}
+
+	b.Stop()
+	select {
+	case m := <-changes:
+		if m.ID != "b" || m.Alive {
+			t.Fatalf("expect b left, got %+v", m)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for b to leave")
+	}
+	if linked(a, "b") || aliveMembers(a)["b"] {
+		t.Fatal("b should be removed after leaving")
+	}
+}
+
+func TestClusterRestartedNodeStaysAlive(t *testing.T) {
+	seed := freeAddr(t)
+	addr := freeAddr(t)
+	a := startNode(t, nil, Option{NodeID: "a", Addr: seed})
+	b := startNode(t, nil, Option{NodeID: "b", Addr: addr, Seeds: []string{seed}})
+	waitFor(t, "b joined", func() bool { return aliveMembers(a)["b"] })
+
+	// 让a记住b较大的心跳计数，再以相同的ID重启b，新的b心跳计数从0开始
+	time.Sleep(10 * testGossipInterval)
+	b.Stop()
+	startNode(t, nil, Option{NodeID: "b", Addr: addr, Seeds: []string{seed}})
+	waitFor(t, "b linked again", func() bool { return linked(a, "b") })
+
+	time.Sleep(3 * a.option.SuspectTimeout)
+	if !aliveMembers(a)["b"] {
+		t.Fatal("restarted node should stay alive")
+	}
+}
+
+func TestClusterTLS(t *testing.T) {
+	config := testTLSConfig(t)
+
+	seed := freeAddr(t)
+	a := startNode(t, nil, Option{NodeID: "a", Addr: seed, TLSConfig: config})
+	b := startNode(t, nil, Option{NodeID: "b", Addr: freeAddr(t), Seeds: []string{seed}, TLSConfig: config})
+	waitFor(t, "nodes linked over TLS", func() bool { return linked(a, "b") && linked(b, "a") })
+
+	// 没有使用TLS的节点无法加入
+	plain := startNode(t, nil, Option{NodeID: "c", Addr: freeAddr(t), Seeds: []string{seed}})
+	time.Sleep(10 * testGossipInterval)
+	if linked(a, "c") || linked(plain, "a") {
+		t.Fatal("node without TLS should not join")
+	}
+}
+
+// testTLSConfig 生成自签名证书，节点之间互相校验对方的证书
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hamble-cluster"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
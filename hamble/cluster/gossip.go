@@ -0,0 +1,217 @@
+package cluster
+
+import (
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"time"
+)
+
+// digest gossip消息中的一个节点
+type digest struct {
+	ID          string `json:"id"`
+	Addr        string `json:"addr"`
+	Incarnation uint64 `json:"incarnation"`
+	Version     uint64 `json:"version"`
+}
+
+// usersDelta 节点上用户的变化，Full为true时是节点上的全部用户
+type usersDelta struct {
+	Full   bool     `json:"full,omitempty"`
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+func (c *Cluster) gossipLoop() {
+	ticker := time.NewTicker(c.option.GossipInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.gossip(now)
+		}
+	}
+}
+
+// gossip 增加自己的心跳计数，检查离线的节点，向所有节点发送成员信息和本节点用户的变化
+func (c *Cluster) gossip(now time.Time) {
+	delta := c.diffLocalUsers(c.server.GetConnManager().Users())
+
+	c.mu.Lock()
+	c.self.version++
+
+	var left []Member
+	for id, m := range c.members {
+		if m.Alive && now.Sub(m.lastSeen) > c.option.SuspectTimeout {
+			m.Alive = false
+			left = append(left, m.Member)
+			c.dropNodeUsers(id)
+			logger.Warnf("cluster node %s: member %s(%s) is not alive", c.option.NodeID, m.ID, m.Addr)
+		}
+	}
+
+	// 只由ID较小的节点主动连接，减少重复的连接
+	var dials []string
+	for id, m := range c.members {
+		if m.Alive && c.links[id] == nil && c.option.NodeID < id {
+			dials = append(dials, m.Addr)
+		}
+	}
+
+	digests := c.digestsLocked()
+	links := c.allLinks()
+	c.mu.Unlock()
+
+	for _, m := range left {
+		c.callOnMemberChange(m)
+	}
+
+	for _, addr := range dials {
+		c.dial(addr)
+	}
+	c.dialSeeds()
+
+	for _, l := range links {
+		_ = l.sendJSON(msgGossip, digests)
+		if delta != nil {
+			_ = l.sendJSON(msgUsers, delta)
+		}
+	}
+}
+
+// diffLocalUsers 计算本节点用户的变化，没有变化时返回nil
+func (c *Cluster) diffLocalUsers(users []string) *usersDelta {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := make(map[string]struct{}, len(users))
+	delta := &usersDelta{}
+	for _, user := range users {
+		current[user] = struct{}{}
+		if _, exist := c.localUsers[user]; !exist {
+			delta.Add = append(delta.Add, user)
+		}
+	}
+	for user := range c.localUsers {
+		if _, exist := current[user]; !exist {
+			delta.Remove = append(delta.Remove, user)
+		}
+	}
+	c.localUsers = current
+
+	if len(delta.Add) == 0 && len(delta.Remove) == 0 {
+		return nil
+	}
+
+	return delta
+}
+
+// digestsLocked 获取所有在线的节点，调用时需持有c.mu
+func (c *Cluster) digestsLocked() []digest {
+	digests := make([]digest, 0, len(c.members)+1)
+	digests = append(digests, digest{ID: c.self.ID, Addr: c.self.Addr, Incarnation: c.self.incarnation, Version: c.self.version})
+	for _, m := range c.members {
+		if m.Alive {
+			digests = append(digests, digest{ID: m.ID, Addr: m.Addr, Incarnation: m.incarnation, Version: m.version})
+		}
+	}
+
+	return digests
+}
+
+// handleGossip 合并from节点发送的成员信息，心跳计数增加或者重启过的节点是在线的。
+// 直接连接的from节点只要发送了gossip就是在线的
+func (c *Cluster) handleGossip(from string, digests []digest) {
+	now := time.Now()
+
+	c.mu.Lock()
+	var joined []Member
+	alive := func(m *member) {
+		m.lastSeen = now
+		if !m.Alive {
+			m.Alive = true
+			joined = append(joined, m.Member)
+			logger.Infof("cluster node %s: member %s(%s) joined", c.option.NodeID, m.ID, m.Addr)
+		}
+	}
+
+	if m := c.members[from]; m != nil && c.links[from] != nil {
+		alive(m)
+	}
+
+	for _, d := range digests {
+		if d.ID == c.self.ID || d.ID == "" {
+			continue
+		}
+
+		m := c.members[d.ID]
+		if m == nil {
+			m = &member{Member: Member{ID: d.ID, Addr: d.Addr}}
+			c.members[d.ID] = m
+		} else if d.Incarnation < m.incarnation || (d.Incarnation == m.incarnation && d.Version <= m.version) {
+			continue
+		}
+
+		m.Addr, m.incarnation, m.version = d.Addr, d.Incarnation, d.Version
+		alive(m)
+	}
+	c.mu.Unlock()
+
+	for _, m := range joined {
+		c.callOnMemberChange(m)
+	}
+}
+
+// handleUsers 更新其他节点上的用户
+func (c *Cluster) handleUsers(node string, delta usersDelta) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if delta.Full {
+		c.dropNodeUsers(node)
+	}
+
+	users := c.nodeUsers[node]
+	if users == nil {
+		users = make(map[string]struct{})
+		c.nodeUsers[node] = users
+	}
+
+	for _, user := range delta.Add {
+		users[user] = struct{}{}
+		if c.users[user] == nil {
+			c.users[user] = make(map[string]struct{})
+		}
+		c.users[user][node] = struct{}{}
+	}
+
+	for _, user := range delta.Remove {
+		delete(users, user)
+		if nodes := c.users[user]; nodes != nil {
+			delete(nodes, node)
+			if len(nodes) == 0 {
+				delete(c.users, user)
+			}
+		}
+	}
+}
+
+// dropNodeUsers 删除节点上的所有用户，调用时需持有c.mu
+func (c *Cluster) dropNodeUsers(node string) {
+	for user := range c.nodeUsers[node] {
+		if nodes := c.users[user]; nodes != nil {
+			delete(nodes, node)
+			if len(nodes) == 0 {
+				delete(c.users, user)
+			}
+		}
+	}
+	delete(c.nodeUsers, node)
+}
+
+func (c *Cluster) callOnMemberChange(m Member) {
+	if c.onMemberChange != nil {
+		c.onMemberChange(m)
+	}
+}
@@ -0,0 +1,468 @@
+package cluster
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/hamble"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// 节点间连接的MsgID，节点间使用独立的端口，不会与客户端的消息冲突
+const (
+	msgHello     = uint32(1) // 握手，数据为JSON格式的hello
+	msgGossip    = uint32(2) // 成员信息，数据为JSON格式的[]digest
+	msgUsers     = uint32(3) // 节点上用户的变化，数据为JSON格式的usersDelta
+	msgSendUser  = uint32(4) // 发送给用户的消息，数据为用户长度（2字节大端）+用户+MsgID（4字节大端）+原始数据
+	msgBroadcast = uint32(5) // 广播，数据为MsgID（4字节大端）+原始数据
+	msgPublish   = uint32(6) // 主题消息，数据为主题长度（2字节大端）+主题+原始数据
+	msgChallenge = uint32(7) // 接受连接的节点发送的随机数，之后发起连接的节点发送hello
+
+	linkQueueLen      = 1024               // 节点间连接的发送队列长度
+	linkFrameOverhead = math.MaxUint16 + 6 // 转发的消息在原始数据之外最多增加的长度
+	helloTimeout      = 5 * time.Second
+	helloMaxLen       = 4 << 10 // 握手之前的消息的最大长度
+	nonceLen          = hamble.HandshakeNonceLen
+)
+
+var (
+	ErrLinkClosed    = errors.New("cluster link closed")
+	ErrLinkQueueFull = errors.New("cluster link send queue is full")
+	ErrInvalidFrame  = errors.New("invalid cluster frame")
+
+	errDuplicateLink = errors.New("duplicate cluster link")
+	errHandshake     = errors.New("cluster handshake failed")
+)
+
+// hello 握手消息，MAC为共享密钥对双方的随机数和hello的HMAC，密钥本身不会发送
+type hello struct {
+	ID          string `json:"id"`
+	Addr        string `json:"addr"`
+	Incarnation uint64 `json:"incarnation"`
+	Nonce       []byte `json:"nonce,omitempty"` // 发起连接的节点生成的随机数
+	MAC         []byte `json:"mac"`
+}
+
+// link 与其他节点的连接
+type link struct {
+	cluster  *Cluster
+	conn     net.Conn
+	outbound bool   // 是否由本节点主动连接
+	nodeID   string // 对端节点ID，握手之后才有
+	addr     string // 对端节点的监听地址，握手之后才有
+
+	nonce     []byte // 本节点在握手时生成的随机数
+	peerNonce []byte // 对端在握手时生成的随机数
+
+	sendChan   chan []byte // 封包之后等待发送的数据
+	closedChan chan struct{}
+	closeOnce  sync.Once
+}
+
+func newLink(cluster *Cluster, conn net.Conn, outbound bool) *link {
+	return &link{
+		cluster:    cluster,
+		conn:       conn,
+		outbound:   outbound,
+		sendChan:   make(chan []byte, linkQueueLen),
+		closedChan: make(chan struct{}),
+	}
+}
+
+// start 开始握手。接受连接的节点先发送随机数，发起连接的节点回复带有HMAC的hello，
+// 接受连接的节点校验之后才回复自己的hello，未知的节点无法获得任何节点的信息
+func (l *link) start() {
+	l.nonce = hamble.NewHandshakeNonce()
+
+	go l.writeLoop()
+	go l.readLoop()
+
+	if !l.outbound {
+		_ = l.send(msgChallenge, l.nonce)
+	}
+}
+
+// handleChallenge 发起连接的节点收到随机数之后发送hello
+func (l *link) handleChallenge(nonce []byte) error {
+	if !l.outbound || l.peerNonce != nil || len(nonce) != nonceLen {
+		return errHandshake
+	}
+	l.peerNonce = append([]byte(nil), nonce...)
+
+	return l.sendHello()
+}
+
+func (l *link) sendHello() error {
+	h := hello{
+		ID:          l.cluster.option.NodeID,
+		Addr:        l.cluster.option.Addr,
+		Incarnation: l.cluster.self.incarnation,
+	}
+	if l.outbound {
+		h.Nonce = l.nonce
+	}
+	h.MAC = l.mac(l.outbound, h)
+
+	return l.sendJSON(msgHello, h)
+}
+
+// verifyHello 校验对端的hello，接受连接的节点从hello中获得对端的随机数
+func (l *link) verifyHello(h hello) error {
+	if !l.outbound {
+		if l.peerNonce != nil || len(h.Nonce) != nonceLen {
+			return errHandshake
+		}
+		l.peerNonce = h.Nonce
+	} else if l.peerNonce == nil {
+		return errHandshake
+	}
+
+	if !hmac.Equal(h.MAC, l.mac(!l.outbound, h)) {
+		return errors.New("cluster secret mismatch")
+	}
+
+	return nil
+}
+
+// mac 计算hello的HMAC，包含双方的随机数和发送方的角色，不能重放或者反射给其他节点
+func (l *link) mac(fromDialer bool, h hello) []byte {
+	dialerNonce, acceptorNonce := l.nonce, l.peerNonce
+	if !l.outbound {
+		dialerNonce, acceptorNonce = l.peerNonce, l.nonce
+	}
+
+	role := "accept"
+	if fromDialer {
+		role = "dial"
+	}
+
+	incarnation := make([]byte, 8)
+	binary.BigEndian.PutUint64(incarnation, h.Incarnation)
+
+	return hamble.HandshakeMAC(l.cluster.option.Secret, []byte(role), dialerNonce, acceptorNonce, []byte(h.ID), []byte(h.Addr), incarnation)
+}
+
+func (l *link) close() {
+	l.closeOnce.Do(func() {
+		close(l.closedChan)
+		_ = l.conn.Close()
+		l.cluster.removeLink(l)
+	})
+}
+
+// send 将消息放入发送队列，队列满时丢弃消息，不阻塞调用者
+func (l *link) send(msgID uint32, data []byte) error {
+	packet, err := l.cluster.dataPack.Pack(hamble.NewMessage(msgID, data))
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-l.closedChan:
+		return ErrLinkClosed
+	default:
+	}
+
+	select {
+	case l.sendChan <- packet:
+		return nil
+	case <-l.closedChan:
+		return ErrLinkClosed
+	default:
+		l.cluster.server.GetMetrics().Inc(iface.MetricClusterDropped)
+		logger.Warnf("cluster link to %s is full, drop msg", l.conn.RemoteAddr())
+		return ErrLinkQueueFull
+	}
+}
+
+func (l *link) sendJSON(msgID uint32, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return l.send(msgID, data)
+}
+
+func (l *link) writeLoop() {
+	writer := bufio.NewWriter(l.conn)
+	for {
+		select {
+		case <-l.closedChan:
+			return
+		case packet := <-l.sendChan:
+			if _, err := writer.Write(packet); err != nil {
+				l.close()
+				return
+			}
+
+			// 合并队列中已有的消息，一起写入
+			for n := len(l.sendChan); n > 0; n-- {
+				if _, err := writer.Write(<-l.sendChan); err != nil {
+					l.close()
+					return
+				}
+			}
+
+			if err := writer.Flush(); err != nil {
+				l.close()
+				return
+			}
+		}
+	}
+}
+
+func (l *link) readLoop() {
+	defer l.close()
+
+	reader := bufio.NewReader(l.conn)
+	head := make([]byte, l.cluster.dataPack.GetHeadLen())
+	timeout := helloTimeout
+	for {
+		// 超过SuspectTimeout没有收到任何消息（至少有gossip）时认为连接已经失效
+		_ = l.conn.SetReadDeadline(time.Now().Add(timeout))
+
+		if _, err := io.ReadFull(reader, head); err != nil {
+			return
+		}
+
+		dataLen := binary.BigEndian.Uint32(head[0:4])
+		msgID := binary.BigEndian.Uint32(head[4:8])
+		if l.nodeID == "" && msgID != msgHello && msgID != msgChallenge {
+			// 握手之前只允许握手消息
+			return
+		}
+		if limit := l.frameLimit(); limit > 0 && dataLen > limit {
+			logger.Warnf("cluster link from %s: %v", l.conn.RemoteAddr(), hamble.ErrPacketTooBig)
+			return
+		}
+
+		data := make([]byte, dataLen)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return
+		}
+
+		if err := l.handle(msgID, data); err != nil {
+			if err != errDuplicateLink {
+				logger.Warnf("cluster link from %s: %v", l.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		timeout = l.cluster.option.SuspectTimeout
+	}
+}
+
+// frameLimit 握手之前只允许很小的握手消息，握手之后按照MaxPacketSize限制转发的消息，为0时不限制
+func (l *link) frameLimit() uint32 {
+	if l.nodeID == "" {
+		return helloMaxLen
+	}
+	if max := conf.Current().MaxPacketSize; max > 0 {
+		return max + linkFrameOverhead
+	}
+
+	return 0
+}
+
+func (l *link) handle(msgID uint32, data []byte) error {
+	c := l.cluster
+
+	switch msgID {
+	case msgChallenge:
+		return l.handleChallenge(data)
+	case msgHello:
+		var h hello
+		if err := json.Unmarshal(data, &h); err != nil {
+			return err
+		}
+		return c.handleHello(l, h)
+	case msgGossip:
+		var digests []digest
+		if err := json.Unmarshal(data, &digests); err != nil {
+			return err
+		}
+		c.handleGossip(l.nodeID, digests)
+	case msgUsers:
+		var delta usersDelta
+		if err := json.Unmarshal(data, &delta); err != nil {
+			return err
+		}
+		c.handleUsers(l.nodeID, delta)
+	case msgSendUser:
+		userID, id, payload, err := decodeSendUser(data)
+		if err != nil {
+			return err
+		}
+		c.server.GetMetrics().Inc(iface.MetricClusterReceived)
+		_ = c.server.GetConnManager().SendToUser(userID, id, payload)
+	case msgBroadcast:
+		if len(data) < 4 {
+			return ErrInvalidFrame
+		}
+		c.server.GetMetrics().Inc(iface.MetricClusterReceived)
+		c.broadcastLocal(binary.BigEndian.Uint32(data), data[4:])
+	case msgPublish:
+		topic, payload, err := decodePublish(data)
+		if err != nil {
+			return err
+		}
+		c.server.GetMetrics().Inc(iface.MetricClusterReceived)
+		c.server.Publish(topic, payload)
+	default:
+		logger.Debugf("cluster link from %s: unknown msgID=%v", l.conn.RemoteAddr(), msgID)
+	}
+
+	return nil
+}
+
+// handleHello 校验对端节点，同一个节点有两个连接时保留由ID较小的节点主动建立的连接
+func (c *Cluster) handleHello(l *link, h hello) error {
+	if l.nodeID != "" {
+		return nil
+	}
+
+	if err := l.verifyHello(h); err != nil {
+		return err
+	}
+	if h.ID == "" || h.ID == c.option.NodeID {
+		return errors.New("invalid cluster node id " + h.ID)
+	}
+
+	if !l.outbound {
+		// 校验发起连接的节点之后才回复，在加入links之前放入发送队列，保证先于其他消息发送
+		if err := l.sendHello(); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClusterClosed
+	}
+
+	old := c.links[h.ID]
+	if old != nil && c.preferred(old) {
+		c.mu.Unlock()
+		// 已经有更合适的连接，关闭当前连接
+		return errDuplicateLink
+	}
+	l.nodeID, l.addr = h.ID, h.Addr
+	c.links[h.ID] = l
+
+	m := c.members[h.ID]
+	if m == nil {
+		m = &member{Member: Member{ID: h.ID}}
+		c.members[h.ID] = m
+	}
+	if h.Incarnation > m.incarnation {
+		// 对端节点重启之后心跳计数重新开始
+		m.incarnation, m.version = h.Incarnation, 0
+	}
+	joined := !m.Alive
+	m.Addr, m.Alive, m.lastSeen = h.Addr, true, time.Now()
+
+	digests := c.digestsLocked()
+	users := make([]string, 0, len(c.localUsers))
+	for user := range c.localUsers {
+		users = append(users, user)
+	}
+	c.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+
+	logger.Infof("cluster node %s: linked to %s(%s)", c.option.NodeID, h.ID, h.Addr)
+	if joined {
+		c.callOnMemberChange(m.Member)
+	}
+
+	_ = l.sendJSON(msgGossip, digests)
+	return l.sendJSON(msgUsers, usersDelta{Full: true, Add: users})
+}
+
+// preferred 判断连接是否由ID较小的节点主动建立，调用时需持有c.mu
+func (c *Cluster) preferred(l *link) bool {
+	if l.outbound {
+		return c.option.NodeID < l.nodeID
+	}
+
+	return l.nodeID < c.option.NodeID
+}
+
+// removeLink 连接关闭时删除连接，没有其他连接时删除对端节点上的用户
+func (c *Cluster) removeLink(l *link) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if l.nodeID == "" || c.links[l.nodeID] != l {
+		return
+	}
+
+	delete(c.links, l.nodeID)
+	c.dropNodeUsers(l.nodeID)
+	logger.Infof("cluster node %s: link to %s closed", c.option.NodeID, l.nodeID)
+}
+
+func encodeSendUser(userID string, msgID uint32, data []byte) []byte {
+	buf := make([]byte, 2+len(userID)+4+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(userID)))
+	copy(buf[2:], userID)
+	binary.BigEndian.PutUint32(buf[2+len(userID):], msgID)
+	copy(buf[6+len(userID):], data)
+
+	return buf
+}
+
+func decodeSendUser(buf []byte) (userID string, msgID uint32, data []byte, err error) {
+	if len(buf) < 2 {
+		return "", 0, nil, ErrInvalidFrame
+	}
+
+	userLen := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 6+userLen {
+		return "", 0, nil, ErrInvalidFrame
+	}
+
+	return string(buf[2 : 2+userLen]), binary.BigEndian.Uint32(buf[2+userLen:]), buf[6+userLen:], nil
+}
+
+func encodeBroadcast(msgID uint32, data []byte) []byte {
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, msgID)
+	copy(buf[4:], data)
+
+	return buf
+}
+
+func encodePublish(topic string, data []byte) []byte {
+	buf := make([]byte, 2+len(topic)+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(topic)))
+	copy(buf[2:], topic)
+	copy(buf[2+len(topic):], data)
+
+	return buf
+}
+
+func decodePublish(buf []byte) (topic string, data []byte, err error) {
+	if len(buf) < 2 {
+		return "", nil, ErrInvalidFrame
+	}
+
+	topicLen := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+topicLen {
+		return "", nil, ErrInvalidFrame
+	}
+
+	return string(buf[2 : 2+topicLen]), buf[2+topicLen:], nil
+}
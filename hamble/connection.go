@@ -1,6 +1,8 @@
 package hamble
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"github.com/dawnzzz/hamble-tcp-server/conf"
 	"github.com/dawnzzz/hamble-tcp-server/iface"
@@ -15,40 +17,127 @@ import (
 // Connection 与客户端的连接，实现了iface.IConnection接口
 type Connection struct {
 	cs iface.ICSBase // 指向客户端或者服务器（client/server）
+	id uint64        // 连接ID
 
 	conn net.Conn // 原始 socket TCP 连接
 
 	msgChan    chan iface.IMessage // 服务器待发送的消息放在这里
 	msgBufChan chan iface.IMessage // 带缓冲区的msgChan
 
-	exitChan chan struct{}
-	isClosed atomic.Bool
+	exitChan   chan struct{} // 通知Start退出
+	closedChan chan struct{} // 连接关闭时关闭，通知所有发送者和写协程
+	isClosed   atomic.Bool
 
 	properties     map[string]interface{} //	记录连接属性
 	propertiesLock sync.Mutex             // 保证连接属性的互斥访问
 
 	heartbeatChecker iface.IHeartBeatChecker
-	lastAliveTime    time.Time // 上一次收到消息的时间，用于在心跳检测中检查是否存活
+	lastReadTime     atomic.Int64 // 上一次收到消息的时间（UnixNano），用于在心跳检测中检查是否存活
+	lastWriteTime    atomic.Int64 // 上一次写出数据的时间（UnixNano）
+
+	idleTimeouts [3]atomic.Int64 // 该连接单独设置的空闲时间，为-1时使用服务器的设置
+	idleTimers   [3]iface.ITimer // 空闲检测的定时任务，由timersLock保护
+
+	limiter   *msgLimiter                // 消息限流
+	rateRules *atomic.Pointer[rateRules] // 服务器的消息限流规则，为nil时不限流，客户端的连接不限流
+
+	loop      eventLoop  // epoll 模式下负责读写的事件循环，为nil时使用读写协程
+	loopState *loopState // 连接在事件循环中的状态
+
+	onStopped func() // 连接关闭之后调用
+
+	timers     map[iface.ITimer]struct{} // 连接的定时任务，连接关闭时全部取消
+	timersLock sync.Mutex
+
+	closeFuncs     []func(conn iface.IConnection) // 连接关闭时调用的函数
+	closeFuncsLock sync.Mutex
+
+	principal atomic.Pointer[iface.Principal] // 通过认证的身份
+	authHello []byte                          // 发送给客户端的hello
+	authTimer iface.ITimer                    // 认证超时的定时任务
+	authing   atomic.Bool                     // 已经收到认证消息
+
+	sessions      *sessionManager         // 服务器的会话管理，为nil时不创建会话
+	session       atomic.Pointer[Session] // 连接绑定的会话
+	clientSession *clientSession          // 客户端的会话状态，为nil时不处理会话消息
+
+	topics *topicTree // 服务器的订阅，连接关闭时删除连接的所有订阅
+
+	sender         *reliableQueue // 没有会话时使用的可靠消息队列
+	keepUnacked    bool           // 连接关闭时保留未确认的消息，客户端重连之后重发
+	receiver       seqReceiver    // 没有会话时接收对端的可靠消息
+	retransmitOnce sync.Once
+	ackTimedOut    atomic.Bool // 对端超时没有确认可靠消息
+
+	gatewaySecret string        // 网关连接认证使用的共享密钥，为空时不处理网关转发的消息
+	gatewayNonces []byte        // 认证握手中网关和后端的随机数，只在读取消息的协程中访问
+	gatewayAuthed bool          // 网关已经通过认证，只在读取消息的协程中访问
+	gatewayConns  *gatewayConns // 网关转发的客户端连接，收到第一条转发的消息时创建
+
+	calls *callTable // 客户端等待回复的请求，为nil时不处理回复
 }
 
-func newConnection(conn net.Conn, cs iface.ICSBase) iface.IConnection {
-	return &Connection{
+var connIDSeq atomic.Uint64 // 分配连接ID
+
+func newConnection(conn net.Conn, cs iface.ICSBase) *Connection {
+	c := &Connection{
 		cs:   cs,
+		id:   connIDSeq.Add(1),
 		conn: conn,
 
 		msgChan:    make(chan iface.IMessage, 1),
-		msgBufChan: make(chan iface.IMessage, conf.GlobalProfile.MaxMsgChanLen),
+		msgBufChan: make(chan iface.IMessage, conf.Current().MaxMsgChanLen),
 		exitChan:   make(chan struct{}, 1),
+		closedChan: make(chan struct{}),
+
+		limiter: newMsgLimiter(),
+		sender:  &reliableQueue{},
+	}
+
+	now := time.Now().UnixNano()
+	c.lastReadTime.Store(now)
+	c.lastWriteTime.Store(now)
+	for i := range c.idleTimeouts {
+		c.idleTimeouts[i].Store(-1)
+	}
+
+	return c
+}
+
+var (
+	ErrConnClosed    = errors.New("connection closed when send msg")
+	ErrSendQueueFull = errors.New("send queue is full")
+	ErrMsgDropped    = errors.New("send queue is full, msg dropped")
+	ErrSlowConsumer  = errors.New("send queue is full, disconnect slow consumer")
+)
+
+// exit 通知Start退出，不会阻塞
+func (c *Connection) exit() {
+	if c.loop != nil {
+		// epoll 模式下Start不会阻塞，直接关闭连接，避免在事件循环中执行Hook函数
+		if !c.isClosed.Load() {
+			go c.Stop()
+		}
+		return
+	}
 
-		lastAliveTime: time.Now(),
+	select {
+	case c.exitChan <- struct{}{}:
+	default:
 	}
 }
 
 func (c *Connection) updateLastAliveTime(newTime time.Time) {
-	c.lastAliveTime = newTime
+	c.lastReadTime.Store(newTime.UnixNano())
+}
+
+func (c *Connection) updateLastWriteTime(newTime time.Time) {
+	c.lastWriteTime.Store(newTime.UnixNano())
 }
 
 func (c *Connection) startRead() {
+	var head []byte
+
 	for {
 		if c.isClosed.Load() {
 			return
@@ -56,80 +145,296 @@ func (c *Connection) startRead() {
 
 		dataPack := c.cs.GetDataPack()
 
-		buf := make([]byte, dataPack.GetHeadLen())
-		_, err := c.conn.Read(buf)
+		// 复用包头缓冲区
+		if uint32(len(head)) != dataPack.GetHeadLen() {
+			head = make([]byte, dataPack.GetHeadLen())
+		}
+		_, err := io.ReadFull(c.conn, head)
 		if err != nil {
-			c.exitChan <- struct{}{}
+			c.exit()
 			return
 		}
 
 		// 解包
-		msg, err := dataPack.Unpack(buf)
+		dataLen, msgID, err := dataPack.UnpackHeader(head)
 		if err != nil {
-			c.exitChan <- struct{}{}
+			c.exit()
 			return
 		}
-		dataBuf := make([]byte, msg.GetDataLen())
-		_, err = io.ReadFull(c.conn, dataBuf)
+		payload := getPayloadBuffer(int(dataLen))
+		_, err = io.ReadFull(c.conn, *payload)
 		if err != nil {
-			c.exitChan <- struct{}{}
+			putPayloadBuffer(payload)
+			c.exit()
+			return
+		}
+		msg := NewMessage(msgID, *payload)
+
+		if !c.handleMsg(msg, payload) {
+			return
+		}
+	}
+}
+
+// handleMsg 处理读取到的一条消息，返回false时停止读取
+func (c *Connection) handleMsg(msg iface.IMessage, payload *[]byte) bool {
+	// 记录收到消息的时间
+	c.updateLastAliveTime(time.Now())
+
+	// 检查是否超过限流
+	handle, keepReading := c.checkRateLimit(msg)
+	if !handle {
+		putPayloadBuffer(payload)
+		return keepReading
+	}
+
+	// 检查是否通过认证
+	if !c.checkAuth(msg) {
+		putPayloadBuffer(payload)
+		return keepReading
+	}
+
+	// 处理会话消息
+	msg, handle = c.checkSession(msg)
+	if !handle {
+		putPayloadBuffer(payload)
+		return keepReading
+	}
+
+	// 处理可靠消息和确认
+	msg, handle = c.checkReliable(msg)
+	if !handle {
+		putPayloadBuffer(payload)
+		return keepReading
+	}
+
+	// 处理网关转发的消息
+	if !c.checkGateway(msg, payload) {
+		return keepReading
+	}
+
+	// 处理请求的回复
+	if !c.checkReply(msg, payload) {
+		return keepReading
+	}
+
+	request, err := newRequestOf(c, msg, payload)
+	if err != nil {
+		logger.Warnf("receive invalid call msg from %s", c.RemoteAddr())
+		putPayloadBuffer(payload)
+		return keepReading
+	}
+
+	// 可靠消息和请求解开之后才能得到真正的MsgID
+	handle, keepReading = c.checkRouteRateLimit(request.GetMsgID())
+	if !handle {
+		request.Release()
+		return keepReading
+	}
+	c.dispatch(request)
+
+	return keepReading
+}
+
+// dispatch 将请求交给Worker或者新的协程处理
+func (c *Connection) dispatch(request iface.IRequest) {
+	if c.cs.GetRouter().WorkerPoolStarted() {
+		if router, ok := c.cs.GetRouter().(*Router); ok && c.loop != nil {
+			c.dispatchInLoop(router, request)
 			return
 		}
-		msg.SetData(dataBuf)
 
-		// 记录收到消息的时间
-		c.updateLastAliveTime(time.Now())
+		//已经启动工作池机制，将消息交给Worker处理
+		c.sendToTaskQueue(c.cs.GetRouter(), request)
+	} else {
+		go func() {
+			c.cs.GetRouter().DoHandler(request) // 执行 handler
+		}()
+	}
+}
+
+// sendToTaskQueue 将请求发送给Worker的任务队列，失败时归还请求数据
+func (c *Connection) sendToTaskQueue(router iface.IRouter, request iface.IRequest) {
+	if err := router.SendMsgToTaskQueue(request); err != nil {
+		logger.Warnf("send request msgID=%v from %s to task queue err: %v", request.GetMsgID(), c.RemoteAddr(), err)
+		request.Release()
+	}
+}
+
+// currentRateRules 获取当前的限流规则，不限流时为nil
+func (c *Connection) currentRateRules() *rateRules {
+	if c.rateRules == nil {
+		return nil
+	}
+
+	return c.rateRules.Load()
+}
+
+// checkRateLimit 检查消息数和字节数是否超过限流，在解开消息之前进行。
+// handle为false时不处理该消息，keepReading为false时停止读取
+func (c *Connection) checkRateLimit(msg iface.IMessage) (handle bool, keepReading bool) {
+	rules := c.currentRateRules()
+	if rules == nil || !rules.enabled() {
+		return true, true
+	}
+
+	if rules.policy == RateLimitPolicyDelay {
+		// 延迟读取下一条消息，让对端感受到背压
+		wait, reason := c.limiter.reserve(rules, int(msg.GetDataLen()))
+		if wait > 0 {
+			c.reportRateLimited(msg.GetMsgID(), reason)
+			c.throttle(wait)
+		}
+		return true, true
+	}
+
+	if ok, reason := c.limiter.allow(rules, int(msg.GetDataLen())); !ok {
+		return c.rateLimited(rules, msg.GetMsgID(), reason)
+	}
+
+	return true, true
+}
 
-		request := NewRequest(c, msg)
+// checkRouteRateLimit 检查解开之后的MsgID是否超过该MsgID的限流
+func (c *Connection) checkRouteRateLimit(msgID uint32) (handle bool, keepReading bool) {
+	rules := c.currentRateRules()
+	if rules == nil || len(rules.routes) == 0 {
+		return true, true
+	}
 
-		if conf.GlobalProfile.WorkerPoolSize > 0 {
-			//已经启动工作池机制，将消息交给Worker处理
-			c.cs.GetRouter().SendMsgToTaskQueue(request)
-		} else {
-			go func() {
-				c.cs.GetRouter().DoHandler(request) // 执行 handler
-			}()
+	if rules.policy == RateLimitPolicyDelay {
+		if wait := c.limiter.reserveRoute(rules, msgID); wait > 0 {
+			c.reportRateLimited(msgID, RateLimitReasonRoute)
+			c.throttle(wait)
 		}
+		return true, true
+	}
 
+	if !c.limiter.allowRoute(rules, msgID) {
+		return c.rateLimited(rules, msgID, RateLimitReasonRoute)
 	}
+
+	return true, true
 }
 
+// rateLimited 按照限流策略处理超过限流的消息
+func (c *Connection) rateLimited(rules *rateRules, msgID uint32, reason string) (handle bool, keepReading bool) {
+	c.reportRateLimited(msgID, reason)
+
+	switch rules.policy {
+	case RateLimitPolicyReply:
+		data := make([]byte, 4, 4+len(reason))
+		binary.BigEndian.PutUint32(data, msgID)
+		data = append(data, reason...)
+		_ = c.TrySend(iface.RateLimitedMsgID, data)
+	case RateLimitPolicyDisconnect:
+		logger.Warnf("connection from %s exceeds %s, disconnect it", c.RemoteAddr(), reason)
+		c.exit()
+		return false, false
+	}
+
+	return false, true
+}
+
+func (c *Connection) reportRateLimited(msgID uint32, reason string) {
+	if metrics := c.cs.GetMetrics(); metrics != nil {
+		metrics.Inc(iface.MetricRateLimited)
+		metrics.Inc(iface.MetricRateLimited + "_" + reason)
+	}
+
+	c.cs.CallOnRateLimited(c, msgID, reason)
+}
+
+// startWrite 每个连接唯一的写协程，将发送队列中的消息合并之后批量写入连接
 func (c *Connection) startWrite() {
-	// 将消息封包，发送
-	dp := NewDataPack()
+	flushTimer := time.NewTimer(time.Hour)
+	flushTimer.Stop()
+	defer flushTimer.Stop()
 
-	for msg := range c.msgChan {
-		packet, err := dp.Pack(msg)
-		if err != nil {
-			c.exitChan <- struct{}{}
+	for {
+		var msg iface.IMessage
+		select {
+		case msg = <-c.msgChan:
+		case msg = <-c.msgBufChan:
+		case <-c.closedChan:
 			return
 		}
 
-		if _, err = c.conn.Write(packet); err != nil {
-			// 发送失败，关闭连接
-			c.exitChan <- struct{}{}
+		if !c.writeBatch(msg, flushTimer) {
 			return
 		}
 	}
 }
 
-func (c *Connection) startBufWrite() {
-	// 将消息封包，发送
-	dp := NewDataPack()
+// writeBatch 以msg开始，尽量多地取出队列中的消息封包到同一个缓冲区，一次性写入连接。
+// 失败时通知连接退出并返回false
+func (c *Connection) writeBatch(msg iface.IMessage, flushTimer *time.Timer) bool {
+	dataPack := c.cs.GetDataPack()
+	maxBatchSize := conf.Current().WriteBatchSize
+	flushDelay := conf.Current().GetWriteFlushDelay()
+
+	buf := getWriteBuffer()
+	defer putWriteBuffer(buf)
+
+	timerStarted := false
+	defer func() {
+		if timerStarted && !flushTimer.Stop() {
+			select {
+			case <-flushTimer.C:
+			default:
+			}
+		}
+	}()
 
-	for msg := range c.msgBufChan {
-		packet, err := dp.Pack(msg)
+	for n := 1; ; n++ {
+		packed, err := dataPack.PackTo(*buf, msg)
 		if err != nil {
-			c.exitChan <- struct{}{}
-			return
+			logger.Errorf("pack msg msgID=%v to %s err: %v", msg.GetMsgID(), c.RemoteAddr(), err)
+			c.exit()
+			return false
 		}
+		*buf = packed
 
-		if _, err = c.conn.Write(packet); err != nil {
-			// 发送失败，关闭连接
-			c.exitChan <- struct{}{}
-			return
+		if n >= maxBatchSize {
+			break
+		}
+
+		// 取出下一条消息，队列为空时最多等待flushDelay
+		msg = nil
+		select {
+		case msg = <-c.msgChan:
+		case msg = <-c.msgBufChan:
+		default:
+		}
+
+		if msg == nil && flushDelay > 0 {
+			if !timerStarted {
+				flushTimer.Reset(flushDelay)
+				timerStarted = true
+			}
+
+			select {
+			case msg = <-c.msgChan:
+			case msg = <-c.msgBufChan:
+			case <-flushTimer.C:
+				timerStarted = false
+			case <-c.closedChan:
+			}
+		}
+
+		if msg == nil {
+			break
 		}
 	}
+
+	if _, err := c.conn.Write(*buf); err != nil {
+		// 发送失败，关闭连接
+		c.exit()
+		return false
+	}
+	c.updateLastWriteTime(time.Now())
+
+	return true
 }
 
 func (c *Connection) Start() {
@@ -139,23 +444,47 @@ func (c *Connection) Start() {
 
 	c.cs.GetConnManager().Add(c)
 
-	go c.startRead()
-	go c.startWrite()
-	go c.startBufWrite()
-
 	if c.cs.GetHeartBeatChecker() != nil {
 		// 开启心跳检测
 		heartbeatChecker := c.cs.GetHeartBeatChecker().Clone()
 		heartbeatChecker.BindConn(c)
+		heartbeatChecker.BindScheduler(c.cs.GetScheduler())
+		heartbeatChecker.BindMetrics(c.cs.GetMetrics())
 		c.heartbeatChecker = heartbeatChecker
 		c.heartbeatChecker.Start()
 	}
 
+	// 开启空闲检测
+	c.startIdleCheck()
+
+	// 开启认证阶段
+	c.startAuth()
+
+	// 创建会话
+	c.startSession()
+
+	if c.loop != nil {
+		// epoll 模式下由事件循环负责读写，不阻塞
+		if err := c.loop.register(c); err != nil {
+			logger.Errorf("register connection from %s to event loop err: %v", c.RemoteAddr(), err)
+			c.Stop()
+			return
+		}
+		// Hook函数中可能已经发送了消息
+		c.notifyWrite()
+		return
+	}
+
+	go c.startRead()
+	go c.startWrite()
+
 	// 阻塞，直到退出
 	select {
 	case <-c.exitChan:
 		c.Stop()
 		return
+	case <-c.closedChan:
+		return
 	}
 }
 
@@ -168,18 +497,70 @@ func (c *Connection) Stop() {
 	// 执行Hook函数
 	c.cs.CallOnConnStop(c)
 
-	// 关闭管道
-	close(c.msgChan)
-	close(c.msgBufChan)
+	if c.loop != nil {
+		// 先从事件循环中移除，再关闭文件描述符，避免事件循环操作复用的文件描述符
+		state := c.loopState
+		state.mu.Lock()
+		state.closed = true
+		c.loop.unregister(c)
+		if state.outBuf != nil {
+			putWriteBuffer(state.outBuf)
+			state.outBuf = nil
+		}
+		state.inbound = nil
+		state.mu.Unlock()
+	}
+
+	// 通知发送者和写协程
+	close(c.closedChan)
 	_ = c.conn.Close()
+	c.stopSession() // 会话需要保存连接绑定的用户，在解除绑定之前调用
 	c.cs.GetConnManager().Remove(c)
+	c.stopReliable()
+	c.stopTopics()
+	c.stopGateway()
 	if c.heartbeatChecker != nil {
 		c.heartbeatChecker.Stop()
 	}
+	c.stopTimers()
+	c.callCloseFuncs()
+
+	if c.onStopped != nil {
+		c.onStopped()
+	}
 
 	logger.Infof("close a connection from %s", c.RemoteAddr())
 }
 
+func (c *Connection) GetConnID() uint64 {
+	return c.id
+}
+
+func (c *Connection) OnClose(f func(conn iface.IConnection)) {
+	c.closeFuncsLock.Lock()
+	if !c.isClosed.Load() {
+		c.closeFuncs = append(c.closeFuncs, f)
+		c.closeFuncsLock.Unlock()
+		return
+	}
+	c.closeFuncsLock.Unlock()
+
+	// 连接已经关闭，立即调用
+	f(c)
+}
+
+// callCloseFuncs 调用注册的连接关闭时的函数
+func (c *Connection) callCloseFuncs() {
+	c.closeFuncsLock.Lock()
+	funcs := c.closeFuncs
+	c.closeFuncs = nil
+	c.closeFuncsLock.Unlock()
+
+	for _, f := range funcs {
+		f(c)
+	}
+}
+
 func (c *Connection) GetConn() net.Conn {
 	return c.conn
 }
@@ -191,31 +572,179 @@ func (c *Connection) RemoteAddr() string {
 func (c *Connection) SendMsg(msgID uint32, data []byte) error {
 	if c.isClosed.Load() {
 		// 关闭直接返回
-		c.exitChan <- struct{}{}
-		return errors.New("connection closed when send msg")
+		return ErrConnClosed
 	}
 
 	msg := NewMessage(msgID, data)
 
 	// 将消息推入c.msgChan，等待发送
-	c.msgChan <- msg
-
-	return nil
+	select {
+	case c.msgChan <- msg:
+		c.notifyWrite()
+		return nil
+	case <-c.closedChan:
+		return ErrConnClosed
+	}
 }
 
+// SendBufMsg 将消息推入发送队列，发送队列满时按照配置的溢出策略处理
 func (c *Connection) SendBufMsg(msgID uint32, data []byte) error {
 	if c.isClosed.Load() {
 		// 关闭直接返回
-		c.exitChan <- struct{}{}
-		return errors.New("connection closed when send msg")
+		return ErrConnClosed
 	}
 
 	msg := NewMessage(msgID, data)
 
-	// 将消息推入c.msgChan，等待发送
-	c.msgBufChan <- msg
+	switch conf.Current().SendQueuePolicy {
+	case OverflowPolicyDropNewest:
+		select {
+		case c.msgBufChan <- msg:
+			c.notifyWrite()
+			return nil
+		case <-c.closedChan:
+			return ErrConnClosed
+		default:
+			// 丢弃当前的消息
+			c.cs.GetMetrics().Inc(iface.MetricSendDropped)
+			return ErrMsgDropped
+		}
+	case OverflowPolicyDropOldest:
+		for {
+			select {
+			case c.msgBufChan <- msg:
+				c.notifyWrite()
+				return nil
+			case <-c.closedChan:
+				return ErrConnClosed
+			default:
+				// 丢弃最早的消息，腾出位置
+				select {
+				case <-c.msgBufChan:
+					c.cs.GetMetrics().Inc(iface.MetricSendDropped)
+				default:
+				}
+			}
+		}
+	case OverflowPolicyDisconnect:
+		select {
+		case c.msgBufChan <- msg:
+			c.notifyWrite()
+			return nil
+		case <-c.closedChan:
+			return ErrConnClosed
+		default:
+			// 对端消费太慢，断开连接
+			logger.Warnf("send queue of connection from %s is full, disconnect slow consumer", c.RemoteAddr())
+			c.cs.GetMetrics().Inc(iface.MetricSlowConsumer)
+			c.exit()
+			return ErrSlowConsumer
+		}
+	default:
+		// 阻塞直到发送队列有空位或者连接关闭
+		select {
+		case c.msgBufChan <- msg:
+			c.notifyWrite()
+			return nil
+		case <-c.closedChan:
+			return ErrConnClosed
+		}
+	}
+}
 
-	return nil
+// TrySend 将消息推入发送队列，发送队列满时不阻塞，直接返回ErrSendQueueFull
+func (c *Connection) TrySend(msgID uint32, data []byte) error {
+	if c.isClosed.Load() {
+		return ErrConnClosed
+	}
+
+	select {
+	case c.msgBufChan <- NewMessage(msgID, data):
+		c.notifyWrite()
+		return nil
+	case <-c.closedChan:
+		return ErrConnClosed
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// SendWithTimeout 将消息推入发送队列，发送队列满时最多阻塞到ctx结束
+func (c *Connection) SendWithTimeout(ctx context.Context, msgID uint32, data []byte) error {
+	if c.isClosed.Load() {
+		return ErrConnClosed
+	}
+
+	select {
+	case c.msgBufChan <- NewMessage(msgID, data):
+		c.notifyWrite()
+		return nil
+	case <-c.closedChan:
+		return ErrConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AfterFunc d之后执行一次f，连接关闭时自动取消
+func (c *Connection) AfterFunc(d time.Duration, f func(conn iface.IConnection)) iface.ITimer {
+	var t iface.ITimer
+	c.timersLock.Lock()
+	defer c.timersLock.Unlock()
+
+	t = c.cs.GetScheduler().AfterFunc(d, func() {
+		c.timersLock.Lock()
+		delete(c.timers, t)
+		c.timersLock.Unlock()
+
+		f(c)
+	})
+	c.addTimer(t)
+
+	return t
+}
+
+// Every 每隔interval执行一次f，连接关闭时自动取消
+func (c *Connection) Every(interval time.Duration, f func(conn iface.IConnection)) iface.ITimer {
+	c.timersLock.Lock()
+	defer c.timersLock.Unlock()
+
+	t := c.cs.GetScheduler().Every(interval, func() {
+		f(c)
+	})
+	c.addTimer(t)
+
+	return t
+}
+
+// addTimer 记录连接的定时任务，调用时需持有timersLock
+func (c *Connection) addTimer(t iface.ITimer) {
+	if c.isClosed.Load() {
+		t.Stop()
+		return
+	}
+
+	if c.timers == nil {
+		c.timers = make(map[iface.ITimer]struct{}) // 延迟初始化
+	}
+	c.timers[t] = struct{}{}
+}
+
+func (c *Connection) stopTimers() {
+	c.timersLock.Lock()
+	defer c.timersLock.Unlock()
+
+	for t := range c.timers {
+		t.Stop()
+	}
+	c.timers = nil
+
+	for i, t := range c.idleTimers {
+		if t != nil {
+			t.Stop()
+			c.idleTimers[i] = nil
+		}
+	}
 }
 
 func (c *Connection) SetProperty(key string, value interface{}) {
@@ -256,11 +785,46 @@ func (c *Connection) RemoveProperty(key string) {
 	delete(c.properties, key)
 }
 
+// copyProperties 复制连接的所有属性
+func (c *Connection) copyProperties() map[string]interface{} {
+	c.propertiesLock.Lock()
+	defer c.propertiesLock.Unlock()
+
+	if len(c.properties) == 0 {
+		return nil
+	}
+
+	properties := make(map[string]interface{}, len(c.properties))
+	for key, value := range c.properties {
+		properties[key] = value
+	}
+
+	return properties
+}
+
+// doneChan 连接关闭时关闭的通道
+func (c *Connection) doneChan() <-chan struct{} {
+	return c.closedChan
+}
+
 func (c *Connection) IsAlive() bool {
 	if c.isClosed.Load() {
 		// 连接已经关闭
 		return false
 	}
 
-	return conf.GlobalProfile.MaxHeartbeatTime <= 0 || time.Now().Before(c.lastAliveTime.Add(conf.GlobalProfile.GetMaxHeartbeatTime()))
+	return conf.Current().MaxHeartbeatTime <= 0 || time.Now().Before(c.GetLastReadTime().Add(conf.Current().GetMaxHeartbeatTime()))
+}
+
+func (c *Connection) GetHeartBeatChecker() iface.IHeartBeatChecker {
+	return c.heartbeatChecker
+}
+
+// Stats 获取连接质量统计，只有ping/pong心跳模式下才有数据
+func (c *Connection) Stats() iface.ConnStats {
+	if c.heartbeatChecker == nil {
+		return iface.ConnStats{}
+	}
+
+	return c.heartbeatChecker.Stats()
 }
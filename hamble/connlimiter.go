@@ -0,0 +1,158 @@
+package hamble
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 连接被拒绝的原因
+const (
+	RejectReasonMaxConn       = "max_conn"          // 超过最大连接数
+	RejectReasonMaxConnPerIP  = "max_conn_per_ip"   // 超过单个IP的最大连接数
+	RejectReasonMaxConnInCIDR = "max_conn_per_cidr" // 超过网段的最大连接数
+	RejectReasonAcceptRate    = "accept_rate"       // 超过建立连接的速率
+	RejectReasonIPDenied      = "ip_denied"         // 被黑白名单拒绝
+	RejectReasonOnAccept      = "on_accept"         // 被OnAccept Hook函数拒绝
+)
+
+type cidrLimit struct {
+	ipNet *net.IPNet
+	max   int
+	count int // 网段内当前的连接数
+}
+
+// connLimiter 按照远程IP和网段限制并发连接数
+type connLimiter struct {
+	maxConnPerIP int
+	cidrLimits   []*cidrLimit
+	ipCounts     map[string]int // ip -> 当前的连接数
+
+	mu sync.Mutex
+}
+
+func newConnLimiter(maxConnPerIP int, cidrConnLimits []string) (*connLimiter, error) {
+	limiter := &connLimiter{
+		ipCounts: make(map[string]int),
+	}
+
+	if err := limiter.reload(maxConnPerIP, cidrConnLimits); err != nil {
+		return nil, err
+	}
+
+	return limiter, nil
+}
+
+// reload 重新设置限制，已经建立的连接仍然计入新的限制中
+func (l *connLimiter) reload(maxConnPerIP int, cidrConnLimits []string) error {
+	cidrLimits := make([]*cidrLimit, 0, len(cidrConnLimits))
+	for _, rule := range cidrConnLimits {
+		limit, err := parseCIDRLimit(rule)
+		if err != nil {
+			return err
+		}
+
+		cidrLimits = append(cidrLimits, limit)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// 重新统计每个网段内的连接数
+	for ip, count := range l.ipCounts {
+		parsedIP := net.ParseIP(ip)
+		for _, limit := range cidrLimits {
+			if limit.ipNet.Contains(parsedIP) {
+				limit.count += count
+			}
+		}
+	}
+
+	l.maxConnPerIP = maxConnPerIP
+	l.cidrLimits = cidrLimits
+
+	return nil
+}
+
+// acquire 为ip占用一个连接名额，超出限制时返回拒绝原因
+func (l *connLimiter) acquire(ip net.IP) (bool, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ip.String()
+	if l.maxConnPerIP > 0 && l.ipCounts[key] >= l.maxConnPerIP {
+		return false, RejectReasonMaxConnPerIP
+	}
+
+	for _, limit := range l.cidrLimits {
+		if limit.ipNet.Contains(ip) && limit.count >= limit.max {
+			return false, RejectReasonMaxConnInCIDR
+		}
+	}
+
+	l.ipCounts[key]++
+	for _, limit := range l.cidrLimits {
+		if limit.ipNet.Contains(ip) {
+			limit.count++
+		}
+	}
+
+	return true, ""
+}
+
+// release 释放ip占用的连接名额
+func (l *connLimiter) release(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ip.String()
+	if l.ipCounts[key] <= 0 {
+		return
+	}
+
+	if l.ipCounts[key]--; l.ipCounts[key] == 0 {
+		delete(l.ipCounts, key)
+	}
+
+	for _, limit := range l.cidrLimits {
+		if limit.ipNet.Contains(ip) && limit.count > 0 {
+			limit.count--
+		}
+	}
+}
+
+// parseCIDRLimit 解析网段连接数限制，格式为 <cidr>=<max>，如 10.0.0.0/8=100
+func parseCIDRLimit(rule string) (*cidrLimit, error) {
+	cidr, maxStr, found := strings.Cut(rule, "=")
+	if !found {
+		return nil, fmt.Errorf("cidr conn limit %q must be in format <cidr>=<max>", rule)
+	}
+
+	_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, fmt.Errorf("parse cidr %q err: %w", cidr, err)
+	}
+
+	max, err := strconv.Atoi(strings.TrimSpace(maxStr))
+	if err != nil || max <= 0 {
+		return nil, fmt.Errorf("cidr conn limit %q must be a positive integer", maxStr)
+	}
+
+	return &cidrLimit{ipNet: ipNet, max: max}, nil
+}
+
+// remoteIP 获取连接的远程IP
+func remoteIP(conn net.Conn) net.IP {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
@@ -1,15 +1,36 @@
 package hamble
 
 import (
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
 	"github.com/dawnzzz/hamble-tcp-server/iface"
 	"github.com/dawnzzz/hamble-tcp-server/logger"
 	"sync"
 	"sync/atomic"
+	"time"
+)
+
+// 用户的连接数超过 max_conns_per_user 时的处理策略
+const (
+	UserConnPolicyKickOldest = "kick_oldest" // 断开最早绑定的连接
+	UserConnPolicyRejectNew  = "reject_new"  // 拒绝绑定新的连接
+
+	RejectReasonMaxConnPerUser = "max_conn_per_user" // 被同一个用户的新连接挤下线
+
+	kickCloseDelay = 100 * time.Millisecond // 等待原因发送给客户端之后再关闭连接
+)
+
+var (
+	ErrUserOffline   = errors.New("user has no connection")
+	ErrUserConnLimit = errors.New("user has too many connections")
 )
 
 type ConnManager struct {
 	connections map[iface.IConnection]struct{}
 
+	users  map[string][]iface.IConnection // 用户 -> 绑定的连接，按绑定的先后顺序排列
+	userOf map[iface.IConnection]string   // 连接 -> 绑定的用户
+
 	mu         sync.Mutex
 	isClearing atomic.Bool
 }
@@ -17,6 +38,8 @@ type ConnManager struct {
 func NewConnManager() iface.IConnManager {
 	return &ConnManager{
 		connections: make(map[iface.IConnection]struct{}),
+		users:       make(map[string][]iface.IConnection),
+		userOf:      make(map[iface.IConnection]string),
 	}
 }
 
@@ -27,7 +50,7 @@ func (cm *ConnManager) Add(connection iface.IConnection) {
 	//将conn连接添加到ConnManager中
 	cm.connections[connection] = struct{}{}
 
-	logger.Infof("connection add to ConnManager successfully: conn num = %v", cm.Len())
+	logger.Infof("connection add to ConnManager successfully: conn num = %v", len(cm.connections))
 }
 
 func (cm *ConnManager) Remove(connection iface.IConnection) {
@@ -40,25 +63,185 @@ func (cm *ConnManager) Remove(connection iface.IConnection) {
 	defer cm.mu.Unlock()
 
 	delete(cm.connections, connection)
+	cm.unbindLocked(connection)
 
-	logger.Infof("connection remove from ConnManager successfully: conn num = %v", cm.Len())
+	logger.Infof("connection remove from ConnManager successfully: conn num = %v", len(cm.connections))
 }
 
 func (cm *ConnManager) Len() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
 	return len(cm.connections)
 }
 
+// Clear 停止所有的连接。停止连接时会执行Hook函数，Hook函数中可能调用ConnManager，不能持有mu
 func (cm *ConnManager) Clear() {
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
 	cm.isClearing.Store(true)
+	connections := cm.connections
+	cm.connections = make(map[iface.IConnection]struct{})
+	cm.users = make(map[string][]iface.IConnection)
+	cm.userOf = make(map[iface.IConnection]string)
+	cm.mu.Unlock()
 
-	for connection := range cm.connections {
-		// 停止
+	for connection := range connections {
 		connection.Stop()
-		// 删除
-		delete(cm.connections, connection)
 	}
+	cm.isClearing.Store(false)
 
 	logger.Infof("Conn Manager cleared: conn num = %v", cm.Len())
 }
+
+// Bind 将连接绑定到用户，一个连接只能绑定一个用户，连接关闭时自动解除绑定
+func (cm *ConnManager) Bind(connection iface.IConnection, userID string) error {
+	kicked, err := cm.bind(connection, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, conn := range kicked {
+		logger.Infof("user %s has too many connections, kick connection from %s", userID, conn.RemoteAddr())
+		_ = conn.TrySend(iface.ConnRejectMsgID, []byte(RejectReasonMaxConnPerUser))
+		conn.AfterFunc(kickCloseDelay, func(conn iface.IConnection) {
+			conn.Stop()
+		})
+	}
+
+	return nil
+}
+
+// bind 绑定连接，返回需要挤下线的连接
+func (cm *ConnManager) bind(connection iface.IConnection, userID string) ([]iface.IConnection, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	// 连接关闭之后会在持有锁的情况下解除绑定，之后不能再绑定
+	if c, ok := connection.(*Connection); ok && c.isClosed.Load() {
+		return nil, ErrConnClosed
+	}
+
+	if old, exist := cm.userOf[connection]; exist {
+		if old == userID {
+			return nil, nil
+		}
+		cm.unbindLocked(connection)
+	}
+
+	var kicked []iface.IConnection
+	conns := cm.users[userID]
+	if max := conf.Current().MaxConnsPerUser; max > 0 && len(conns) >= max {
+		if conf.Current().UserConnPolicy == UserConnPolicyRejectNew {
+			return nil, ErrUserConnLimit
+		}
+
+		kicked = append(kicked, conns[:len(conns)-max+1]...)
+		for _, conn := range kicked {
+			cm.unbindLocked(conn)
+		}
+	}
+
+	cm.users[userID] = append(cm.users[userID], connection)
+	cm.userOf[connection] = userID
+
+	return kicked, nil
+}
+
+// Unbind 解除连接与用户的绑定
+func (cm *ConnManager) Unbind(connection iface.IConnection) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.unbindLocked(connection)
+}
+
+func (cm *ConnManager) unbindLocked(connection iface.IConnection) {
+	userID, exist := cm.userOf[connection]
+	if !exist {
+		return
+	}
+	delete(cm.userOf, connection)
+
+	conns := cm.users[userID]
+	for i, conn := range conns {
+		if conn == connection {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+
+	if len(conns) == 0 {
+		delete(cm.users, userID)
+	} else {
+		cm.users[userID] = conns
+	}
+}
+
+// ConnsOf 获取用户的所有连接，按绑定的先后顺序排列
+func (cm *ConnManager) ConnsOf(userID string) []iface.IConnection {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	return append([]iface.IConnection(nil), cm.users[userID]...)
+}
+
+// UserOf 获取连接绑定的用户，没有绑定时为空
+func (cm *ConnManager) UserOf(connection iface.IConnection) string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	return cm.userOf[connection]
+}
+
+// Users 获取所有绑定了连接的用户
+func (cm *ConnManager) Users() []string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	users := make([]string, 0, len(cm.users))
+	for userID := range cm.users {
+		users = append(users, userID)
+	}
+
+	return users
+}
+
+// Range 遍历所有的连接，遍历的是调用时的快照，f中可以关闭连接
+func (cm *ConnManager) Range(f func(connection iface.IConnection) bool) {
+	cm.mu.Lock()
+	connections := make([]iface.IConnection, 0, len(cm.connections))
+	for connection := range cm.connections {
+		connections = append(connections, connection)
+	}
+	cm.mu.Unlock()
+
+	for _, connection := range connections {
+		if !f(connection) {
+			return
+		}
+	}
+}
+
+// SendToUser 向用户的所有连接发送消息，只要有一个连接发送成功就返回nil
+func (cm *ConnManager) SendToUser(userID string, msgID uint32, data []byte) error {
+	conns := cm.ConnsOf(userID)
+	if len(conns) == 0 {
+		return ErrUserOffline
+	}
+
+	var lastErr error
+	sent := false
+	for _, conn := range conns {
+		if err := conn.SendBufMsg(msgID, data); err != nil {
+			lastErr = err
+			continue
+		}
+		sent = true
+	}
+
+	if sent {
+		return nil
+	}
+
+	return lastErr
+}
@@ -0,0 +1,45 @@
+package hamble
+
+import (
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerStopWithHookUsingConnManager(t *testing.T) {
+	var server *Server
+	addr := startTestServer(t, func(s *Server) {
+		server = s
+		s.SetOnConnStart(func(conn iface.IConnection) {
+			_ = s.GetConnManager().Bind(conn, "alice")
+		})
+		// 服务器停止时在Hook函数中访问ConnManager
+		s.SetOnConnStop(func(conn iface.IConnection) {
+			_ = s.GetConnManager().UserOf(conn)
+			_ = s.GetConnManager().Len()
+		})
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitUntil(t, "alice bound", func() bool { return len(server.GetConnManager().ConnsOf("alice")) > 0 })
+
+	done := make(chan struct{})
+	go func() {
+		server.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("server stop deadlocked in OnConnStop")
+	}
+
+	if server.GetConnManager().Len() != 0 || len(server.GetConnManager().Users()) != 0 {
+		t.Fatal("expect all connections removed after stop")
+	}
+}
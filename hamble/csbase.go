@@ -1,9 +1,11 @@
 package hamble
 
 import (
+	"github.com/dawnzzz/hamble-tcp-server/conf"
 	"github.com/dawnzzz/hamble-tcp-server/hamble/heartbeat"
 	"github.com/dawnzzz/hamble-tcp-server/iface"
 	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,7 +19,28 @@ type CSBase struct {
 	onConnStart func(connection iface.IConnection) // Hook
 	onConnStop  func(connection iface.IConnection) // Hook
 
+	onRateLimited iface.OnRateLimited // 消息超过限流时的Hook
+	onIdle        iface.OnIdle        // 连接空闲时的Hook
+
+	idleTimeouts map[iface.IdleKind]time.Duration // 覆盖配置文件的空闲时间
+
+	authenticator   iface.Authenticator   // 认证方式，为nil时不进行认证
+	authOption      iface.AuthOption      // 认证阶段的选项
+	onAuthenticated iface.OnAuthenticated // 连接通过认证时的Hook
+
+	reliableOption iface.ReliableOption // 可靠消息的选项
+	onDelivered    iface.OnDelivered    // 可靠消息被对端确认时的Hook
+	onSendFailed   iface.OnSendFailed   // 可靠消息发送失败时的Hook
+
 	checker iface.IHeartBeatChecker // 心跳检测
+
+	metrics iface.IMetrics // 运行指标
+
+	scheduler iface.IScheduler // 所有连接共用的定时任务调度器
+
+	codec iface.ICodec // 服务请求和回复的编码方式
+
+	rateRules atomic.Pointer[rateRules] // 消息限流规则，配置发生变化时整体替换，客户端不加载
 }
 
 func (cs *CSBase) RegisterHandler(id uint32, handler iface.IHandler) {
@@ -52,9 +75,70 @@ func (cs *CSBase) CallOnConnStop(conn iface.IConnection) {
 	}
 }
 
+func (cs *CSBase) SetOnRateLimited(f iface.OnRateLimited) {
+	cs.onRateLimited = f
+}
+
+func (cs *CSBase) CallOnRateLimited(conn iface.IConnection, msgID uint32, reason string) {
+	if cs.onRateLimited != nil {
+		cs.onRateLimited(conn, msgID, reason)
+	}
+}
+
+func (cs *CSBase) SetOnIdle(f iface.OnIdle) {
+	cs.onIdle = f
+}
+
+// CallOnIdle 调用连接空闲时的Hook函数，未设置时读空闲和读写空闲的连接会被关闭
+func (cs *CSBase) CallOnIdle(conn iface.IConnection, kind iface.IdleKind) {
+	if cs.onIdle != nil {
+		cs.onIdle(conn, kind)
+		return
+	}
+
+	if kind != iface.WriterIdle {
+		logger.Infof("connection from %s is %s, stop it", conn.RemoteAddr(), kind)
+		conn.Stop()
+	}
+}
+
+// SetIdleTimeout 设置所有连接的空闲时间，需要在启动之前调用
+func (cs *CSBase) SetIdleTimeout(kind iface.IdleKind, timeout time.Duration) {
+	if cs.idleTimeouts == nil {
+		cs.idleTimeouts = make(map[iface.IdleKind]time.Duration)
+	}
+
+	cs.idleTimeouts[kind] = timeout
+}
+
+func (cs *CSBase) GetIdleTimeout(kind iface.IdleKind) time.Duration {
+	if timeout, exist := cs.idleTimeouts[kind]; exist {
+		return timeout
+	}
+
+	switch kind {
+	case iface.ReaderIdle:
+		return conf.Current().GetReaderIdleTime()
+	case iface.WriterIdle:
+		return conf.Current().GetWriterIdleTime()
+	case iface.AllIdle:
+		return conf.Current().GetAllIdleTime()
+	default:
+		return 0
+	}
+}
+
 func (cs *CSBase) StartHeartbeat(interval time.Duration) {
 	cs.checker = heartbeat.NewHearBeatChecker(interval)
 	cs.RegisterHandler(iface.DefaultHeartbeatMsgID, &heartbeat.DefaultHandler{})
+	cs.registerBuiltinHeartbeatHandler()
+}
+
+// registerBuiltinHeartbeatHandler 注册框架内置的心跳Handler：对端使用ping/pong心跳时回复pong消息。
+// 心跳参数只由服务器通告给客户端，服务器不处理对端通告的心跳参数
+func (cs *CSBase) registerBuiltinHeartbeatHandler() {
+	cs.RegisterHandler(iface.PingMsgID, &heartbeat.PingHandler{})
+	cs.RegisterHandler(iface.PongMsgID, &heartbeat.PongHandler{})
 }
 
 func (cs *CSBase) StartHeartbeatWithOption(option iface.CheckerOption) {
@@ -63,14 +147,28 @@ func (cs *CSBase) StartHeartbeatWithOption(option iface.CheckerOption) {
 		return
 	}
 
-	cs.checker = heartbeat.NewHearBeatChecker(option.Interval)
+	if option.Mode == iface.HeartbeatModePingPong {
+		cs.checker = heartbeat.NewPingPongChecker(option.Interval)
+	} else {
+		cs.checker = heartbeat.NewHearBeatChecker(option.Interval)
+	}
 
 	if option.OnRemoteNotAlive != nil {
 		cs.checker.SetOnRemoteNotAlive(option.OnRemoteNotAlive)
 	}
 
 	if option.HeartbeatMsgFunc != nil {
-		cs.checker.SetOnRemoteNotAlive(option.OnRemoteNotAlive)
+		cs.checker.SetHeartbeatMsgFunc(option.HeartbeatMsgFunc)
+	}
+
+	if option.HeartBeatFunc != nil {
+		cs.checker.SetHeartbeatFunc(option.HeartBeatFunc)
+	}
+
+	if option.Negotiate {
+		if checker, ok := cs.checker.(*heartbeat.Checker); ok {
+			checker.SetNegotiate(true)
+		}
 	}
 
 	if option.Handler != nil {
@@ -78,12 +176,17 @@ func (cs *CSBase) StartHeartbeatWithOption(option iface.CheckerOption) {
 	} else {
 		cs.RegisterHandler(iface.DefaultHeartbeatMsgID, &heartbeat.DefaultHandler{})
 	}
+	cs.registerBuiltinHeartbeatHandler()
 }
 
 func (cs *CSBase) GetHeartBeatChecker() iface.IHeartBeatChecker {
 	return cs.checker
 }
 
+func (cs *CSBase) GetScheduler() iface.IScheduler {
+	return cs.scheduler
+}
+
 func (cs *CSBase) GetDataPack() iface.IDataPack {
 	return cs.dataPack
 }
@@ -95,3 +198,23 @@ func (cs *CSBase) SetDataPack(dataPack iface.IDataPack) {
 
 	cs.dataPack = dataPack
 }
+
+func (cs *CSBase) GetMetrics() iface.IMetrics {
+	return cs.metrics
+}
+
+func (cs *CSBase) SetCodec(codec iface.ICodec) {
+	if codec == nil {
+		return
+	}
+
+	cs.codec = codec
+}
+
+func (cs *CSBase) GetCodec() iface.ICodec {
+	if cs.codec == nil {
+		return JSONCodec{}
+	}
+
+	return cs.codec
+}
@@ -1,7 +1,6 @@
 package hamble
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"github.com/dawnzzz/hamble-tcp-server/conf"
@@ -10,6 +9,11 @@ import (
 
 const headLen = uint32(8) // 数据长度4字节（uint32）+MsgID占4字节（uint32）
 
+var (
+	ErrPacketTooBig = errors.New("packet size is too big")
+	ErrHeadTooShort = errors.New("packet head is too short")
+)
+
 type DataPack struct {
 }
 
@@ -23,50 +27,47 @@ func (dp *DataPack) GetHeadLen() uint32 {
 
 // Pack 封包方法
 func (dp *DataPack) Pack(msg iface.IMessage) ([]byte, error) {
-	buffer := bytes.NewBuffer([]byte{})
-
-	// 写入数据长度
-	err := binary.Write(buffer, binary.BigEndian, msg.GetDataLen())
-	if err != nil {
-		return nil, err
-	}
+	return dp.PackTo(make([]byte, 0, headLen+msg.GetDataLen()), msg)
+}
 
-	// 写入MsgID
-	err = binary.Write(buffer, binary.BigEndian, msg.GetMsgID())
-	if err != nil {
-		return nil, err
-	}
+// PackTo 封包方法，将封包后的数据追加到dst之后并返回，dst容量足够时不会分配内存
+func (dp *DataPack) PackTo(dst []byte, msg iface.IMessage) ([]byte, error) {
+	// 写入数据长度和MsgID
+	dst = binary.BigEndian.AppendUint32(dst, msg.GetDataLen())
+	dst = binary.BigEndian.AppendUint32(dst, msg.GetMsgID())
 
 	// 写入数据
-	err = binary.Write(buffer, binary.BigEndian, msg.GetData())
-	if err != nil {
-		return nil, err
-	}
-
-	return buffer.Bytes(), nil
+	return append(dst, msg.GetData()...), nil
 }
 
 // Unpack 解包方法
 func (dp *DataPack) Unpack(data []byte) (iface.IMessage, error) {
-	reader := bytes.NewReader(data)
-
-	msg := &Message{}
-	// 读取数据长度
-	err := binary.Read(reader, binary.BigEndian, &msg.length)
+	dataLen, msgID, err := dp.UnpackHeader(data)
 	if err != nil {
 		return nil, err
 	}
 
-	// 读取MsgID
-	err = binary.Read(reader, binary.BigEndian, &msg.msgID)
-	if err != nil {
-		return nil, err
+	return &Message{
+		msgID:  msgID,
+		length: dataLen,
+	}, nil
+}
+
+// UnpackHeader 解析包头，返回数据长度和MsgID
+func (dp *DataPack) UnpackHeader(head []byte) (uint32, uint32, error) {
+	if len(head) < int(headLen) {
+		return 0, 0, ErrHeadTooShort
 	}
 
+	// 读取数据长度
+	dataLen := binary.BigEndian.Uint32(head[0:4])
+	// 读取MsgID
+	msgID := binary.BigEndian.Uint32(head[4:8])
+
 	//判断dataLen的长度是否超出允许的最大包长度
-	if conf.GlobalProfile.MaxPacketSize > 0 && msg.length > conf.GlobalProfile.MaxPacketSize {
-		return nil, errors.New("packet size is too big")
+	if conf.Current().MaxPacketSize > 0 && dataLen > conf.Current().MaxPacketSize {
+		return 0, 0, ErrPacketTooBig
 	}
 
-	return msg, nil
+	return dataLen, msgID, nil
 }
@@ -0,0 +1,89 @@
+package hamble
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDataPack(t *testing.T) {
+	dp := NewDataPack()
+	msg := NewMessage(7, []byte("hello"))
+
+	packet, err := dp.Pack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataLen, msgID, err := dp.UnpackHeader(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataLen != 5 || msgID != 7 {
+		t.Fatalf("unpack header got dataLen=%v msgID=%v", dataLen, msgID)
+	}
+	if !bytes.Equal(packet[dp.GetHeadLen():], []byte("hello")) {
+		t.Fatalf("unexpected payload %q", packet[dp.GetHeadLen():])
+	}
+
+	// PackTo追加到已有数据之后
+	batch, _ := dp.PackTo(packet, msg)
+	if !bytes.Equal(batch[:len(packet)], batch[len(packet):]) {
+		t.Fatal("PackTo should append the packet")
+	}
+
+	if _, _, err := dp.UnpackHeader(packet[:4]); err != ErrHeadTooShort {
+		t.Fatalf("expect ErrHeadTooShort, got %v", err)
+	}
+}
+
+func BenchmarkPack(b *testing.B) {
+	dp := NewDataPack()
+	msg := NewMessage(1, make([]byte, 512))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := dp.Pack(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPackTo 写协程复用同一个缓冲区封包，不分配内存
+func BenchmarkPackTo(b *testing.B) {
+	dp := NewDataPack()
+	msg := NewMessage(1, make([]byte, 512))
+	buf := make([]byte, 0, 4096)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = dp.PackTo(buf[:0], msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnpack(b *testing.B) {
+	dp := NewDataPack()
+	packet, _ := dp.Pack(NewMessage(1, make([]byte, 512)))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := dp.Unpack(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkUnpackHeader 读协程只解析包头，不分配内存
+func BenchmarkUnpackHeader(b *testing.B) {
+	dp := NewDataPack()
+	packet, _ := dp.Pack(NewMessage(1, make([]byte, 512)))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := dp.UnpackHeader(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
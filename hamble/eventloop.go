@@ -0,0 +1,260 @@
+package hamble
+
+import (
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 网络模型
+const (
+	NetworkModeGoroutine = "goroutine" // 每个连接使用独立的读写协程
+	NetworkModeEpoll     = "epoll"     // 少量事件循环处理所有连接的读写，仅支持 Linux
+)
+
+var ErrEventLoopUnsupported = errors.New("epoll event loop is only supported on linux")
+
+// eventLoop 事件循环，负责多个连接的读写
+type eventLoop interface {
+	register(c *Connection) error // 开始监听连接的读事件
+	unregister(c *Connection)     // 停止监听连接，调用时需持有 loopState.mu
+	modify(c *Connection) error   // 根据连接状态更新监听的事件，调用时需持有 loopState.mu
+	wakeWrite(c *Connection)      // 通知事件循环发送队列中有待发送的消息
+	close() error
+}
+
+// loopState 连接在事件循环中的状态
+type loopState struct {
+	fd int // socket 文件描述符
+
+	inbound []byte  // 已经读取但还未解包的数据
+	outBuf  *[]byte // 已经封包但还未写完的数据
+	written int     // outBuf 中已经写入的字节数
+
+	paused    bool // 暂停读取，用于限流中的背压
+	blocked   bool // 任务队列已满，等待请求放入任务队列之后再读取
+	waitWrite bool // 正在等待可写事件
+	closed    bool
+
+	writeScheduled atomic.Bool // 已经通知事件循环发送数据
+
+	mu sync.Mutex
+}
+
+// reading 是否继续读取连接的数据
+func (state *loopState) reading() bool {
+	return !state.paused && !state.blocked
+}
+
+// eventLoopGroup 一组事件循环，新连接轮流分配到各个事件循环
+type eventLoopGroup struct {
+	loops []eventLoop
+	next  atomic.Uint32
+}
+
+func newEventLoopGroup(num int) (*eventLoopGroup, error) {
+	if num <= 0 {
+		num = runtime.NumCPU()
+	}
+
+	group := &eventLoopGroup{loops: make([]eventLoop, 0, num)}
+	for i := 0; i < num; i++ {
+		loop, err := newEventLoop()
+		if err != nil {
+			_ = group.close()
+			return nil, err
+		}
+		group.loops = append(group.loops, loop)
+	}
+
+	return group, nil
+}
+
+func (g *eventLoopGroup) pick() eventLoop {
+	return g.loops[int(g.next.Add(1))%len(g.loops)]
+}
+
+func (g *eventLoopGroup) close() error {
+	var err error
+	for _, loop := range g.loops {
+		if e := loop.close(); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// newLoopConnection 创建一个由事件循环负责读写的连接
+func newLoopConnection(conn *net.TCPConn, cs iface.ICSBase, loop eventLoop) (*Connection, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &loopState{fd: -1}
+	if err = rawConn.Control(func(fd uintptr) {
+		state.fd = int(fd)
+	}); err != nil {
+		return nil, err
+	}
+
+	c := newConnection(conn, cs)
+	c.loop = loop
+	c.loopState = state
+
+	return c, nil
+}
+
+// processInbound 从已经读取的数据中解出完整的消息并处理，调用时需持有 loopState.mu
+func (c *Connection) processInbound() {
+	state := c.loopState
+	dataPack := c.cs.GetDataPack()
+	headLen := int(dataPack.GetHeadLen())
+
+	offset := 0
+	for state.reading() && !state.closed && len(state.inbound)-offset >= headLen {
+		dataLen, msgID, err := dataPack.UnpackHeader(state.inbound[offset : offset+headLen])
+		if err != nil {
+			state.paused = true
+			c.exit()
+			break
+		}
+
+		if len(state.inbound)-offset-headLen < int(dataLen) {
+			// 消息还未读取完整
+			break
+		}
+
+		payload := getPayloadBuffer(int(dataLen))
+		copy(*payload, state.inbound[offset+headLen:])
+		offset += headLen + int(dataLen)
+
+		if !c.handleMsg(NewMessage(msgID, *payload), payload) {
+			// 不再读取该连接的消息
+			state.paused = true
+			_ = c.loop.modify(c)
+			break
+		}
+	}
+
+	remain := copy(state.inbound, state.inbound[offset:])
+	state.inbound = state.inbound[:remain]
+	if remain == 0 && cap(state.inbound) > maxPooledWriteBufferSize {
+		// 释放过大的缓冲区，避免大量空闲连接占用内存
+		state.inbound = nil
+	}
+}
+
+// fillOutbound 从发送队列中取出最多WriteBatchSize条消息封包到outBuf，调用时需持有 loopState.mu
+func (c *Connection) fillOutbound() error {
+	state := c.loopState
+	dataPack := c.cs.GetDataPack()
+
+	for n := 0; n < conf.Current().WriteBatchSize; n++ {
+		var msg iface.IMessage
+		select {
+		case msg = <-c.msgChan:
+		case msg = <-c.msgBufChan:
+		default:
+			return nil
+		}
+
+		if state.outBuf == nil {
+			state.outBuf = getWriteBuffer()
+		}
+
+		packed, err := dataPack.PackTo(*state.outBuf, msg)
+		if err != nil {
+			logger.Errorf("pack msg msgID=%v to %s err: %v", msg.GetMsgID(), c.RemoteAddr(), err)
+			return err
+		}
+		*state.outBuf = packed
+	}
+
+	return nil
+}
+
+// hasPendingMsg 发送队列中是否还有消息
+func (c *Connection) hasPendingMsg() bool {
+	return len(c.msgChan) > 0 || len(c.msgBufChan) > 0
+}
+
+// notifyWrite 消息推入发送队列之后调用，epoll 模式下通知事件循环发送
+func (c *Connection) notifyWrite() {
+	if c.loop == nil {
+		return
+	}
+
+	if c.loopState.writeScheduled.CompareAndSwap(false, true) {
+		c.loop.wakeWrite(c)
+	}
+}
+
+// throttle 限流时延迟读取下一条消息
+func (c *Connection) throttle(wait time.Duration) {
+	if c.loop == nil {
+		time.Sleep(wait)
+		return
+	}
+
+	// epoll 模式下不能阻塞事件循环，暂停监听读事件，等待之后再恢复。调用时已经持有 loopState.mu
+	state := c.loopState
+	state.paused = true
+	_ = c.loop.modify(c)
+
+	time.AfterFunc(wait, func() {
+		c.resumeRead(func() {
+			state.paused = false
+		})
+	})
+}
+
+// dispatchInLoop epoll 模式下将请求交给Worker，不能阻塞事件循环。
+// 任务队列已满并且溢出策略为block时暂停读取，在新的协程中等待任务队列有空位，之后恢复读取。调用时已经持有 loopState.mu
+func (c *Connection) dispatchInLoop(router *Router, request iface.IRequest) {
+	if conf.Current().TaskQueuePolicy != OverflowPolicyBlock {
+		// 其他溢出策略不会阻塞
+		c.sendToTaskQueue(router, request)
+		return
+	}
+
+	if router.trySendMsgToTaskQueue(request) {
+		return
+	}
+
+	state := c.loopState
+	state.blocked = true
+	_ = c.loop.modify(c)
+
+	go func() {
+		c.sendToTaskQueue(router, request)
+
+		c.resumeRead(func() {
+			state.blocked = false
+		})
+	}()
+}
+
+// resumeRead 调用resume清除暂停读取的原因，之后处理已经读取的数据，并恢复监听读事件
+func (c *Connection) resumeRead(resume func()) {
+	state := c.loopState
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.closed {
+		return
+	}
+
+	resume()
+	c.processInbound()
+	if state.reading() {
+		_ = c.loop.modify(c)
+	}
+}
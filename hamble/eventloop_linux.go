@@ -0,0 +1,307 @@
+//go:build linux
+
+package hamble
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"golang.org/x/sys/unix"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	epollReadEvents  = unix.EPOLLIN | unix.EPOLLRDHUP
+	epollWriteEvents = unix.EPOLLOUT
+	epollWaitEvents  = 256       // 一次最多取出的事件数
+	loopReadBufSize  = 64 * 1024 // 每个事件循环共用的读缓冲区大小
+)
+
+// epollLoop 基于 epoll 的事件循环，使用水平触发，通过 eventfd 唤醒
+type epollLoop struct {
+	epfd   int
+	wakeFd int
+
+	conns     map[int]*Connection // fd -> 连接
+	connsLock sync.Mutex
+
+	pending     []*Connection // 等待发送数据的连接
+	pendingLock sync.Mutex
+
+	readBuf []byte
+	closed  atomic.Bool
+}
+
+func newEventLoop() (eventLoop, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	wakeFd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		_ = unix.Close(epfd)
+		return nil, err
+	}
+
+	if err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wakeFd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(wakeFd)}); err != nil {
+		_ = unix.Close(wakeFd)
+		_ = unix.Close(epfd)
+		return nil, err
+	}
+
+	l := &epollLoop{
+		epfd:    epfd,
+		wakeFd:  wakeFd,
+		conns:   make(map[int]*Connection),
+		readBuf: make([]byte, loopReadBufSize),
+	}
+	go l.run()
+
+	return l, nil
+}
+
+func (l *epollLoop) register(c *Connection) error {
+	state := c.loopState
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.closed {
+		return ErrConnClosed
+	}
+
+	l.connsLock.Lock()
+	l.conns[state.fd] = c
+	l.connsLock.Unlock()
+
+	if err := unix.EpollCtl(l.epfd, unix.EPOLL_CTL_ADD, state.fd, &unix.EpollEvent{Events: l.events(state), Fd: int32(state.fd)}); err != nil {
+		l.connsLock.Lock()
+		delete(l.conns, state.fd)
+		l.connsLock.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (l *epollLoop) unregister(c *Connection) {
+	state := c.loopState
+
+	_ = unix.EpollCtl(l.epfd, unix.EPOLL_CTL_DEL, state.fd, nil)
+
+	l.connsLock.Lock()
+	if l.conns[state.fd] == c {
+		delete(l.conns, state.fd)
+	}
+	l.connsLock.Unlock()
+}
+
+func (l *epollLoop) modify(c *Connection) error {
+	state := c.loopState
+	if state.closed {
+		return ErrConnClosed
+	}
+
+	return unix.EpollCtl(l.epfd, unix.EPOLL_CTL_MOD, state.fd, &unix.EpollEvent{Events: l.events(state), Fd: int32(state.fd)})
+}
+
+func (l *epollLoop) events(state *loopState) uint32 {
+	var events uint32
+	if state.reading() {
+		events |= epollReadEvents
+	}
+	if state.waitWrite {
+		events |= epollWriteEvents
+	}
+
+	return events
+}
+
+func (l *epollLoop) wakeWrite(c *Connection) {
+	l.pendingLock.Lock()
+	l.pending = append(l.pending, c)
+	l.pendingLock.Unlock()
+
+	l.wake()
+}
+
+func (l *epollLoop) wake() {
+	var one [8]byte
+	binary.LittleEndian.PutUint64(one[:], 1)
+	// 计数器已满时写入会返回 EAGAIN，此时事件循环一定会被唤醒，忽略即可
+	_, _ = unix.Write(l.wakeFd, one[:])
+}
+
+func (l *epollLoop) close() error {
+	if !l.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	l.wake()
+
+	return nil
+}
+
+func (l *epollLoop) run() {
+	defer func() {
+		_ = unix.Close(l.wakeFd)
+		_ = unix.Close(l.epfd)
+	}()
+
+	events := make([]unix.EpollEvent, epollWaitEvents)
+	for {
+		n, err := unix.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			logger.Errorf("epoll wait err: %v", err)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == l.wakeFd {
+				var buf [8]byte
+				_, _ = unix.Read(l.wakeFd, buf[:])
+				continue
+			}
+
+			l.connsLock.Lock()
+			c := l.conns[fd]
+			l.connsLock.Unlock()
+			if c == nil {
+				continue
+			}
+
+			if events[i].Events&(unix.EPOLLHUP|unix.EPOLLERR) != 0 {
+				// 连接出错，即使暂停读取也会一直触发，需要立即停止监听
+				l.handleError(c)
+				continue
+			}
+			if events[i].Events&(unix.EPOLLIN|unix.EPOLLRDHUP) != 0 {
+				l.handleRead(c)
+			}
+			if events[i].Events&unix.EPOLLOUT != 0 {
+				l.handleWrite(c)
+			}
+		}
+
+		l.flushPending()
+
+		if l.closed.Load() {
+			return
+		}
+	}
+}
+
+// handleRead 读取连接中的数据并处理完整的消息
+func (l *epollLoop) handleRead(c *Connection) {
+	state := c.loopState
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.closed || !state.reading() {
+		return
+	}
+
+	n, err := unix.Read(state.fd, l.readBuf)
+	if err != nil {
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			return
+		}
+		state.paused = true
+		_ = l.modify(c)
+		c.exit()
+		return
+	}
+
+	if n == 0 {
+		// 对端关闭连接
+		state.paused = true
+		_ = l.modify(c)
+		c.exit()
+		return
+	}
+
+	state.inbound = append(state.inbound, l.readBuf[:n]...)
+	c.processInbound()
+}
+
+func (l *epollLoop) handleError(c *Connection) {
+	state := c.loopState
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	l.unregister(c)
+	c.exit()
+}
+
+func (l *epollLoop) flushPending() {
+	l.pendingLock.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.pendingLock.Unlock()
+
+	for _, c := range pending {
+		c.loopState.writeScheduled.Store(false)
+		l.handleWrite(c)
+	}
+}
+
+// handleWrite 将发送队列中的消息封包之后非阻塞地写入连接，写不完时等待可写事件
+func (l *epollLoop) handleWrite(c *Connection) {
+	state := c.loopState
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.closed {
+		return
+	}
+
+	if state.outBuf == nil {
+		if err := c.fillOutbound(); err != nil {
+			c.exit()
+			return
+		}
+		if state.outBuf == nil {
+			return
+		}
+	}
+
+	for state.written < len(*state.outBuf) {
+		n, err := unix.Write(state.fd, (*state.outBuf)[state.written:])
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			if errors.Is(err, unix.EAGAIN) {
+				// 内核发送缓冲区已满，等待可写事件
+				if !state.waitWrite {
+					state.waitWrite = true
+					_ = l.modify(c)
+				}
+				return
+			}
+			c.exit()
+			return
+		}
+		state.written += n
+	}
+
+	putWriteBuffer(state.outBuf)
+	state.outBuf, state.written = nil, 0
+	c.updateLastWriteTime(time.Now())
+
+	if state.waitWrite {
+		state.waitWrite = false
+		_ = l.modify(c)
+	}
+
+	if c.hasPendingMsg() {
+		// 还有待发送的消息，在下一轮事件循环中继续发送，避免一个连接占用事件循环
+		c.notifyWrite()
+	}
+}
@@ -0,0 +1,284 @@
+package hamble
+
+import (
+	"bytes"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useEpoll 之后启动的服务器使用一个事件循环，setup修改其它配置，测试结束时恢复配置
+func useEpoll(t *testing.T, setup func(profile *conf.Profile)) {
+	t.Helper()
+
+	old := *conf.GlobalProfile
+	t.Cleanup(func() {
+		*conf.GlobalProfile = old
+		conf.BindProfile(&old)
+	})
+
+	conf.GlobalProfile.NetworkMode = NetworkModeEpoll
+	conf.GlobalProfile.EventLoopNum = 1
+	if setup != nil {
+		setup(conf.GlobalProfile)
+	}
+}
+
+// loopConn 获取客户端连接在服务器上对应的连接，连接由事件循环负责读写
+func loopConn(t *testing.T, s *Server, client net.Conn) *Connection {
+	t.Helper()
+
+	var conn *Connection
+	waitUntil(t, "connection registered", func() bool {
+		s.GetConnManager().Range(func(connection iface.IConnection) bool {
+			if connection.RemoteAddr() == client.LocalAddr().String() {
+				conn, _ = connection.(*Connection)
+				return false
+			}
+			return true
+		})
+		return conn != nil
+	})
+	if conn.loop == nil {
+		t.Fatal("expect connection served by the event loop")
+	}
+
+	return conn
+}
+
+// loopStateOf 在持有loopState.mu时读取连接在事件循环中的状态
+func loopStateOf(c *Connection, f func(state *loopState) bool) bool {
+	c.loopState.mu.Lock()
+	defer c.loopState.mu.Unlock()
+
+	return f(c.loopState)
+}
+
+func writeMsg(t *testing.T, conn net.Conn, msgID uint32, data []byte) {
+	t.Helper()
+
+	packet, err := NewDataPack().Pack(NewMessage(msgID, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readMsg(t *testing.T, conn net.Conn) iface.IMessage {
+	t.Helper()
+
+	dp := NewDataPack()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	head := make([]byte, dp.GetHeadLen())
+	if _, err := io.ReadFull(conn, head); err != nil {
+		t.Fatal(err)
+	}
+	dataLen, msgID, err := dp.UnpackHeader(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, dataLen)
+	if _, err = io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewMessage(msgID, data)
+}
+
+type echoHandler struct {
+	BaseHandler
+}
+
+func (h *echoHandler) Handle(request iface.IRequest) {
+	_ = request.GetConnection().SendMsg(request.GetMsgID(), append([]byte(nil), request.GetData()...))
+}
+
+func TestEventLoopEchoPartialWrites(t *testing.T) {
+	useEpoll(t, nil)
+
+	var server *Server
+	addr := startTestServer(t, func(s *Server) {
+		server = s
+		s.RegisterHandler(1, &echoHandler{})
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.(*net.TCPConn).SetReadBuffer(16 * 1024)
+
+	// 大消息分多次读取才能解出完整的消息，回复时写满内核的发送缓冲区
+	data := make([]byte, 16<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	writeMsg(t, conn, 1, data)
+
+	c := loopConn(t, server, conn)
+	waitUntil(t, "server waiting for writable", func() bool {
+		return loopStateOf(c, func(state *loopState) bool { return state.waitWrite })
+	})
+
+	msg := readMsg(t, conn)
+	if msg.GetMsgID() != 1 || !bytes.Equal(msg.GetData(), data) {
+		t.Fatalf("echo mismatch: msgID=%v len=%v", msg.GetMsgID(), len(msg.GetData()))
+	}
+	waitUntil(t, "server finished writing", func() bool {
+		return loopStateOf(c, func(state *loopState) bool { return !state.waitWrite && state.outBuf == nil })
+	})
+
+	// 之后的小消息不受影响
+	for i := 0; i < 10; i++ {
+		writeMsg(t, conn, 1, []byte{byte(i)})
+	}
+	for i := 0; i < 10; i++ {
+		if msg = readMsg(t, conn); !bytes.Equal(msg.GetData(), []byte{byte(i)}) {
+			t.Fatalf("expect echo %v, got %v", i, msg.GetData())
+		}
+	}
+}
+
+func TestEventLoopClose(t *testing.T) {
+	useEpoll(t, nil)
+
+	var server *Server
+	stopped := make(chan iface.IConnection, 8)
+	addr := startTestServer(t, func(s *Server) {
+		server = s
+		s.RegisterHandler(1, &echoHandler{})
+		s.SetOnConnStop(func(conn iface.IConnection) {
+			stopped <- conn
+		})
+	})
+	// 启动服务器时检查端口的连接也会调用OnConnStop，只等待指定的连接
+	waitStopped := func(c *Connection) {
+		t.Helper()
+		for {
+			select {
+			case got := <-stopped:
+				if got == c {
+					return
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatalf("timeout waiting for OnConnStop of %s", c.RemoteAddr())
+			}
+		}
+	}
+
+	// 客户端关闭连接
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeMsg(t, conn, 1, []byte("ping"))
+	readMsg(t, conn)
+	c := loopConn(t, server, conn)
+	_ = conn.Close()
+	waitStopped(c)
+	waitUntil(t, "connection removed", func() bool { return server.GetConnManager().Len() == 0 })
+	loop := c.loop.(*epollLoop)
+	loop.connsLock.Lock()
+	registered := len(loop.conns)
+	loop.connsLock.Unlock()
+	if registered != 0 {
+		t.Fatalf("expect closed connection unregistered from the event loop, got %v", registered)
+	}
+	if !loopStateOf(c, func(state *loopState) bool { return state.closed }) {
+		t.Fatal("expect loop state closed")
+	}
+
+	// 服务器关闭连接，客户端读到EOF
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c = loopConn(t, server, conn)
+	c.Stop()
+	waitStopped(c)
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect EOF after server closed the connection, got %v", err)
+	}
+}
+
+// gateHandler 在release关闭之前阻塞，记录收到的消息
+type gateHandler struct {
+	BaseHandler
+	release chan struct{}
+
+	received []byte
+	mu       sync.Mutex
+}
+
+func (h *gateHandler) Handle(request iface.IRequest) {
+	<-h.release
+
+	h.mu.Lock()
+	h.received = append(h.received, request.GetData()...)
+	h.mu.Unlock()
+}
+
+func (h *gateHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.received)
+}
+
+func TestEventLoopTaskQueueFull(t *testing.T) {
+	useEpoll(t, func(profile *conf.Profile) {
+		profile.WorkerPoolSize = 1
+		profile.MaxWorkerTaskLen = 1
+		profile.TaskQueuePolicy = OverflowPolicyBlock
+	})
+
+	var server *Server
+	handler := &gateHandler{release: make(chan struct{})}
+	addr := startTestServer(t, func(s *Server) {
+		server = s
+		s.RegisterHandler(1, handler)
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := loopConn(t, server, conn)
+
+	// Worker处理第一条消息时阻塞，第二条消息放入任务队列，第三条消息放不进去时暂停读取
+	const n = 5
+	for i := 0; i < n; i++ {
+		writeMsg(t, conn, 1, []byte{byte(i)})
+	}
+	waitUntil(t, "reading paused by full task queue", func() bool {
+		return loopStateOf(c, func(state *loopState) bool { return state.blocked })
+	})
+
+	// 事件循环没有被阻塞，仍然可以发送消息
+	if err = c.SendMsg(2, []byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readMsg(t, conn); msg.GetMsgID() != 2 {
+		t.Fatalf("expect msgID 2 while reading is paused, got %v", msg.GetMsgID())
+	}
+
+	close(handler.release)
+	waitUntil(t, "all msgs handled", func() bool { return handler.count() == n })
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if !bytes.Equal(handler.received, []byte{0, 1, 2, 3, 4}) {
+		t.Fatalf("expect msgs handled in order, got %v", handler.received)
+	}
+	if !loopStateOf(c, func(state *loopState) bool { return state.reading() }) {
+		t.Fatal("expect reading resumed")
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package hamble
+
+func newEventLoop() (eventLoop, error) {
+	return nil, ErrEventLoopUnsupported
+}
@@ -0,0 +1,474 @@
+package hamble
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrInvalidGatewayMsg = errors.New("invalid gateway msg")
+	ErrGatewayAuth       = errors.New("gateway auth failed")
+)
+
+// 网关与后端之间认证握手的步骤，网关和后端各自生成随机数，并证明自己持有共享密钥
+const (
+	gatewayAuthHello     = byte(1) // 网关发送网关的随机数
+	gatewayAuthChallenge = byte(2) // 后端发送后端的随机数和后端的HMAC
+	gatewayAuthProof     = byte(3) // 网关发送网关的HMAC
+)
+
+// EncodeGatewayMsg 编码网关与后端之间转发的消息
+func EncodeGatewayMsg(connID uint64, msgID uint32, data []byte) []byte {
+	buf := make([]byte, 12+len(data))
+	binary.BigEndian.PutUint64(buf, connID)
+	binary.BigEndian.PutUint32(buf[8:], msgID)
+	copy(buf[12:], data)
+
+	return buf
+}
+
+// DecodeGatewayMsg 解码网关与后端之间转发的消息，返回的data引用原始数据
+func DecodeGatewayMsg(buf []byte) (connID uint64, msgID uint32, data []byte, err error) {
+	if len(buf) < 12 {
+		return 0, 0, nil, ErrInvalidGatewayMsg
+	}
+
+	return binary.BigEndian.Uint64(buf), binary.BigEndian.Uint32(buf[8:]), buf[12:], nil
+}
+
+// EncodeGatewayClose 编码关闭客户端连接的消息
+func EncodeGatewayClose(connID uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, connID)
+
+	return buf
+}
+
+// DecodeGatewayClose 解码关闭客户端连接的消息
+func DecodeGatewayClose(buf []byte) (uint64, error) {
+	if len(buf) != 8 {
+		return 0, ErrInvalidGatewayMsg
+	}
+
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+// EncodeGatewayHello 编码网关发起认证的消息
+func EncodeGatewayHello(gatewayNonce []byte) []byte {
+	return append([]byte{gatewayAuthHello}, gatewayNonce...)
+}
+
+// GatewayProof 网关校验后端回复的随机数和HMAC，返回网关需要发送的证明
+func GatewayProof(secret string, gatewayNonce []byte, challenge []byte) ([]byte, error) {
+	if len(challenge) != 1+HandshakeNonceLen+HandshakeMACLen || challenge[0] != gatewayAuthChallenge {
+		return nil, ErrInvalidGatewayMsg
+	}
+
+	backendNonce := challenge[1 : 1+HandshakeNonceLen]
+	if !hmac.Equal(challenge[1+HandshakeNonceLen:], gatewayAuthMAC(secret, false, gatewayNonce, backendNonce)) {
+		return nil, ErrGatewayAuth
+	}
+
+	return append([]byte{gatewayAuthProof}, gatewayAuthMAC(secret, true, gatewayNonce, backendNonce)...), nil
+}
+
+// gatewayAuthMAC 计算网关或者后端对双方随机数的HMAC，区分角色使得一方的HMAC不能被另一方原样发回
+func gatewayAuthMAC(secret string, fromGateway bool, gatewayNonce, backendNonce []byte) []byte {
+	role := "backend"
+	if fromGateway {
+		role = "gateway"
+	}
+
+	return HandshakeMAC(secret, []byte(role), gatewayNonce, backendNonce)
+}
+
+// EnableGateway 处理网关转发的消息，网关需要先通过共享密钥的认证
+func (s *Server) EnableGateway(secret string) {
+	if secret == "" {
+		logger.Errorf("enable gateway err: secret is empty")
+		return
+	}
+
+	s.gatewaySecret = secret
+}
+
+// gatewayConns 网关连接上转发的所有客户端连接
+type gatewayConns struct {
+	conns map[uint64]*gatewayConn
+	mu    sync.Mutex
+}
+
+// checkGateway 处理网关转发的消息，返回false时已经处理了该消息
+func (c *Connection) checkGateway(msg iface.IMessage, payload *[]byte) bool {
+	if c.gatewaySecret == "" {
+		return true
+	}
+
+	switch msg.GetMsgID() {
+	case iface.GatewayAuthMsgID:
+		c.handleGatewayAuth(msg.GetData())
+		putPayloadBuffer(payload)
+		return false
+	case iface.GatewayMsgID, iface.GatewayCloseMsgID:
+		if !c.gatewayAuthed {
+			logger.Warnf("receive gateway msg from unauthenticated %s, disconnect", c.RemoteAddr())
+			putPayloadBuffer(payload)
+			c.exit()
+			return false
+		}
+	}
+
+	switch msg.GetMsgID() {
+	case iface.GatewayMsgID:
+		connID, msgID, data, err := DecodeGatewayMsg(msg.GetData())
+		if err != nil {
+			logger.Warnf("receive invalid gateway msg from %s", c.RemoteAddr())
+			putPayloadBuffer(payload)
+			return false
+		}
+
+		if connID == 0 {
+			// 健康检查，原样返回
+			_ = c.TrySend(iface.GatewayMsgID, append([]byte(nil), msg.GetData()...))
+			putPayloadBuffer(payload)
+			return false
+		}
+
+		gc := c.gatewayConn(connID)
+		if gc == nil {
+			putPayloadBuffer(payload)
+			return false
+		}
+
+		// 按MsgID的限流已经由网关对客户端的连接进行
+		request, err := newRequestOf(gc, NewMessage(msgID, data), payload)
+		if err != nil {
+			logger.Warnf("receive invalid call msg from %s", gc.RemoteAddr())
+			putPayloadBuffer(payload)
+			return false
+		}
+		c.dispatch(request)
+	case iface.GatewayCloseMsgID:
+		connID, err := DecodeGatewayClose(msg.GetData())
+		putPayloadBuffer(payload)
+		if err != nil {
+			logger.Warnf("receive invalid gateway close msg from %s", c.RemoteAddr())
+			return false
+		}
+
+		// 客户端已经断开，不需要再通知网关
+		if gc := c.removeGatewayConn(connID); gc != nil {
+			gc.close()
+		}
+	default:
+		return true
+	}
+
+	return false
+}
+
+// handleGatewayAuth 处理网关的认证握手，认证失败时断开连接
+func (c *Connection) handleGatewayAuth(data []byte) {
+	switch {
+	case len(data) == 1+HandshakeNonceLen && data[0] == gatewayAuthHello && c.gatewayNonces == nil:
+		gatewayNonce, backendNonce := data[1:], NewHandshakeNonce()
+		c.gatewayNonces = append(append([]byte(nil), gatewayNonce...), backendNonce...)
+
+		challenge := append([]byte{gatewayAuthChallenge}, backendNonce...)
+		challenge = append(challenge, gatewayAuthMAC(c.gatewaySecret, false, gatewayNonce, backendNonce)...)
+		_ = c.TrySend(iface.GatewayAuthMsgID, challenge)
+		return
+	case len(data) == 1+HandshakeMACLen && data[0] == gatewayAuthProof && c.gatewayNonces != nil && !c.gatewayAuthed:
+		gatewayNonce, backendNonce := c.gatewayNonces[:HandshakeNonceLen], c.gatewayNonces[HandshakeNonceLen:]
+		if hmac.Equal(data[1:], gatewayAuthMAC(c.gatewaySecret, true, gatewayNonce, backendNonce)) {
+			c.gatewayAuthed = true
+			logger.Infof("gateway %s authenticated", c.RemoteAddr())
+			return
+		}
+	}
+
+	logger.Warnf("gateway %s failed to authenticate, disconnect", c.RemoteAddr())
+	c.exit()
+}
+
+// gatewayConn 获取网关转发的客户端连接，不存在时创建
+func (c *Connection) gatewayConn(connID uint64) *gatewayConn {
+	c.propertiesLock.Lock()
+	if c.gatewayConns == nil {
+		c.gatewayConns = &gatewayConns{conns: make(map[uint64]*gatewayConn)}
+	}
+	conns := c.gatewayConns
+	c.propertiesLock.Unlock()
+
+	conns.mu.Lock()
+	if c.isClosed.Load() {
+		conns.mu.Unlock()
+		return nil
+	}
+	gc, exist := conns.conns[connID]
+	if !exist {
+		gc = &gatewayConn{
+			Connection: c,
+			id:         connIDSeq.Add(1),
+			remoteID:   connID,
+			done:       make(chan struct{}),
+			timers:     make(map[iface.ITimer]struct{}),
+		}
+		conns.conns[connID] = gc
+	}
+	conns.mu.Unlock()
+
+	if !exist {
+		// 第一次收到该客户端的消息，执行Hook函数
+		c.cs.CallOnConnStart(gc)
+	}
+
+	return gc
+}
+
+func (c *Connection) removeGatewayConn(connID uint64) *gatewayConn {
+	c.propertiesLock.Lock()
+	conns := c.gatewayConns
+	c.propertiesLock.Unlock()
+	if conns == nil {
+		return nil
+	}
+
+	conns.mu.Lock()
+	defer conns.mu.Unlock()
+
+	gc := conns.conns[connID]
+	delete(conns.conns, connID)
+
+	return gc
+}
+
+// stopGateway 网关连接关闭时关闭所有转发的客户端连接
+func (c *Connection) stopGateway() {
+	c.propertiesLock.Lock()
+	conns := c.gatewayConns
+	c.propertiesLock.Unlock()
+	if conns == nil {
+		return
+	}
+
+	conns.mu.Lock()
+	closing := conns.conns
+	conns.conns = make(map[uint64]*gatewayConn)
+	conns.mu.Unlock()
+
+	for _, gc := range closing {
+		gc.close()
+	}
+}
+
+// gatewayConn 经过网关转发的客户端连接，发送的消息经过网关连接转发给客户端
+type gatewayConn struct {
+	*Connection // 网关连接
+
+	id       uint64 // 后端分配的连接ID，与后端的其它连接不会重复
+	remoteID uint64 // 网关上的连接ID，只在同一个网关连接上唯一，用于与网关之间的消息
+	closed   atomic.Bool
+	done     chan struct{} // 客户端连接关闭时关闭
+
+	properties     map[string]interface{}
+	propertiesLock sync.Mutex
+
+	timers     map[iface.ITimer]struct{} // 客户端连接关闭时全部取消
+	closeFuncs []func(conn iface.IConnection)
+	mu         sync.Mutex // 保护timers和closeFuncs
+}
+
+// Start 客户端连接由网关启动，不需要做任何事
+func (gc *gatewayConn) Start() {}
+
+// Stop 关闭客户端连接，并通知网关断开客户端
+func (gc *gatewayConn) Stop() {
+	if gc.closed.Load() {
+		return
+	}
+
+	if gc.Connection.removeGatewayConn(gc.remoteID) == gc {
+		_ = gc.Connection.TrySend(iface.GatewayCloseMsgID, EncodeGatewayClose(gc.remoteID))
+	}
+	gc.close()
+}
+
+// exit 在新的协程中关闭客户端连接，不能关闭与网关之间的连接
+func (gc *gatewayConn) exit() {
+	go gc.Stop()
+}
+
+// close 关闭客户端连接，不通知网关
+func (gc *gatewayConn) close() {
+	if !gc.closed.CompareAndSwap(false, true) {
+		return
+	}
+	close(gc.done)
+
+	gc.cs.CallOnConnStop(gc)
+	gc.cs.GetConnManager().Remove(gc)
+
+	gc.mu.Lock()
+	timers := gc.timers
+	gc.timers = nil
+	closeFuncs := gc.closeFuncs
+	gc.closeFuncs = nil
+	gc.mu.Unlock()
+
+	for t := range timers {
+		t.Stop()
+	}
+	for _, f := range closeFuncs {
+		f(gc)
+	}
+
+	logger.Infof("close a gateway connection %v from %s", gc.remoteID, gc.Connection.RemoteAddr())
+}
+
+func (gc *gatewayConn) doneChan() <-chan struct{} {
+	return gc.done
+}
+
+func (gc *gatewayConn) GetConnID() uint64 {
+	return gc.id
+}
+
+func (gc *gatewayConn) RemoteAddr() string {
+	return fmt.Sprintf("%s#%v", gc.Connection.RemoteAddr(), gc.remoteID)
+}
+
+func (gc *gatewayConn) SendMsg(msgID uint32, data []byte) error {
+	if gc.closed.Load() {
+		return ErrConnClosed
+	}
+
+	return gc.Connection.SendMsg(iface.GatewayMsgID, EncodeGatewayMsg(gc.remoteID, msgID, data))
+}
+
+func (gc *gatewayConn) SendBufMsg(msgID uint32, data []byte) error {
+	if gc.closed.Load() {
+		return ErrConnClosed
+	}
+
+	return gc.Connection.SendBufMsg(iface.GatewayMsgID, EncodeGatewayMsg(gc.remoteID, msgID, data))
+}
+
+func (gc *gatewayConn) TrySend(msgID uint32, data []byte) error {
+	if gc.closed.Load() {
+		return ErrConnClosed
+	}
+
+	return gc.Connection.TrySend(iface.GatewayMsgID, EncodeGatewayMsg(gc.remoteID, msgID, data))
+}
+
+func (gc *gatewayConn) SendWithTimeout(ctx context.Context, msgID uint32, data []byte) error {
+	if gc.closed.Load() {
+		return ErrConnClosed
+	}
+
+	return gc.Connection.SendWithTimeout(ctx, iface.GatewayMsgID, EncodeGatewayMsg(gc.remoteID, msgID, data))
+}
+
+// SendReliable 网关与后端之间的连接是可靠的，直接转发给网关。与可靠消息一样不会阻塞，发送队列满时返回错误
+func (gc *gatewayConn) SendReliable(msgID uint32, data []byte) error {
+	return gc.TrySend(msgID, data)
+}
+
+func (gc *gatewayConn) AfterFunc(d time.Duration, f func(conn iface.IConnection)) iface.ITimer {
+	var t iface.ITimer
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	t = gc.Connection.AfterFunc(d, func(iface.IConnection) {
+		gc.mu.Lock()
+		delete(gc.timers, t)
+		gc.mu.Unlock()
+
+		f(gc)
+	})
+	gc.addTimer(t)
+
+	return t
+}
+
+func (gc *gatewayConn) Every(interval time.Duration, f func(conn iface.IConnection)) iface.ITimer {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	t := gc.Connection.Every(interval, func(iface.IConnection) {
+		f(gc)
+	})
+	gc.addTimer(t)
+
+	return t
+}
+
+// addTimer 记录客户端连接的定时任务，调用时需持有mu
+func (gc *gatewayConn) addTimer(t iface.ITimer) {
+	if gc.timers == nil {
+		// 已经关闭
+		t.Stop()
+		return
+	}
+	gc.timers[t] = struct{}{}
+}
+
+func (gc *gatewayConn) SetProperty(key string, value interface{}) {
+	gc.propertiesLock.Lock()
+	defer gc.propertiesLock.Unlock()
+
+	if gc.properties == nil {
+		gc.properties = make(map[string]interface{})
+	}
+	gc.properties[key] = value
+}
+
+func (gc *gatewayConn) GetProperty(key string) interface{} {
+	gc.propertiesLock.Lock()
+	defer gc.propertiesLock.Unlock()
+
+	return gc.properties[key]
+}
+
+func (gc *gatewayConn) RemoveProperty(key string) {
+	gc.propertiesLock.Lock()
+	defer gc.propertiesLock.Unlock()
+
+	delete(gc.properties, key)
+}
+
+func (gc *gatewayConn) IsAlive() bool {
+	return !gc.closed.Load() && gc.Connection.IsAlive()
+}
+
+// SetIdleTimeout 客户端的空闲检测由网关负责
+func (gc *gatewayConn) SetIdleTimeout(kind iface.IdleKind, timeout time.Duration) {}
+
+func (gc *gatewayConn) GetHeartBeatChecker() iface.IHeartBeatChecker {
+	return nil
+}
+
+func (gc *gatewayConn) GetSession() iface.ISession {
+	return nil
+}
+
+func (gc *gatewayConn) OnClose(f func(conn iface.IConnection)) {
+	gc.mu.Lock()
+	if !gc.closed.Load() {
+		gc.closeFuncs = append(gc.closeFuncs, f)
+		gc.mu.Unlock()
+		return
+	}
+	gc.mu.Unlock()
+
+	f(gc)
+}
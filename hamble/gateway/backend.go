@@ -0,0 +1,311 @@
+package gateway
+
+import (
+	"github.com/dawnzzz/hamble-tcp-server/hamble"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// service 后端服务
+type service struct {
+	name      string
+	instances []*instance
+	next      atomic.Uint64 // 轮询的计数
+	mu        sync.Mutex
+}
+
+func (svc *service) addInstances(instances []*instance) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	svc.instances = append(svc.instances, instances...)
+}
+
+func (svc *service) snapshot() []*instance {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	return append([]*instance(nil), svc.instances...)
+}
+
+// pick 按照负载均衡策略选择一个健康实例的后端连接
+func (svc *service) pick(balance string, connID uint64) *backend {
+	var healthy []*instance
+	for _, inst := range svc.snapshot() {
+		if inst.healthy() {
+			healthy = append(healthy, inst)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	inst := healthy[svc.next.Add(1)%uint64(len(healthy))]
+	if balance == BalanceLeastConn {
+		for _, candidate := range healthy {
+			if candidate.clients.Load() < inst.clients.Load() {
+				inst = candidate
+			}
+		}
+	}
+
+	return inst.backend(connID)
+}
+
+// instance 后端服务的一个实例，持有PoolSize个连接
+type instance struct {
+	gateway *Gateway
+	addr    string
+	host    string
+	port    int
+
+	backends []atomic.Pointer[backend]
+	clients  atomic.Int64 // 选择了该实例的客户端连接数
+	checking atomic.Bool  // 正在进行健康检查
+}
+
+func newInstance(g *Gateway, addr, host string, port int) *instance {
+	return &instance{
+		gateway:  g,
+		addr:     addr,
+		host:     host,
+		port:     port,
+		backends: make([]atomic.Pointer[backend], g.option.PoolSize),
+	}
+}
+
+// healthy 至少有一个连接可用时实例是健康的
+func (inst *instance) healthy() bool {
+	for i := range inst.backends {
+		if b := inst.backends[i].Load(); b != nil && b.alive() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backend 选择一个可用的连接，同一个客户端连接优先使用同一个连接
+func (inst *instance) backend(connID uint64) *backend {
+	n := len(inst.backends)
+	for i := 0; i < n; i++ {
+		if b := inst.backends[(int(connID%uint64(n))+i)%n].Load(); b != nil && b.alive() {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// check 重连断开的连接，对可用的连接发送健康检查，在新的协程中进行
+func (inst *instance) check() {
+	if !inst.checking.CompareAndSwap(false, true) {
+		// 上一次检查还没有结束
+		return
+	}
+
+	go func() {
+		defer inst.checking.Store(false)
+
+		for i := range inst.backends {
+			if inst.gateway.stopped() {
+				return
+			}
+
+			b := inst.backends[i].Load()
+			if b != nil && !b.closed.Load() {
+				b.probe(inst.gateway.option.HealthTimeout)
+				continue
+			}
+
+			b, err := inst.connect()
+			if err != nil {
+				logger.Warnf("connect to backend %s err: %v", inst.addr, err)
+				return
+			}
+			inst.backends[i].Store(b)
+
+			if inst.gateway.stopped() {
+				b.stop()
+			}
+		}
+	}()
+}
+
+func (inst *instance) connect() (*backend, error) {
+	client, err := hamble.NewClient(defaultNetwork, inst.host, inst.port)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &backend{
+		inst:   inst,
+		client: client,
+		nonce:  hamble.NewHandshakeNonce(),
+	}
+	b.lastReply.Store(time.Now().UnixNano())
+
+	client.RegisterHandler(iface.GatewayAuthMsgID, &authHandler{backend: b})
+	client.RegisterHandler(iface.GatewayMsgID, &replyHandler{backend: b})
+	client.RegisterHandler(iface.GatewayCloseMsgID, &closeHandler{backend: b})
+	// 同一个连接上的回复由一个Worker按顺序处理
+	client.GetRouter().StartWorkerPool()
+
+	// 连接建立之后首先进行认证，认证通过之前不转发消息
+	_ = client.GetConnection().TrySend(iface.GatewayAuthMsgID, hamble.EncodeGatewayHello(b.nonce))
+
+	go func() {
+		client.Start()
+
+		b.closed.Store(true)
+		client.GetRouter().StopWorkerPool()
+		client.Stop()
+		logger.Warnf("backend connection to %s closed", inst.addr)
+	}()
+
+	logger.Infof("connect to backend %s", inst.addr)
+
+	return b, nil
+}
+
+func (inst *instance) close() {
+	for i := range inst.backends {
+		if b := inst.backends[i].Load(); b != nil {
+			b.stop()
+		}
+	}
+}
+
+// backend 网关到后端实例的一个连接
+type backend struct {
+	inst      *instance
+	client    iface.IClient
+	nonce     []byte       // 认证握手中网关的随机数
+	lastReply atomic.Int64 // 上一次收到后端消息的时间（UnixNano）
+	authed    atomic.Bool  // 已经通过后端的认证
+	closed    atomic.Bool
+}
+
+func (b *backend) alive() bool {
+	return b.authed.Load() && !b.closed.Load()
+}
+
+// probe 超时没有收到后端的消息（包括认证没有完成）时断开连接，否则发送健康检查
+func (b *backend) probe(timeout time.Duration) {
+	if time.Since(time.Unix(0, b.lastReply.Load())) > timeout {
+		logger.Warnf("backend %s not reply in %v, disconnect", b.inst.addr, timeout)
+		b.stop()
+		return
+	}
+	if !b.authed.Load() {
+		return
+	}
+
+	_ = b.client.GetConnection().TrySend(iface.GatewayMsgID, hamble.EncodeGatewayMsg(0, 0, nil))
+}
+
+// forward 将客户端的消息转发给后端
+func (b *backend) forward(connID uint64, msgID uint32, data []byte) error {
+	if !b.alive() {
+		return ErrNoHealthyBackend
+	}
+
+	return b.client.GetConnection().SendBufMsg(iface.GatewayMsgID, hamble.EncodeGatewayMsg(connID, msgID, data))
+}
+
+// closeClient 通知后端客户端连接已经关闭
+func (b *backend) closeClient(connID uint64) {
+	if b.alive() {
+		_ = b.client.GetConnection().TrySend(iface.GatewayCloseMsgID, hamble.EncodeGatewayClose(connID))
+	}
+}
+
+func (b *backend) stop() {
+	if b.closed.CompareAndSwap(false, true) {
+		b.client.Stop()
+	}
+}
+
+// authHandler 校验后端的认证回复，并发送网关的证明
+type authHandler struct {
+	hamble.BaseHandler
+	backend *backend
+}
+
+func (handler *authHandler) Handle(request iface.IRequest) {
+	b := handler.backend
+	proof, err := hamble.GatewayProof(b.inst.gateway.option.Secret, b.nonce, request.GetData())
+	request.Release()
+	if err == nil {
+		err = b.client.GetConnection().TrySend(iface.GatewayAuthMsgID, proof)
+	}
+	if err != nil {
+		logger.Warnf("authenticate backend %s err: %v, disconnect", b.inst.addr, err)
+		b.stop()
+		return
+	}
+
+	// 证明在转发的消息之前发送
+	b.lastReply.Store(time.Now().UnixNano())
+	b.authed.Store(true)
+	logger.Infof("backend %s authenticated", b.inst.addr)
+}
+
+// replyHandler 将后端的回复转发给客户端
+type replyHandler struct {
+	hamble.BaseHandler
+	backend *backend
+}
+
+func (handler *replyHandler) Handle(request iface.IRequest) {
+	b := handler.backend
+	b.lastReply.Store(time.Now().UnixNano())
+
+	connID, msgID, data, err := hamble.DecodeGatewayMsg(request.GetData())
+	if err != nil {
+		logger.Warnf("receive invalid gateway msg from backend %s", b.inst.addr)
+		request.Release()
+		return
+	}
+	if connID == 0 {
+		// 健康检查的回复
+		request.Release()
+		return
+	}
+
+	data = append([]byte(nil), data...)
+	request.Release()
+
+	conn := b.inst.gateway.client(connID)
+	if conn == nil {
+		// 客户端已经断开
+		return
+	}
+
+	if err := conn.SendBufMsg(msgID, data); err != nil {
+		logger.Warnf("send reply msgID=%v from backend %s to %s err: %v", msgID, b.inst.addr, conn.RemoteAddr(), err)
+		return
+	}
+	b.inst.gateway.server.GetMetrics().Inc(iface.MetricGatewayReplied)
+}
+
+// closeHandler 后端要求关闭客户端连接
+type closeHandler struct {
+	hamble.BaseHandler
+	backend *backend
+}
+
+func (handler *closeHandler) Handle(request iface.IRequest) {
+	connID, err := hamble.DecodeGatewayClose(request.GetData())
+	request.Release()
+	if err != nil {
+		return
+	}
+
+	if conn := handler.backend.inst.gateway.client(connID); conn != nil {
+		conn.Stop()
+	}
+}
@@ -0,0 +1,335 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dawnzzz/hamble-tcp-server/hamble"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 负载均衡策略
+const (
+	BalanceRoundRobin = "round_robin" // 轮询
+	BalanceLeastConn  = "least_conn"  // 转发的客户端连接最少的实例
+)
+
+const (
+	defaultHealthInterval = 5 * time.Second
+	defaultNetwork        = "tcp"
+)
+
+var (
+	ErrUnknownService   = errors.New("unknown service")
+	ErrRouteOverlap     = errors.New("msgID range overlaps another route")
+	ErrNoHealthyBackend = errors.New("no healthy backend")
+)
+
+// Option 网关的选项
+type Option struct {
+	PoolSize       int           // 每个后端实例的连接数，为0则为1
+	Balance        string        // 负载均衡策略 round_robin/least_conn，为空则为round_robin
+	HealthInterval time.Duration // 健康检查和重连的间隔，为0则为5s
+	HealthTimeout  time.Duration // 超过此时间没有收到健康检查的回复时断开后端连接，为0则为3倍的HealthInterval
+	Secret         string        // 与后端认证使用的共享密钥，需要与后端EnableGateway的密钥相同
+}
+
+// Gateway 网关，持有客户端连接，按照MsgID的范围将消息转发给后端服务，并将后端的回复转发给客户端
+type Gateway struct {
+	server iface.IServer
+	option Option
+
+	services map[string]*service
+	routes   []route
+	clients  map[uint64]*client // 转发过消息的客户端连接
+	mu       sync.Mutex
+
+	started  atomic.Bool
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// route 一个MsgID范围的路由
+type route struct {
+	min, max uint32
+	service  *service
+}
+
+// client 转发过消息的客户端连接，以及每个服务为它选择的后端连接
+type client struct {
+	conn     iface.IConnection
+	backends map[*service]*backend
+}
+
+func New(server iface.IServer, option Option) *Gateway {
+	if option.PoolSize <= 0 {
+		option.PoolSize = 1
+	}
+	if option.Balance == "" {
+		option.Balance = BalanceRoundRobin
+	}
+	if option.HealthInterval <= 0 {
+		option.HealthInterval = defaultHealthInterval
+	}
+	if option.HealthTimeout <= 0 {
+		option.HealthTimeout = 3 * option.HealthInterval
+	}
+
+	return &Gateway{
+		server:   server,
+		option:   option,
+		services: make(map[string]*service),
+		clients:  make(map[uint64]*client),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// AddService 添加后端服务，addrs为服务所有实例的地址 host:port，可以多次调用添加实例
+func (g *Gateway) AddService(name string, addrs ...string) error {
+	instances := make([]*instance, 0, len(addrs))
+	for _, addr := range addrs {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid addr %q of service %s: %w", addr, name, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return fmt.Errorf("invalid port of addr %q of service %s: %w", addr, name, err)
+		}
+
+		instances = append(instances, newInstance(g, addr, host, port))
+	}
+
+	g.mu.Lock()
+	svc, exist := g.services[name]
+	if !exist {
+		svc = &service{name: name}
+		g.services[name] = svc
+	}
+	g.mu.Unlock()
+
+	svc.addInstances(instances)
+
+	if g.started.Load() {
+		for _, inst := range instances {
+			inst.check()
+		}
+	}
+
+	return nil
+}
+
+// Route 将[min, max]范围内的MsgID转发给服务，需要在服务器Start之前调用
+func (g *Gateway) Route(min, max uint32, name string) error {
+	if min > max {
+		return fmt.Errorf("invalid msgID range [%v, %v]", min, max)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	svc, exist := g.services[name]
+	if !exist {
+		return fmt.Errorf("%w: %s", ErrUnknownService, name)
+	}
+
+	for _, r := range g.routes {
+		if min <= r.max && r.min <= max {
+			return fmt.Errorf("%w: [%v, %v] and [%v, %v]", ErrRouteOverlap, min, max, r.min, r.max)
+		}
+	}
+
+	g.server.GetRouter().AddRangeRouter(min, max, &forwardHandler{gateway: g, service: svc})
+	g.routes = append(g.routes, route{min: min, max: max, service: svc})
+
+	return nil
+}
+
+// Start 连接所有后端实例，并定时进行健康检查
+func (g *Gateway) Start() {
+	if !g.started.CompareAndSwap(false, true) {
+		return
+	}
+
+	g.checkAll()
+	go g.healthLoop()
+}
+
+// Stop 断开所有后端连接
+func (g *Gateway) Stop() {
+	g.stopOnce.Do(func() {
+		close(g.stopChan)
+	})
+
+	for _, svc := range g.snapshotServices() {
+		for _, inst := range svc.snapshot() {
+			inst.close()
+		}
+	}
+}
+
+func (g *Gateway) healthLoop() {
+	ticker := time.NewTicker(g.option.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.checkAll()
+		case <-g.stopChan:
+			return
+		}
+	}
+}
+
+func (g *Gateway) checkAll() {
+	for _, svc := range g.snapshotServices() {
+		for _, inst := range svc.snapshot() {
+			inst.check()
+		}
+	}
+}
+
+func (g *Gateway) snapshotServices() []*service {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	services := make([]*service, 0, len(g.services))
+	for _, svc := range g.services {
+		services = append(services, svc)
+	}
+
+	return services
+}
+
+func (g *Gateway) stopped() bool {
+	select {
+	case <-g.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Healthy 返回服务健康的实例地址
+func (g *Gateway) Healthy(name string) []string {
+	g.mu.Lock()
+	svc, exist := g.services[name]
+	g.mu.Unlock()
+	if !exist {
+		return nil
+	}
+
+	var addrs []string
+	for _, inst := range svc.snapshot() {
+		if inst.healthy() {
+			addrs = append(addrs, inst.addr)
+		}
+	}
+
+	return addrs
+}
+
+// backendOf 获取客户端连接在服务上使用的后端连接，没有或者已经断开时重新选择
+func (g *Gateway) backendOf(conn iface.IConnection, svc *service) (*backend, error) {
+	connID := conn.GetConnID()
+
+	g.mu.Lock()
+	c, exist := g.clients[connID]
+	if exist {
+		if b := c.backends[svc]; b != nil && b.alive() {
+			g.mu.Unlock()
+			return b, nil
+		}
+	}
+	g.mu.Unlock()
+
+	b := svc.pick(g.option.Balance, connID)
+	if b == nil {
+		return nil, ErrNoHealthyBackend
+	}
+
+	g.mu.Lock()
+	c, exist = g.clients[connID]
+	if !exist {
+		c = &client{conn: conn, backends: make(map[*service]*backend)}
+		g.clients[connID] = c
+	}
+	if old := c.backends[svc]; old != nil {
+		old.inst.clients.Add(-1)
+	}
+	c.backends[svc] = b
+	b.inst.clients.Add(1)
+	g.mu.Unlock()
+
+	if !exist {
+		// 客户端连接关闭时通知所有使用过的后端
+		conn.OnClose(g.closeClient)
+	}
+
+	return b, nil
+}
+
+// closeClient 客户端连接关闭，通知后端关闭对应的连接
+func (g *Gateway) closeClient(conn iface.IConnection) {
+	g.mu.Lock()
+	c, exist := g.clients[conn.GetConnID()]
+	delete(g.clients, conn.GetConnID())
+	g.mu.Unlock()
+	if !exist {
+		return
+	}
+
+	for _, b := range c.backends {
+		b.inst.clients.Add(-1)
+		b.closeClient(conn.GetConnID())
+	}
+}
+
+// client 根据连接ID获取客户端连接
+func (g *Gateway) client(connID uint64) iface.IConnection {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if c, exist := g.clients[connID]; exist {
+		return c.conn
+	}
+
+	return nil
+}
+
+// forwardHandler 将消息转发给服务
+type forwardHandler struct {
+	hamble.BaseHandler
+	gateway *Gateway
+	service *service
+}
+
+func (handler *forwardHandler) Handle(request iface.IRequest) {
+	conn := request.GetConnection()
+	metrics := handler.gateway.server.GetMetrics()
+
+	msgID, data := request.GetMsgID(), request.GetData()
+	if callID := request.GetCallID(); callID != 0 {
+		// 由Call发送的请求，后端的回复原样转发给客户端
+		msgID, data = iface.CallMsgID, hamble.EncodeCall(callID, msgID, data)
+	}
+
+	b, err := handler.gateway.backendOf(conn, handler.service)
+	if err == nil {
+		err = b.forward(conn.GetConnID(), msgID, data)
+	}
+	request.Release()
+	if err != nil {
+		metrics.Inc(iface.MetricGatewayDropped)
+		logger.Warnf("forward msgID=%v from %s to service %s err: %v", request.GetMsgID(), conn.RemoteAddr(), handler.service.name, err)
+		return
+	}
+
+	metrics.Inc(iface.MetricGatewayForwarded)
+}
@@ -0,0 +1,365 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/hamble"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testSecret     = "test-secret"
+	testReplyMsgID = uint32(1)
+)
+
+// startServer 在本机空闲的端口上启动服务器，setup在启动之前调用，返回监听地址和停止服务器的函数
+func startServer(t *testing.T, setup func(s iface.IServer)) (string, func()) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	conf.GlobalProfile.Port = port
+	s := hamble.NewServerWithOption(conf.GlobalProfile)
+	setup(s)
+	go s.Start()
+
+	var once sync.Once
+	stop := func() { once.Do(s.Stop) }
+	t.Cleanup(stop)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	waitFor(t, "server "+addr+" started", func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	})
+
+	return addr, stop
+}
+
+// startBackend 启动后端服务器，回复的数据为 后端名称:原始数据
+func startBackend(t *testing.T, name string, secret string) (string, func(), *echoHandler) {
+	t.Helper()
+
+	handler := &echoHandler{name: name}
+	addr, stop := startServer(t, func(s iface.IServer) {
+		s.EnableGateway(secret)
+		s.GetRouter().AddRangeRouter(1000, 2999, handler)
+	})
+
+	return addr, stop, handler
+}
+
+// startGateway 启动网关服务器，setup在启动之前添加服务和路由
+func startGateway(t *testing.T, option Option, setup func(g *Gateway)) (string, *Gateway) {
+	t.Helper()
+
+	if option.Secret == "" {
+		option.Secret = testSecret
+	}
+	option.HealthInterval = 20 * time.Millisecond
+
+	var g *Gateway
+	addr, _ := startServer(t, func(s iface.IServer) {
+		g = New(s, option)
+		setup(g)
+	})
+	g.Start()
+	t.Cleanup(g.Stop)
+
+	return addr, g
+}
+
+// startClient 连接网关，收到的回复推入返回的channel
+func startClient(t *testing.T, addr string) (iface.IClient, chan string) {
+	t.Helper()
+
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	client, err := hamble.NewClient("tcp", host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replies := make(chan string, 16)
+	client.RegisterHandler(testReplyMsgID, &chanHandler{replies: replies})
+	go client.Start()
+	t.Cleanup(client.Stop)
+
+	return client, replies
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func waitHealthy(t *testing.T, g *Gateway, name string, n int) {
+	t.Helper()
+
+	waitFor(t, fmt.Sprintf("%v healthy instances of %s", n, name), func() bool {
+		return len(g.Healthy(name)) == n
+	})
+}
+
+// request 发送消息并等待回复
+func request(t *testing.T, client iface.IClient, replies chan string, msgID uint32, data string) string {
+	t.Helper()
+
+	if err := client.GetConnection().SendMsg(msgID, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case reply := <-replies:
+		return reply
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout waiting for reply of msgID=%v", msgID)
+		return ""
+	}
+}
+
+type echoHandler struct {
+	hamble.BaseHandler
+	name string
+
+	connIDs map[uint64]struct{} // 收到消息的连接ID
+	mu      sync.Mutex
+}
+
+func (h *echoHandler) Handle(request iface.IRequest) {
+	conn := request.GetConnection()
+
+	h.mu.Lock()
+	if h.connIDs == nil {
+		h.connIDs = make(map[uint64]struct{})
+	}
+	h.connIDs[conn.GetConnID()] = struct{}{}
+	h.mu.Unlock()
+
+	_ = conn.SendMsg(testReplyMsgID, []byte(h.name+":"+string(request.GetData())))
+}
+
+func (h *echoHandler) conns() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.connIDs)
+}
+
+type chanHandler struct {
+	hamble.BaseHandler
+	replies chan string
+}
+
+func (h *chanHandler) Handle(request iface.IRequest) {
+	h.replies <- string(request.GetData())
+}
+
+func TestGatewayRoutesByMsgIDRange(t *testing.T) {
+	authAddr, _, _ := startBackend(t, "auth", testSecret)
+	gameAddr, _, _ := startBackend(t, "game", testSecret)
+	addr, g := startGateway(t, Option{}, func(g *Gateway) {
+		_ = g.AddService("auth", authAddr)
+		_ = g.AddService("game", gameAddr)
+		if err := g.Route(1000, 1999, "auth"); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Route(2000, 2999, "game"); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Route(1500, 2500, "game"); err == nil {
+			t.Fatal("expect overlapping route rejected")
+		}
+	})
+	waitHealthy(t, g, "auth", 1)
+	waitHealthy(t, g, "game", 1)
+
+	client, replies := startClient(t, addr)
+	for _, tc := range []struct {
+		msgID uint32
+		want  string
+	}{
+		{1000, "auth:a"},
+		{1999, "auth:b"},
+		{2000, "game:c"},
+		{2999, "game:d"},
+	} {
+		data := tc.want[strings.Index(tc.want, ":")+1:]
+		if got := request(t, client, replies, tc.msgID, data); got != tc.want {
+			t.Fatalf("msgID=%v: expect %q, got %q", tc.msgID, tc.want, got)
+		}
+	}
+}
+
+func TestGatewayHealthCheck(t *testing.T) {
+	backendAddr, stopBackend, _ := startBackend(t, "a", testSecret)
+	_, g := startGateway(t, Option{HealthTimeout: 100 * time.Millisecond}, func(g *Gateway) {
+		_ = g.AddService("svc", backendAddr)
+	})
+	waitHealthy(t, g, "svc", 1)
+
+	// 后端回复健康检查，超过HealthTimeout之后仍然是健康的
+	time.Sleep(300 * time.Millisecond)
+	if got := g.Healthy("svc"); len(got) != 1 || got[0] != backendAddr {
+		t.Fatalf("expect %s still healthy, got %v", backendAddr, got)
+	}
+
+	stopBackend()
+	waitHealthy(t, g, "svc", 0)
+}
+
+func TestGatewayBalance(t *testing.T) {
+	for _, balance := range []string{BalanceRoundRobin, BalanceLeastConn} {
+		t.Run(balance, func(t *testing.T) {
+			addr1, _, backend1 := startBackend(t, "a", testSecret)
+			addr2, _, backend2 := startBackend(t, "b", testSecret)
+			addr, g := startGateway(t, Option{Balance: balance}, func(g *Gateway) {
+				_ = g.AddService("svc", addr1, addr2)
+				_ = g.Route(1000, 1999, "svc")
+			})
+			waitHealthy(t, g, "svc", 2)
+
+			// 每个客户端固定使用一个实例，客户端平均分布在两个实例上
+			for i := 0; i < 4; i++ {
+				client, replies := startClient(t, addr)
+				first := request(t, client, replies, 1000, "x")
+				if got := request(t, client, replies, 1000, "x"); got != first {
+					t.Fatalf("client %v moved from %q to %q", i, first, got)
+				}
+			}
+			if backend1.conns() != 2 || backend2.conns() != 2 {
+				t.Fatalf("expect 2 clients on each backend, got %v and %v", backend1.conns(), backend2.conns())
+			}
+		})
+	}
+}
+
+func TestGatewayFailover(t *testing.T) {
+	addr1, stop1, _ := startBackend(t, "a", testSecret)
+	addr2, stop2, _ := startBackend(t, "b", testSecret)
+	addr, g := startGateway(t, Option{}, func(g *Gateway) {
+		_ = g.AddService("svc", addr1, addr2)
+		_ = g.Route(1000, 1999, "svc")
+	})
+	waitHealthy(t, g, "svc", 2)
+
+	client, replies := startClient(t, addr)
+	first := request(t, client, replies, 1000, "x")
+	stop, other := stop1, "b:x"
+	if first == "b:x" {
+		stop, other = stop2, "a:x"
+	}
+	stop()
+	waitHealthy(t, g, "svc", 1)
+
+	// 客户端改为使用另一个实例
+	if got := request(t, client, replies, 1000, "x"); got != other {
+		t.Fatalf("expect failover to %q, got %q", other, got)
+	}
+}
+
+func TestGatewayRejectWrongSecret(t *testing.T) {
+	backendAddr, _, handler := startBackend(t, "a", testSecret)
+	addr, g := startGateway(t, Option{Secret: "wrong"}, func(g *Gateway) {
+		_ = g.AddService("svc", backendAddr)
+		_ = g.Route(1000, 1999, "svc")
+	})
+
+	client, _ := startClient(t, addr)
+	time.Sleep(100 * time.Millisecond)
+	_ = client.GetConnection().SendMsg(1000, []byte("x"))
+	time.Sleep(100 * time.Millisecond)
+	if got := g.Healthy("svc"); len(got) != 0 {
+		t.Fatalf("expect no healthy backend with wrong secret, got %v", got)
+	}
+	if handler.conns() != 0 {
+		t.Fatal("backend should not handle msgs from gateway with wrong secret")
+	}
+}
+
+func TestBackendRejectUnauthenticatedGatewayMsg(t *testing.T) {
+	backendAddr, _, handler := startBackend(t, "a", testSecret)
+
+	// 直接连接后端，冒充网关转发消息
+	client, _ := startClient(t, backendAddr)
+	if err := client.GetConnection().SendMsg(iface.GatewayMsgID, hamble.EncodeGatewayMsg(1, 1000, []byte("x"))); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "unauthenticated connection closed", func() bool { return !client.GetConnection().IsAlive() })
+	if handler.conns() != 0 {
+		t.Fatal("backend should not handle msgs from unauthenticated gateway")
+	}
+}
+
+// fakeGateway 直接连接后端，完成认证之后以固定的连接ID转发消息
+func fakeGateway(t *testing.T, addr string) iface.IClient {
+	t.Helper()
+
+	client, _ := startClient(t, addr)
+	nonce := hamble.NewHandshakeNonce()
+	authed := make(chan struct{})
+	client.RegisterHandler(iface.GatewayAuthMsgID, &fakeAuthHandler{client: client, nonce: nonce, authed: authed})
+	if err := client.GetConnection().SendMsg(iface.GatewayAuthMsgID, hamble.EncodeGatewayHello(nonce)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-authed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for gateway auth")
+	}
+
+	return client
+}
+
+type fakeAuthHandler struct {
+	hamble.BaseHandler
+	client iface.IClient
+	nonce  []byte
+	authed chan struct{}
+}
+
+func (h *fakeAuthHandler) Handle(request iface.IRequest) {
+	proof, err := hamble.GatewayProof(testSecret, h.nonce, request.GetData())
+	if err == nil && h.client.GetConnection().SendMsg(iface.GatewayAuthMsgID, proof) == nil {
+		close(h.authed)
+	}
+}
+
+func TestGatewayConnIDsAreUnique(t *testing.T) {
+	backendAddr, _, handler := startBackend(t, "a", testSecret)
+
+	// 两个网关上的客户端使用相同的连接ID，在后端上仍然是不同的连接
+	for i := 0; i < 2; i++ {
+		gateway := fakeGateway(t, backendAddr)
+		if err := gateway.GetConnection().SendMsg(iface.GatewayMsgID, hamble.EncodeGatewayMsg(1, 1000, []byte("x"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client, replies := startClient(t, backendAddr)
+	request(t, client, replies, 1000, "x")
+
+	waitFor(t, "3 distinct conn IDs on backend", func() bool { return handler.conns() == 3 })
+}
@@ -0,0 +1,36 @@
+package hamble
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// 集群节点之间、网关与后端之间使用共享密钥的挑战应答握手，双方各自生成随机数，
+// 只发送对随机数的HMAC，密钥本身不会发送
+const (
+	HandshakeNonceLen = 16          // 握手时双方各自生成的随机数的长度
+	HandshakeMACLen   = sha256.Size // HandshakeMAC的长度
+)
+
+// NewHandshakeNonce 生成握手时使用的随机数
+func NewHandshakeNonce() []byte {
+	nonce := make([]byte, HandshakeNonceLen)
+	_, _ = rand.Read(nonce)
+
+	return nonce
+}
+
+// HandshakeMAC 计算共享密钥对握手字段的HMAC-SHA256，每个字段前加上长度，不同的字段划分不会得到相同的结果
+func HandshakeMAC(secret string, fields ...[]byte) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	var n [4]byte
+	for _, field := range fields {
+		binary.BigEndian.PutUint32(n[:], uint32(len(field)))
+		m.Write(n[:])
+		m.Write(field)
+	}
+
+	return m.Sum(nil)
+}
@@ -14,6 +14,7 @@ func (heartbeatHandler *DefaultHandler) PreHandle(_ iface.IRequest) {
 
 func (heartbeatHandler *DefaultHandler) Handle(request iface.IRequest) {
 	logger.Infof("receive heartbeat from %s, msgID=%v, data=%s", request.GetConnection().RemoteAddr(), request.GetMsgID(), request.GetData())
+	request.Release() // 不持有心跳数据，归还缓冲区
 }
 
 func (heartbeatHandler *DefaultHandler) PostHandle(_ iface.IRequest) {
@@ -1,14 +1,18 @@
 package heartbeat
 
 import (
+	"github.com/dawnzzz/hamble-tcp-server/conf"
 	"github.com/dawnzzz/hamble-tcp-server/iface"
 	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Checker  心跳检测器
 type Checker struct {
-	interval         time.Duration          // 心跳检查的时间间隔
+	interval         atomic.Int64           // 心跳检查的时间间隔
+	timeout          atomic.Int64           // 多长时间没有收到消息视为不存活，为0则使用配置文件中的 max_heartbeat_time
 	onRemoteNotAlive iface.OnRemoteNotAlive // 连接不存活时进行的处理
 	heartbeatMsgFunc iface.HeartBeatMsgFunc // 用户自定义的心跳消息生成函数
 	heartbeatFunc    iface.HeartBeatFunc    // 用户自定义心跳检测机制处理函数
@@ -17,20 +21,42 @@ type Checker struct {
 	msgID      uint32            // 心跳消息的消息id
 	handler    iface.IHandler
 
+	negotiate bool                // 启动时向对端通告心跳参数
+	mode      iface.HeartbeatMode // 心跳模式
+	pingStats pingStats           // ping/pong心跳模式下的连接质量统计
+	metrics   iface.IMetrics
+
+	scheduler iface.IScheduler // 共用的定时任务调度器，为nil时使用独立的协程
+	timer     iface.ITimer
+	timerLock sync.Mutex
+
+	checking atomic.Bool // 正在进行检查，避免上一次检查还未结束时重复检查
+
+	resetChan  chan struct{} // 不使用调度器时，通知心跳协程心跳间隔发生了变化
 	closedChan chan struct{}
+	stopOnce   sync.Once
 }
 
 func NewHearBeatChecker(interval time.Duration) iface.IHeartBeatChecker {
 	checker := &Checker{
-		interval:         interval,
 		onRemoteNotAlive: defaultOnRemoteNotAlive,
 		heartbeatMsgFunc: defaultHeartbeatMsgFunc,
 
 		msgID:   iface.DefaultHeartbeatMsgID,
 		handler: &DefaultHandler{},
 
-		closedChan: make(chan struct{}, 1),
+		resetChan:  make(chan struct{}, 1),
+		closedChan: make(chan struct{}),
 	}
+	checker.interval.Store(int64(interval))
+
+	return checker
+}
+
+// NewPingPongChecker 创建ping/pong模式的心跳检测器，对端需要注册PingHandler回复pong消息
+func NewPingPongChecker(interval time.Duration) iface.IHeartBeatChecker {
+	checker := NewHearBeatChecker(interval).(*Checker)
+	checker.mode = iface.HeartbeatModePingPong
 
 	return checker
 }
@@ -55,16 +81,47 @@ func (checker *Checker) BindHandler(handler iface.IHandler) {
 	checker.handler = handler
 }
 
+func (checker *Checker) BindScheduler(scheduler iface.IScheduler) {
+	checker.scheduler = scheduler
+}
+
+// SetNegotiate 设置启动时是否向对端通告心跳间隔和超时时间
+func (checker *Checker) SetNegotiate(negotiate bool) {
+	checker.negotiate = negotiate
+}
+
+func (checker *Checker) BindMetrics(metrics iface.IMetrics) {
+	checker.metrics = metrics
+}
+
 func (checker *Checker) Start() {
-	go checker.start()
+	if checker.scheduler != nil {
+		checker.timerLock.Lock()
+		select {
+		case <-checker.closedChan:
+			// 已经停止
+		default:
+			checker.timer = checker.scheduler.Every(checker.GetInterval(), checker.tick)
+		}
+		checker.timerLock.Unlock()
+	} else {
+		go checker.start()
+	}
+
+	if checker.negotiate {
+		// 通告心跳参数，对端的心跳检测器会自动调整
+		_ = Advertise(checker.connection, checker.GetInterval(), checker.getTimeout())
+	}
 }
 
 func (checker *Checker) start() {
-	ticker := time.NewTicker(checker.interval)
+	ticker := time.NewTicker(checker.GetInterval())
 	for {
 		select {
 		case <-ticker.C:
-			_ = checker.check()
+			checker.tick()
+		case <-checker.resetChan:
+			ticker.Reset(checker.GetInterval())
 		case <-checker.closedChan:
 			ticker.Stop()
 			return
@@ -72,9 +129,79 @@ func (checker *Checker) start() {
 	}
 }
 
+func (checker *Checker) tick() {
+	if !checker.checking.CompareAndSwap(false, true) {
+		return
+	}
+	defer checker.checking.Store(false)
+
+	select {
+	case <-checker.closedChan:
+		return
+	default:
+	}
+
+	_ = checker.check()
+}
+
+// SetInterval 修改心跳间隔，已经启动时立即按照新的间隔发送心跳
+func (checker *Checker) SetInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	checker.interval.Store(int64(interval))
+
+	checker.timerLock.Lock()
+	defer checker.timerLock.Unlock()
+
+	if checker.timer != nil {
+		select {
+		case <-checker.closedChan:
+		default:
+			checker.timer.Stop()
+			checker.timer = checker.scheduler.Every(interval, checker.tick)
+		}
+	}
+
+	select {
+	case checker.resetChan <- struct{}{}:
+	default:
+	}
+}
+
+func (checker *Checker) GetInterval() time.Duration {
+	return time.Duration(checker.interval.Load())
+}
+
+func (checker *Checker) SetTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	checker.timeout.Store(int64(timeout))
+}
+
+// getTimeout 多长时间没有收到消息视为不存活
+func (checker *Checker) getTimeout() time.Duration {
+	if timeout := checker.timeout.Load(); timeout > 0 {
+		return time.Duration(timeout)
+	}
+
+	return conf.Current().GetMaxHeartbeatTime()
+}
+
+// isAlive 设置了超时时间时按照超时时间检查，否则使用连接自身的检查
+func (checker *Checker) isAlive() bool {
+	timeout := time.Duration(checker.timeout.Load())
+	if timeout <= 0 {
+		return checker.connection.IsAlive()
+	}
+
+	return time.Since(checker.connection.GetLastReadTime()) < timeout && checker.connection.IsAlive()
+}
+
 func (checker *Checker) check() error {
 	// 首先检查连接是否存活
-	if !checker.connection.IsAlive() {
+	if !checker.isAlive() {
 		// 如果不存活
 		checker.onRemoteNotAlive(checker.connection)
 		checker.Stop()
@@ -82,6 +209,10 @@ func (checker *Checker) check() error {
 	}
 
 	// 存活则发送心跳消息
+	if checker.mode == iface.HeartbeatModePingPong {
+		return checker.sendPing()
+	}
+
 	if checker.heartbeatFunc != nil {
 		err := checker.heartbeatFunc(checker.connection)
 		if err != nil {
@@ -97,15 +228,26 @@ func (checker *Checker) check() error {
 	return nil
 }
 
+// Stop 停止心跳检测，可以重复调用，不会阻塞
 func (checker *Checker) Stop() {
-	checker.closedChan <- struct{}{}
+	checker.stopOnce.Do(func() {
+		checker.timerLock.Lock()
+		defer checker.timerLock.Unlock()
+
+		close(checker.closedChan)
+		if checker.timer != nil {
+			checker.timer.Stop()
+		}
+	})
 }
 
+// SendHeartBeatMsg 在共用的调度器中调用，不能阻塞。发送队列满时不发送，记为丢失的心跳
 func (checker *Checker) SendHeartBeatMsg() error {
 	msg := checker.heartbeatMsgFunc(checker.connection)
 
-	err := checker.connection.SendMsg(checker.msgID, msg)
+	err := checker.connection.TrySend(checker.msgID, msg)
 	if err != nil {
+		checker.missed()
 		logger.Errorf("send heartbeat msg error: %v, msgId=%+v msg=%+v", err, checker.msgID, msg)
 		return err
 	}
@@ -113,15 +255,71 @@ func (checker *Checker) SendHeartBeatMsg() error {
 	return nil
 }
 
+// missed 心跳消息没有放入发送队列
+func (checker *Checker) missed() {
+	if checker.metrics != nil {
+		checker.metrics.Inc(iface.MetricHeartbeatMissed)
+	}
+}
+
+// lossTimeout 超过两个心跳间隔没有收到pong时，判定ping消息丢失
+func (checker *Checker) lossTimeout() time.Duration {
+	return 2 * checker.GetInterval()
+}
+
+func (checker *Checker) sendPing() error {
+	data, lost := checker.pingStats.nextPing(time.Now(), checker.lossTimeout())
+	if checker.metrics != nil {
+		checker.metrics.Inc(iface.MetricPingSent)
+		if lost > 0 {
+			checker.metrics.Add(iface.MetricPingLost, lost)
+		}
+	}
+
+	// 没有发送的ping收不到pong，超时之后同样记为丢失
+	err := checker.connection.TrySend(iface.PingMsgID, data)
+	if err != nil {
+		checker.missed()
+		logger.Errorf("send ping msg error: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (checker *Checker) HandlePong(data []byte) {
+	rtt, ok := checker.pingStats.pong(time.Now(), data)
+	if !ok {
+		return
+	}
+
+	if checker.metrics != nil {
+		checker.metrics.Inc(iface.MetricPongReceived)
+		checker.metrics.Add(iface.MetricRTTMicros, uint64(rtt.Microseconds()))
+	}
+}
+
+func (checker *Checker) Stats() iface.ConnStats {
+	return checker.pingStats.snapshot(time.Now(), checker.lossTimeout())
+}
+
 func (checker *Checker) Clone() iface.IHeartBeatChecker {
-	return &Checker{
-		interval:         checker.interval,
+	clone := &Checker{
 		onRemoteNotAlive: checker.onRemoteNotAlive,
 		heartbeatMsgFunc: checker.heartbeatMsgFunc,
 		heartbeatFunc:    checker.heartbeatFunc,
 		connection:       nil,
 		msgID:            checker.msgID,
 		handler:          checker.handler,
+		negotiate:        checker.negotiate,
+		mode:             checker.mode,
+		scheduler:        checker.scheduler,
+		metrics:          checker.metrics,
+		resetChan:        make(chan struct{}, 1),
 		closedChan:       make(chan struct{}),
 	}
+	clone.interval.Store(checker.interval.Load())
+	clone.timeout.Store(checker.timeout.Load())
+
+	return clone
 }
@@ -0,0 +1,82 @@
+package heartbeat
+
+import (
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errQueueFull = errors.New("send queue full")
+
+// fullConn 发送队列已满的连接，SendMsg会一直阻塞
+type fullConn struct {
+	iface.IConnection
+}
+
+func (c *fullConn) IsAlive() bool {
+	return true
+}
+
+func (c *fullConn) SendMsg(uint32, []byte) error {
+	select {}
+}
+
+func (c *fullConn) TrySend(uint32, []byte) error {
+	return errQueueFull
+}
+
+type counter struct {
+	counts map[string]uint64
+	mu     sync.Mutex
+}
+
+func (c *counter) Inc(name string) {
+	c.Add(name, 1)
+}
+
+func (c *counter) Add(name string, delta uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts[name] += delta
+}
+
+func (c *counter) Get(name string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.counts[name]
+}
+
+func (c *counter) Snapshot() map[string]uint64 {
+	return nil
+}
+
+func TestCheckNeverBlocksOnFullQueue(t *testing.T) {
+	for _, checker := range []*Checker{
+		NewHearBeatChecker(time.Second).(*Checker),
+		NewPingPongChecker(time.Second).(*Checker),
+	} {
+		metrics := &counter{counts: make(map[string]uint64)}
+		checker.BindConn(&fullConn{})
+		checker.BindMetrics(metrics)
+		checker.SetHeartbeatMsgFunc(func(iface.IConnection) []byte { return []byte("heartbeat") })
+
+		done := make(chan error, 1)
+		go func() { done <- checker.check() }()
+		select {
+		case err := <-done:
+			if err != errQueueFull {
+				t.Fatalf("expect %v, got %v", errQueueFull, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("check blocked on a full send queue in mode %v", checker.mode)
+		}
+
+		if missed := metrics.Get(iface.MetricHeartbeatMissed); missed != 1 {
+			t.Fatalf("expect 1 missed heartbeat, got %v", missed)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package heartbeat
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"math"
+	"time"
+)
+
+const heartbeatConfigLen = 8 // 心跳间隔（4字节）+超时时间（4字节），单位为毫秒
+
+var ErrInvalidHeartbeatConfig = errors.New("invalid heartbeat config")
+
+// EncodeConfig 编码心跳参数
+func EncodeConfig(interval, timeout time.Duration) []byte {
+	data := make([]byte, heartbeatConfigLen)
+	binary.BigEndian.PutUint32(data, toMillis(interval))
+	binary.BigEndian.PutUint32(data[4:], toMillis(timeout))
+
+	return data
+}
+
+// DecodeConfig 解码心跳参数
+func DecodeConfig(data []byte) (interval, timeout time.Duration, err error) {
+	if len(data) != heartbeatConfigLen {
+		return 0, 0, ErrInvalidHeartbeatConfig
+	}
+
+	interval = time.Duration(binary.BigEndian.Uint32(data)) * time.Millisecond
+	timeout = time.Duration(binary.BigEndian.Uint32(data[4:])) * time.Millisecond
+
+	return interval, timeout, nil
+}
+
+func toMillis(d time.Duration) uint32 {
+	if d <= 0 {
+		return 0
+	}
+
+	return uint32(math.Min(float64(d.Milliseconds()), math.MaxUint32))
+}
+
+// Advertise 向对端通告心跳间隔和超时时间，发送队列满时不阻塞
+func Advertise(connection iface.IConnection, interval, timeout time.Duration) error {
+	return connection.TrySend(iface.HeartbeatConfigMsgID, EncodeConfig(interval, timeout))
+}
+
+// ConfigHandler 客户端收到服务器通告的心跳参数时，调整当前连接的心跳检测器
+type ConfigHandler struct {
+}
+
+func (handler *ConfigHandler) PreHandle(_ iface.IRequest) {
+}
+
+func (handler *ConfigHandler) Handle(request iface.IRequest) {
+	interval, timeout, err := DecodeConfig(request.GetData())
+	request.Release()
+	if err != nil {
+		logger.Warnf("receive heartbeat config from %s err: %v", request.GetConnection().RemoteAddr(), err)
+		return
+	}
+
+	checker := request.GetConnection().GetHeartBeatChecker()
+	if checker == nil {
+		logger.Warnf("receive heartbeat config from %s, but heartbeat is not started", request.GetConnection().RemoteAddr())
+		return
+	}
+
+	if interval > 0 {
+		checker.SetInterval(interval)
+	}
+	checker.SetTimeout(timeout)
+
+	logger.Infof("heartbeat of connection to %s adjusted: interval=%v timeout=%v", request.GetConnection().RemoteAddr(), interval, timeout)
+}
+
+func (handler *ConfigHandler) PostHandle(_ iface.IRequest) {
+}
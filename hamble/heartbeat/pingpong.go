@@ -0,0 +1,166 @@
+package heartbeat
+
+import (
+	"encoding/binary"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"sync"
+	"time"
+)
+
+const (
+	pingDataLen    = 12 // 序号（4字节）+发送时间（8字节）
+	pingWindowSize = 32 // 计算丢包率时统计最近的ping消息数
+)
+
+// PingHandler 收到ping消息时原样回复pong消息
+type PingHandler struct {
+}
+
+func (handler *PingHandler) PreHandle(_ iface.IRequest) {
+}
+
+func (handler *PingHandler) Handle(request iface.IRequest) {
+	data := append([]byte(nil), request.GetData()...)
+	request.Release()
+
+	_ = request.GetConnection().TrySend(iface.PongMsgID, data)
+}
+
+func (handler *PingHandler) PostHandle(_ iface.IRequest) {
+}
+
+// PongHandler 收到pong消息时交给连接的心跳检测器计算RTT
+type PongHandler struct {
+}
+
+func (handler *PongHandler) PreHandle(_ iface.IRequest) {
+}
+
+func (handler *PongHandler) Handle(request iface.IRequest) {
+	if checker := request.GetConnection().GetHeartBeatChecker(); checker != nil {
+		checker.HandlePong(request.GetData())
+	}
+	request.Release()
+}
+
+func (handler *PongHandler) PostHandle(_ iface.IRequest) {
+}
+
+type pingRecord struct {
+	seq    uint32
+	sentAt time.Time
+	acked  bool
+	lost   bool
+}
+
+// pingStats 记录最近发送的ping消息，计算RTT、抖动和丢包率
+type pingStats struct {
+	seq    uint32
+	window [pingWindowSize]pingRecord
+	stats  iface.ConnStats
+
+	mu sync.Mutex
+}
+
+// nextPing 生成下一个ping消息的数据，并返回在此之前被判定为丢失的ping消息数
+func (ps *pingStats) nextPing(now time.Time, lossTimeout time.Duration) ([]byte, uint64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	lost := ps.markLost(now, lossTimeout)
+
+	ps.seq++
+	ps.window[ps.seq%pingWindowSize] = pingRecord{seq: ps.seq, sentAt: now}
+	ps.stats.PingSent++
+
+	data := make([]byte, pingDataLen)
+	binary.BigEndian.PutUint32(data, ps.seq)
+	binary.BigEndian.PutUint64(data[4:], uint64(now.UnixNano()))
+
+	return data, lost
+}
+
+// markLost 超过lossTimeout还没有收到pong的ping消息判定为丢失
+func (ps *pingStats) markLost(now time.Time, lossTimeout time.Duration) uint64 {
+	var lost uint64
+	for i := range ps.window {
+		record := &ps.window[i]
+		if record.seq == 0 || record.acked || record.lost {
+			continue
+		}
+
+		if now.Sub(record.sentAt) >= lossTimeout {
+			record.lost = true
+			lost++
+		}
+	}
+
+	return lost
+}
+
+// pong 收到pong消息，返回本次的RTT，数据不合法时ok为false
+func (ps *pingStats) pong(now time.Time, data []byte) (rtt time.Duration, ok bool) {
+	if len(data) != pingDataLen {
+		return 0, false
+	}
+
+	seq := binary.BigEndian.Uint32(data)
+	sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(data[4:])))
+	rtt = now.Sub(sentAt)
+	if rtt < 0 {
+		return 0, false
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	record := &ps.window[seq%pingWindowSize]
+	if record.seq != seq || record.acked {
+		// 太早的或者重复的pong消息
+		return 0, false
+	}
+	record.acked, record.lost = true, false
+
+	stats := &ps.stats
+	if stats.PongReceived == 0 {
+		stats.SmoothedRTT = rtt
+	} else {
+		// 与 RFC 6298 和 RFC 3550 相同的平滑方式
+		diff := rtt - stats.RTT
+		if diff < 0 {
+			diff = -diff
+		}
+		stats.Jitter += (diff - stats.Jitter) / 16
+		stats.SmoothedRTT += (rtt - stats.SmoothedRTT) / 8
+	}
+	stats.RTT = rtt
+	stats.PongReceived++
+	stats.LastPongTime = now
+
+	return rtt, true
+}
+
+func (ps *pingStats) snapshot(now time.Time, lossTimeout time.Duration) iface.ConnStats {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var acked, lost int
+	for _, record := range ps.window {
+		if record.seq == 0 {
+			continue
+		}
+
+		if record.acked {
+			acked++
+		} else if record.lost || now.Sub(record.sentAt) >= lossTimeout {
+			lost++
+		}
+	}
+
+	stats := ps.stats
+	if acked+lost > 0 {
+		stats.Loss = float64(lost) / float64(acked+lost)
+	}
+
+	return stats
+}
@@ -0,0 +1,101 @@
+package hamble
+
+import (
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"time"
+)
+
+var idleKinds = [...]iface.IdleKind{iface.ReaderIdle, iface.WriterIdle, iface.AllIdle}
+
+func (c *Connection) GetLastReadTime() time.Time {
+	return time.Unix(0, c.lastReadTime.Load())
+}
+
+func (c *Connection) GetLastWriteTime() time.Time {
+	return time.Unix(0, c.lastWriteTime.Load())
+}
+
+// SetIdleTimeout 设置该连接的空闲时间，覆盖服务器的设置，为0则不检测
+func (c *Connection) SetIdleTimeout(kind iface.IdleKind, timeout time.Duration) {
+	if kind < 0 || int(kind) >= len(c.idleTimeouts) {
+		return
+	}
+
+	c.idleTimeouts[kind].Store(int64(timeout))
+	c.scheduleIdleCheck(kind)
+}
+
+func (c *Connection) idleTimeout(kind iface.IdleKind) time.Duration {
+	if timeout := c.idleTimeouts[kind].Load(); timeout >= 0 {
+		return time.Duration(timeout)
+	}
+
+	return c.cs.GetIdleTimeout(kind)
+}
+
+// lastActiveTime 返回对应空闲类型的上一次活跃时间
+func (c *Connection) lastActiveTime(kind iface.IdleKind) time.Time {
+	switch kind {
+	case iface.ReaderIdle:
+		return c.GetLastReadTime()
+	case iface.WriterIdle:
+		return c.GetLastWriteTime()
+	default:
+		lastRead, lastWrite := c.GetLastReadTime(), c.GetLastWriteTime()
+		if lastRead.After(lastWrite) {
+			return lastRead
+		}
+		return lastWrite
+	}
+}
+
+func (c *Connection) startIdleCheck() {
+	for _, kind := range idleKinds {
+		c.scheduleIdleCheck(kind)
+	}
+}
+
+// scheduleIdleCheck 在预计空闲的时间点检查连接是否空闲，空闲时间为0时取消检查
+func (c *Connection) scheduleIdleCheck(kind iface.IdleKind) {
+	timeout := c.idleTimeout(kind)
+	delay := timeout - time.Since(c.lastActiveTime(kind))
+	if delay < 0 {
+		delay = 0
+	}
+
+	c.armIdleCheck(kind, timeout, delay)
+}
+
+func (c *Connection) armIdleCheck(kind iface.IdleKind, timeout, delay time.Duration) {
+	c.timersLock.Lock()
+	defer c.timersLock.Unlock()
+
+	if c.idleTimers[kind] != nil {
+		c.idleTimers[kind].Stop()
+		c.idleTimers[kind] = nil
+	}
+
+	if timeout <= 0 || c.isClosed.Load() {
+		return
+	}
+
+	c.idleTimers[kind] = c.cs.GetScheduler().AfterFunc(delay, func() {
+		c.checkIdle(kind)
+	})
+}
+
+func (c *Connection) checkIdle(kind iface.IdleKind) {
+	if c.isClosed.Load() {
+		return
+	}
+
+	timeout := c.idleTimeout(kind)
+	if timeout > 0 && time.Since(c.lastActiveTime(kind)) >= timeout {
+		// 持续空闲时，每隔一个空闲时间通知一次
+		c.armIdleCheck(kind, timeout, timeout)
+		c.cs.CallOnIdle(c, kind)
+		return
+	}
+
+	c.scheduleIdleCheck(kind)
+}
@@ -0,0 +1,104 @@
+package hamble
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// IPFilter 基于CIDR的黑白名单，可以在运行时重新加载。
+// 黑名单优先于白名单，白名单为空时允许所有不在黑名单中的IP
+type IPFilter struct {
+	allowList []*net.IPNet
+	denyList  []*net.IPNet
+
+	mu sync.RWMutex
+}
+
+func NewIPFilter(allowList, denyList []string) (*IPFilter, error) {
+	filter := &IPFilter{}
+	if err := filter.Reload(allowList, denyList); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// Reload 重新加载黑白名单，支持CIDR和单个IP，解析失败时保留之前的名单
+func (f *IPFilter) Reload(allowList, denyList []string) error {
+	allow, err := parseIPNets(allowList)
+	if err != nil {
+		return fmt.Errorf("parse allow list err: %w", err)
+	}
+
+	deny, err := parseIPNets(denyList)
+	if err != nil {
+		return fmt.Errorf("parse deny list err: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.allowList = allow
+	f.denyList = deny
+
+	return nil
+}
+
+// Allowed 判断ip是否允许建立连接
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if ip == nil {
+		return len(f.allowList) == 0
+	}
+
+	for _, ipNet := range f.denyList {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(f.allowList) == 0 {
+		return true
+	}
+
+	for _, ipNet := range f.allowList {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseIPNets(list []string) ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, 0, len(list))
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if !strings.Contains(item, "/") {
+			// 单个IP
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", item)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+
+	return ipNets, nil
+}
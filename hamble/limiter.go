@@ -0,0 +1,102 @@
+package hamble
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket 令牌桶限流器，以rate的速率向桶中放入令牌，桶的容量为burst
+type TokenBucket struct {
+	rate   float64 // 每秒产生的令牌数，<=0 表示不限流
+	burst  float64 // 桶的容量
+	tokens float64 // 当前桶中的令牌数
+	last   time.Time
+
+	mu sync.Mutex
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow 取出一个令牌，取不到则返回false
+func (tb *TokenBucket) Allow() bool {
+	return tb.AllowN(1)
+}
+
+// AllowN 取出n个令牌，取不到则返回false。
+// n超过桶的容量时，只要桶是满的就允许取出，不足的部分从之后产生的令牌中扣除
+func (tb *TokenBucket) AllowN(n int) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if tb.rate <= 0 {
+		return true
+	}
+
+	tb.refill(time.Now())
+	if tb.tokens < math.Min(float64(n), tb.burst) {
+		return false
+	}
+
+	tb.tokens -= float64(n)
+
+	return true
+}
+
+// ReserveN 取出n个令牌，令牌不足时预支之后产生的令牌，返回需要等待的时间
+func (tb *TokenBucket) ReserveN(n int) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if tb.rate <= 0 {
+		return 0
+	}
+
+	tb.refill(time.Now())
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// SetRate 修改令牌产生速率和桶的容量
+func (tb *TokenBucket) SetRate(rate float64, burst int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(time.Now())
+
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+
+	tb.rate = rate
+	tb.burst = float64(burst)
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
+
+func (tb *TokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(tb.last)
+	tb.last = now
+
+	if elapsed <= 0 || tb.rate <= 0 {
+		return
+	}
+
+	tb.tokens = math.Min(tb.burst, tb.tokens+elapsed.Seconds()*tb.rate)
+}
@@ -0,0 +1,48 @@
+package hamble
+
+import (
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics 以名称区分的计数器集合，实现了iface.IMetrics接口
+type Metrics struct {
+	counters sync.Map // name -> *atomic.Uint64
+}
+
+func NewMetrics() iface.IMetrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) Inc(name string) {
+	m.Add(name, 1)
+}
+
+func (m *Metrics) Add(name string, delta uint64) {
+	counter, ok := m.counters.Load(name)
+	if !ok {
+		counter, _ = m.counters.LoadOrStore(name, &atomic.Uint64{})
+	}
+
+	counter.(*atomic.Uint64).Add(delta)
+}
+
+func (m *Metrics) Get(name string) uint64 {
+	counter, ok := m.counters.Load(name)
+	if !ok {
+		return 0
+	}
+
+	return counter.(*atomic.Uint64).Load()
+}
+
+func (m *Metrics) Snapshot() map[string]uint64 {
+	snapshot := make(map[string]uint64)
+	m.counters.Range(func(key, value interface{}) bool {
+		snapshot[key.(string)] = value.(*atomic.Uint64).Load()
+		return true
+	})
+
+	return snapshot
+}
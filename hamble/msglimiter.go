@@ -0,0 +1,204 @@
+package hamble
+
+import (
+	"fmt"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 消息超过限流时的处理策略
+const (
+	RateLimitPolicyDrop       = "drop"       // 丢弃消息
+	RateLimitPolicyDelay      = "delay"      // 延迟读取下一条消息，形成背压
+	RateLimitPolicyReply      = "reply"      // 丢弃消息，并向对端回复错误消息
+	RateLimitPolicyDisconnect = "disconnect" // 断开连接
+)
+
+// 消息超过限流的原因
+const (
+	RateLimitReasonMsg   = "msg_rate"   // 超过每秒消息数
+	RateLimitReasonByte  = "byte_rate"  // 超过每秒字节数
+	RateLimitReasonRoute = "route_rate" // 超过该MsgID的每秒消息数
+)
+
+// rateRules 消息限流规则，配置发生变化时整体替换
+type rateRules struct {
+	msgRate   float64
+	msgBurst  int
+	byteRate  float64
+	byteBurst int
+	routes    map[uint32]float64 // msgID -> 每秒消息数
+	policy    string
+}
+
+func (rules *rateRules) enabled() bool {
+	return rules.msgRate > 0 || rules.byteRate > 0
+}
+
+// loadRateRules 根据配置加载消息限流规则，新规则对服务器的所有连接生效
+func (cs *CSBase) loadRateRules(profile *conf.Profile) error {
+	rules := &rateRules{
+		msgRate:   profile.MsgRateLimit,
+		msgBurst:  profile.MsgRateBurst,
+		byteRate:  profile.ByteRateLimit,
+		byteBurst: profile.ByteRateBurst,
+		routes:    make(map[uint32]float64, len(profile.RouteRateLimits)),
+		policy:    profile.RateLimitPolicy,
+	}
+
+	for _, rule := range profile.RouteRateLimits {
+		msgID, rate, err := parseRouteRateLimit(rule)
+		if err != nil {
+			return err
+		}
+
+		rules.routes[msgID] = rate
+	}
+
+	cs.rateRules.Store(rules)
+
+	return nil
+}
+
+// parseRouteRateLimit 解析MsgID的限流规则，格式为 <msgID>=<每秒消息数>，如 1=100
+func parseRouteRateLimit(rule string) (uint32, float64, error) {
+	msgIDStr, rateStr, found := strings.Cut(rule, "=")
+	if !found {
+		return 0, 0, fmt.Errorf("route rate limit %q must be in format <msgID>=<rate>", rule)
+	}
+
+	msgID, err := strconv.ParseUint(strings.TrimSpace(msgIDStr), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("route rate limit %q has invalid msgID: %w", rule, err)
+	}
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+	if err != nil || rate <= 0 {
+		return 0, 0, fmt.Errorf("route rate limit %q must have a positive rate", rule)
+	}
+
+	return uint32(msgID), rate, nil
+}
+
+// msgLimiter 一个连接的消息限流器
+type msgLimiter struct {
+	rules *rateRules // 当前使用的限流规则
+
+	msgBucket    *TokenBucket
+	byteBucket   *TokenBucket
+	routeBuckets map[uint32]*TokenBucket
+
+	mu sync.Mutex
+}
+
+func newMsgLimiter() *msgLimiter {
+	return &msgLimiter{
+		routeBuckets: make(map[uint32]*TokenBucket),
+	}
+}
+
+// sync 规则发生变化时更新令牌桶
+func (l *msgLimiter) sync(rules *rateRules) {
+	if l.rules == rules {
+		return
+	}
+
+	if l.msgBucket == nil {
+		l.msgBucket = NewTokenBucket(rules.msgRate, rules.msgBurst)
+		l.byteBucket = NewTokenBucket(rules.byteRate, rules.byteBurst)
+	} else {
+		l.msgBucket.SetRate(rules.msgRate, rules.msgBurst)
+		l.byteBucket.SetRate(rules.byteRate, rules.byteBurst)
+	}
+
+	for msgID, bucket := range l.routeBuckets {
+		if rate, exist := rules.routes[msgID]; exist {
+			bucket.SetRate(rate, 0)
+		} else {
+			delete(l.routeBuckets, msgID)
+		}
+	}
+
+	l.rules = rules
+}
+
+func (l *msgLimiter) routeBucket(msgID uint32) *TokenBucket {
+	rate, exist := l.rules.routes[msgID]
+	if !exist {
+		return nil
+	}
+
+	bucket, exist := l.routeBuckets[msgID]
+	if !exist {
+		bucket = NewTokenBucket(rate, 0)
+		l.routeBuckets[msgID] = bucket
+	}
+
+	return bucket
+}
+
+// allow 检查消息数和字节数是否超过限流，超过时返回原因
+func (l *msgLimiter) allow(rules *rateRules, size int) (bool, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sync(rules)
+
+	if !l.msgBucket.Allow() {
+		return false, RateLimitReasonMsg
+	}
+
+	if !l.byteBucket.AllowN(size) {
+		return false, RateLimitReasonByte
+	}
+
+	return true, ""
+}
+
+// allowRoute 检查MsgID的消息数是否超过限流
+func (l *msgLimiter) allowRoute(rules *rateRules, msgID uint32) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sync(rules)
+
+	bucket := l.routeBucket(msgID)
+	return bucket == nil || bucket.Allow()
+}
+
+// reserve 预支消息数和字节数的令牌，返回需要等待的时间和原因
+func (l *msgLimiter) reserve(rules *rateRules, size int) (time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sync(rules)
+
+	var wait time.Duration
+	var reason string
+	if d := l.msgBucket.ReserveN(1); d > wait {
+		wait, reason = d, RateLimitReasonMsg
+	}
+
+	if d := l.byteBucket.ReserveN(size); d > wait {
+		wait, reason = d, RateLimitReasonByte
+	}
+
+	return wait, reason
+}
+
+// reserveRoute 预支MsgID的令牌，返回需要等待的时间
+func (l *msgLimiter) reserveRoute(rules *rateRules, msgID uint32) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sync(rules)
+
+	if bucket := l.routeBucket(msgID); bucket != nil {
+		return bucket.ReserveN(1)
+	}
+
+	return 0
+}
@@ -0,0 +1,165 @@
+package hamble
+
+import (
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"sync"
+)
+
+var ErrIdentityOffline = errors.New("identity is offline and no outbox store")
+
+// outbox 客户端离线时将消息保存在存储中，上线之后投递。客户端身份即ConnManager中绑定的用户
+type outbox struct {
+	store iface.OutboxStore
+	mu    sync.Mutex // 保证离线消息先于新消息投递
+
+	inflight map[uint64]string // 已经发送还没有确认的离线消息的ID到用户的映射，由mu保护
+}
+
+// reliableSender 可以发送带有离线消息ID的可靠消息的连接
+type reliableSender interface {
+	sendReliable(msg iface.ReliableMsg) error
+}
+
+func (s *Server) SetOutboxStore(store iface.OutboxStore) {
+	s.outbox.mu.Lock()
+	defer s.outbox.mu.Unlock()
+
+	s.outbox.store, s.outbox.inflight = store, nil
+}
+
+// SendTo 向身份为identity的所有在线连接发送可靠消息，没有在线的连接时保存在离线消息存储中。
+// SendReliable只把消息放入可靠消息队列，不会阻塞，持有mu不会影响其他用户
+func (s *Server) SendTo(identity string, msgID uint32, data []byte) error {
+	s.outbox.mu.Lock()
+	defer s.outbox.mu.Unlock()
+
+	sent := false
+	for _, conn := range s.connManager.ConnsOf(identity) {
+		if err := conn.SendReliable(msgID, data); err != nil {
+			logger.Warnf("send msgID=%v to %s on %s err: %v", msgID, identity, conn.RemoteAddr(), err)
+			continue
+		}
+		sent = true
+	}
+	if sent {
+		return nil
+	}
+
+	if s.outbox.store == nil {
+		return ErrIdentityOffline
+	}
+
+	if _, err := s.outbox.store.Put(identity, msgID, data); err != nil {
+		return err
+	}
+	s.metrics.Inc(iface.MetricOutboxStored)
+
+	return nil
+}
+
+// DeliverOutbox 将连接绑定到用户identity，并投递保存的离线消息。
+// 开启认证时通过认证之后自动调用，使用Principal.ID作为用户
+func (s *Server) DeliverOutbox(conn iface.IConnection, identity string) error {
+	s.outbox.mu.Lock()
+	defer s.outbox.mu.Unlock()
+
+	if err := s.connManager.Bind(conn, identity); err != nil {
+		return err
+	}
+
+	if s.outbox.store == nil {
+		return nil
+	}
+
+	msgs, err := s.outbox.store.Load(identity)
+	if err != nil {
+		return err
+	}
+
+	sender, ok := conn.(reliableSender)
+	if !ok {
+		// 网关转发的连接没有确认，交给网关之后即可删除
+		return s.deliverUnacked(conn, identity, msgs)
+	}
+
+	// 对端确认之后才从存储中删除，发送失败的消息仍然保留在存储中，下次上线时重新投递
+	if s.outbox.inflight == nil {
+		s.outbox.inflight = make(map[uint64]string)
+	}
+	for _, msg := range msgs {
+		if _, exist := s.outbox.inflight[msg.ID]; exist {
+			// 已经通过其他连接发送，等待确认
+			continue
+		}
+
+		if err = sender.sendReliable(iface.ReliableMsg{MsgID: msg.MsgID, Data: msg.Data, OutboxID: msg.ID}); err != nil {
+			return err
+		}
+		s.outbox.inflight[msg.ID] = identity
+	}
+
+	return nil
+}
+
+// deliverUnacked 发送之后立即从存储中删除
+func (s *Server) deliverUnacked(conn iface.IConnection, identity string, msgs []iface.OutboxMsg) (err error) {
+	delivered := make([]uint64, 0, len(msgs))
+	for _, msg := range msgs {
+		if err = conn.SendReliable(msg.MsgID, msg.Data); err != nil {
+			break
+		}
+		delivered = append(delivered, msg.ID)
+	}
+
+	if len(delivered) > 0 {
+		if removeErr := s.outbox.store.Remove(identity, delivered...); removeErr != nil {
+			return removeErr
+		}
+		s.metrics.Add(iface.MetricOutboxDelivered, uint64(len(delivered)))
+	}
+
+	return err
+}
+
+// CallOnDelivered 离线消息被确认之后从存储中删除，再调用用户设置的Hook函数
+func (s *Server) CallOnDelivered(conn iface.IConnection, msg iface.ReliableMsg) {
+	if msg.OutboxID != 0 {
+		s.outbox.mu.Lock()
+		identity, ok := s.outbox.inflight[msg.OutboxID]
+		delete(s.outbox.inflight, msg.OutboxID)
+		store := s.outbox.store
+		s.outbox.mu.Unlock()
+
+		if ok && store != nil {
+			if err := store.Remove(identity, msg.OutboxID); err != nil {
+				logger.Errorf("remove delivered outbox msg %v of %s err: %v", msg.OutboxID, identity, err)
+			} else {
+				s.metrics.Inc(iface.MetricOutboxDelivered)
+			}
+		}
+	}
+
+	s.CSBase.CallOnDelivered(conn, msg)
+}
+
+// CallOnSendFailed 发送失败的离线消息仍然保留在存储中，下次上线时重新投递
+func (s *Server) CallOnSendFailed(conn iface.IConnection, msg iface.ReliableMsg, err error) {
+	if msg.OutboxID != 0 {
+		s.outbox.mu.Lock()
+		delete(s.outbox.inflight, msg.OutboxID)
+		s.outbox.mu.Unlock()
+	}
+
+	s.CSBase.CallOnSendFailed(conn, msg, err)
+}
+
+// CallOnAuthenticated 通过认证之后先投递离线消息，再调用用户设置的Hook函数
+func (s *Server) CallOnAuthenticated(conn iface.IConnection, principal *iface.Principal) {
+	if err := s.DeliverOutbox(conn, principal.ID); err != nil {
+		logger.Errorf("deliver outbox to %s err: %v", principal.ID, err)
+	}
+
+	s.CSBase.CallOnAuthenticated(conn, principal)
+}
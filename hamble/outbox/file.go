@@ -0,0 +1,421 @@
+package outbox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	opPut    = byte(1)
+	opRemove = byte(2)
+
+	recordHeadLen  = 8       // crc32（4字节）+记录长度（4字节）
+	compactMinSize = 1 << 20 // 删除的记录超过该字节数，并且超过日志文件的一半时压缩日志文件
+)
+
+var errBadRecord = errors.New("bad outbox record")
+
+// FileStore 保存在本地文件中的离线消息，实现了iface.OutboxStore接口。
+// 日志文件只追加写入，内存中保存消息的索引，打开时扫描日志文件重建索引
+type FileStore struct {
+	option  iface.OutboxOption
+	path    string
+	file    *os.File
+	size    int64 // 日志文件大小
+	garbage int64 // 已经删除的消息占用的字节数
+	queues  map[string]*queue
+	nextID  uint64
+	mu      sync.Mutex
+}
+
+// NewFileStore 打开或者创建离线消息日志文件，日志文件末尾不完整的记录会被截断
+func NewFileStore(path string, option iface.OutboxOption) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &FileStore{
+		option: option,
+		path:   path,
+		file:   file,
+		queues: make(map[string]*queue),
+	}
+
+	if err = store.replay(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	// 清理打开之前已经过期的消息
+	now := time.Now()
+	for identity, q := range store.queues {
+		if err = store.removeEntries(identity, q.trim(now, option)); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// replay 扫描日志文件重建索引
+func (store *FileStore) replay() error {
+	if _, err := store.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(store.file)
+	var offset int64
+	for {
+		body, err := readRecord(reader)
+		if err != nil {
+			if err != io.EOF {
+				// 进程在写入时退出，丢弃最后一条不完整的记录
+				if err = store.file.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+
+		record := int64(recordHeadLen + len(body))
+		if err = store.apply(body, offset, record); err != nil {
+			if err = store.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset += record
+	}
+
+	store.size = offset
+	_, err := store.file.Seek(offset, io.SeekStart)
+
+	return err
+}
+
+// apply 将一条记录应用到索引
+func (store *FileStore) apply(body []byte, offset, record int64) error {
+	if len(body) < 11 {
+		return errBadRecord
+	}
+
+	op, id := body[0], binary.BigEndian.Uint64(body[1:])
+	identityLen := int(binary.BigEndian.Uint16(body[9:]))
+	if len(body) < 11+identityLen {
+		return errBadRecord
+	}
+	identity := string(body[11 : 11+identityLen])
+	if id > store.nextID {
+		store.nextID = id
+	}
+
+	switch op {
+	case opPut:
+		rest := body[11+identityLen:]
+		if len(rest) < 12 {
+			return errBadRecord
+		}
+
+		var expire time.Time
+		if nano := int64(binary.BigEndian.Uint64(rest[4:])); nano != 0 {
+			expire = time.Unix(0, nano)
+		}
+
+		q := store.queues[identity]
+		if q == nil {
+			q = &queue{}
+			store.queues[identity] = q
+		}
+		q.push(entry{
+			OutboxMsg: iface.OutboxMsg{ID: id, MsgID: binary.BigEndian.Uint32(rest), ExpireAt: expire},
+			size:      len(rest) - 12,
+			offset:    offset + recordHeadLen + int64(11+identityLen+12),
+			record:    record,
+		})
+	case opRemove:
+		store.garbage += record
+		q := store.queues[identity]
+		if q == nil {
+			return nil
+		}
+		for _, e := range q.remove([]uint64{id}) {
+			store.garbage += e.record
+		}
+		if len(q.entries) == 0 {
+			delete(store.queues, identity)
+		}
+	default:
+		return errBadRecord
+	}
+
+	return nil
+}
+
+func readRecord(reader io.Reader) ([]byte, error) {
+	var head [recordHeadLen]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errBadRecord
+		}
+		return nil, err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(head[4:]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, errBadRecord
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(head[:]) {
+		return nil, errBadRecord
+	}
+
+	return body, nil
+}
+
+func encodeRecord(op byte, id uint64, identity string, msgID uint32, expire time.Time, data []byte) []byte {
+	bodyLen := 11 + len(identity)
+	if op == opPut {
+		bodyLen += 12 + len(data)
+	}
+
+	buf := make([]byte, recordHeadLen+bodyLen)
+	body := buf[recordHeadLen:]
+	body[0] = op
+	binary.BigEndian.PutUint64(body[1:], id)
+	binary.BigEndian.PutUint16(body[9:], uint16(len(identity)))
+	copy(body[11:], identity)
+	if op == opPut {
+		rest := body[11+len(identity):]
+		binary.BigEndian.PutUint32(rest, msgID)
+		if !expire.IsZero() {
+			binary.BigEndian.PutUint64(rest[4:], uint64(expire.UnixNano()))
+		}
+		copy(rest[12:], data)
+	}
+
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(body))
+	binary.BigEndian.PutUint32(buf[4:], uint32(bodyLen))
+
+	return buf
+}
+
+// write 在日志文件末尾追加一条记录，返回记录的位置
+func (store *FileStore) write(record []byte) (int64, error) {
+	offset := store.size
+	if _, err := store.file.WriteAt(record, offset); err != nil {
+		// 写入失败时截断不完整的记录
+		_ = store.file.Truncate(offset)
+		return 0, err
+	}
+	store.size += int64(len(record))
+
+	return offset, nil
+}
+
+// removeEntries 为已经从索引中删除的消息追加删除记录
+func (store *FileStore) removeEntries(identity string, entries []entry) error {
+	for _, e := range entries {
+		record := encodeRecord(opRemove, e.ID, identity, 0, time.Time{}, nil)
+		if _, err := store.write(record); err != nil {
+			return err
+		}
+		store.garbage += e.record + int64(len(record))
+	}
+
+	if q := store.queues[identity]; q != nil && len(q.entries) == 0 {
+		delete(store.queues, identity)
+	}
+
+	return nil
+}
+
+func (store *FileStore) Put(identity string, msgID uint32, data []byte) (uint64, error) {
+	if store.option.MaxBytes > 0 && len(data) > store.option.MaxBytes {
+		return 0, ErrMsgTooLarge
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.file == nil {
+		return 0, ErrStoreClosed
+	}
+
+	now := time.Now()
+	id := store.nextID + 1
+	expire := expireAt(now, store.option.TTL)
+	record := encodeRecord(opPut, id, identity, msgID, expire, data)
+	offset, err := store.write(record)
+	if err != nil {
+		return 0, err
+	}
+	// 返回之前写入磁盘，保存成功的消息在进程或者机器崩溃之后不会丢失
+	if err = store.file.Sync(); err != nil {
+		_ = store.file.Truncate(offset)
+		store.size = offset
+		return 0, err
+	}
+	store.nextID = id
+
+	q := store.queues[identity]
+	if q == nil {
+		q = &queue{}
+		store.queues[identity] = q
+	}
+	q.push(entry{
+		OutboxMsg: iface.OutboxMsg{ID: id, MsgID: msgID, ExpireAt: expire},
+		size:      len(data),
+		offset:    offset + int64(len(record)-len(data)),
+		record:    int64(len(record)),
+	})
+
+	if err = store.removeEntries(identity, q.trim(now, store.option)); err != nil {
+		return 0, err
+	}
+
+	return id, store.maybeCompact()
+}
+
+func (store *FileStore) Load(identity string) ([]iface.OutboxMsg, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.file == nil {
+		return nil, ErrStoreClosed
+	}
+
+	q := store.queues[identity]
+	if q == nil {
+		return nil, nil
+	}
+
+	if err := store.removeEntries(identity, q.trim(time.Now(), store.option)); err != nil {
+		return nil, err
+	}
+
+	msgs := make([]iface.OutboxMsg, 0, len(q.entries))
+	for _, e := range q.entries {
+		msg := e.OutboxMsg
+		msg.Data = make([]byte, e.size)
+		if _, err := store.file.ReadAt(msg.Data, e.offset); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+func (store *FileStore) Remove(identity string, ids ...uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.file == nil {
+		return ErrStoreClosed
+	}
+
+	q := store.queues[identity]
+	if q == nil {
+		return nil
+	}
+
+	if err := store.removeEntries(identity, q.remove(ids)); err != nil {
+		return err
+	}
+
+	return store.maybeCompact()
+}
+
+// maybeCompact 删除的记录过多时，只保留未删除的消息重写日志文件
+func (store *FileStore) maybeCompact() error {
+	if store.garbage < compactMinSize || store.garbage*2 < store.size {
+		return nil
+	}
+
+	tmpPath := store.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for identity, q := range store.queues {
+		for i := range q.entries {
+			e := &q.entries[i]
+			data := make([]byte, e.size)
+			if _, err = store.file.ReadAt(data, e.offset); err == nil {
+				record := encodeRecord(opPut, e.ID, identity, e.MsgID, e.ExpireAt, data)
+				if _, err = tmp.WriteAt(record, size); err == nil {
+					e.offset = size + int64(len(record)-len(data))
+					size += int64(len(record))
+					continue
+				}
+			}
+
+			_ = tmp.Close()
+			_ = os.Remove(tmpPath)
+			// 索引中的位置可能已经被修改，重新扫描原来的日志文件
+			store.queues = make(map[string]*queue)
+			store.garbage = 0
+			if replayErr := store.replay(); replayErr != nil {
+				return replayErr
+			}
+			return err
+		}
+	}
+
+	if err = tmp.Sync(); err == nil {
+		err = os.Rename(tmpPath, store.path)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	_ = store.file.Close()
+	store.file, store.size, store.garbage = tmp, size, 0
+
+	return syncDir(filepath.Dir(store.path))
+}
+
+// syncDir 将目录写入磁盘，保证重命名之后的日志文件在崩溃之后仍然存在
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (store *FileStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.file == nil {
+		return nil
+	}
+
+	err := store.file.Sync()
+	if closeErr := store.file.Close(); err == nil {
+		err = closeErr
+	}
+	store.file, store.queues = nil, nil
+
+	return err
+}
@@ -0,0 +1,171 @@
+package outbox
+
+import (
+	"bytes"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, path string) *FileStore {
+	t.Helper()
+
+	store, err := NewFileStore(path, iface.OutboxOption{})
+	if err != nil {
+		t.Fatalf("open file store err: %v", err)
+	}
+
+	return store
+}
+
+func loadMsgs(t *testing.T, store *FileStore, identity string) []iface.OutboxMsg {
+	t.Helper()
+
+	msgs, err := store.Load(identity)
+	if err != nil {
+		t.Fatalf("load %s err: %v", identity, err)
+	}
+
+	return msgs
+}
+
+func TestFileStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.log")
+	store := openTestStore(t, path)
+
+	for i := 0; i < 3; i++ {
+		if _, err := store.Put("alice", uint32(100+i), []byte{byte(i)}); err != nil {
+			t.Fatalf("put err: %v", err)
+		}
+	}
+	bobID, err := store.Put("bob", 200, []byte("bob"))
+	if err != nil {
+		t.Fatalf("put err: %v", err)
+	}
+	if err = store.Remove("alice", 2); err != nil {
+		t.Fatalf("remove err: %v", err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatalf("close err: %v", err)
+	}
+
+	store = openTestStore(t, path)
+	defer store.Close()
+
+	msgs := loadMsgs(t, store, "alice")
+	if len(msgs) != 2 || msgs[0].MsgID != 100 || msgs[1].MsgID != 102 || !bytes.Equal(msgs[1].Data, []byte{2}) {
+		t.Fatalf("unexpected msgs of alice after replay: %+v", msgs)
+	}
+	msgs = loadMsgs(t, store, "bob")
+	if len(msgs) != 1 || msgs[0].ID != bobID || string(msgs[0].Data) != "bob" {
+		t.Fatalf("unexpected msgs of bob after replay: %+v", msgs)
+	}
+
+	// 重新打开之后继续分配更大的ID
+	id, err := store.Put("bob", 201, nil)
+	if err != nil || id <= bobID {
+		t.Fatalf("expect id greater than %v, got %v, err: %v", bobID, id, err)
+	}
+}
+
+func TestFileStoreTruncateTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.log")
+	store := openTestStore(t, path)
+	if _, err := store.Put("alice", 100, []byte("complete")); err != nil {
+		t.Fatalf("put err: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close err: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟写入一半时进程退出
+	record := encodeRecord(opPut, 2, "alice", 101, time.Time{}, []byte("torn"))
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.Write(record[:len(record)-2])
+	_ = file.Close()
+
+	store = openTestStore(t, path)
+	defer store.Close()
+
+	msgs := loadMsgs(t, store, "alice")
+	if len(msgs) != 1 || string(msgs[0].Data) != "complete" {
+		t.Fatalf("expect only the complete msg, got %+v", msgs)
+	}
+	if store.size != info.Size() {
+		t.Fatalf("expect log truncated to %v bytes, got %v", info.Size(), store.size)
+	}
+}
+
+func TestFileStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.log")
+	store := openTestStore(t, path)
+
+	data := make([]byte, 64<<10)
+	var ids []uint64
+	for i := 0; i < 24; i++ {
+		data[0] = byte(i)
+		id, err := store.Put("alice", uint32(i), data)
+		if err != nil {
+			t.Fatalf("put err: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	// 删除前20条消息，删除的记录超过一半，触发压缩
+	if err := store.Remove("alice", ids[:20]...); err != nil {
+		t.Fatalf("remove err: %v", err)
+	}
+	if store.garbage != 0 {
+		t.Fatalf("expect log compacted, garbage=%v", store.garbage)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != store.size || info.Size() > 5*int64(len(data)) {
+		t.Fatalf("unexpected log size %v after compaction, store size %v", info.Size(), store.size)
+	}
+	if _, err = os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Fatalf("temporary compaction file left: %v", err)
+	}
+
+	check := func(msgs []iface.OutboxMsg) {
+		t.Helper()
+		if len(msgs) != 4 {
+			t.Fatalf("expect 4 msgs, got %v", len(msgs))
+		}
+		for i, msg := range msgs {
+			if msg.ID != ids[20+i] || msg.Data[0] != byte(20+i) || len(msg.Data) != len(data) {
+				t.Fatalf("unexpected msg %v after compaction: id=%v first=%v", i, msg.ID, msg.Data[0])
+			}
+		}
+	}
+	check(loadMsgs(t, store, "alice"))
+
+	// 压缩之后仍然可以追加写入，并且重新打开之后恢复相同的消息
+	if _, err = store.Put("bob", 1, []byte("after")); err != nil {
+		t.Fatalf("put after compaction err: %v", err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatalf("close err: %v", err)
+	}
+
+	store = openTestStore(t, path)
+	defer store.Close()
+
+	check(loadMsgs(t, store, "alice"))
+	if msgs := loadMsgs(t, store, "bob"); len(msgs) != 1 || string(msgs[0].Data) != "after" {
+		t.Fatalf("unexpected msgs of bob: %+v", msgs)
+	}
+}
@@ -0,0 +1,115 @@
+package outbox
+
+import (
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"sync"
+	"time"
+)
+
+// MemoryStore 保存在内存中的离线消息，实现了iface.OutboxStore接口，进程退出之后消息丢失
+type MemoryStore struct {
+	option iface.OutboxOption
+	queues map[string]*queue
+	nextID uint64
+	closed bool
+	mu     sync.Mutex
+}
+
+func NewMemoryStore(option iface.OutboxOption) *MemoryStore {
+	return &MemoryStore{
+		option: option,
+		queues: make(map[string]*queue),
+	}
+}
+
+func (store *MemoryStore) Put(identity string, msgID uint32, data []byte) (uint64, error) {
+	if store.option.MaxBytes > 0 && len(data) > store.option.MaxBytes {
+		return 0, ErrMsgTooLarge
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.closed {
+		return 0, ErrStoreClosed
+	}
+
+	q := store.queues[identity]
+	if q == nil {
+		q = &queue{}
+		store.queues[identity] = q
+	}
+
+	now := time.Now()
+	store.nextID++
+	q.push(entry{
+		OutboxMsg: iface.OutboxMsg{
+			ID:       store.nextID,
+			MsgID:    msgID,
+			Data:     append([]byte(nil), data...),
+			ExpireAt: expireAt(now, store.option.TTL),
+		},
+		size: len(data),
+	})
+	q.trim(now, store.option)
+
+	return store.nextID, nil
+}
+
+func (store *MemoryStore) Load(identity string) ([]iface.OutboxMsg, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.closed {
+		return nil, ErrStoreClosed
+	}
+
+	q := store.queues[identity]
+	if q == nil {
+		return nil, nil
+	}
+
+	q.trim(time.Now(), store.option)
+	if len(q.entries) == 0 {
+		delete(store.queues, identity)
+		return nil, nil
+	}
+
+	msgs := make([]iface.OutboxMsg, len(q.entries))
+	for i, e := range q.entries {
+		msgs[i] = e.OutboxMsg
+	}
+
+	return msgs, nil
+}
+
+func (store *MemoryStore) Remove(identity string, ids ...uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.closed {
+		return ErrStoreClosed
+	}
+
+	q := store.queues[identity]
+	if q == nil {
+		return nil
+	}
+
+	q.remove(ids)
+	if len(q.entries) == 0 {
+		delete(store.queues, identity)
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.closed = true
+	store.queues = nil
+
+	return nil
+}
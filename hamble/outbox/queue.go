@@ -0,0 +1,94 @@
+package outbox
+
+import (
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"time"
+)
+
+var (
+	ErrMsgTooLarge = errors.New("outbox msg is larger than max bytes")
+	ErrStoreClosed = errors.New("outbox store closed")
+)
+
+// entry 一条保存的消息，文件存储中Data为nil，数据位于日志文件的offset处
+type entry struct {
+	iface.OutboxMsg
+	size   int   // 数据长度
+	offset int64 // 数据在日志文件中的位置
+	record int64 // 记录在日志文件中占用的字节数
+}
+
+// queue 一个客户端的离线消息，按保存顺序排列
+type queue struct {
+	entries []entry
+	bytes   int
+}
+
+func (q *queue) push(e entry) {
+	q.entries = append(q.entries, e)
+	q.bytes += e.size
+}
+
+// trim 删除过期的消息，以及超过容量的最早的消息，返回被删除的消息。
+// 同一个存储中的TTL相同，所以过期的消息总是在最前面
+func (q *queue) trim(now time.Time, option iface.OutboxOption) []entry {
+	n := 0
+	for bytes := q.bytes; n < len(q.entries); n++ {
+		e := q.entries[n]
+		expired := !e.ExpireAt.IsZero() && !now.Before(e.ExpireAt)
+		overMsgs := option.MaxMsgs > 0 && len(q.entries)-n > option.MaxMsgs
+		overBytes := option.MaxBytes > 0 && bytes > option.MaxBytes
+		if !expired && !overMsgs && !overBytes {
+			break
+		}
+		bytes -= e.size
+	}
+
+	return q.cut(n)
+}
+
+// cut 删除最早的n条消息
+func (q *queue) cut(n int) []entry {
+	if n == 0 {
+		return nil
+	}
+
+	removed := append([]entry(nil), q.entries[:n]...)
+	for _, e := range removed {
+		q.bytes -= e.size
+	}
+	q.entries = append(q.entries[:0], q.entries[n:]...)
+
+	return removed
+}
+
+// remove 删除指定的消息，返回被删除的消息
+func (q *queue) remove(ids []uint64) []entry {
+	set := make(map[uint64]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+
+	var removed []entry
+	kept := q.entries[:0]
+	for _, e := range q.entries {
+		if _, exist := set[e.ID]; exist {
+			removed = append(removed, e)
+			q.bytes -= e.size
+			continue
+		}
+		kept = append(kept, e)
+	}
+	q.entries = kept
+
+	return removed
+}
+
+func expireAt(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return now.Add(ttl)
+}
@@ -0,0 +1,9 @@
+package hamble
+
+// 发送队列和Worker任务队列满时的溢出策略
+const (
+	OverflowPolicyBlock      = "block"       // 阻塞，直到队列有空位
+	OverflowPolicyDropNewest = "drop_newest" // 丢弃当前的消息
+	OverflowPolicyDropOldest = "drop_oldest" // 丢弃队列中最早的消息
+	OverflowPolicyDisconnect = "disconnect"  // 断开消费太慢的连接
+)
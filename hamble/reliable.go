@@ -0,0 +1,438 @@
+package hamble
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"sync"
+	"time"
+)
+
+const (
+	reliableSeqLen  = 8  // 序号（8字节）
+	reliableHeadLen = 12 // 序号（8字节）+MsgID（4字节）
+)
+
+var (
+	ErrAckTimeout      = errors.New("reliable msg not acked in time")
+	ErrReliableFull    = errors.New("too many unacked reliable msgs")
+	ErrInvalidReliable = errors.New("invalid reliable msg")
+	ErrNotResumed      = errors.New("reconnected without resuming a session")
+)
+
+// reliableMsg 等待对端确认的消息
+type reliableMsg struct {
+	iface.ReliableMsg
+	sentAt  time.Time // 上一次放入发送队列的时间，为零值表示还没有发送
+	retries int       // 超时重发的次数
+}
+
+// reliableQueue 等待对端确认的可靠消息，按序号排列。
+// 对端只按顺序接收消息，所以消息总是按序号发送，超时之后从最早的消息开始全部重发
+type reliableQueue struct {
+	pending []*reliableMsg
+	nextSeq uint64 // 上一条消息的序号
+	mu      sync.Mutex
+}
+
+// send 分配序号之后放入队列，c不为nil时发送给对端。持有mu时不能阻塞，发送队列满时不等待，
+// 发送失败的消息仍然保留，由超时重发的定时任务按顺序发送
+func (q *reliableQueue) send(c *Connection, msg iface.ReliableMsg, maxPending int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) >= maxPending {
+		return ErrReliableFull
+	}
+
+	// 前面还有没有发送的消息时不能发送，否则对端会因为序号不连续丢弃该消息
+	blocked := len(q.pending) > 0 && q.pending[len(q.pending)-1].sentAt.IsZero()
+
+	q.nextSeq++
+	msg.Seq = q.nextSeq
+	pending := &reliableMsg{ReliableMsg: msg}
+	q.pending = append(q.pending, pending)
+
+	if c != nil && !blocked && c.TrySend(iface.ReliableMsgID, encodeReliableMsg(msg)) == nil {
+		pending.sentAt = time.Now()
+	}
+
+	return nil
+}
+
+// ack 删除对端已经确认的消息，返回这些消息
+func (q *reliableQueue) ack(seq uint64) []iface.ReliableMsg {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.ackLocked(seq)
+}
+
+// ackLocked 调用时需持有mu
+func (q *reliableQueue) ackLocked(seq uint64) []iface.ReliableMsg {
+	n := 0
+	for n < len(q.pending) && q.pending[n].Seq <= seq {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	delivered := make([]iface.ReliableMsg, n)
+	for i := 0; i < n; i++ {
+		delivered[i] = q.pending[i].ReliableMsg
+		q.pending[i] = nil
+	}
+	q.pending = q.pending[n:]
+
+	return delivered
+}
+
+// replay 对端已经收到lastSeq及之前的消息，按顺序重发其余的消息，返回被确认的消息
+func (q *reliableQueue) replay(c *Connection, lastSeq uint64) []iface.ReliableMsg {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delivered := q.ackLocked(lastSeq)
+	for _, msg := range q.pending {
+		msg.sentAt, msg.retries = time.Time{}, 0
+	}
+	q.flushLocked(c, time.Now())
+
+	return delivered
+}
+
+// retransmit 最早的消息超时没有确认时，从它开始全部重发。重发次数超过maxRetries时broken为true
+func (q *reliableQueue) retransmit(c *Connection, now time.Time, timeout time.Duration, maxRetries int) (resent int, broken bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return 0, false
+	}
+
+	head := q.pending[0]
+	if !head.sentAt.IsZero() && now.Sub(head.sentAt) >= timeout {
+		if maxRetries > 0 && head.retries >= maxRetries {
+			return 0, true
+		}
+
+		head.retries++
+		for _, msg := range q.pending {
+			msg.sentAt = time.Time{}
+		}
+	}
+
+	return q.flushLocked(c, now), false
+}
+
+// flushLocked 按顺序发送还没有发送的消息，发送队列满时停止，调用时需持有mu
+func (q *reliableQueue) flushLocked(c *Connection, now time.Time) int {
+	n := 0
+	for _, msg := range q.pending {
+		if !msg.sentAt.IsZero() {
+			continue
+		}
+
+		if c.TrySend(iface.ReliableMsgID, encodeReliableMsg(msg.ReliableMsg)) != nil {
+			break
+		}
+		msg.sentAt = now
+		n++
+	}
+
+	return n
+}
+
+// merge 把其他队列中的消息按顺序加入队列，重新分配序号
+func (q *reliableQueue) merge(msgs []iface.ReliableMsg) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, msg := range msgs {
+		q.nextSeq++
+		msg.Seq = q.nextSeq
+		q.pending = append(q.pending, &reliableMsg{ReliableMsg: msg})
+	}
+}
+
+// drain 清空队列，返回所有等待确认的消息
+func (q *reliableQueue) drain() []iface.ReliableMsg {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msgs := make([]iface.ReliableMsg, len(q.pending))
+	for i, msg := range q.pending {
+		msgs[i] = msg.ReliableMsg
+	}
+	q.pending = nil
+
+	return msgs
+}
+
+func (q *reliableQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending)
+}
+
+// seqReceiver 接收可靠消息，只按序号顺序接收，丢弃重复的和序号不连续的消息
+type seqReceiver struct {
+	lastSeq uint64 // 已经收到的最大序号
+	started bool   // 是否收到过消息，收到的第一条消息总是接收
+	mu      sync.Mutex
+}
+
+// receive 收到序号为seq的消息，accept为false时丢弃该消息，ack为需要回复给对端的累计确认
+func (r *seqReceiver) receive(seq uint64) (accept bool, ack uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.started && seq > 0 {
+		// 对端可能在之前的连接中已经确认了一部分消息
+		r.started, r.lastSeq = true, seq-1
+	}
+
+	if seq != r.lastSeq+1 {
+		// 重复的消息，或者前面的消息丢失了，等待对端重发
+		return false, r.lastSeq
+	}
+	r.lastSeq = seq
+
+	return true, seq
+}
+
+func (r *seqReceiver) last() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lastSeq
+}
+
+func (r *seqReceiver) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastSeq, r.started = 0, false
+}
+
+func encodeReliableMsg(msg iface.ReliableMsg) []byte {
+	data := make([]byte, reliableHeadLen, reliableHeadLen+len(msg.Data))
+	binary.BigEndian.PutUint64(data, msg.Seq)
+	binary.BigEndian.PutUint32(data[reliableSeqLen:], msg.MsgID)
+
+	return append(data, msg.Data...)
+}
+
+func decodeReliableMsg(data []byte) (seq uint64, msgID uint32, payload []byte, err error) {
+	if len(data) < reliableHeadLen {
+		return 0, 0, nil, ErrInvalidReliable
+	}
+
+	return binary.BigEndian.Uint64(data), binary.BigEndian.Uint32(data[reliableSeqLen:]), data[reliableHeadLen:], nil
+}
+
+func encodeReliableSeq(seq uint64) []byte {
+	data := make([]byte, reliableSeqLen)
+	binary.BigEndian.PutUint64(data, seq)
+
+	return data
+}
+
+func decodeReliableSeq(data []byte) (uint64, error) {
+	if len(data) != reliableSeqLen {
+		return 0, ErrInvalidReliable
+	}
+
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// SendReliable 发送需要对端确认的消息，开启会话时由会话发送，断线重连之后重放
+func (c *Connection) SendReliable(msgID uint32, data []byte) error {
+	return c.sendReliable(iface.ReliableMsg{MsgID: msgID, Data: data})
+}
+
+func (c *Connection) sendReliable(msg iface.ReliableMsg) error {
+	if s := c.session.Load(); s != nil {
+		return s.send(msg)
+	}
+
+	if c.isClosed.Load() {
+		return ErrConnClosed
+	}
+
+	if err := c.sender.send(c, msg, c.cs.GetReliableOption().MaxPending); err != nil {
+		return err
+	}
+	c.startRetransmit()
+
+	return nil
+}
+
+// reliableQueue 获取连接的可靠消息队列，开启会话时使用会话的队列
+func (c *Connection) reliableQueue() *reliableQueue {
+	if s := c.session.Load(); s != nil {
+		return &s.queue
+	}
+
+	return c.sender
+}
+
+// startRetransmit 开启超时重发的定时任务，每个连接只会开启一次
+func (c *Connection) startRetransmit() {
+	c.retransmitOnce.Do(func() {
+		interval := c.cs.GetReliableOption().AckTimeout / 2
+		if interval <= 0 {
+			interval = time.Millisecond
+		}
+
+		c.Every(interval, func(_ iface.IConnection) {
+			c.retransmit()
+		})
+	})
+}
+
+// retransmit 重发超时没有确认的消息，重发次数过多时认为连接已经失效，关闭连接
+func (c *Connection) retransmit() {
+	option := c.cs.GetReliableOption()
+	resent, broken := c.reliableQueue().retransmit(c, time.Now(), option.AckTimeout, option.MaxRetries)
+	if resent > 0 {
+		c.cs.GetMetrics().Add(iface.MetricRetransmit, uint64(resent))
+	}
+
+	if broken {
+		logger.Warnf("connection from %s does not ack reliable msgs after %d retries, close it", c.RemoteAddr(), option.MaxRetries)
+		c.ackTimedOut.Store(true)
+		c.Stop()
+	}
+}
+
+// checkReliable 处理可靠消息和确认，返回解开之后的消息，返回false时不再交给Router处理。
+// 可靠消息需要按照收到的顺序处理，不能交给Worker
+func (c *Connection) checkReliable(msg iface.IMessage) (iface.IMessage, bool) {
+	switch msg.GetMsgID() {
+	case iface.ReliableAckMsgID:
+		seq, err := decodeReliableSeq(msg.GetData())
+		if err != nil {
+			logger.Warnf("receive reliable ack from %s err: %v", c.RemoteAddr(), err)
+			return nil, false
+		}
+		c.handleAck(seq)
+		return nil, false
+	case iface.ReliableMsgID:
+		seq, msgID, payload, err := decodeReliableMsg(msg.GetData())
+		if err != nil {
+			logger.Warnf("receive reliable msg from %s err: %v", c.RemoteAddr(), err)
+			return nil, false
+		}
+
+		accept, ack, ok := c.receiveReliable(seq)
+		if !ok {
+			return nil, false
+		}
+		_ = c.TrySend(iface.ReliableAckMsgID, encodeReliableSeq(ack))
+		if !accept {
+			if seq <= ack {
+				c.cs.GetMetrics().Inc(iface.MetricDuplicateMsg)
+			}
+			return nil, false
+		}
+		return NewMessage(msgID, payload), true
+	}
+
+	return msg, true
+}
+
+// receiveReliable 开启会话时使用会话的接收状态，在断线重连之后仍然可以识别重复的消息。
+// ok为false表示客户端正在恢复会话，丢弃该消息
+func (c *Connection) receiveReliable(seq uint64) (accept bool, ack uint64, ok bool) {
+	if c.clientSession != nil {
+		return c.clientSession.receive(seq)
+	}
+
+	receiver := &c.receiver
+	if s := c.session.Load(); s != nil {
+		receiver = &s.receiver
+	}
+	accept, ack = receiver.receive(seq)
+
+	return accept, ack, true
+}
+
+// handleAck 对端确认了seq及之前的消息
+func (c *Connection) handleAck(seq uint64) {
+	delivered := c.reliableQueue().ack(seq)
+	if len(delivered) == 0 {
+		return
+	}
+
+	// Hook函数可能阻塞，不能影响读取
+	go func() {
+		for _, msg := range delivered {
+			c.cs.CallOnDelivered(c, msg)
+		}
+	}()
+}
+
+// stopReliable 连接关闭时，没有会话的连接中未确认的消息全部发送失败
+func (c *Connection) stopReliable() {
+	if c.session.Load() != nil || c.keepUnacked {
+		return
+	}
+
+	failed := c.sender.drain()
+	if len(failed) == 0 {
+		return
+	}
+
+	err := ErrConnClosed
+	if c.ackTimedOut.Load() {
+		err = ErrAckTimeout
+	}
+	c.cs.GetMetrics().Add(iface.MetricReliableFail, uint64(len(failed)))
+	for _, msg := range failed {
+		c.cs.CallOnSendFailed(c, msg, err)
+	}
+}
+
+func (cs *CSBase) SetReliableOption(option iface.ReliableOption) {
+	cs.reliableOption = option
+}
+
+func (cs *CSBase) GetReliableOption() iface.ReliableOption {
+	option := cs.reliableOption
+	if option.AckTimeout <= 0 {
+		option.AckTimeout = conf.Current().GetReliableTimeout()
+	}
+	if option.MaxRetries <= 0 {
+		option.MaxRetries = conf.Current().ReliableRetries
+	}
+	if option.MaxPending <= 0 {
+		option.MaxPending = conf.Current().ReliablePending
+	}
+
+	return option
+}
+
+func (cs *CSBase) SetOnDelivered(f iface.OnDelivered) {
+	cs.onDelivered = f
+}
+
+func (cs *CSBase) CallOnDelivered(conn iface.IConnection, msg iface.ReliableMsg) {
+	if cs.onDelivered != nil {
+		cs.onDelivered(conn, msg)
+	}
+}
+
+func (cs *CSBase) SetOnSendFailed(f iface.OnSendFailed) {
+	cs.onSendFailed = f
+}
+
+func (cs *CSBase) CallOnSendFailed(conn iface.IConnection, msg iface.ReliableMsg, err error) {
+	if cs.onSendFailed != nil {
+		cs.onSendFailed(conn, msg, err)
+	}
+}
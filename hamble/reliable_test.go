@@ -0,0 +1,291 @@
+package hamble
+
+import (
+	"fmt"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReliableQueueAck(t *testing.T) {
+	var q reliableQueue
+	for i := 0; i < 3; i++ {
+		if err := q.send(nil, iface.ReliableMsg{MsgID: uint32(100 + i)}, 3); err != nil {
+			t.Fatalf("send err: %v", err)
+		}
+	}
+	if err := q.send(nil, iface.ReliableMsg{MsgID: 103}, 3); err != ErrReliableFull {
+		t.Fatalf("expect ErrReliableFull, got %v", err)
+	}
+
+	// 累计确认，之前的消息一起确认
+	delivered := q.ack(2)
+	if len(delivered) != 2 || delivered[0].Seq != 1 || delivered[1].MsgID != 101 {
+		t.Fatalf("unexpected delivered msgs: %+v", delivered)
+	}
+
+	// 重复的确认不会再次确认
+	if delivered = q.ack(2); len(delivered) != 0 {
+		t.Fatalf("expect no msgs delivered by duplicate ack, got %+v", delivered)
+	}
+	if q.len() != 1 {
+		t.Fatalf("expect 1 pending msg, got %v", q.len())
+	}
+
+	if delivered = q.ack(3); len(delivered) != 1 || delivered[0].Seq != 3 {
+		t.Fatalf("unexpected delivered msgs: %+v", delivered)
+	}
+}
+
+func TestReliableQueueMergeKeepsOrder(t *testing.T) {
+	var q reliableQueue
+	_ = q.send(nil, iface.ReliableMsg{MsgID: 100}, 10)
+	q.merge([]iface.ReliableMsg{{Seq: 1, MsgID: 200, OutboxID: 7}, {Seq: 2, MsgID: 201}})
+
+	msgs := q.drain()
+	if len(msgs) != 3 {
+		t.Fatalf("expect 3 msgs, got %+v", msgs)
+	}
+	for i, msg := range msgs {
+		if msg.Seq != uint64(i+1) {
+			t.Fatalf("expect msgs renumbered in order, got %+v", msgs)
+		}
+	}
+	if msgs[1].MsgID != 200 || msgs[1].OutboxID != 7 {
+		t.Fatalf("merged msg lost its fields: %+v", msgs[1])
+	}
+}
+
+func TestSeqReceiverDropsDuplicates(t *testing.T) {
+	var r seqReceiver
+
+	// 第一条消息总是接收，对端可能在之前的连接中已经确认了一部分消息
+	if accept, ack := r.receive(5); !accept || ack != 5 {
+		t.Fatalf("expect first msg accepted, got accept=%v ack=%v", accept, ack)
+	}
+	if accept, ack := r.receive(5); accept || ack != 5 {
+		t.Fatalf("expect duplicate dropped, got accept=%v ack=%v", accept, ack)
+	}
+	if accept, ack := r.receive(7); accept || ack != 5 {
+		t.Fatalf("expect out of order msg dropped, got accept=%v ack=%v", accept, ack)
+	}
+	if accept, ack := r.receive(6); !accept || ack != 6 {
+		t.Fatalf("expect next msg accepted, got accept=%v ack=%v", accept, ack)
+	}
+	if accept, _ := r.receive(3); accept {
+		t.Fatal("expect old msg dropped")
+	}
+
+	r.reset()
+	if accept, ack := r.receive(1); !accept || ack != 1 {
+		t.Fatalf("expect msg accepted after reset, got accept=%v ack=%v", accept, ack)
+	}
+}
+
+func TestReliableMsgCodec(t *testing.T) {
+	data := encodeReliableMsg(iface.ReliableMsg{Seq: 42, MsgID: 300, Data: []byte("payload")})
+
+	seq, msgID, payload, err := decodeReliableMsg(data)
+	if err != nil || seq != 42 || msgID != 300 || string(payload) != "payload" {
+		t.Fatalf("unexpected decoded msg: seq=%v msgID=%v payload=%q err=%v", seq, msgID, payload, err)
+	}
+
+	if _, _, _, err = decodeReliableMsg(data[:reliableHeadLen-1]); err != ErrInvalidReliable {
+		t.Fatalf("expect ErrInvalidReliable, got %v", err)
+	}
+	if _, err = decodeReliableSeq(encodeReliableSeq(42)[:4]); err != ErrInvalidReliable {
+		t.Fatalf("expect ErrInvalidReliable, got %v", err)
+	}
+}
+
+// lossyProxy 转发客户端与服务器之间的数据，dropReplies为true时丢弃服务器发给客户端的数据
+type lossyProxy struct {
+	listener    net.Listener
+	target      string
+	dropReplies atomic.Bool
+}
+
+func startLossyProxy(t *testing.T, target string) *lossyProxy {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &lossyProxy{listener: listener, target: target}
+	go p.serve()
+	t.Cleanup(func() { _ = listener.Close() })
+
+	return p
+}
+
+func (p *lossyProxy) serve() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			_ = client.Close()
+			continue
+		}
+
+		go func() {
+			_, _ = io.Copy(server, client)
+			_ = server.Close()
+			_ = client.Close()
+		}()
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				n, err := server.Read(buf)
+				if err != nil {
+					break
+				}
+				if p.dropReplies.Load() {
+					continue
+				}
+				if _, err = client.Write(buf[:n]); err != nil {
+					break
+				}
+			}
+			_ = server.Close()
+			_ = client.Close()
+		}()
+	}
+}
+
+func (p *lossyProxy) port() int {
+	return p.listener.Addr().(*net.TCPAddr).Port
+}
+
+// countHandler 记录每条消息被处理的次数
+type countHandler struct {
+	BaseHandler
+	counts map[string]int
+	mu     sync.Mutex
+}
+
+func (h *countHandler) Handle(request iface.IRequest) {
+	h.mu.Lock()
+	h.counts[string(request.GetData())]++
+	h.mu.Unlock()
+}
+
+func (h *countHandler) total() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := 0
+	for _, count := range h.counts {
+		n += count
+	}
+
+	return n
+}
+
+func (h *countHandler) expectOnce(t *testing.T, n int) {
+	t.Helper()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.counts) != n {
+		t.Fatalf("expect %v msgs handled, got %v", n, h.counts)
+	}
+	for data, count := range h.counts {
+		if count != 1 {
+			t.Fatalf("msg %q handled %v times", data, count)
+		}
+	}
+}
+
+// testReconnect 服务器处理了客户端的可靠消息，但是确认丢失，之后客户端重连并继续发送消息
+func testReconnect(t *testing.T, session bool) (*countHandler, []iface.ReliableMsg) {
+	handler := &countHandler{counts: make(map[string]int)}
+	addr := startTestServer(t, func(s *Server) {
+		if session {
+			s.EnableSession(iface.SessionOption{})
+		}
+		s.RegisterHandler(300, handler)
+	})
+	proxy := startLossyProxy(t, addr)
+
+	iClient, err := NewClient("tcp", "127.0.0.1", proxy.port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := iClient.(*Client)
+	var failed []iface.ReliableMsg
+	var failedLock sync.Mutex
+	client.SetOnSendFailed(func(_ iface.IConnection, msg iface.ReliableMsg, _ error) {
+		failedLock.Lock()
+		failed = append(failed, msg)
+		failedLock.Unlock()
+	})
+	if session {
+		client.EnableSession()
+	}
+	go client.Start()
+	t.Cleanup(client.Stop)
+	if session {
+		waitUntil(t, "session token", func() bool { return client.GetSessionToken() != "" })
+	}
+
+	proxy.dropReplies.Store(true)
+	for i := 0; i < 5; i++ {
+		if err = client.GetConnection().SendReliable(300, []byte("msg-"+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUntil(t, "msgs handled", func() bool { return handler.total() == 5 })
+	if client.sender.len() != 5 {
+		t.Fatalf("expect 5 unacked msgs, got %v", client.sender.len())
+	}
+
+	proxy.dropReplies.Store(false)
+	if err = client.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	go client.Start()
+
+	if err = client.GetConnection().SendReliable(300, []byte("msg-5")); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "all msgs acked", func() bool { return client.sender.len() == 0 })
+
+	failedLock.Lock()
+	defer failedLock.Unlock()
+
+	return handler, append([]iface.ReliableMsg(nil), failed...)
+}
+
+func TestReconnectWithSessionHandlesOnce(t *testing.T) {
+	handler, failed := testReconnect(t, true)
+
+	// 重发的消息被服务器识别为重复的消息
+	handler.expectOnce(t, 6)
+	if len(failed) != 0 {
+		t.Fatalf("expect no failed msgs, got %+v", failed)
+	}
+}
+
+func TestReconnectWithoutSessionHandlesOnce(t *testing.T) {
+	handler, failed := testReconnect(t, false)
+
+	// 没有会话时不重发，未确认的消息发送失败
+	handler.expectOnce(t, 6)
+	if len(failed) != 5 {
+		t.Fatalf("expect 5 failed msgs, got %+v", failed)
+	}
+	for i, msg := range failed {
+		if string(msg.Data) != fmt.Sprintf("msg-%d", i) {
+			t.Fatalf("unexpected failed msg %+v", msg)
+		}
+	}
+}
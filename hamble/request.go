@@ -2,11 +2,17 @@ package hamble
 
 import (
 	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"sync/atomic"
 )
 
 type Request struct {
 	conn iface.IConnection
 	data iface.IMessage
+
+	payload  *[]byte // 从池中分配的读缓冲区，为nil则不需要归还
+	released atomic.Bool
+
+	callID uint64 // 请求ID，不是由Call发送的请求为0
 }
 
 func NewRequest(conn iface.IConnection, message iface.IMessage) iface.IRequest {
@@ -16,6 +22,15 @@ func NewRequest(conn iface.IConnection, message iface.IMessage) iface.IRequest {
 	}
 }
 
+// newPooledRequest 创建数据位于池化读缓冲区中的请求，调用Release时归还缓冲区
+func newPooledRequest(conn iface.IConnection, message iface.IMessage, payload *[]byte) *Request {
+	return &Request{
+		conn:    conn,
+		data:    message,
+		payload: payload,
+	}
+}
+
 func (req *Request) GetConnection() iface.IConnection {
 	return req.conn
 }
@@ -27,3 +42,26 @@ func (req *Request) GetData() []byte {
 func (req *Request) GetMsgID() uint32 {
 	return req.data.GetMsgID()
 }
+
+// Release 归还请求数据所在的读缓冲区，调用之后不能再使用GetData返回的数据。
+// 只有不持有请求数据的Handler才应该调用，不调用时缓冲区由GC回收
+func (req *Request) Release() {
+	if req.payload == nil || !req.released.CompareAndSwap(false, true) {
+		return
+	}
+
+	req.data.SetData(nil)
+	putPayloadBuffer(req.payload)
+}
+
+func (req *Request) GetCallID() uint64 {
+	return req.callID
+}
+
+func (req *Request) Reply(msgID uint32, data []byte) error {
+	if req.callID == 0 {
+		return req.conn.SendBufMsg(msgID, data)
+	}
+
+	return req.conn.SendBufMsg(iface.ReplyMsgID, EncodeCall(req.callID, msgID, data))
+}
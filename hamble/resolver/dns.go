@@ -0,0 +1,103 @@
+package resolver
+
+import (
+	"context"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDNSInterval = 30 * time.Second
+
+// DNSOption DNS解析的选项
+type DNSOption struct {
+	Host     string        // 域名
+	Port     int           // 查询A/AAAA记录时使用的端口
+	Service  string        // 不为空时查询SRV记录 _service._proto.host，端口由SRV记录指定
+	Proto    string        // SRV记录的协议，为空则为tcp
+	Interval time.Duration // 重新解析的间隔，为0则为30s
+	Resolver *net.Resolver // 为nil则使用net.DefaultResolver
+}
+
+// DNS 定时解析域名的A/AAAA或者SRV记录
+type DNS struct {
+	option DNSOption
+}
+
+func NewDNS(option DNSOption) *DNS {
+	if option.Proto == "" {
+		option.Proto = "tcp"
+	}
+	if option.Interval <= 0 {
+		option.Interval = defaultDNSInterval
+	}
+	if option.Resolver == nil {
+		option.Resolver = net.DefaultResolver
+	}
+
+	return &DNS{option: option}
+}
+
+func (d *DNS) Resolve(ctx context.Context) ([]iface.Endpoint, error) {
+	var addrs []string
+
+	if d.option.Service != "" {
+		_, records, err := d.option.Resolver.LookupSRV(ctx, d.option.Service, d.option.Proto, d.option.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			target := strings.TrimSuffix(record.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+		}
+	} else {
+		hosts, err := d.option.Resolver.LookupHost(ctx, d.option.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(d.option.Port)))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	return newEndpoints(addrs)
+}
+
+// Watch 每隔Interval重新解析一次，解析失败时保留之前的地址
+func (d *DNS) Watch(ctx context.Context, onChange func(endpoints []iface.Endpoint)) error {
+	go func() {
+		ticker := time.NewTicker(d.option.Interval)
+		defer ticker.Stop()
+
+		var current []iface.Endpoint
+		resolved := false
+		for {
+			endpoints, err := d.Resolve(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Warnf("resolve %s err: %v", d.option.Host, err)
+				}
+			} else if !resolved || !equalEndpoints(current, endpoints) {
+				current, resolved = endpoints, true
+				onChange(append([]iface.Endpoint(nil), endpoints...))
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package resolver
+
+import (
+	"context"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"sync"
+)
+
+// Fake 内存中的地址列表，通过Update修改，用于测试
+type Fake struct {
+	endpoints []iface.Endpoint
+	err       error
+	watchers  map[int]func(endpoints []iface.Endpoint)
+	nextID    int
+	mu        sync.Mutex
+}
+
+func NewFake(addrs ...string) (*Fake, error) {
+	endpoints, err := newEndpoints(addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Fake{
+		endpoints: endpoints,
+		watchers:  make(map[int]func(endpoints []iface.Endpoint)),
+	}, nil
+}
+
+func (f *Fake) Resolve(_ context.Context) ([]iface.Endpoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return append([]iface.Endpoint(nil), f.endpoints...), nil
+}
+
+// Watch 同步调用onChange，便于测试
+func (f *Fake) Watch(ctx context.Context, onChange func(endpoints []iface.Endpoint)) error {
+	f.mu.Lock()
+	id := f.nextID
+	f.nextID++
+	f.watchers[id] = onChange
+	endpoints := append([]iface.Endpoint(nil), f.endpoints...)
+	f.mu.Unlock()
+
+	onChange(endpoints)
+
+	go func() {
+		<-ctx.Done()
+
+		f.mu.Lock()
+		delete(f.watchers, id)
+		f.mu.Unlock()
+	}()
+
+	return nil
+}
+
+// Update 修改地址列表，地址发生变化时同步通知所有监听者
+func (f *Fake) Update(addrs ...string) error {
+	endpoints, err := newEndpoints(addrs)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	if equalEndpoints(f.endpoints, endpoints) {
+		f.mu.Unlock()
+		return nil
+	}
+	f.endpoints = endpoints
+	watchers := make([]func(endpoints []iface.Endpoint), 0, len(f.watchers))
+	for _, watcher := range f.watchers {
+		watchers = append(watchers, watcher)
+	}
+	f.mu.Unlock()
+
+	for _, watcher := range watchers {
+		watcher(append([]iface.Endpoint(nil), endpoints...))
+	}
+
+	return nil
+}
+
+// SetError 之后Resolve返回err，为nil时恢复正常
+func (f *Fake) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+}
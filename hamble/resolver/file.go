@@ -0,0 +1,95 @@
+package resolver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File 从文件中读取地址，每行一个 host:port，#之后为注释。文件发生变化时重新读取
+type File struct {
+	path string
+}
+
+func NewFile(path string) *File {
+	return &File{path: filepath.Clean(path)}
+}
+
+func (f *File) Resolve(_ context.Context) ([]iface.Endpoint, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			addrs = append(addrs, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return newEndpoints(addrs)
+}
+
+// Watch 监听文件所在的目录，兼容先写入临时文件再重命名的修改方式。读取失败时保留之前的地址
+func (f *File) Watch(ctx context.Context, onChange func(endpoints []iface.Endpoint)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(f.path)); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var current []iface.Endpoint
+		resolved := false
+		reload := func() {
+			endpoints, err := f.Resolve(ctx)
+			if err != nil {
+				logger.Warnf("resolve file %s err: %v", f.path, err)
+				return
+			}
+			if !resolved || !equalEndpoints(current, endpoints) {
+				current, resolved = endpoints, true
+				onChange(append([]iface.Endpoint(nil), endpoints...))
+			}
+		}
+
+		reload()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == f.path && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					reload()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warnf("watch file %s err: %v", f.path, err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"net"
+	"sort"
+)
+
+var ErrNoEndpoints = errors.New("no endpoints resolved")
+
+// Addrs 获取所有地址的host:port
+func Addrs(endpoints []iface.Endpoint) []string {
+	addrs := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		addrs = append(addrs, endpoint.Addr)
+	}
+
+	return addrs
+}
+
+// newEndpoints 检查地址的格式，去重并排序
+func newEndpoints(addrs []string) ([]iface.Endpoint, error) {
+	seen := make(map[string]struct{}, len(addrs))
+	endpoints := make([]iface.Endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid addr %q: %w", addr, err)
+		}
+		if _, exist := seen[addr]; exist {
+			continue
+		}
+		seen[addr] = struct{}{}
+		endpoints = append(endpoints, iface.Endpoint{Addr: addr})
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Addr < endpoints[j].Addr
+	})
+
+	return endpoints, nil
+}
+
+func equalEndpoints(a, b []iface.Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
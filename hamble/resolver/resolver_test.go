@@ -0,0 +1,182 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder 记录Watch通知的地址
+type recorder struct {
+	changes [][]string
+	mu      sync.Mutex
+}
+
+func (r *recorder) onChange(endpoints []iface.Endpoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.changes = append(r.changes, Addrs(endpoints))
+}
+
+func (r *recorder) last() (int, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.changes) == 0 {
+		return 0, nil
+	}
+
+	return len(r.changes), r.changes[len(r.changes)-1]
+}
+
+func TestNewEndpointsSortAndDedup(t *testing.T) {
+	endpoints, err := newEndpoints([]string{"10.0.0.2:80", "10.0.0.1:80", "10.0.0.2:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Addrs(endpoints); !reflect.DeepEqual(got, []string{"10.0.0.1:80", "10.0.0.2:80"}) {
+		t.Fatalf("unexpected endpoints %v", got)
+	}
+
+	if _, err = newEndpoints([]string{"10.0.0.1"}); err == nil {
+		t.Fatal("addr without port should be invalid")
+	}
+}
+
+func TestFakeWatch(t *testing.T) {
+	fake, err := NewFake("10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var r recorder
+	if err = fake.Watch(ctx, r.onChange); err != nil {
+		t.Fatal(err)
+	}
+
+	// Watch同步通知当前的地址
+	if n, addrs := r.last(); n != 1 || !reflect.DeepEqual(addrs, []string{"10.0.0.1:80"}) {
+		t.Fatalf("expect initial addrs, got %v %v", n, addrs)
+	}
+
+	if err = fake.Update("10.0.0.2:80", "10.0.0.1:80"); err != nil {
+		t.Fatal(err)
+	}
+	if n, addrs := r.last(); n != 2 || !reflect.DeepEqual(addrs, []string{"10.0.0.1:80", "10.0.0.2:80"}) {
+		t.Fatalf("expect updated addrs, got %v %v", n, addrs)
+	}
+
+	// 地址没有变化时不通知
+	if err = fake.Update("10.0.0.1:80", "10.0.0.2:80"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := r.last(); n != 2 {
+		t.Fatalf("expect no notification for the same addrs, got %v", n)
+	}
+
+	if err = fake.Update("bad addr"); err == nil {
+		t.Fatal("expect error for invalid addr")
+	}
+
+	// ctx结束之后不再通知
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for {
+		fake.mu.Lock()
+		watchers := len(fake.watchers)
+		fake.mu.Unlock()
+		if watchers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watcher not removed after ctx done")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_ = fake.Update("10.0.0.3:80")
+	if n, _ := r.last(); n != 2 {
+		t.Fatalf("expect no notification after ctx done, got %v", n)
+	}
+}
+
+func TestFakeSetError(t *testing.T) {
+	fake, _ := NewFake("10.0.0.1:80")
+	resolveErr := errors.New("resolve failed")
+
+	fake.SetError(resolveErr)
+	if _, err := fake.Resolve(context.Background()); err != resolveErr {
+		t.Fatalf("expect %v, got %v", resolveErr, err)
+	}
+
+	fake.SetError(nil)
+	endpoints, err := fake.Resolve(context.Background())
+	if err != nil || len(endpoints) != 1 {
+		t.Fatalf("expect endpoints after clearing error, got %v %v", endpoints, err)
+	}
+}
+
+func TestStatic(t *testing.T) {
+	static, err := NewStatic("10.0.0.2:80", "10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r recorder
+	_ = static.Watch(context.Background(), r.onChange)
+	if n, addrs := r.last(); n != 1 || !reflect.DeepEqual(addrs, []string{"10.0.0.1:80", "10.0.0.2:80"}) {
+		t.Fatalf("unexpected addrs %v %v", n, addrs)
+	}
+}
+
+func TestFileResolveAndWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints")
+	write := func(content string) {
+		t.Helper()
+		// 先写入临时文件再重命名
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# backends\n10.0.0.1:80\n\n  10.0.0.2:80  # second\n")
+
+	file := NewFile(path)
+	endpoints, err := file.Resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Addrs(endpoints); !reflect.DeepEqual(got, []string{"10.0.0.1:80", "10.0.0.2:80"}) {
+		t.Fatalf("unexpected addrs %v", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var r recorder
+	if err = file.Watch(ctx, r.onChange); err != nil {
+		t.Fatal(err)
+	}
+
+	write("10.0.0.3:80\n")
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, addrs := r.last(); reflect.DeepEqual(addrs, []string{"10.0.0.3:80"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			_, addrs := r.last()
+			t.Fatalf("file change not watched, last addrs %v", addrs)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
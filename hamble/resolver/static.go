@@ -0,0 +1,31 @@
+package resolver
+
+import (
+	"context"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+)
+
+// Static 固定的地址列表
+type Static struct {
+	endpoints []iface.Endpoint
+}
+
+func NewStatic(addrs ...string) (*Static, error) {
+	endpoints, err := newEndpoints(addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Static{endpoints: endpoints}, nil
+}
+
+func (s *Static) Resolve(_ context.Context) ([]iface.Endpoint, error) {
+	return append([]iface.Endpoint(nil), s.endpoints...), nil
+}
+
+// Watch 地址不会变化，只调用一次onChange
+func (s *Static) Watch(_ context.Context, onChange func(endpoints []iface.Endpoint)) error {
+	onChange(append([]iface.Endpoint(nil), s.endpoints...))
+
+	return nil
+}
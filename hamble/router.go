@@ -1,27 +1,53 @@
 package hamble
 
 import (
+	"errors"
 	"fmt"
 	"github.com/dawnzzz/hamble-tcp-server/conf"
 	"github.com/dawnzzz/hamble-tcp-server/iface"
 	"github.com/dawnzzz/hamble-tcp-server/logger"
 	"sync"
+	"sync/atomic"
 )
 
+var (
+	ErrTaskQueueFull     = errors.New("worker task queue is full")
+	ErrWorkerPoolStopped = errors.New("worker pool is stopped")
+	ErrDuplicateHandler  = errors.New("handler register duplicate")
+)
+
+// exiter 可以通知退出的连接，不会在调用者的协程中关闭连接
+type exiter interface {
+	exit()
+}
+
 type Router struct {
 	apis map[uint32]iface.IHandler
 	mu   sync.Mutex
 
+	ranges []rangeRoute // AddRangeRouter注册的路由，由mu保护
+
 	workerPoolSize int                   // worker 的数量
 	taskQueues     []chan iface.IRequest // Worker 负责取任务的消息队列
+	started        atomic.Bool           // Worker池是否已经启动
+	stopChan       chan struct{}         // 关闭时通知所有Worker退出，由mu保护
+
+	metrics iface.IMetrics
+}
+
+// rangeRoute 一个MsgID范围的路由
+type rangeRoute struct {
+	min, max uint32
+	handler  iface.IHandler
 }
 
-func newRouter() iface.IRouter {
+func newRouter(metrics iface.IMetrics) iface.IRouter {
 	return &Router{
-		apis: make(map[uint32]iface.IHandler),
+		apis:    make(map[uint32]iface.IHandler),
+		metrics: metrics,
 
-		workerPoolSize: conf.GlobalProfile.WorkerPoolSize,
-		taskQueues:     make([]chan iface.IRequest, conf.GlobalProfile.WorkerPoolSize),
+		workerPoolSize: conf.Current().WorkerPoolSize,
+		taskQueues:     make([]chan iface.IRequest, conf.Current().WorkerPoolSize),
 	}
 }
 
@@ -37,6 +63,41 @@ func (r *Router) AddRouter(id uint32, handler iface.IHandler) {
 	r.apis[id] = handler
 }
 
+func (r *Router) AddRouters(handlers map[uint32]iface.IHandler) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id := range handlers {
+		if _, exist := r.apis[id]; exist {
+			return fmt.Errorf("%w: %v", ErrDuplicateHandler, id)
+		}
+	}
+
+	for id, handler := range handlers {
+		r.apis[id] = handler
+	}
+
+	return nil
+}
+
+func (r *Router) AddRangeRouter(min, max uint32, handler iface.IHandler) {
+	if min > max {
+		panic(fmt.Sprintf("invalid handler range [%v, %v]", min, max))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, route := range r.ranges {
+		if min <= route.max && route.min <= max {
+			// 范围不能重叠
+			panic(fmt.Sprintf("[%v, %v] handler register overlaps [%v, %v]", min, max, route.min, route.max))
+		}
+	}
+
+	r.ranges = append(r.ranges, rangeRoute{min: min, max: max, handler: handler})
+}
+
 func (r *Router) GetHandler(id uint32) iface.IHandler {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -45,6 +106,12 @@ func (r *Router) GetHandler(id uint32) iface.IHandler {
 		return handler
 	}
 
+	for _, route := range r.ranges {
+		if route.min <= id && id <= route.max {
+			return route.handler
+		}
+	}
+
 	return &BaseHandler{}
 }
 
@@ -56,7 +123,7 @@ func (r *Router) DoHandler(request iface.IRequest) {
 	handler.PostHandle(request)
 }
 
-func (r *Router) startOneWorker(workerID int, taskQueue chan iface.IRequest) {
+func (r *Router) startOneWorker(workerID int, taskQueue chan iface.IRequest, stopChan chan struct{}) {
 	logger.Infof("Worker ID = %v is started", workerID)
 
 	//不断等待队列中的消息
@@ -65,25 +132,151 @@ func (r *Router) startOneWorker(workerID int, taskQueue chan iface.IRequest) {
 		//有消息则取出队列的Request，并执行绑定的业务方法
 		case request := <-taskQueue:
 			r.DoHandler(request)
+		case <-stopChan:
+			logger.Infof("Worker ID = %v is stopped", workerID)
+			return
 		}
 	}
 }
 
 func (r *Router) StartWorkerPool() {
+	if r.workerPoolSize <= 0 || !r.started.CompareAndSwap(false, true) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stopChan = make(chan struct{})
 	for i := 0; i < r.workerPoolSize; i++ {
 		//给当前worker对应的任务队列开辟空间
-		r.taskQueues[i] = make(chan iface.IRequest, conf.GlobalProfile.MaxWorkerTaskLen)
+		r.taskQueues[i] = make(chan iface.IRequest, conf.Current().MaxWorkerTaskLen)
 
 		// 开启worker
-		go r.startOneWorker(i, r.taskQueues[i])
+		go r.startOneWorker(i, r.taskQueues[i], r.stopChan)
 	}
 }
 
-func (r *Router) SendMsgToTaskQueue(request iface.IRequest) {
+func (r *Router) StopWorkerPool() {
+	if !r.started.CompareAndSwap(true, false) {
+		return
+	}
+
+	r.mu.Lock()
+	close(r.stopChan)
+	taskQueues := make([]chan iface.IRequest, len(r.taskQueues))
+	copy(taskQueues, r.taskQueues)
+	for i := range r.taskQueues {
+		r.taskQueues[i] = nil
+	}
+	r.mu.Unlock()
+
+	// 归还还没有处理的请求
+	for _, taskQueue := range taskQueues {
+		r.releaseTasks(taskQueue)
+	}
+}
+
+// releaseTasks 取出任务队列中的所有请求并归还请求数据
+func (r *Router) releaseTasks(taskQueue chan iface.IRequest) {
+	for {
+		select {
+		case request := <-taskQueue:
+			request.Release()
+			r.metrics.Inc(iface.MetricTaskDropped)
+		default:
+			return
+		}
+	}
+}
+
+// taskQueue 获取处理该MsgID的Worker的任务队列，Worker池没有启动时taskQueue为nil
+func (r *Router) taskQueue(msgID uint32) (taskQueue chan iface.IRequest, stopChan chan struct{}, workerID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	workerID = int(msgID) % r.workerPoolSize
+
+	return r.taskQueues[workerID], r.stopChan, workerID
+}
+
+func (r *Router) WorkerPoolStarted() bool {
+	return r.started.Load()
+}
+
+// trySendMsgToTaskQueue 不阻塞地将请求发送给Worker的任务队列，任务队列已满时返回false
+func (r *Router) trySendMsgToTaskQueue(request iface.IRequest) bool {
+	taskQueue, _, _ := r.taskQueue(request.GetMsgID())
+	if taskQueue == nil {
+		return false
+	}
+
+	select {
+	case taskQueue <- request:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendMsgToTaskQueue 将请求发送给Worker的任务队列，任务队列满时按照配置的溢出策略处理
+func (r *Router) SendMsgToTaskQueue(request iface.IRequest) error {
 	//根据ConnID来分配当前的连接应该由哪个worker负责处理
 
-	workerID := int(request.GetMsgID()) % r.workerPoolSize
+	taskQueue, stopChan, workerID := r.taskQueue(request.GetMsgID())
+	if taskQueue == nil {
+		return ErrWorkerPoolStopped
+	}
 	logger.Infof("Add request msgID=%v to workerID=%v", request.GetMsgID(), workerID)
+
 	//将请求消息发送给任务队列
-	r.taskQueues[workerID] <- request
+	switch conf.Current().TaskQueuePolicy {
+	case OverflowPolicyDropNewest:
+		select {
+		case taskQueue <- request:
+		default:
+			r.metrics.Inc(iface.MetricTaskDropped)
+			return ErrTaskQueueFull
+		}
+	case OverflowPolicyDropOldest:
+		for {
+			select {
+			case taskQueue <- request:
+				return nil
+			default:
+				// 丢弃最早的请求，腾出位置
+				select {
+				case dropped := <-taskQueue:
+					dropped.Release()
+					r.metrics.Inc(iface.MetricTaskDropped)
+				default:
+				}
+			}
+		}
+	case OverflowPolicyDisconnect:
+		select {
+		case taskQueue <- request:
+		default:
+			// 任务队列已满，断开发送请求的连接
+			logger.Warnf("task queue of worker %v is full, disconnect %s", workerID, request.GetConnection().RemoteAddr())
+			r.metrics.Inc(iface.MetricTaskDropped)
+			r.metrics.Inc(iface.MetricSlowConsumer)
+			// 调用者可能是连接的读协程或者事件循环，不能在这里同步关闭连接
+			if conn, ok := request.GetConnection().(exiter); ok {
+				conn.exit()
+			} else {
+				go request.GetConnection().Stop()
+			}
+			return ErrTaskQueueFull
+		}
+	default:
+		select {
+		case taskQueue <- request:
+		case <-stopChan:
+			// 等待期间Worker池已经关闭，不会再有Worker处理该请求
+			return ErrWorkerPoolStopped
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,85 @@
+package hamble
+
+import (
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"testing"
+	"time"
+)
+
+type blockingHandler struct {
+	BaseHandler
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (h *blockingHandler) Handle(iface.IRequest) {
+	h.started <- struct{}{}
+	<-h.unblock
+}
+
+func TestStopWorkerPoolReleasesQueuedRequests(t *testing.T) {
+	metrics := NewMetrics()
+	r := newRouter(metrics).(*Router)
+	handler := &blockingHandler{started: make(chan struct{}, 1), unblock: make(chan struct{})}
+	r.AddRouter(0, handler)
+	r.StartWorkerPool()
+
+	// 第一个请求占住Worker，之后的请求留在任务队列中
+	if err := r.SendMsgToTaskQueue(NewRequest(nil, NewMessage(0, nil))); err != nil {
+		t.Fatal(err)
+	}
+	<-handler.started
+
+	queued := make([]*Request, 3)
+	for i := range queued {
+		queued[i] = newPooledRequest(nil, NewMessage(0, []byte("queued")), getPayloadBuffer(8))
+		if err := r.SendMsgToTaskQueue(queued[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r.StopWorkerPool()
+	close(handler.unblock)
+
+	for i, request := range queued {
+		if !request.released.Load() {
+			t.Fatalf("queued request %v not released after stopping worker pool", i)
+		}
+	}
+	if dropped := metrics.Get(iface.MetricTaskDropped); dropped != uint64(len(queued)) {
+		t.Fatalf("expect %v dropped tasks, got %v", len(queued), dropped)
+	}
+
+	if err := r.SendMsgToTaskQueue(NewRequest(nil, NewMessage(0, nil))); err != ErrWorkerPoolStopped {
+		t.Fatalf("expect ErrWorkerPoolStopped, got %v", err)
+	}
+	if r.trySendMsgToTaskQueue(NewRequest(nil, NewMessage(0, nil))) {
+		t.Fatal("try send should fail after stopping worker pool")
+	}
+
+	// 重新启动之后可以继续处理请求
+	r.StartWorkerPool()
+	defer r.StopWorkerPool()
+	if err := r.SendMsgToTaskQueue(NewRequest(nil, NewMessage(0, nil))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handler.started:
+	case <-time.After(time.Second):
+		t.Fatal("request not handled after restarting worker pool")
+	}
+}
+
+func TestServerStopStopsWorkerPool(t *testing.T) {
+	var server *Server
+	startTestServer(t, func(s *Server) { server = s })
+	r := server.GetRouter().(*Router)
+	if r.workerPoolSize <= 0 || !r.started.Load() {
+		t.Fatalf("expect worker pool started, size=%v", r.workerPoolSize)
+	}
+
+	server.Stop()
+	if r.started.Load() {
+		t.Fatal("expect worker pool stopped with the server")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"github.com/dawnzzz/hamble-tcp-server/conf"
 	"github.com/dawnzzz/hamble-tcp-server/hamble/heartbeat"
+	"github.com/dawnzzz/hamble-tcp-server/hamble/timer"
 	"github.com/dawnzzz/hamble-tcp-server/iface"
 	"github.com/dawnzzz/hamble-tcp-server/logger"
 	"github.com/dawnzzz/hamble-tcp-server/utils"
@@ -33,39 +34,33 @@ type Server struct {
 	wg          sync.WaitGroup
 	closingChan chan struct{} // 发送退出信号
 
-	useTLS bool
-}
+	useTLS    bool
+	tlsConfig *tls.Config
 
-func NewServer() iface.IServer {
-	conf.Reload() // 加载配置文件
+	logWriter *logger.RotateWriter // 日志文件，未配置日志文件时为nil
 
-	ctx, cancel := context.WithCancel(context.Background())
+	connLimiter   *connLimiter       // 按IP和网段限制连接数
+	acceptLimiter *TokenBucket       // 限制接受连接的速率
+	onConnReject  iface.OnConnReject // 拒绝连接时的Hook函数
+	ipFilter      *IPFilter          // 黑白名单
+	onAccept      iface.OnAccept     // 连接准入的Hook函数
 
-	router := newRouter()
+	sessions *sessionManager // 会话管理，调用EnableSession之后才会为连接创建会话
+	outbox   outbox          // 离线消息，按客户端身份投递
 
-	s := &Server{
-		CSBase: CSBase{
-			router:      router,
-			dataPack:    NewDataPack(),
-			connManager: NewConnManager(),
-		},
+	topics          *topicTree            // 所有连接的订阅
+	topicAuthorizer iface.TopicAuthorizer // 主题的授权Hook函数
 
-		Name:    conf.GlobalProfile.Name,
-		Version: conf.GlobalProfile.TcpVersion,
-		IP:      conf.GlobalProfile.Host,
-		Port:    conf.GlobalProfile.Port,
+	gatewaySecret string // 作为网关的后端，网关连接认证使用的共享密钥，为空时不处理网关转发的消息
 
-		ctx:         ctx,
-		cancel:      cancel,
-		closingChan: make(chan struct{}, 1),
-	}
+	configOnce    sync.Once // 每个服务器只注册一次配置变化的回调函数
+	unwatchConfig func()    // 取消注册配置变化的回调函数，Stop时调用
+}
 
-	logger.WithFields(logrus.Fields{
-		"TCPServer": "Hamble",
-		"Name":      s.Name,
-	})
+func NewServer() iface.IServer {
+	conf.Reload() // 加载配置文件
 
-	return s
+	return newServer()
 }
 
 func NewTLSServer() iface.IServer {
@@ -76,28 +71,88 @@ func NewTLSServer() iface.IServer {
 	return s
 }
 
+// NewServerWithConfigFile 使用指定的配置文件创建服务器，支持 yaml/yml/json/toml 格式
+func NewServerWithConfigFile(path string) (iface.IServer, error) {
+	if err := conf.Load(path); err != nil {
+		return nil, err
+	}
+
+	return newServer(), nil
+}
+
+func NewTLSServerWithConfigFile(path string) (iface.IServer, error) {
+	iServer, err := NewServerWithConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s, _ := iServer.(*Server)
+	s.useTLS = true
+
+	return s, nil
+}
+
 func NewServerWithOption(option *conf.Profile) iface.IServer {
 	conf.BindProfile(option)
 
+	return newServer()
+}
+
+func NewTLSServerWithOption(option *conf.Profile) iface.IServer {
+	iServer := NewServerWithOption(option)
+
+	s, _ := iServer.(*Server)
+	s.useTLS = true
+
+	return s
+}
+
+func newServer() *Server {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	router := newRouter()
+	metrics := NewMetrics()
+	router := newRouter(metrics)
 
 	s := &Server{
 		CSBase: CSBase{
 			router:      router,
 			dataPack:    NewDataPack(),
 			connManager: NewConnManager(),
+			metrics:     metrics,
+			scheduler:   timer.NewScheduler(),
 		},
 
-		Name:    conf.GlobalProfile.Name,
-		Version: conf.GlobalProfile.TcpVersion,
-		IP:      conf.GlobalProfile.Host,
-		Port:    conf.GlobalProfile.Port,
+		Name:    conf.Current().Name,
+		Version: conf.Current().TcpVersion,
+		IP:      conf.Current().Host,
+		Port:    conf.Current().Port,
 
 		ctx:         ctx,
 		cancel:      cancel,
 		closingChan: make(chan struct{}, 1),
+
+		acceptLimiter: NewTokenBucket(conf.Current().AcceptRate, conf.Current().AcceptBurst),
+	}
+
+	limiter, err := newConnLimiter(conf.Current().MaxConnPerIP, conf.Current().CIDRConnLimits)
+	if err != nil {
+		logger.Errorf("invalid cidr conn limits: %v, ignore them", err)
+		limiter, _ = newConnLimiter(conf.Current().MaxConnPerIP, nil)
+	}
+	s.connLimiter = limiter
+	s.sessions = newSessionManager(s)
+	s.topics = newTopicTree()
+	s.registerTopicHandler()
+
+	ipFilter, err := NewIPFilter(conf.Current().AllowList, conf.Current().DenyList)
+	if err != nil {
+		logger.Errorf("invalid allow/deny list: %v, ignore them", err)
+		ipFilter, _ = NewIPFilter(nil, nil)
+	}
+	s.ipFilter = ipFilter
+
+	if err := s.loadRateRules(conf.Current()); err != nil {
+		logger.Errorf("invalid rate limits: %v, ignore them", err)
 	}
 
 	logger.WithFields(logrus.Fields{
@@ -108,15 +163,6 @@ func NewServerWithOption(option *conf.Profile) iface.IServer {
 	return s
 }
 
-func NewTLSServerWithOption(option *conf.Profile) iface.IServer {
-	iServer := NewServerWithOption(option)
-
-	s, _ := iServer.(*Server)
-	s.useTLS = true
-
-	return s
-}
-
 const banner = `
  ___  ___  ________  _____ ______   ________  ___       _______      
 |\  \|\  \|\   __  \|\   _ \  _   \|\   __  \|\  \     |\  ___ \     
@@ -130,16 +176,26 @@ const url = "https://github.com/dawnzzz/hamble-tcp-server"
 
 // Start 开启hamble TCP 服务器，当调用此函数时，当前协程会阻塞住进行TCP服务
 func (s *Server) Start() {
-	if conf.GlobalProfile.LogFileName != "" {
-		logFile, err := os.OpenFile(conf.GlobalProfile.LogFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if conf.Current().LogFileName != "" {
+		logWriter, err := logger.NewRotateWriter(conf.Current().LogFileName, logger.RotateOption{
+			MaxSize:    conf.Current().LogMaxSize,
+			Interval:   conf.Current().GetLogRotateTime(),
+			MaxBackups: conf.Current().LogMaxBackups,
+			Compress:   conf.Current().LogCompress,
+		})
 		if err != nil {
-			logger.Error("open log file [%s] err: %v", conf.GlobalProfile.LogFileName, err.Error())
+			logger.Errorf("open log file [%s] err: %v", conf.Current().LogFileName, err.Error())
 		} else {
-			logger.SetMultiOutPut(logFile)
+			s.logWriter = logWriter
+			logger.SetMultiOutPut(logWriter)
 		}
 	}
 
-	if conf.GlobalProfile.PrintBanner {
+	if err := logger.SetLevel(conf.Current().LogLevel); err != nil {
+		logger.Errorf("set log level err: %v", err)
+	}
+
+	if conf.Current().PrintBanner {
 		fmt.Printf("%s\n\npowered by %s\n\n", banner, url)
 	}
 
@@ -151,13 +207,27 @@ func (s *Server) Start() {
 
 	logger.Infof("server start")
 
+	// 配置发生变化时应用到服务器
+	s.configOnce.Do(func() {
+		s.unwatchConfig = conf.OnConfigChange(s.onConfigChange)
+	})
+	if conf.Current().WatchConfig {
+		conf.Watch()
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
-	// 开启一个协程监听退出信号
+	// 开启一个协程监听信号
 	go func() {
-		select {
-		case <-sigChan:
+		for sig := range sigChan {
+			if sig == syscall.SIGHUP {
+				// SIGHUP 表示重新加载，不退出服务器
+				s.reload()
+				continue
+			}
+
 			// 收到退出信号，向closingChan中发送消息，表示需要退出TCP服务器
+			signal.Stop(sigChan)
 			s.closingChan <- struct{}{}
 			close(s.closingChan)
 			return
@@ -193,61 +263,108 @@ func (s *Server) Stop() {
 
 	// 退出之前关闭全部连接，实现优雅的关闭
 	s.connManager.Clear()
+	s.router.StopWorkerPool()
+	s.scheduler.Stop()
+
+	// 在Start之前调用时，之后的Start也不会再注册回调函数
+	s.configOnce.Do(func() {})
+	if s.unwatchConfig != nil {
+		s.unwatchConfig()
+	}
 
 	// 调用cancel取消
 	s.cancel()
 }
 
+// reload 收到SIGHUP信号时调用，重新打开日志文件并重新加载配置文件
+func (s *Server) reload() {
+	if s.logWriter != nil {
+		if err := s.logWriter.Reopen(); err != nil {
+			logger.Errorf("reopen log file [%s] err: %v", conf.Current().LogFileName, err.Error())
+		} else {
+			logger.Infof("log file [%s] reopened", conf.Current().LogFileName)
+		}
+	}
+
+	if err := conf.Refresh(); err != nil && !errors.Is(err, conf.ErrConfigNotLoaded) {
+		logger.Errorf("reload config err: %v, keep the previous config", err)
+	}
+}
+
+// onConfigChange 配置文件发生变化时调用
+func (s *Server) onConfigChange(old, new *conf.Profile) {
+	if old.LogLevel != new.LogLevel {
+		if err := logger.SetLevel(new.LogLevel); err != nil {
+			logger.Errorf("set log level err: %v", err)
+		}
+	}
+
+	if err := s.connLimiter.reload(new.MaxConnPerIP, new.CIDRConnLimits); err != nil {
+		logger.Errorf("reload conn limits err: %v", err)
+	}
+	s.acceptLimiter.SetRate(new.AcceptRate, new.AcceptBurst)
+	if err := s.ipFilter.Reload(new.AllowList, new.DenyList); err != nil {
+		logger.Errorf("reload allow/deny list err: %v", err)
+	}
+	if err := s.loadRateRules(new); err != nil {
+		logger.Errorf("reload rate limits err: %v", err)
+	}
+
+	logger.Infof("config changed: max_conn=%v max_packet_size=%v max_heartbeat_time=%v log_level=%v",
+		new.MaxConn, new.MaxPacketSize, new.MaxHeartbeatTime, new.LogLevel)
+}
+
 func (s *Server) Serve() {
 	defer s.wg.Done() // 通知主线程退出
 
-	var listener net.Listener
 	if s.useTLS {
 		// 使用 TLS 加密
 
 		// 必要时生成私钥和证书文件
-		if !utils.IsFileExist(conf.GlobalProfile.CrtFileName) && !utils.IsFileExist(conf.GlobalProfile.KeyFileName) {
-			err := utils.GenerateCrtAndKeyFile(conf.GlobalProfile.CrtFileName, conf.GlobalProfile.KeyFileName)
+		if !utils.IsFileExist(conf.Current().CrtFileName) && !utils.IsFileExist(conf.Current().KeyFileName) {
+			err := utils.GenerateCrtAndKeyFile(conf.Current().CrtFileName, conf.Current().KeyFileName)
 			if err != nil {
 				logger.Errorf("create crt and private key err: %v", err.Error())
 				return
 			}
 		}
 
-		if !utils.IsFileExist(conf.GlobalProfile.CrtFileName) || !utils.IsFileExist(conf.GlobalProfile.KeyFileName) {
+		if !utils.IsFileExist(conf.Current().CrtFileName) || !utils.IsFileExist(conf.Current().KeyFileName) {
 			logger.Error("CRT file and PrivateKey File must both exist or both not exist!!!")
 		}
 
 		// 读取证书和密钥
-		crt, err := tls.LoadX509KeyPair(conf.GlobalProfile.CrtFileName, conf.GlobalProfile.KeyFileName)
+		crt, err := tls.LoadX509KeyPair(conf.Current().CrtFileName, conf.Current().KeyFileName)
 		if err != nil {
 			logger.Errorf("load x509 err: %v", err.Error())
 			return
 		}
 
-		// TLS连接
+		// TLS连接，通过准入检查之后才进行TLS握手
 		tlsConfig := &tls.Config{}
 		tlsConfig.Certificates = []tls.Certificate{crt}
 		tlsConfig.Time = time.Now
 		tlsConfig.Rand = rand.Reader
-		listener, err = tls.Listen(s.Version, fmt.Sprintf("%s:%d", s.IP, s.Port), tlsConfig)
-		if err != nil {
-			logger.Errorf("listen tcp tls err: %v", err)
-			return
-		}
-	} else {
-		// 开始正常的服务
-		addr, err := net.ResolveTCPAddr(s.Version, fmt.Sprintf("%s:%d", s.IP, s.Port))
-		if err != nil {
-			logger.Error("resolve tcp addr err,", err)
-			return
-		}
+		s.tlsConfig = tlsConfig
+	}
 
-		listener, err = net.ListenTCP(s.Version, addr)
-		if err != nil {
-			logger.Error("listen tcp err,", err)
-			return
-		}
+	addr, err := net.ResolveTCPAddr(s.Version, fmt.Sprintf("%s:%d", s.IP, s.Port))
+	if err != nil {
+		logger.Error("resolve tcp addr err,", err)
+		return
+	}
+
+	listener, err := net.ListenTCP(s.Version, addr)
+	if err != nil {
+		logger.Error("listen tcp err,", err)
+		return
+	}
+
+	loops := s.newEventLoopGroup()
+	if loops != nil {
+		defer func() {
+			_ = loops.close()
+		}()
 	}
 
 	// 开启一个协程检查退出信号
@@ -276,20 +393,156 @@ func (s *Server) Serve() {
 			continue
 		}
 
-		if s.connManager.Len() >= conf.GlobalProfile.MaxConn {
-			// 超过了最大连接数，直接关闭连接
-			_ = tcpConn.Close()
+		if ok, reason, detail := s.admit(tcpConn); !ok {
+			// 不接受连接，拒绝之后关闭
+			s.rejectConn(tcpConn, reason, detail)
 			continue
 		}
 
-		conn := newConnection(tcpConn, s)
-		go func() {
-			defer func() {
-				conn.Stop()
-			}()
-			conn.Start() // 连接开始工作
+		if s.onAccept == nil {
+			s.acceptConn(tcpConn, loops)
+			continue
+		}
+
+		// OnAccept可能比较慢，在新的协程中调用，不能阻塞accept
+		go func(tcpConn net.Conn) {
+			if allow, reason := s.onAccept(tcpConn); !allow {
+				s.rejectConn(tcpConn, RejectReasonOnAccept, reason)
+				return
+			}
+			if s.ctx.Err() != nil {
+				// 服务器已经停止
+				_ = tcpConn.Close()
+				return
+			}
+
+			s.acceptConn(tcpConn, loops)
+		}(tcpConn)
+	}
+}
+
+// acceptConn 检查连接数限制，通过之后创建连接并开始工作
+func (s *Server) acceptConn(tcpConn net.Conn, loops *eventLoopGroup) {
+	if ok, reason := s.acquireConn(tcpConn); !ok {
+		s.rejectConn(tcpConn, reason, reason)
+		return
+	}
+	s.metrics.Inc(iface.MetricConnAccepted)
+
+	ip := remoteIP(tcpConn)
+	if loops != nil {
+		// epoll 模式，由事件循环负责读写
+		conn, err := newLoopConnection(tcpConn.(*net.TCPConn), s, loops.pick())
+		if err != nil {
+			logger.Errorf("create connection from %s err: %v", tcpConn.RemoteAddr(), err)
+			_ = tcpConn.Close()
+			s.connLimiter.release(ip)
+			return
+		}
+		conn.onStopped = func() {
+			s.connLimiter.release(ip)
+		}
+		conn.sessions = s.sessions
+		conn.topics = s.topics
+		conn.gatewaySecret = s.gatewaySecret
+		conn.rateRules = &s.rateRules
+		go conn.Start()
+		return
+	}
+
+	netConn := tcpConn
+	if s.tlsConfig != nil {
+		netConn = tls.Server(tcpConn, s.tlsConfig)
+	}
+
+	conn := newConnection(netConn, s)
+	conn.sessions = s.sessions
+	conn.topics = s.topics
+	conn.gatewaySecret = s.gatewaySecret
+	conn.rateRules = &s.rateRules
+	go func() {
+		defer func() {
+			conn.Stop()
+			s.connLimiter.release(ip)
 		}()
+		conn.Start() // 连接开始工作
+	}()
+}
+
+// newEventLoopGroup 配置为 epoll 模式时创建事件循环，不支持时退回到 goroutine 模式并返回nil
+func (s *Server) newEventLoopGroup() *eventLoopGroup {
+	if conf.Current().NetworkMode != NetworkModeEpoll {
+		return nil
+	}
+
+	if s.tlsConfig != nil {
+		logger.Warn("epoll network mode does not support TLS, fall back to goroutine mode")
+		return nil
+	}
+
+	loops, err := newEventLoopGroup(conf.Current().EventLoopNum)
+	if err != nil {
+		logger.Warnf("create event loops err: %v, fall back to goroutine mode", err)
+		return nil
+	}
+	logger.Infof("network mode epoll with %d event loops", len(loops.loops))
+
+	return loops
+}
+
+// admit 在accept的协程中检查是否接受新的连接，只进行不会阻塞的检查。
+// 不接受时返回拒绝的原因reason，以及告诉客户端的详细原因detail
+func (s *Server) admit(conn net.Conn) (ok bool, reason string, detail string) {
+	if !s.ipFilter.Allowed(remoteIP(conn)) {
+		return false, RejectReasonIPDenied, RejectReasonIPDenied
+	}
+
+	if !s.acceptLimiter.Allow() {
+		return false, RejectReasonAcceptRate, RejectReasonAcceptRate
 	}
+
+	return true, "", ""
+}
+
+// acquireConn 通过OnAccept之后检查最大连接数，并计入IP和网段的连接数，在TLS握手之前进行
+func (s *Server) acquireConn(conn net.Conn) (ok bool, reason string) {
+	if s.connManager.Len() >= conf.Current().MaxConn {
+		return false, RejectReasonMaxConn
+	}
+
+	return s.connLimiter.acquire(remoteIP(conn))
+}
+
+// rejectConn 拒绝连接，必要时告诉客户端拒绝的原因。被黑白名单拒绝的连接直接关闭
+func (s *Server) rejectConn(conn net.Conn, reason string, detail string) {
+	s.metrics.Inc(iface.MetricConnRejected)
+	s.metrics.Inc(iface.MetricConnRejected + "_" + reason)
+	logger.Warnf("reject connection from %s: %s", conn.RemoteAddr(), detail)
+
+	if s.onConnReject != nil {
+		s.onConnReject(conn, detail)
+	}
+
+	if !conf.Current().SendRejectFrame || reason == RejectReasonIPDenied {
+		_ = conn.Close()
+		return
+	}
+
+	// 发送拒绝原因可能阻塞，不能影响accept
+	go func() {
+		if s.tlsConfig != nil {
+			conn = tls.Server(conn, s.tlsConfig)
+		}
+		defer conn.Close()
+
+		packet, err := s.dataPack.Pack(NewMessage(iface.ConnRejectMsgID, []byte(detail)))
+		if err != nil {
+			return
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Write(packet)
+	}()
 }
 
 func (s *Server) RegisterHandler(id uint32, handler iface.IHandler) {
@@ -324,40 +577,21 @@ func (s *Server) CallOnConnStop(conn iface.IConnection) {
 	}
 }
 
-func (s *Server) StartHeartbeat(interval time.Duration) {
-	s.checker = heartbeat.NewHearBeatChecker(interval)
-	s.RegisterHandler(iface.DefaultHeartbeatMsgID, &heartbeat.DefaultHandler{})
+// AdviseHeartbeat 要求客户端调整心跳间隔，超时时间为服务器的 max_heartbeat_time
+func (s *Server) AdviseHeartbeat(conn iface.IConnection, interval time.Duration) error {
+	return heartbeat.Advertise(conn, interval, conf.Current().GetMaxHeartbeatTime())
 }
 
-func (s *Server) StartHeartbeatWithOption(option iface.CheckerOption) {
-	if option.Interval <= 0 {
-		logger.Fatal("heartbeat checker interval must > 0")
-		return
-	}
-
-	s.checker = heartbeat.NewHearBeatChecker(option.Interval)
-
-	if option.OnRemoteNotAlive != nil {
-		s.checker.SetOnRemoteNotAlive(option.OnRemoteNotAlive)
-	}
-
-	if option.HeartbeatMsgFunc != nil {
-		s.checker.SetOnRemoteNotAlive(option.OnRemoteNotAlive)
-	}
-
-	if option.HeartBeatFunc != nil {
-		s.checker.SetHeartbeatFunc(option.HeartBeatFunc)
-	}
+func (s *Server) SetOnConnReject(f iface.OnConnReject) {
+	s.onConnReject = f
+}
 
-	if option.Handler != nil {
-		s.RegisterHandler(option.MsgID, option.Handler)
-	} else {
-		s.RegisterHandler(iface.DefaultHeartbeatMsgID, &heartbeat.DefaultHandler{})
-	}
+func (s *Server) SetOnAccept(f iface.OnAccept) {
+	s.onAccept = f
 }
 
-func (s *Server) GetHeartBeatChecker() iface.IHeartBeatChecker {
-	return s.checker
+func (s *Server) GetIPFilter() iface.IIPFilter {
+	return s.ipFilter
 }
 
 func (s *Server) GetDataPack() iface.IDataPack {
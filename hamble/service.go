@@ -0,0 +1,316 @@
+package hamble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"runtime/debug"
+	"strings"
+)
+
+// 服务回复的状态，回复数据为状态（1字节）+编码后的回复或者错误信息
+const (
+	serviceStatusOK    byte = 0
+	serviceStatusError byte = 1
+)
+
+// serviceMsgIDBase 根据方法名计算的MsgID不小于此值，避免和用户定义以及内置的MsgID冲突
+const serviceMsgIDBase uint32 = 1 << 24
+
+var (
+	ErrInvalidService      = errors.New("invalid service")
+	ErrInvalidServiceReply = errors.New("invalid service reply")
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// JSONCodec 使用JSON编码服务请求和回复，是默认的编码方式
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ServiceError 服务方法返回的错误
+type ServiceError struct {
+	Message string
+}
+
+func (e *ServiceError) Error() string {
+	return e.Message
+}
+
+// ServiceMsgID 根据服务名和方法名计算MsgID，服务端和客户端使用同一个算法
+func ServiceMsgID(service, method string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(service + "." + method))
+
+	return serviceMsgIDBase + h.Sum32()%(math.MaxUint32-serviceMsgIDBase)
+}
+
+type connContextKey struct{}
+
+// ConnFromContext 获取服务方法的ctx对应的连接
+func ConnFromContext(ctx context.Context) iface.IConnection {
+	conn, _ := ctx.Value(connContextKey{}).(iface.IConnection)
+	return conn
+}
+
+// serviceMethod 服务的一个方法
+type serviceMethod struct {
+	name     string
+	receiver reflect.Value
+	method   reflect.Method
+	reqType  reflect.Type // 请求的类型，不是指针
+}
+
+// parseService 解析服务的所有可以注册的方法，返回MsgID到方法的映射
+func parseService(service interface{}) (string, map[uint32]*serviceMethod, error) {
+	receiver := reflect.ValueOf(service)
+	if !receiver.IsValid() {
+		return "", nil, fmt.Errorf("%w: nil service", ErrInvalidService)
+	}
+
+	name := reflect.Indirect(receiver).Type().Name()
+	if namer, ok := service.(iface.ServiceNamer); ok {
+		name = namer.ServiceName()
+	}
+	if name == "" {
+		return "", nil, fmt.Errorf("%w: no service name for %v", ErrInvalidService, receiver.Type())
+	}
+
+	var msgIDs map[string]uint32
+	if specified, ok := service.(iface.ServiceMsgIDs); ok {
+		msgIDs = specified.MsgIDs()
+	}
+
+	methods := make(map[uint32]*serviceMethod)
+	typ := receiver.Type()
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		if !isServiceMethod(method.Type) {
+			continue
+		}
+
+		msgID, ok := msgIDs[method.Name]
+		if !ok {
+			msgID = ServiceMsgID(name, method.Name)
+		} else if msgID >= iface.ReservedMsgIDMin && msgID <= iface.ReservedMsgIDMax {
+			return "", nil, fmt.Errorf("%w: msgID %v of %s.%s is reserved", ErrInvalidService, msgID, name, method.Name)
+		}
+		if exist, ok := methods[msgID]; ok {
+			return "", nil, fmt.Errorf("%w: %s.%s and %s.%s have the same msgID %v", ErrInvalidService, name, exist.name, name, method.Name, msgID)
+		}
+
+		methods[msgID] = &serviceMethod{
+			name:     method.Name,
+			receiver: receiver,
+			method:   method,
+			reqType:  method.Type.In(2).Elem(),
+		}
+	}
+
+	if len(methods) == 0 {
+		return "", nil, fmt.Errorf("%w: %s has no method like func(context.Context, *Req) (*Resp, error)", ErrInvalidService, name)
+	}
+
+	return name, methods, nil
+}
+
+// isServiceMethod 判断方法的类型是否为 func(receiver, context.Context, *Req) (*Resp, error)
+func isServiceMethod(typ reflect.Type) bool {
+	if typ.NumIn() != 3 || typ.NumOut() != 2 {
+		return false
+	}
+
+	return typ.In(1) == contextType &&
+		typ.In(2).Kind() == reflect.Pointer &&
+		typ.Out(0).Kind() == reflect.Pointer &&
+		typ.Out(1) == errorType
+}
+
+// RegisterService 注册服务的所有形如 func(ctx, *Req) (*Resp, error) 的方法，
+// 任意方法的MsgID已经注册时都不注册并返回错误
+func (s *Server) RegisterService(service interface{}) error {
+	name, methods, err := parseService(service)
+	if err != nil {
+		return err
+	}
+
+	handlers := make(map[uint32]iface.IHandler, len(methods))
+	for msgID, method := range methods {
+		handlers[msgID] = &serviceHandler{codec: s, method: method}
+	}
+
+	if err := s.router.AddRouters(handlers); err != nil {
+		return fmt.Errorf("register service %s: %w", name, err)
+	}
+
+	for msgID, method := range methods {
+		logger.Infof("register service method %s.%s msgID=%v", name, method.name, msgID)
+	}
+
+	return nil
+}
+
+// serviceHandler 解码请求，调用服务方法，并将编码后的回复通过Reply发送给对端
+type serviceHandler struct {
+	BaseHandler
+	codec  iface.ICSBase // 在处理时获取编码方式，注册之后仍然可以调用SetCodec
+	method *serviceMethod
+}
+
+func (handler *serviceHandler) Handle(request iface.IRequest) {
+	codec := handler.codec.GetCodec()
+	method := handler.method
+
+	req := reflect.New(method.reqType)
+	err := codec.Unmarshal(request.GetData(), req.Interface())
+	request.Release()
+	if err != nil {
+		handler.reply(request, nil, fmt.Errorf("decode request of %s err: %w", method.name, err))
+		return
+	}
+
+	ctx, cancel := newServiceContext(request.GetConnection())
+	resp, err := handler.call(ctx, req)
+	cancel()
+	if err != nil {
+		handler.reply(request, nil, err)
+		return
+	}
+
+	data, err := codec.Marshal(resp)
+	if err != nil {
+		err = fmt.Errorf("encode response of %s err: %w", method.name, err)
+	}
+	handler.reply(request, data, err)
+}
+
+// call 调用服务方法，方法panic时返回错误，不影响处理其它请求
+func (handler *serviceHandler) call(ctx context.Context, req reflect.Value) (resp interface{}, err error) {
+	method := handler.method
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("service method %s panic: %v\n%s", method.name, r, debug.Stack())
+			err = fmt.Errorf("service method %s panic", method.name)
+		}
+	}()
+
+	out := method.method.Func.Call([]reflect.Value{method.receiver, reflect.ValueOf(ctx), req})
+	if errValue := out[1].Interface(); errValue != nil {
+		return nil, errValue.(error)
+	}
+
+	return out[0].Interface(), nil
+}
+
+// newServiceContext 创建服务方法的ctx，连接关闭时取消
+func newServiceContext(conn iface.IConnection) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), connContextKey{}, conn))
+
+	if c, ok := conn.(interface{ doneChan() <-chan struct{} }); ok {
+		done := c.doneChan()
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	return ctx, cancel
+}
+
+func (handler *serviceHandler) reply(request iface.IRequest, data []byte, err error) {
+	var buf []byte
+	if err != nil {
+		buf = append([]byte{serviceStatusError}, err.Error()...)
+	} else {
+		buf = append([]byte{serviceStatusOK}, data...)
+	}
+
+	if err := request.Reply(request.GetMsgID(), buf); err != nil {
+		logger.Warnf("reply %s to %s err: %v", handler.method.name, request.GetConnection().RemoteAddr(), err)
+	}
+}
+
+// invoke 编码请求，通过Call发送给对端，并解码回复
+func invoke(ctx context.Context, client iface.IClient, msgID uint32, req, resp interface{}) error {
+	codec := client.GetCodec()
+
+	data, err := codec.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	reply, err := client.Call(ctx, msgID, data)
+	if err != nil {
+		return err
+	}
+
+	buf := reply.GetData()
+	if len(buf) == 0 {
+		return ErrInvalidServiceReply
+	}
+	if buf[0] != serviceStatusOK {
+		return &ServiceError{Message: string(buf[1:])}
+	}
+
+	return codec.Unmarshal(buf[1:], resp)
+}
+
+// Invoke 调用服务端注册的服务方法，method为 服务名.方法名，服务方法返回的错误为*ServiceError
+func (c *Client) Invoke(ctx context.Context, method string, req, resp interface{}) error {
+	service, name, ok := strings.Cut(method, ".")
+	if !ok {
+		return fmt.Errorf("%w: method %q should be Service.Method", ErrInvalidService, method)
+	}
+
+	return invoke(ctx, c, ServiceMsgID(service, name), req, resp)
+}
+
+// Method 服务方法的客户端存根
+type Method[Req, Resp any] struct {
+	client iface.IClient
+	msgID  uint32
+}
+
+// NewMethod 创建服务方法的客户端存根，method为 服务名.方法名
+func NewMethod[Req, Resp any](client iface.IClient, method string) (*Method[Req, Resp], error) {
+	service, name, ok := strings.Cut(method, ".")
+	if !ok {
+		return nil, fmt.Errorf("%w: method %q should be Service.Method", ErrInvalidService, method)
+	}
+
+	return NewMethodWithMsgID[Req, Resp](client, ServiceMsgID(service, name)), nil
+}
+
+// NewMethodWithMsgID 创建服务方法的客户端存根，用于服务通过MsgIDs指定了MsgID的方法
+func NewMethodWithMsgID[Req, Resp any](client iface.IClient, msgID uint32) *Method[Req, Resp] {
+	return &Method[Req, Resp]{client: client, msgID: msgID}
+}
+
+// Call 调用服务方法，最多等待到ctx结束
+func (m *Method[Req, Resp]) Call(ctx context.Context, req *Req) (*Resp, error) {
+	resp := new(Resp)
+	if err := invoke(ctx, m.client, m.msgID, req, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
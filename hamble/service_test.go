@@ -0,0 +1,298 @@
+package hamble
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"testing"
+	"time"
+)
+
+type addReq struct {
+	A, B int
+}
+
+type addResp struct {
+	Sum int
+}
+
+// testCalc 测试用的服务，Wait在ctx结束之前阻塞，结束时将ctx.Err()推入done
+type testCalc struct {
+	started chan struct{}
+	done    chan error
+}
+
+func (*testCalc) ServiceName() string {
+	return "Calc"
+}
+
+func (*testCalc) Add(ctx context.Context, req *addReq) (*addResp, error) {
+	if ConnFromContext(ctx) == nil {
+		return nil, errors.New("no connection in ctx")
+	}
+
+	return &addResp{Sum: req.A + req.B}, nil
+}
+
+func (*testCalc) Fail(ctx context.Context, req *addReq) (*addResp, error) {
+	return nil, errors.New("boom")
+}
+
+func (*testCalc) Panic(ctx context.Context, req *addReq) (*addResp, error) {
+	panic("boom")
+}
+
+func (calc *testCalc) Wait(ctx context.Context, req *addReq) (*addResp, error) {
+	close(calc.started)
+	<-ctx.Done()
+	calc.done <- ctx.Err()
+
+	return &addResp{}, nil
+}
+
+// Helper 不是服务方法，注册时被忽略
+func (*testCalc) Helper(a int) int {
+	return a
+}
+
+// badArgService 请求不是指针
+type badArgService struct{}
+
+func (badArgService) Add(ctx context.Context, req addReq) (*addResp, error) {
+	return nil, nil
+}
+
+// noContextService 第一个参数不是context.Context
+type noContextService struct{}
+
+func (noContextService) Add(req *addReq, other *addReq) (*addResp, error) {
+	return nil, nil
+}
+
+// badReturnService 第二个返回值不是error
+type badReturnService struct{}
+
+func (badReturnService) Add(ctx context.Context, req *addReq) (*addResp, bool) {
+	return nil, false
+}
+
+// msgIDService 通过MsgIDs指定方法的MsgID
+type msgIDService struct {
+	msgIDs map[string]uint32
+}
+
+func (s *msgIDService) MsgIDs() map[string]uint32 {
+	return s.msgIDs
+}
+
+func (*msgIDService) Add(ctx context.Context, req *addReq) (*addResp, error) {
+	return &addResp{Sum: req.A + req.B}, nil
+}
+
+func (*msgIDService) Sub(ctx context.Context, req *addReq) (*addResp, error) {
+	return &addResp{Sum: req.A - req.B}, nil
+}
+
+// prefixCodec 在JSON之前加上前缀，对端使用不同的编码方式时解码失败
+type prefixCodec struct {
+	JSONCodec
+}
+
+func (codec prefixCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := codec.JSONCodec.Marshal(v)
+	return append([]byte("prefix"), data...), err
+}
+
+func (codec prefixCodec) Unmarshal(data []byte, v interface{}) error {
+	if !bytes.HasPrefix(data, []byte("prefix")) {
+		return errors.New("missing prefix")
+	}
+
+	return codec.JSONCodec.Unmarshal(data[len("prefix"):], v)
+}
+
+// startServiceClient 启动注册了服务的服务器，并连接服务器
+func startServiceClient(t *testing.T, service interface{}, codec iface.ICodec) *Client {
+	t.Helper()
+
+	addr := startTestServer(t, func(s *Server) {
+		if codec != nil {
+			s.SetCodec(codec)
+		}
+		if err := s.RegisterService(service); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	host, port := splitTestAddr(t, addr)
+	iClient, err := NewClient("tcp", host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := iClient.(*Client)
+	if codec != nil {
+		client.SetCodec(codec)
+	}
+	go client.Start()
+	t.Cleanup(client.Stop)
+
+	return client
+}
+
+func TestParseService(t *testing.T) {
+	name, methods, err := parseService(&testCalc{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "Calc" {
+		t.Fatalf("expect service name Calc, got %s", name)
+	}
+
+	// 只注册符合签名的导出方法，MsgID由服务名和方法名计算
+	if len(methods) != 4 {
+		t.Fatalf("expect 4 methods, got %v", len(methods))
+	}
+	for _, method := range []string{"Add", "Fail", "Panic", "Wait"} {
+		msgID := ServiceMsgID("Calc", method)
+		if msgID < serviceMsgIDBase {
+			t.Fatalf("msgID %v of %s is less than %v", msgID, method, serviceMsgIDBase)
+		}
+		if m := methods[msgID]; m == nil || m.name != method {
+			t.Fatalf("expect %s registered at msgID %v", method, msgID)
+		}
+	}
+}
+
+func TestParseServiceMsgIDs(t *testing.T) {
+	_, methods, err := parseService(&msgIDService{msgIDs: map[string]uint32{"Add": 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := methods[100]; m == nil || m.name != "Add" {
+		t.Fatal("expect Add registered at the specified msgID")
+	}
+	if m := methods[ServiceMsgID("msgIDService", "Sub")]; m == nil || m.name != "Sub" {
+		t.Fatal("expect Sub registered at the computed msgID")
+	}
+}
+
+func TestParseServiceRejectInvalid(t *testing.T) {
+	for name, service := range map[string]interface{}{
+		"nil":              nil,
+		"request by value": badArgService{},
+		"no context":       noContextService{},
+		"bad return":       badReturnService{},
+		"same msgID":       &msgIDService{msgIDs: map[string]uint32{"Add": 100, "Sub": 100}},
+		"reserved min":     &msgIDService{msgIDs: map[string]uint32{"Add": iface.ReservedMsgIDMin}},
+		"reserved max":     &msgIDService{msgIDs: map[string]uint32{"Add": iface.ReservedMsgIDMax}},
+		"reserved call":    &msgIDService{msgIDs: map[string]uint32{"Add": iface.CallMsgID}},
+	} {
+		if _, _, err := parseService(service); !errors.Is(err, ErrInvalidService) {
+			t.Fatalf("%s: expect ErrInvalidService, got %v", name, err)
+		}
+	}
+}
+
+func TestRegisterServiceConflict(t *testing.T) {
+	s := NewServerWithOption(conf.GlobalProfile).(*Server)
+	if err := s.RegisterService(&testCalc{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(&testCalc{}); err == nil {
+		t.Fatal("expect registering the same service twice to fail")
+	}
+}
+
+func TestServiceInvoke(t *testing.T) {
+	for name, codec := range map[string]iface.ICodec{"json": nil, "custom": prefixCodec{}} {
+		t.Run(name, func(t *testing.T) {
+			client := startServiceClient(t, &testCalc{}, codec)
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			var resp addResp
+			if err := client.Invoke(ctx, "Calc.Add", &addReq{A: 1, B: 2}, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Sum != 3 {
+				t.Fatalf("expect sum 3, got %v", resp.Sum)
+			}
+
+			add, err := NewMethod[addReq, addResp](client, "Calc.Add")
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := add.Call(ctx, &addReq{A: 3, B: 4})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Sum != 7 {
+				t.Fatalf("expect sum 7, got %v", result.Sum)
+			}
+		})
+	}
+}
+
+func TestServiceCodecMismatch(t *testing.T) {
+	client := startServiceClient(t, &testCalc{}, nil)
+	client.SetCodec(prefixCodec{})
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// 服务器无法解码请求，回复错误
+	var serviceErr *ServiceError
+	if err := client.Invoke(ctx, "Calc.Add", &addReq{A: 1, B: 2}, &addResp{}); !errors.As(err, &serviceErr) {
+		t.Fatalf("expect *ServiceError, got %v", err)
+	}
+}
+
+func TestServiceError(t *testing.T) {
+	client := startServiceClient(t, &testCalc{}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var serviceErr *ServiceError
+	err := client.Invoke(ctx, "Calc.Fail", &addReq{}, &addResp{})
+	if !errors.As(err, &serviceErr) || serviceErr.Message != "boom" {
+		t.Fatalf("expect ServiceError boom, got %v", err)
+	}
+
+	// panic回复错误，之后的请求仍然正常处理
+	if err = client.Invoke(ctx, "Calc.Panic", &addReq{}, &addResp{}); !errors.As(err, &serviceErr) {
+		t.Fatalf("expect *ServiceError for panic, got %v", err)
+	}
+	var resp addResp
+	if err = client.Invoke(ctx, "Calc.Add", &addReq{A: 1, B: 1}, &resp); err != nil || resp.Sum != 2 {
+		t.Fatalf("expect sum 2 after panic, got %v, %v", resp.Sum, err)
+	}
+
+	if err = client.Invoke(ctx, "Add", &addReq{}, &addResp{}); !errors.Is(err, ErrInvalidService) {
+		t.Fatalf("expect ErrInvalidService for method without service, got %v", err)
+	}
+}
+
+func TestServiceContextCancelledOnClose(t *testing.T) {
+	calc := &testCalc{started: make(chan struct{}), done: make(chan error, 1)}
+	client := startServiceClient(t, calc, nil)
+
+	go func() {
+		_ = client.Invoke(context.Background(), "Calc.Wait", &addReq{}, &addResp{})
+	}()
+	select {
+	case <-calc.started:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for Calc.Wait")
+	}
+
+	client.GetConnection().Stop()
+	select {
+	case err := <-calc.done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expect context.Canceled, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("ctx of service method not cancelled after the connection closed")
+	}
+}
@@ -0,0 +1,610 @@
+package hamble
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"sync"
+	"time"
+)
+
+// 会话令牌消息的类型
+const (
+	sessionNew          = byte(0) // 连接建立时新建的会话
+	sessionResumed      = byte(1) // 恢复了之前的会话
+	sessionResumeFailed = byte(2) // 之前的会话不存在或已过期，继续使用新建的会话
+
+	sessionTokenLen = 16 // 会话令牌的随机字节数
+)
+
+var (
+	ErrSessionExpired    = errors.New("session expired")
+	ErrInvalidSessionMsg = errors.New("invalid session msg")
+)
+
+// Session 可以跨连接恢复的会话，实现了iface.ISession接口
+type Session struct {
+	token   string
+	manager *sessionManager
+
+	conn        *Connection  // 当前绑定的连接，连接断开时为nil
+	expireTimer iface.ITimer // 连接断开之后删除会话的定时任务
+	expired     bool
+	mu          sync.Mutex
+
+	queue    reliableQueue // 未确认的消息，断线重连之后重放
+	receiver seqReceiver   // 接收客户端的可靠消息，断线重连之后仍然可以识别重复的消息
+
+	properties     map[string]interface{}
+	propertiesLock sync.Mutex
+
+	// 连接断开时保存的连接状态，由mu保护，恢复会话时还原到新的连接
+	principal      *iface.Principal
+	user           string // ConnManager中绑定的用户
+	connProperties map[string]interface{}
+	patterns       []string
+}
+
+// sessionIdentity 恢复会话时新的连接继承的身份，释放mu之后再完成认证和绑定
+type sessionIdentity struct {
+	principal *iface.Principal // 新的连接继承的认证身份，新的连接已经认证时为nil
+	user      string           // 之前的连接绑定的用户
+}
+
+func (s *Session) GetToken() string {
+	return s.token
+}
+
+func (s *Session) GetConnection() iface.IConnection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	return s.conn
+}
+
+// Send 发送需要客户端确认的可靠消息，连接断开时只保存消息，恢复会话之后再发送
+func (s *Session) Send(msgID uint32, data []byte) error {
+	return s.send(iface.ReliableMsg{MsgID: msgID, Data: data})
+}
+
+func (s *Session) send(msg iface.ReliableMsg) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expired {
+		return ErrSessionExpired
+	}
+
+	if err := s.queue.send(s.conn, msg, s.manager.maxPending); err != nil {
+		return err
+	}
+
+	if s.conn != nil {
+		s.conn.startRetransmit()
+	}
+
+	return nil
+}
+
+func (s *Session) Pending() int {
+	return s.queue.len()
+}
+
+// attach 将会话绑定到新的连接，告诉客户端会话令牌之后，按顺序重放客户端没有收到的消息。
+// merged为需要合并到该会话的消息，会重新分配序号。会话已经过期时返回false
+func (s *Session) attach(c *Connection, kind byte, lastSeq uint64, merged []iface.ReliableMsg) (prev *Connection, identity sessionIdentity, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expired {
+		return nil, identity, false
+	}
+
+	if s.expireTimer != nil {
+		s.expireTimer.Stop()
+		s.expireTimer = nil
+	}
+
+	prev = s.conn
+	if prev != nil && prev != c {
+		// 旧的连接还没有断开，接管它的状态
+		s.save(prev)
+	}
+	s.conn = c
+	c.session.Store(s)
+	identity = s.restore(c)
+
+	// 在读取消息的过程中调用，不能阻塞
+	_ = c.TrySend(iface.SessionMsgID, encodeSessionToken(kind, s.token))
+
+	s.queue.merge(merged)
+	if delivered := s.queue.replay(c, lastSeq); len(delivered) > 0 {
+		go func() {
+			for _, msg := range delivered {
+				c.cs.CallOnDelivered(c, msg)
+			}
+		}()
+	}
+	if s.queue.len() > 0 {
+		c.startRetransmit()
+	}
+
+	return prev, identity, true
+}
+
+// detach 连接断开，宽限期之后删除会话
+func (s *Session) detach(c *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != c || s.expired {
+		return
+	}
+
+	s.save(c)
+	s.conn = nil
+	s.expireTimer = s.manager.cs.GetScheduler().AfterFunc(s.manager.gracePeriod, func() {
+		s.manager.expire(s)
+	})
+}
+
+// save 保存连接的身份、属性和订阅，需要持有mu，在解除绑定和删除连接的订阅之前调用
+func (s *Session) save(c *Connection) {
+	if principal := c.principal.Load(); principal != nil {
+		s.principal = principal
+	}
+	if user := c.cs.GetConnManager().UserOf(c); user != "" {
+		s.user = user
+	}
+	s.connProperties = c.copyProperties()
+	if c.topics != nil {
+		s.patterns = c.topics.patterns(c)
+	}
+}
+
+// restore 将保存的连接状态还原到新的连接，需要持有mu。新的连接已经设置的属性不会被覆盖，
+// 返回新的连接继承的身份
+func (s *Session) restore(c *Connection) (identity sessionIdentity) {
+	if s.principal != nil && c.principal.CompareAndSwap(nil, s.principal) {
+		identity.principal = s.principal
+	}
+	identity.user = s.user
+
+	for key, value := range s.connProperties {
+		if c.GetProperty(key) == nil {
+			c.SetProperty(key, value)
+		}
+	}
+
+	if c.topics != nil {
+		for _, pattern := range s.patterns {
+			if err := c.topics.subscribe(c, pattern); err != nil {
+				logger.Warnf("restore subscription %q for %s err: %v", pattern, c.RemoteAddr(), err)
+			}
+		}
+	}
+
+	s.connProperties, s.patterns = nil, nil
+
+	return identity
+}
+
+// owns 判断连接能否恢复该会话，连接已经认证为其他身份时不能恢复
+func (s *Session) owns(c *Connection) bool {
+	current := c.principal.Load()
+	if current == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	principal := s.principal
+	if s.conn != nil {
+		if p := s.conn.principal.Load(); p != nil {
+			principal = p
+		}
+	}
+
+	return principal == nil || principal.ID == current.ID
+}
+
+// close 删除会话，返回还没有确认的消息
+func (s *Session) close() []iface.ReliableMsg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expireTimer != nil {
+		s.expireTimer.Stop()
+		s.expireTimer = nil
+	}
+	s.expired, s.conn = true, nil
+
+	return s.queue.drain()
+}
+
+func (s *Session) SetProperty(key string, value interface{}) {
+	s.propertiesLock.Lock()
+	defer s.propertiesLock.Unlock()
+
+	if s.properties == nil {
+		s.properties = make(map[string]interface{}) // 延迟初始化
+	}
+
+	s.properties[key] = value
+}
+
+func (s *Session) GetProperty(key string) interface{} {
+	s.propertiesLock.Lock()
+	defer s.propertiesLock.Unlock()
+
+	return s.properties[key]
+}
+
+func (s *Session) RemoveProperty(key string) {
+	s.propertiesLock.Lock()
+	defer s.propertiesLock.Unlock()
+
+	delete(s.properties, key)
+}
+
+// sessionManager 管理服务器的所有会话
+type sessionManager struct {
+	enabled  bool
+	sessions map[string]*Session
+	mu       sync.Mutex
+
+	gracePeriod time.Duration
+	maxPending  int
+
+	cs iface.ICSBase
+
+	onResumed iface.OnSessionResumed
+	onExpired iface.OnSessionExpired
+}
+
+func newSessionManager(cs iface.ICSBase) *sessionManager {
+	return &sessionManager{
+		sessions: make(map[string]*Session),
+		cs:       cs,
+	}
+}
+
+// enable 开启会话，为0的选项使用配置文件中的值
+func (m *sessionManager) enable(option iface.SessionOption) {
+	m.gracePeriod = option.GracePeriod
+	if m.gracePeriod <= 0 {
+		m.gracePeriod = conf.Current().GetSessionGraceTime()
+	}
+
+	m.maxPending = option.MaxPending
+	if m.maxPending <= 0 {
+		m.maxPending = conf.Current().SessionMaxPending
+	}
+
+	m.enabled = true
+}
+
+// create 为新的连接创建会话
+func (m *sessionManager) create(c *Connection) *Session {
+	s := &Session{
+		token:   newSessionToken(),
+		manager: m,
+		conn:    c,
+	}
+
+	m.mu.Lock()
+	m.sessions[s.token] = s
+	m.mu.Unlock()
+
+	m.cs.GetMetrics().Inc(iface.MetricSessionNew)
+
+	return s
+}
+
+func (m *sessionManager) get(token string) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.sessions[token]
+}
+
+func (m *sessionManager) remove(s *Session) []iface.ReliableMsg {
+	m.mu.Lock()
+	if m.sessions[s.token] == s {
+		delete(m.sessions, s.token)
+	}
+	m.mu.Unlock()
+
+	return s.close()
+}
+
+// expire 宽限期内没有恢复，删除会话
+func (m *sessionManager) expire(s *Session) {
+	s.mu.Lock()
+	alive := s.conn != nil || s.expired
+	s.mu.Unlock()
+	if alive {
+		return
+	}
+
+	failed := m.remove(s)
+	m.cs.GetMetrics().Inc(iface.MetricSessionExpired)
+	logger.Debugf("session %s expired with %d unacked msgs", s.token, len(failed))
+
+	if len(failed) > 0 {
+		m.cs.GetMetrics().Add(iface.MetricReliableFail, uint64(len(failed)))
+		for _, msg := range failed {
+			m.cs.CallOnSendFailed(nil, msg, ErrSessionExpired)
+		}
+	}
+
+	if m.onExpired != nil {
+		m.onExpired(s)
+	}
+}
+
+// resume 客户端使用令牌恢复会话，连接建立时新建的会话中的消息合并到恢复的会话中。
+// 客户端在恢复期间会丢弃收到的消息，所以恢复失败时从头重放新建的会话。
+// 恢复之后新的连接继承之前的连接的身份、属性和订阅
+func (m *sessionManager) resume(c *Connection, token string, lastSeq uint64) {
+	fresh := c.session.Load()
+	if fresh == nil {
+		return
+	}
+
+	old := m.get(token)
+	if old == fresh {
+		_, _, _ = fresh.attach(c, sessionResumed, lastSeq, nil)
+		return
+	}
+	if old == nil || !old.owns(c) {
+		if old != nil {
+			logger.Warnf("connection from %s authenticated as %s cannot resume session %s", c.RemoteAddr(), c.GetPrincipal().ID, token)
+		}
+		_, _, _ = fresh.attach(c, sessionResumeFailed, 0, nil)
+		return
+	}
+
+	// 先删除新建的会话，避免恢复的过程中再有消息加入
+	merged := m.remove(fresh)
+	prev, identity, ok := old.attach(c, sessionResumed, lastSeq, merged)
+	if !ok {
+		// 会话刚好过期，重新创建会话
+		_, _, _ = m.create(c).attach(c, sessionResumeFailed, 0, merged)
+		return
+	}
+
+	m.cs.GetMetrics().Inc(iface.MetricSessionResumed)
+	logger.Infof("connection from %s resumed session %s", c.RemoteAddr(), old.token)
+
+	// 在读取消息的过程中调用，关闭连接和Hook函数都可能阻塞
+	go func() {
+		if prev != nil && prev != c {
+			// 旧的连接还没有断开，由新的连接接管会话
+			prev.Stop()
+		}
+		c.resumeIdentity(identity)
+
+		if m.onResumed != nil {
+			m.onResumed(c, old)
+		}
+	}()
+}
+
+func newSessionToken() string {
+	token := make([]byte, sessionTokenLen)
+	_, _ = rand.Read(token)
+
+	return hex.EncodeToString(token)
+}
+
+func encodeSessionToken(kind byte, token string) []byte {
+	data := make([]byte, 0, 1+len(token))
+	data = append(data, kind)
+
+	return append(data, token...)
+}
+
+func decodeSessionToken(data []byte) (kind byte, token string, err error) {
+	if len(data) <= 1 || data[0] > sessionResumeFailed {
+		return 0, "", ErrInvalidSessionMsg
+	}
+
+	return data[0], string(data[1:]), nil
+}
+
+func encodeSessionResume(lastSeq uint64, token string) []byte {
+	data := make([]byte, reliableSeqLen, reliableSeqLen+len(token))
+	binary.BigEndian.PutUint64(data, lastSeq)
+
+	return append(data, token...)
+}
+
+func decodeSessionResume(data []byte) (lastSeq uint64, token string, err error) {
+	if len(data) <= reliableSeqLen {
+		return 0, "", ErrInvalidSessionMsg
+	}
+
+	return binary.BigEndian.Uint64(data), string(data[reliableSeqLen:]), nil
+}
+
+func (c *Connection) GetSession() iface.ISession {
+	if s := c.session.Load(); s != nil {
+		return s
+	}
+
+	return nil
+}
+
+// startSession 服务器开启会话时，为新的连接创建会话并告诉客户端会话令牌
+func (c *Connection) startSession() {
+	if c.sessions == nil || !c.sessions.enabled {
+		return
+	}
+
+	s := c.sessions.create(c)
+	c.session.Store(s)
+	_ = c.TrySend(iface.SessionMsgID, encodeSessionToken(sessionNew, s.token))
+}
+
+// resumeIdentity 新的连接继承了认证身份时与通过认证一样处理，会绑定用户并投递离线消息；
+// 否则重新绑定之前的连接绑定的用户
+func (c *Connection) resumeIdentity(identity sessionIdentity) {
+	if identity.principal != nil {
+		c.authenticated(identity.principal)
+		return
+	}
+	if identity.user == "" {
+		return
+	}
+
+	var err error
+	if deliverer, ok := c.cs.(interface {
+		DeliverOutbox(conn iface.IConnection, identity string) error
+	}); ok {
+		err = deliverer.DeliverOutbox(c, identity.user)
+	} else {
+		err = c.cs.GetConnManager().Bind(c, identity.user)
+	}
+	if err != nil {
+		logger.Errorf("bind resumed connection from %s to %s err: %v", c.RemoteAddr(), identity.user, err)
+	}
+}
+
+// stopSession 连接断开时保留会话，等待客户端恢复
+func (c *Connection) stopSession() {
+	if s := c.session.Load(); s != nil {
+		s.detach(c)
+	}
+}
+
+// checkSession 服务器处理恢复会话的请求，客户端处理会话令牌，返回false时不再交给Router处理。
+// 会话消息需要和可靠消息按照收到的顺序处理，不能交给Worker
+func (c *Connection) checkSession(msg iface.IMessage) (iface.IMessage, bool) {
+	switch {
+	case msg.GetMsgID() == iface.SessionResumeMsgID && c.sessions != nil && c.sessions.enabled:
+		lastSeq, token, err := decodeSessionResume(msg.GetData())
+		if err != nil {
+			logger.Warnf("receive session resume from %s err: %v", c.RemoteAddr(), err)
+			return nil, false
+		}
+		c.sessions.resume(c, token, lastSeq)
+		return nil, false
+	case msg.GetMsgID() == iface.SessionMsgID && c.clientSession != nil:
+		kind, token, err := decodeSessionToken(msg.GetData())
+		if err != nil {
+			logger.Warnf("receive session token from %s err: %v", c.RemoteAddr(), err)
+			return nil, false
+		}
+		c.clientSession.update(kind, token)
+		return nil, false
+	}
+
+	return msg, true
+}
+
+// clientSession 客户端的会话状态，重连之后仍然保留
+type clientSession struct {
+	token    string
+	resuming bool // 已经发送恢复请求，还没有收到结果
+	mu       sync.Mutex
+
+	receiver seqReceiver // 接收服务器的可靠消息
+}
+
+func (cs *clientSession) update(kind byte, token string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	switch kind {
+	case sessionNew:
+		if cs.resuming {
+			// 连接建立时服务器新建的会话，以恢复的结果为准
+			return
+		}
+		cs.token = token
+		cs.receiver.reset()
+	case sessionResumed:
+		cs.token, cs.resuming = token, false
+	case sessionResumeFailed:
+		cs.token, cs.resuming = token, false
+		cs.receiver.reset()
+	}
+}
+
+// receive 收到服务器的可靠消息，ok为false表示正在恢复会话，丢弃该消息，恢复之后服务器会重放
+func (cs *clientSession) receive(seq uint64) (accept bool, ack uint64, ok bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.resuming {
+		return false, 0, false
+	}
+	accept, ack = cs.receiver.receive(seq)
+
+	return accept, ack, true
+}
+
+// resumeRequest 重连之后恢复会话的请求，还没有会话时返回nil
+func (cs *clientSession) resumeRequest() []byte {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.token == "" {
+		return nil
+	}
+	cs.resuming = true
+
+	return encodeSessionResume(cs.receiver.last(), cs.token)
+}
+
+func (cs *clientSession) getToken() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.token
+}
+
+func (s *Server) EnableSession(option iface.SessionOption) {
+	s.sessions.enable(option)
+}
+
+func (s *Server) GetSession(token string) iface.ISession {
+	if session := s.sessions.get(token); session != nil {
+		return session
+	}
+
+	return nil
+}
+
+func (s *Server) SetOnSessionResumed(f iface.OnSessionResumed) {
+	s.sessions.onResumed = f
+}
+
+func (s *Server) SetOnSessionExpired(f iface.OnSessionExpired) {
+	s.sessions.onExpired = f
+}
+
+func (c *Client) EnableSession() {
+	c.session = &clientSession{}
+	if conn, ok := c.connection.(*Connection); ok {
+		conn.clientSession = c.session
+	}
+}
+
+func (c *Client) GetSessionToken() string {
+	if c.session == nil {
+		return ""
+	}
+
+	return c.session.getToken()
+}
@@ -0,0 +1,176 @@
+package hamble
+
+import (
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// onceAuthenticator 只有第一次认证可以通过，之后的连接只能通过恢复会话继承身份
+type onceAuthenticator struct {
+	calls atomic.Int32
+}
+
+func (a *onceAuthenticator) Hello(iface.IConnection) []byte {
+	return []byte("hello")
+}
+
+func (a *onceAuthenticator) Authenticate(_ iface.IConnection, _, credentials []byte) (*iface.Principal, error) {
+	if a.calls.Add(1) > 1 {
+		return nil, errors.New("authenticate more than once")
+	}
+
+	return &iface.Principal{ID: string(credentials)}, nil
+}
+
+type chanHandler struct {
+	BaseHandler
+	received chan string
+}
+
+func (h *chanHandler) Handle(request iface.IRequest) {
+	h.received <- string(request.GetData())
+}
+
+// startSessionClient 连接服务器并开启会话，等待收到会话令牌
+func startSessionClient(t *testing.T, addr string, setup func(c *Client)) *Client {
+	t.Helper()
+
+	host, port := splitTestAddr(t, addr)
+	iClient, err := NewClient("tcp", host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := iClient.(*Client)
+	client.EnableSession()
+	if setup != nil {
+		setup(client)
+	}
+	go client.Start()
+	t.Cleanup(client.Stop)
+	waitUntil(t, "session token", func() bool { return client.GetSessionToken() != "" })
+
+	return client
+}
+
+func splitTestAddr(t *testing.T, addr string) (string, int) {
+	t.Helper()
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return host, port
+}
+
+func expectReceived(t *testing.T, received chan string, want string) {
+	t.Helper()
+
+	select {
+	case got := <-received:
+		if got != want {
+			t.Fatalf("expect %q, got %q", want, got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout waiting for %q", want)
+	}
+}
+
+func TestResumedSessionIsAuthenticated(t *testing.T) {
+	var server *Server
+	auth := &onceAuthenticator{}
+	var authenticated atomic.Int32
+	addr := startTestServer(t, func(s *Server) {
+		server = s
+		s.SetAuthenticator(auth, iface.AuthOption{})
+		s.EnableSession(iface.SessionOption{})
+		s.SetOnAuthenticated(func(iface.IConnection, *iface.Principal) {
+			authenticated.Add(1)
+		})
+	})
+
+	received := make(chan string, 4)
+	results := make(chan string, 4)
+	client := startSessionClient(t, addr, func(c *Client) {
+		c.SetCredentials(func(iface.IConnection, []byte) []byte { return []byte("alice") })
+		c.SetOnAuthResult(func(_ iface.IConnection, ok bool, detail string) {
+			if ok {
+				results <- detail
+			}
+		})
+		c.RegisterHandler(400, &chanHandler{received: received})
+	})
+	expectReceived(t, results, "alice")
+
+	if err := client.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	go client.Start()
+
+	// 恢复会话之后与通过认证一样通知客户端，并执行Hook函数
+	expectReceived(t, results, "alice")
+	waitUntil(t, "OnAuthenticated for the resumed connection", func() bool { return authenticated.Load() == 2 })
+	if calls := auth.calls.Load(); calls != 1 {
+		t.Fatalf("expect the resumed connection not authenticated again, got %v calls", calls)
+	}
+
+	conns := server.GetConnManager().ConnsOf("alice")
+	if len(conns) != 1 || conns[0].GetPrincipal() == nil || conns[0].GetPrincipal().ID != "alice" {
+		t.Fatalf("expect only the resumed connection bound to alice, got %v", conns)
+	}
+	if err := server.SendTo("alice", 400, []byte("welcome back")); err != nil {
+		t.Fatalf("send to alice err: %v", err)
+	}
+	expectReceived(t, received, "welcome back")
+}
+
+type bindHandler struct {
+	BaseHandler
+}
+
+func (h *bindHandler) Handle(request iface.IRequest) {
+	_ = request.GetConnection().(*Connection).cs.GetConnManager().Bind(request.GetConnection(), string(request.GetData()))
+}
+
+func TestResumedSessionKeepsUserBinding(t *testing.T) {
+	var server *Server
+	addr := startTestServer(t, func(s *Server) {
+		server = s
+		s.EnableSession(iface.SessionOption{})
+		s.RegisterHandler(301, &bindHandler{})
+	})
+
+	received := make(chan string, 4)
+	client := startSessionClient(t, addr, func(c *Client) {
+		c.RegisterHandler(400, &chanHandler{received: received})
+	})
+	if err := client.GetConnection().SendBufMsg(301, []byte("bob")); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "bob bound", func() bool { return len(server.GetConnManager().ConnsOf("bob")) == 1 })
+	first := server.GetConnManager().ConnsOf("bob")[0]
+
+	if err := client.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	go client.Start()
+
+	// 新的连接不需要再次绑定
+	waitUntil(t, "resumed connection bound to bob", func() bool {
+		conns := server.GetConnManager().ConnsOf("bob")
+		return len(conns) == 1 && conns[0] != first
+	})
+	if err := server.SendTo("bob", 400, []byte("hi bob")); err != nil {
+		t.Fatalf("send to bob err: %v", err)
+	}
+	expectReceived(t, received, "hi bob")
+}
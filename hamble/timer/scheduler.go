@@ -0,0 +1,226 @@
+package timer
+
+import (
+	"container/heap"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const dueQueueLen = 4096 // 等待Worker执行的到期任务数
+
+// Scheduler 基于最小堆的定时任务调度器，实现了iface.IScheduler接口。
+// 所有定时任务共用一个调度协程和一个time.Timer，到期的任务交给固定数量的Worker执行，不会阻塞调度。
+// 任务函数不应该长时间阻塞，所有Worker都在忙并且队列已满时，到期的任务在新的协程中执行
+type Scheduler struct {
+	tasks taskHeap
+	mu    sync.Mutex
+
+	dueChan chan func() // 到期的任务，由Worker取出执行
+
+	wakeChan   chan struct{} // 最早到期的任务发生变化时唤醒调度协程
+	closedChan chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewScheduler 创建调度器，使用CPU核数个Worker执行到期的任务
+func NewScheduler() *Scheduler {
+	s := &Scheduler{
+		dueChan:    make(chan func(), dueQueueLen),
+		wakeChan:   make(chan struct{}, 1),
+		closedChan: make(chan struct{}),
+	}
+	go s.run()
+	for i := 0; i < runtime.NumCPU(); i++ {
+		go s.worker()
+	}
+
+	return s
+}
+
+func (s *Scheduler) AfterFunc(d time.Duration, f func()) iface.ITimer {
+	return s.schedule(time.Now().Add(d), 0, f)
+}
+
+func (s *Scheduler) Every(interval time.Duration, f func()) iface.ITimer {
+	if interval <= 0 {
+		panic("timer: non-positive interval for Every")
+	}
+
+	return s.schedule(time.Now().Add(interval), interval, f)
+}
+
+func (s *Scheduler) Stop() {
+	s.closeOnce.Do(func() {
+		close(s.closedChan)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, t := range s.tasks {
+			t.index = -1
+		}
+		s.tasks = nil
+	})
+}
+
+func (s *Scheduler) schedule(when time.Time, interval time.Duration, f func()) *task {
+	t := &task{
+		when:      when,
+		interval:  interval,
+		f:         f,
+		index:     -1,
+		scheduler: s,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closedChan:
+		// 调度器已经停止，任务不会执行
+		return t
+	default:
+	}
+
+	heap.Push(&s.tasks, t)
+	if t.index == 0 {
+		s.wake()
+	}
+
+	return t
+}
+
+func (s *Scheduler) wake() {
+	select {
+	case s.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		wait := s.runDue(time.Now())
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-s.wakeChan:
+		case <-s.closedChan:
+			return
+		}
+	}
+}
+
+// runDue 执行所有到期的任务，返回距离下一个任务到期的时间
+func (s *Scheduler) runDue(now time.Time) time.Duration {
+	var due []func()
+
+	s.mu.Lock()
+	for len(s.tasks) > 0 && !s.tasks[0].when.After(now) {
+		t := heap.Pop(&s.tasks).(*task)
+		due = append(due, t.f)
+
+		if t.interval > 0 {
+			// 周期任务，按照原定的时间计算下一次执行时间，落后太多时从现在开始计算
+			t.when = t.when.Add(t.interval)
+			if t.when.Before(now) {
+				t.when = now.Add(t.interval)
+			}
+			heap.Push(&s.tasks, t)
+		}
+	}
+
+	wait := time.Hour
+	if len(s.tasks) > 0 {
+		wait = s.tasks[0].when.Sub(now)
+	}
+	s.mu.Unlock()
+
+	for _, f := range due {
+		select {
+		case s.dueChan <- f:
+		default:
+			// 所有Worker都在忙，不能阻塞调度
+			go f()
+		}
+	}
+
+	return wait
+}
+
+// worker 执行到期的任务，调度器停止之后退出，没有执行的任务被丢弃
+func (s *Scheduler) worker() {
+	for {
+		select {
+		case f := <-s.dueChan:
+			f()
+		case <-s.closedChan:
+			return
+		}
+	}
+}
+
+// task 一个定时任务，实现了iface.ITimer接口
+type task struct {
+	when     time.Time
+	interval time.Duration // 周期任务的时间间隔，为0表示只执行一次
+	f        func()
+	index    int // 在堆中的位置，为-1表示不在堆中
+
+	scheduler *Scheduler
+}
+
+func (t *task) Stop() bool {
+	s := t.scheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.index < 0 {
+		return false
+	}
+
+	heap.Remove(&s.tasks, t.index)
+
+	return true
+}
+
+// taskHeap 按照到期时间排序的最小堆
+type taskHeap []*task
+
+func (h taskHeap) Len() int { return len(h) }
+
+func (h taskHeap) Less(i, j int) bool { return h[i].when.Before(h[j].when) }
+
+func (h taskHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *taskHeap) Push(x interface{}) {
+	t := x.(*task)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+
+	return t
+}
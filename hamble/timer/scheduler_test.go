@@ -0,0 +1,83 @@
+package timer
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerAfterFunc(t *testing.T) {
+	s := NewScheduler()
+	defer s.Stop()
+
+	done := make(chan int, 2)
+	s.AfterFunc(30*time.Millisecond, func() { done <- 2 })
+	s.AfterFunc(10*time.Millisecond, func() { done <- 1 })
+
+	for want := 1; want <= 2; want++ {
+		select {
+		case got := <-done:
+			if got != want {
+				t.Fatalf("expect task %v, got %v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("task %v not run", want)
+		}
+	}
+}
+
+func TestSchedulerStop(t *testing.T) {
+	s := NewScheduler()
+	defer s.Stop()
+
+	var count atomic.Int32
+	timer := s.AfterFunc(20*time.Millisecond, func() { count.Add(1) })
+	if !timer.Stop() {
+		t.Fatal("stop a pending timer should return true")
+	}
+	if timer.Stop() {
+		t.Fatal("stop a stopped timer should return false")
+	}
+
+	every := s.Every(5*time.Millisecond, func() { count.Add(1) })
+	time.Sleep(50 * time.Millisecond)
+	every.Stop()
+	time.Sleep(10 * time.Millisecond) // 等待已经交给Worker的任务执行完
+	n := count.Load()
+	if n == 0 {
+		t.Fatal("periodic task not run")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if count.Load() != n {
+		t.Fatal("periodic task run after stop")
+	}
+
+	// 调度器停止之后任务不会执行
+	s.Stop()
+	s.AfterFunc(time.Millisecond, func() { count.Add(1) })
+	time.Sleep(20 * time.Millisecond)
+	if count.Load() != n {
+		t.Fatal("task run after scheduler stopped")
+	}
+}
+
+// TestSchedulerBlockedWorkers 所有Worker都阻塞时，到期的任务仍然会执行
+func TestSchedulerBlockedWorkers(t *testing.T) {
+	s := NewScheduler()
+	defer s.Stop()
+
+	block := make(chan struct{})
+	defer close(block)
+	for i := 0; i < dueQueueLen*2; i++ {
+		s.AfterFunc(0, func() { <-block })
+	}
+
+	done := make(chan struct{})
+	s.AfterFunc(10*time.Millisecond, func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("task not run while workers are blocked")
+	}
+}
@@ -0,0 +1,548 @@
+package hamble
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/dawnzzz/hamble-tcp-server/conf"
+	"github.com/dawnzzz/hamble-tcp-server/iface"
+	"github.com/dawnzzz/hamble-tcp-server/logger"
+	"math"
+	"strings"
+	"sync"
+)
+
+const (
+	topicSeparator  = "/"
+	topicSingleWild = "+" // 匹配一个层级
+	topicMultiWild  = "#" // 匹配之后的所有层级，只能是最后一个层级
+
+	subscribeOK     = byte(0)
+	subscribeDenied = byte(1)
+)
+
+var (
+	ErrInvalidTopic    = errors.New("invalid topic")
+	ErrInvalidPattern  = errors.New("invalid topic pattern")
+	ErrInvalidTopicMsg = errors.New("invalid topic msg")
+)
+
+// validTopic 发布的主题不能为空，不能包含通配符
+func validTopic(topic string) bool {
+	if topic == "" || len(topic) > math.MaxUint16 {
+		return false
+	}
+
+	return !strings.ContainsAny(topic, topicSingleWild+topicMultiWild)
+}
+
+// validPattern 通配符必须占据整个层级，#只能是最后一个层级
+func validPattern(pattern string) bool {
+	if pattern == "" || len(pattern) > math.MaxUint16 {
+		return false
+	}
+
+	levels := strings.Split(pattern, topicSeparator)
+	for i, level := range levels {
+		if level == topicMultiWild {
+			if i != len(levels)-1 {
+				return false
+			}
+			continue
+		}
+
+		if level != topicSingleWild && strings.ContainsAny(level, topicSingleWild+topicMultiWild) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func encodePublish(topic string, data []byte) []byte {
+	buf := make([]byte, 2+len(topic)+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(topic)))
+	copy(buf[2:], topic)
+	copy(buf[2+len(topic):], data)
+
+	return buf
+}
+
+func decodePublish(buf []byte) (topic string, data []byte, err error) {
+	if len(buf) < 2 {
+		return "", nil, ErrInvalidTopicMsg
+	}
+
+	topicLen := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+topicLen {
+		return "", nil, ErrInvalidTopicMsg
+	}
+
+	return string(buf[2 : 2+topicLen]), buf[2+topicLen:], nil
+}
+
+func encodeSubscribeResult(pattern string, ok bool, reason string) []byte {
+	status := subscribeDenied
+	if ok {
+		status = subscribeOK
+	}
+
+	buf := make([]byte, 3, 3+len(pattern)+len(reason))
+	buf[0] = status
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(pattern)))
+	buf = append(buf, pattern...)
+
+	return append(buf, reason...)
+}
+
+func decodeSubscribeResult(buf []byte) (pattern string, ok bool, reason string, err error) {
+	if len(buf) < 3 {
+		return "", false, "", ErrInvalidTopicMsg
+	}
+
+	patternLen := int(binary.BigEndian.Uint16(buf[1:]))
+	if len(buf) < 3+patternLen {
+		return "", false, "", ErrInvalidTopicMsg
+	}
+
+	return string(buf[3 : 3+patternLen]), buf[0] == subscribeOK, string(buf[3+patternLen:]), nil
+}
+
+// subscriber 一个连接的所有订阅，待发送的主题消息放在有界队列中，由一个协程按顺序发送
+type subscriber struct {
+	conn     *Connection
+	patterns map[string]struct{}
+
+	queue   [][]byte // 编码之后的主题消息
+	size    int
+	sending bool // 是否有协程正在发送队列中的消息
+	mu      sync.Mutex
+}
+
+// push 将主题消息放入队列，队列满时按照 topic_queue_policy 处理
+func (sub *subscriber) push(payload []byte) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if len(sub.queue) >= sub.size {
+		metrics := sub.conn.cs.GetMetrics()
+		switch conf.Current().TopicQueuePolicy {
+		case OverflowPolicyDropNewest:
+			metrics.Inc(iface.MetricTopicDropped)
+			return
+		case OverflowPolicyDisconnect:
+			logger.Warnf("topic queue of connection from %s is full, disconnect slow consumer", sub.conn.RemoteAddr())
+			metrics.Inc(iface.MetricSlowConsumer)
+			sub.conn.exit()
+			return
+		default:
+			// 丢弃最早的消息，腾出位置
+			metrics.Inc(iface.MetricTopicDropped)
+			sub.queue[0] = nil
+			sub.queue = sub.queue[1:]
+		}
+	}
+
+	sub.queue = append(sub.queue, payload)
+	if !sub.sending {
+		sub.sending = true
+		go sub.drain()
+	}
+}
+
+// drain 将队列中的消息按顺序推入连接的发送队列，队列为空时退出
+func (sub *subscriber) drain() {
+	for {
+		sub.mu.Lock()
+		if len(sub.queue) == 0 {
+			sub.sending = false
+			sub.mu.Unlock()
+			return
+		}
+		payload := sub.queue[0]
+		sub.queue[0] = nil
+		sub.queue = sub.queue[1:]
+		sub.mu.Unlock()
+
+		if err := sub.conn.SendBufMsg(iface.PublishMsgID, payload); errors.Is(err, ErrConnClosed) {
+			sub.mu.Lock()
+			sub.queue, sub.sending = nil, false
+			sub.mu.Unlock()
+			return
+		}
+	}
+}
+
+// topicNode 主题树的一个层级
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[*subscriber]struct{}
+}
+
+func (node *topicNode) empty() bool {
+	return len(node.children) == 0 && len(node.subscribers) == 0
+}
+
+// match 收集匹配levels的订阅者
+func (node *topicNode) match(levels []string, out map[*subscriber]struct{}) {
+	if child := node.children[topicMultiWild]; child != nil {
+		for sub := range child.subscribers {
+			out[sub] = struct{}{}
+		}
+	}
+
+	if len(levels) == 0 {
+		for sub := range node.subscribers {
+			out[sub] = struct{}{}
+		}
+		return
+	}
+
+	if child := node.children[levels[0]]; child != nil {
+		child.match(levels[1:], out)
+	}
+	if child := node.children[topicSingleWild]; child != nil {
+		child.match(levels[1:], out)
+	}
+}
+
+// remove 删除levels对应的订阅，并删除空的层级
+func (node *topicNode) remove(levels []string, sub *subscriber) {
+	if len(levels) == 0 {
+		delete(node.subscribers, sub)
+		return
+	}
+
+	child := node.children[levels[0]]
+	if child == nil {
+		return
+	}
+
+	child.remove(levels[1:], sub)
+	if child.empty() {
+		delete(node.children, levels[0])
+	}
+}
+
+// topicTree 服务器的所有订阅
+type topicTree struct {
+	root        topicNode
+	subscribers map[*Connection]*subscriber
+	mu          sync.RWMutex
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{
+		subscribers: make(map[*Connection]*subscriber),
+	}
+}
+
+func (tree *topicTree) subscribe(c *Connection, pattern string) error {
+	if !validPattern(pattern) {
+		return ErrInvalidPattern
+	}
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	// 连接关闭时会在持有锁的情况下删除订阅，之后不能再订阅
+	if c.isClosed.Load() {
+		return ErrConnClosed
+	}
+
+	sub := tree.subscribers[c]
+	if sub == nil {
+		sub = &subscriber{
+			conn:     c,
+			patterns: make(map[string]struct{}),
+			size:     conf.Current().TopicQueueSize,
+		}
+		tree.subscribers[c] = sub
+	}
+	if _, exist := sub.patterns[pattern]; exist {
+		return nil
+	}
+	sub.patterns[pattern] = struct{}{}
+
+	node := &tree.root
+	for _, level := range strings.Split(pattern, topicSeparator) {
+		if node.children == nil {
+			node.children = make(map[string]*topicNode)
+		}
+		child := node.children[level]
+		if child == nil {
+			child = &topicNode{}
+			node.children[level] = child
+		}
+		node = child
+	}
+	if node.subscribers == nil {
+		node.subscribers = make(map[*subscriber]struct{})
+	}
+	node.subscribers[sub] = struct{}{}
+
+	return nil
+}
+
+func (tree *topicTree) unsubscribe(c *Connection, pattern string) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	sub := tree.subscribers[c]
+	if sub == nil {
+		return
+	}
+	if _, exist := sub.patterns[pattern]; !exist {
+		return
+	}
+
+	delete(sub.patterns, pattern)
+	tree.root.remove(strings.Split(pattern, topicSeparator), sub)
+	if len(sub.patterns) == 0 {
+		delete(tree.subscribers, c)
+	}
+}
+
+// patterns 返回连接的所有订阅
+func (tree *topicTree) patterns(c *Connection) []string {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	sub := tree.subscribers[c]
+	if sub == nil {
+		return nil
+	}
+
+	patterns := make([]string, 0, len(sub.patterns))
+	for pattern := range sub.patterns {
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns
+}
+
+// unsubscribeAll 连接关闭时删除连接的所有订阅
+func (tree *topicTree) unsubscribeAll(c *Connection) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	sub := tree.subscribers[c]
+	if sub == nil {
+		return
+	}
+
+	for pattern := range sub.patterns {
+		tree.root.remove(strings.Split(pattern, topicSeparator), sub)
+	}
+	delete(tree.subscribers, c)
+}
+
+// publish 将消息放入所有匹配的订阅者的队列，一个连接有多个匹配的订阅时只会收到一次
+func (tree *topicTree) publish(topic string, data []byte) int {
+	matched := make(map[*subscriber]struct{})
+
+	tree.mu.RLock()
+	tree.root.match(strings.Split(topic, topicSeparator), matched)
+	tree.mu.RUnlock()
+
+	if len(matched) == 0 {
+		return 0
+	}
+
+	payload := encodePublish(topic, data)
+	for sub := range matched {
+		sub.push(payload)
+	}
+
+	return len(matched)
+}
+
+// stopTopics 连接关闭时删除连接的所有订阅
+func (c *Connection) stopTopics() {
+	if c.topics != nil {
+		c.topics.unsubscribeAll(c)
+	}
+}
+
+// subscribeHandler 服务器收到客户端的订阅请求
+type subscribeHandler struct {
+	BaseHandler
+	server *Server
+}
+
+func (handler *subscribeHandler) Handle(request iface.IRequest) {
+	pattern := string(request.GetData())
+	request.Release()
+
+	conn := request.GetConnection()
+	err := handler.server.authorizeTopic(conn, iface.TopicSubscribe, pattern)
+	if err == nil {
+		err = handler.server.Subscribe(conn, pattern)
+	}
+
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+		logger.Debugf("connection from %s subscribe %q err: %v", conn.RemoteAddr(), pattern, err)
+	}
+	_ = conn.SendBufMsg(iface.SubscribeResultMsgID, encodeSubscribeResult(pattern, err == nil, reason))
+}
+
+// unsubscribeHandler 服务器收到客户端的取消订阅请求
+type unsubscribeHandler struct {
+	BaseHandler
+	server *Server
+}
+
+func (handler *unsubscribeHandler) Handle(request iface.IRequest) {
+	pattern := string(request.GetData())
+	request.Release()
+
+	_ = handler.server.Unsubscribe(request.GetConnection(), pattern)
+}
+
+// publishHandler 服务器收到客户端发布的消息，转发给所有匹配的订阅者
+type publishHandler struct {
+	BaseHandler
+	server *Server
+}
+
+func (handler *publishHandler) Handle(request iface.IRequest) {
+	topic, data, err := decodePublish(request.GetData())
+	if err == nil && !validTopic(topic) {
+		err = ErrInvalidTopic
+	}
+	if err == nil {
+		err = handler.server.authorizeTopic(request.GetConnection(), iface.TopicPublish, topic)
+	}
+	if err != nil {
+		logger.Debugf("drop publish from %s: %v", request.GetConnection().RemoteAddr(), err)
+		request.Release()
+		return
+	}
+
+	handler.server.Publish(topic, data)
+	request.Release()
+}
+
+// registerTopicHandler 注册服务器处理订阅和发布的Handler
+func (s *Server) registerTopicHandler() {
+	s.RegisterHandler(iface.SubscribeMsgID, &subscribeHandler{server: s})
+	s.RegisterHandler(iface.UnsubscribeMsgID, &unsubscribeHandler{server: s})
+	s.RegisterHandler(iface.PublishMsgID, &publishHandler{server: s})
+}
+
+func (s *Server) SetTopicAuthorizer(f iface.TopicAuthorizer) {
+	s.topicAuthorizer = f
+}
+
+func (s *Server) authorizeTopic(conn iface.IConnection, action iface.TopicAction, topic string) error {
+	if s.topicAuthorizer == nil {
+		return nil
+	}
+
+	if err := s.topicAuthorizer(conn, action, topic); err != nil {
+		s.metrics.Inc(iface.MetricTopicDenied)
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) Subscribe(conn iface.IConnection, pattern string) error {
+	c, ok := conn.(*Connection)
+	if !ok {
+		return errors.New("unsupported connection type")
+	}
+
+	return s.topics.subscribe(c, pattern)
+}
+
+func (s *Server) Unsubscribe(conn iface.IConnection, pattern string) error {
+	c, ok := conn.(*Connection)
+	if !ok {
+		return errors.New("unsupported connection type")
+	}
+
+	s.topics.unsubscribe(c, pattern)
+
+	return nil
+}
+
+// Publish 发布消息到主题，消息放入订阅者的队列之后立即返回
+func (s *Server) Publish(topic string, data []byte) int {
+	if !validTopic(topic) {
+		logger.Warnf("publish to invalid topic %q", topic)
+		return 0
+	}
+
+	s.metrics.Inc(iface.MetricTopicPublished)
+
+	return s.topics.publish(topic, data)
+}
+
+// topicMsgHandler 客户端收到订阅的主题消息
+type topicMsgHandler struct {
+	BaseHandler
+	onTopicMsg iface.OnTopicMsg
+}
+
+func (handler *topicMsgHandler) Handle(request iface.IRequest) {
+	topic, data, err := decodePublish(request.GetData())
+	if err != nil {
+		logger.Warnf("receive topic msg from %s err: %v", request.GetConnection().RemoteAddr(), err)
+		request.Release()
+		return
+	}
+
+	handler.onTopicMsg(request.GetConnection(), topic, append([]byte(nil), data...))
+	request.Release()
+}
+
+// subscribeResultHandler 客户端收到订阅结果
+type subscribeResultHandler struct {
+	BaseHandler
+	onSubscribeResult iface.OnSubscribeResult
+}
+
+func (handler *subscribeResultHandler) Handle(request iface.IRequest) {
+	pattern, ok, reason, err := decodeSubscribeResult(request.GetData())
+	request.Release()
+	if err != nil {
+		logger.Warnf("receive subscribe result from %s err: %v", request.GetConnection().RemoteAddr(), err)
+		return
+	}
+
+	handler.onSubscribeResult(request.GetConnection(), pattern, ok, reason)
+}
+
+func (c *Client) Subscribe(pattern string) error {
+	if !validPattern(pattern) {
+		return ErrInvalidPattern
+	}
+
+	return c.connection.SendBufMsg(iface.SubscribeMsgID, []byte(pattern))
+}
+
+func (c *Client) Unsubscribe(pattern string) error {
+	if !validPattern(pattern) {
+		return ErrInvalidPattern
+	}
+
+	return c.connection.SendBufMsg(iface.UnsubscribeMsgID, []byte(pattern))
+}
+
+func (c *Client) Publish(topic string, data []byte) error {
+	if !validTopic(topic) {
+		return ErrInvalidTopic
+	}
+
+	return c.connection.SendBufMsg(iface.PublishMsgID, encodePublish(topic, data))
+}
+
+func (c *Client) SetOnTopicMsg(f iface.OnTopicMsg) {
+	c.RegisterHandler(iface.PublishMsgID, &topicMsgHandler{onTopicMsg: f})
+}
+
+func (c *Client) SetOnSubscribeResult(f iface.OnSubscribeResult) {
+	c.RegisterHandler(iface.SubscribeResultMsgID, &subscribeResultHandler{onSubscribeResult: f})
+}
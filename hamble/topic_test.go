@@ -0,0 +1,126 @@
+package hamble
+
+import (
+	"strings"
+	"testing"
+)
+
+// matched 返回主题匹配的所有连接
+func matched(tree *topicTree, topic string) map[*Connection]bool {
+	subs := make(map[*subscriber]struct{})
+	tree.root.match(strings.Split(topic, topicSeparator), subs)
+
+	conns := make(map[*Connection]bool, len(subs))
+	for sub := range subs {
+		conns[sub.conn] = true
+	}
+
+	return conns
+}
+
+func TestTopicWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		miss    []string
+	}{
+		{"a/b", []string{"a/b"}, []string{"a", "a/b/c", "a/c"}},
+		{"a/+", []string{"a/b", "a/c"}, []string{"a", "a/b/c", "b/c"}},
+		{"a/+/c", []string{"a/b/c", "a/x/c"}, []string{"a/b", "a/b/d", "a/b/c/d"}},
+		{"a/#", []string{"a", "a/b", "a/b/c"}, []string{"b", "b/a"}},
+		{"#", []string{"a", "a/b/c"}, nil},
+		{"+/+", []string{"a/b", "x/y"}, []string{"a", "a/b/c"}},
+		{"+/b/#", []string{"a/b", "x/b/c/d"}, []string{"a/c", "b"}},
+	}
+
+	for _, test := range tests {
+		tree := newTopicTree()
+		conn := &Connection{}
+		if err := tree.subscribe(conn, test.pattern); err != nil {
+			t.Fatalf("subscribe %q err: %v", test.pattern, err)
+		}
+
+		for _, topic := range test.match {
+			if !matched(tree, topic)[conn] {
+				t.Errorf("pattern %q should match topic %q", test.pattern, topic)
+			}
+		}
+		for _, topic := range test.miss {
+			if matched(tree, topic)[conn] {
+				t.Errorf("pattern %q should not match topic %q", test.pattern, topic)
+			}
+		}
+	}
+}
+
+func TestTopicMatchOncePerConnection(t *testing.T) {
+	tree := newTopicTree()
+	c1, c2 := &Connection{}, &Connection{}
+	for _, pattern := range []string{"a/b", "a/+", "a/#"} {
+		if err := tree.subscribe(c1, pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.subscribe(c2, "+/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	subs := make(map[*subscriber]struct{})
+	tree.root.match([]string{"a", "b"}, subs)
+	if len(subs) != 2 {
+		t.Fatalf("expect each connection matched once, got %v subscribers", len(subs))
+	}
+}
+
+func TestTopicUnsubscribe(t *testing.T) {
+	tree := newTopicTree()
+	conn := &Connection{}
+	_ = tree.subscribe(conn, "a/+")
+	_ = tree.subscribe(conn, "a/b/#")
+
+	tree.unsubscribe(conn, "a/+")
+	if matched(tree, "a/c")[conn] {
+		t.Fatal("unsubscribed pattern should not match")
+	}
+	if !matched(tree, "a/b/c")[conn] {
+		t.Fatal("other patterns should still match")
+	}
+
+	tree.unsubscribeAll(conn)
+	if !tree.root.empty() || len(tree.subscribers) != 0 {
+		t.Fatal("expect empty levels removed after unsubscribing all patterns")
+	}
+}
+
+func TestTopicValidation(t *testing.T) {
+	for _, pattern := range []string{"a", "a/+/c", "a/#", "#", "+", "a//b"} {
+		if !validPattern(pattern) {
+			t.Errorf("pattern %q should be valid", pattern)
+		}
+	}
+	for _, pattern := range []string{"", "a/#/b", "a/b+", "a/#b", "a+/b"} {
+		if validPattern(pattern) {
+			t.Errorf("pattern %q should be invalid", pattern)
+		}
+	}
+
+	if !validTopic("a/b") || validTopic("a/+") || validTopic("a/#") || validTopic("") {
+		t.Error("publish topic should not be empty or contain wildcards")
+	}
+
+	if err := newTopicTree().subscribe(&Connection{}, "a/#/b"); err != ErrInvalidPattern {
+		t.Fatalf("expect ErrInvalidPattern, got %v", err)
+	}
+}
+
+func TestPublishCodec(t *testing.T) {
+	topic, data, err := decodePublish(encodePublish("a/b", []byte("payload")))
+	if err != nil || topic != "a/b" || string(data) != "payload" {
+		t.Fatalf("unexpected decoded publish: topic=%q data=%q err=%v", topic, data, err)
+	}
+
+	pattern, ok, reason, err := decodeSubscribeResult(encodeSubscribeResult("a/+", false, "denied"))
+	if err != nil || pattern != "a/+" || ok || reason != "denied" {
+		t.Fatalf("unexpected decoded subscribe result: %q %v %q %v", pattern, ok, reason, err)
+	}
+}
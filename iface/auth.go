@@ -0,0 +1,30 @@
+package iface
+
+import "time"
+
+// Principal 通过认证的身份
+type Principal struct {
+	ID   string      // 身份的唯一标识，例如用户ID或者设备ID
+	Data interface{} // 认证时附带的其他信息
+}
+
+// Authenticator 连接的认证方式
+type Authenticator interface {
+	Hello(conn IConnection) []byte                                                // 连接建立时发送给客户端的数据，例如随机的challenge
+	Authenticate(conn IConnection, hello, credentials []byte) (*Principal, error) // 校验客户端发送的凭证，失败时error为拒绝的原因
+}
+
+// AuthOption 认证阶段的选项
+type AuthOption struct {
+	Timeout       time.Duration // 在此时间内没有通过认证的连接会被关闭，为0则使用配置文件中的 auth_timeout
+	AllowedMsgIDs []uint32      // 通过认证之前允许处理的MsgID，认证和心跳相关的消息总是允许的
+}
+
+// OnAuthenticated 连接通过认证时的Hook函数
+type OnAuthenticated func(conn IConnection, principal *Principal)
+
+// OnAuthResult 客户端收到认证结果时的Hook函数，认证失败时detail为拒绝的原因，成功时为身份的唯一标识
+type OnAuthResult func(conn IConnection, ok bool, detail string)
+
+// CredentialsFunc 客户端根据服务器发送的hello生成凭证
+type CredentialsFunc func(conn IConnection, hello []byte) []byte
@@ -1,6 +1,9 @@
 package iface
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type IClient interface {
 	ICSBase
@@ -9,4 +12,19 @@ type IClient interface {
 	GetConnection() IConnection             // 获取连接
 	StartHeartbeat(interval time.Duration)  // 开始心跳检测
 	StartHeartbeatWithOption(CheckerOption) // 开始心跳检测，使用CheckerOption
+	SetCredentials(CredentialsFunc)         // 设置收到服务器的hello之后发送的凭证
+	SetOnAuthResult(OnAuthResult)           // 设置收到认证结果时的Hook函数
+	EnableSession()                         // 开启会话，记录服务器发送的会话令牌，重连时恢复会话
+	GetSessionToken() string                // 获取会话令牌，还没有收到时为空
+	Reconnect() error                       // 重新连接服务器，开启会话时恢复之前的会话，之后需要调用Start
+
+	Subscribe(pattern string) error          // 订阅主题，订阅结果通过OnSubscribeResult通知
+	Unsubscribe(pattern string) error        // 取消订阅
+	Publish(topic string, data []byte) error // 发布消息到主题
+	SetOnTopicMsg(OnTopicMsg)                // 设置收到订阅的主题消息时的Hook函数
+	SetOnSubscribeResult(OnSubscribeResult)  // 设置收到订阅结果时的Hook函数
+
+	Call(ctx context.Context, msgID uint32, data []byte) (IMessage, error) // 发送请求并等待对端通过Reply回复，最多等待到ctx结束
+
+	Invoke(ctx context.Context, method string, req, resp interface{}) error // 调用服务端注册的服务方法，method为 服务名.方法名
 }
@@ -0,0 +1,48 @@
+package iface
+
+import (
+	"context"
+	"time"
+)
+
+// 连接池选择连接的策略
+const (
+	PoolBalanceRoundRobin     = "round_robin"     // 轮询
+	PoolBalanceLeastInflight  = "least_inflight"  // 正在处理的请求最少的连接
+	PoolBalanceConsistentHash = "consistent_hash" // 按照key一致性哈希选择地址，没有key时轮询
+)
+
+// ClientPoolOption 连接池的选项
+type ClientPoolOption struct {
+	Network string   // tcp or tcp4 or tcp6，为空则为tcp
+	Addrs   []string // 服务器地址 host:port
+	UseTLS  bool     // 使用TLS连接
+	Balance string   // 选择连接的策略 round_robin/least_inflight/consistent_hash，为空则为round_robin
+
+	MinIdle  int // 每个地址至少保持的空闲连接数，为0则为1
+	MaxIdle  int // 每个地址最多保持的空闲连接数，多余的空闲连接会被关闭，为0则不限制
+	MaxConns int // 每个地址的最大连接数，为0则不限制
+
+	HeartbeatInterval time.Duration // 连接的心跳间隔，对端不存活时关闭连接并重新建立，为0则不开启心跳检测
+	CheckInterval     time.Duration // 检查连接数和重连的间隔，为0则为1s
+
+	OnNewClient func(client IClient) // 创建连接之后、启动之前调用，可以注册Handler和Hook函数
+
+	Resolver Resolver // 服务发现，不为nil时忽略Addrs，服务器地址随解析结果变化
+}
+
+// IClientPool 客户端连接池，保持到一个或多个服务器地址的多个连接
+type IClientPool interface {
+	SendMsg(msgID uint32, data []byte) error                               // 选择一个连接直接发送消息
+	SendBufMsg(msgID uint32, data []byte) error                            // 选择一个连接将消息发送到有缓冲区的通道中
+	Call(ctx context.Context, msgID uint32, data []byte) (IMessage, error) // 选择一个连接发送请求并等待回复
+
+	SendMsgByKey(key string, msgID uint32, data []byte) error                               // 按照key选择连接发送消息
+	CallByKey(ctx context.Context, key string, msgID uint32, data []byte) (IMessage, error) // 按照key选择连接发送请求并等待回复
+	Do(key string, f func(client IClient) error) error                                      // 按照key选择连接执行f，执行期间计入该连接正在处理的请求数
+
+	SetAddrs(addrs []string) error // 替换服务器地址，新的地址建立连接，移除的地址关闭连接
+	Addrs() []string               // 获取服务器地址
+	Len() int                      // 获取可用的连接数
+	Close()                        // 关闭所有连接
+}
@@ -1,6 +1,10 @@
 package iface
 
-import "net"
+import (
+	"context"
+	"net"
+	"time"
+)
 
 // IConnection 与客户端连接的抽象表示
 type IConnection interface {
@@ -8,12 +12,33 @@ type IConnection interface {
 	Stop()             // 停止连接，结束当前连接状态M
 	GetConn() net.Conn // 获取原始socket TCP连接
 	RemoteAddr() string
-	SendMsg(msgID uint32, data []byte) error    // 直接将Message数据发送数据给远程的TCP客户端
-	SendBufMsg(msgID uint32, data []byte) error // 将Message发送到有缓冲区的通道中等待发送
+	SendMsg(msgID uint32, data []byte) error                              // 直接将Message数据发送数据给远程的TCP客户端
+	SendBufMsg(msgID uint32, data []byte) error                           // 将Message发送到有缓冲区的通道中等待发送
+	TrySend(msgID uint32, data []byte) error                              // 将Message发送到有缓冲区的通道中，通道满时不阻塞直接返回错误
+	SendReliable(msgID uint32, data []byte) error                         // 发送需要对端确认的消息，超时没有确认时重发
+	SendWithTimeout(ctx context.Context, msgID uint32, data []byte) error // 将Message发送到有缓冲区的通道中，通道满时最多阻塞到ctx结束
+
+	AfterFunc(d time.Duration, f func(conn IConnection)) ITimer    // d之后执行一次f，连接关闭时自动取消
+	Every(interval time.Duration, f func(conn IConnection)) ITimer // 每隔interval执行一次f，连接关闭时自动取消
 
 	SetProperty(key string, value interface{}) // 设置连接属性
 	GetProperty(key string) interface{}        // 获取连接属性
 	RemoveProperty(key string)                 // 移除连接属性
 
 	IsAlive() bool // 检测连接是否存活
+
+	SetIdleTimeout(kind IdleKind, timeout time.Duration) // 设置该连接的空闲时间，覆盖服务器的设置，为0则不检测
+	GetLastReadTime() time.Time                          // 上一次读到数据的时间
+	GetLastWriteTime() time.Time                         // 上一次写出数据的时间
+
+	GetHeartBeatChecker() IHeartBeatChecker // 获取该连接的心跳检测器，未开启心跳检测时为nil
+	Stats() ConnStats                       // 获取连接质量统计，由ping/pong心跳计算
+
+	GetPrincipal() *Principal // 获取通过认证的身份，未通过认证时为nil
+	IsAuthenticated() bool    // 是否已经通过认证，未开启认证时总是返回true
+
+	GetSession() ISession // 获取连接绑定的会话，未开启会话时为nil
+
+	GetConnID() uint64                // 获取连接ID，在同一个进程中唯一，经过网关转发的连接也由后端分配
+	OnClose(f func(conn IConnection)) // 注册连接关闭时调用的函数，连接已经关闭时立即调用
 }
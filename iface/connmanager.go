@@ -6,4 +6,12 @@ type IConnManager interface {
 	Remove(connection IConnection) // 删除链接
 	Len() int                      // 获取链接个数
 	Clear()                        // 清除所有的链接
+
+	Bind(connection IConnection, userID string) error          // 将链接绑定到用户，链接关闭时自动解除绑定
+	Unbind(connection IConnection)                             // 解除链接与用户的绑定
+	ConnsOf(userID string) []IConnection                       // 获取用户的所有链接，按绑定的先后顺序排列
+	UserOf(connection IConnection) string                      // 获取链接绑定的用户，没有绑定时为空
+	Users() []string                                           // 获取所有绑定了链接的用户
+	Range(f func(connection IConnection) bool)                 // 遍历所有的链接，f返回false时停止遍历
+	SendToUser(userID string, msgID uint32, data []byte) error // 向用户的所有链接发送消息
 }
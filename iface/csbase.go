@@ -1,15 +1,42 @@
 package iface
 
+import "time"
+
+// OnRateLimited 消息超过限流时的Hook函数，reason为超过的限制
+type OnRateLimited func(conn IConnection, msgID uint32, reason string)
+
 // ICSBase ISserver和IClient的祖先，这两个接口都继承于此
 type ICSBase interface {
-	RegisterHandler(id uint32, handler IHandler) // 注册Handler
-	GetRouter() IRouter                          // 获取Router
-	GetConnManager() IConnManager                // 获取ConnManager
-	SetOnConnStart(func(conn IConnection))       // 设置连接创建时的Hook函数
-	SetOnConnStop(func(conn IConnection))        // 设置连接结束时的Hook函数
-	CallOnConnStart(conn IConnection)            // 调用连接创建时的Hook函数
-	CallOnConnStop(conn IConnection)             // 调用连接结束时的Hook函数
-	GetHeartBeatChecker() IHeartBeatChecker      // 获取心跳检测器
-	GetDataPack() IDataPack                      // 获取封包/解包方式
-	SetDataPack(dataPack IDataPack)              // 设置封包/解包方式
+	RegisterHandler(id uint32, handler IHandler)                     // 注册Handler
+	GetRouter() IRouter                                              // 获取Router
+	GetConnManager() IConnManager                                    // 获取ConnManager
+	SetOnConnStart(func(conn IConnection))                           // 设置连接创建时的Hook函数
+	SetOnConnStop(func(conn IConnection))                            // 设置连接结束时的Hook函数
+	CallOnConnStart(conn IConnection)                                // 调用连接创建时的Hook函数
+	CallOnConnStop(conn IConnection)                                 // 调用连接结束时的Hook函数
+	GetHeartBeatChecker() IHeartBeatChecker                          // 获取心跳检测器
+	GetScheduler() IScheduler                                        // 获取定时任务调度器
+	GetDataPack() IDataPack                                          // 获取封包/解包方式
+	SetDataPack(dataPack IDataPack)                                  // 设置封包/解包方式
+	GetMetrics() IMetrics                                            // 获取运行指标
+	SetOnRateLimited(OnRateLimited)                                  // 设置消息超过限流时的Hook函数
+	CallOnRateLimited(conn IConnection, msgID uint32, reason string) // 调用消息超过限流时的Hook函数
+	SetOnIdle(OnIdle)                                                // 设置连接空闲时的Hook函数
+	CallOnIdle(conn IConnection, kind IdleKind)                      // 调用连接空闲时的Hook函数
+	SetIdleTimeout(kind IdleKind, timeout time.Duration)             // 设置所有连接的空闲时间，覆盖配置文件，为0则不检测
+	GetIdleTimeout(kind IdleKind) time.Duration                      // 获取所有连接的空闲时间
+	SetAuthenticator(auth Authenticator, option AuthOption)          // 开启认证阶段，新连接需要通过认证才能处理其他消息
+	GetAuthenticator() Authenticator                                 // 获取认证方式，未开启认证时为nil
+	GetAuthOption() AuthOption                                       // 获取认证阶段的选项
+	SetOnAuthenticated(OnAuthenticated)                              // 设置连接通过认证时的Hook函数
+	CallOnAuthenticated(conn IConnection, principal *Principal)      // 调用连接通过认证时的Hook函数
+	SetReliableOption(option ReliableOption)                         // 设置可靠消息的选项
+	GetReliableOption() ReliableOption                               // 获取可靠消息的选项，为0的字段已经替换为配置文件中的值
+	SetOnDelivered(OnDelivered)                                      // 设置可靠消息被对端确认时的Hook函数
+	CallOnDelivered(conn IConnection, msg ReliableMsg)               // 调用可靠消息被对端确认时的Hook函数
+	SetOnSendFailed(OnSendFailed)                                    // 设置可靠消息发送失败时的Hook函数
+	CallOnSendFailed(conn IConnection, msg ReliableMsg, err error)   // 调用可靠消息发送失败时的Hook函数
+
+	SetCodec(codec ICodec) // 设置服务请求和回复的编码方式
+	GetCodec() ICodec      // 获取服务请求和回复的编码方式，未设置时为JSON
 }
@@ -1,7 +1,9 @@
 package iface
 
 type IDataPack interface {
-	GetHeadLen() uint32                //获取包头长度方法
-	Pack(msg IMessage) ([]byte, error) //封包方法
-	Unpack([]byte) (IMessage, error)   //拆包方法
+	GetHeadLen() uint32                                          //获取包头长度方法
+	Pack(msg IMessage) ([]byte, error)                           //封包方法
+	PackTo(dst []byte, msg IMessage) ([]byte, error)             //封包方法，将封包后的数据追加到dst之后并返回
+	Unpack([]byte) (IMessage, error)                             //拆包方法
+	UnpackHeader(head []byte) (dataLen, msgID uint32, err error) //解析包头，返回数据长度和MsgID
 }
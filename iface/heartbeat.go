@@ -20,9 +20,35 @@ type IHeartBeatChecker interface {
 	SendHeartBeatMsg() error
 	BindHandler(IHandler)
 	BindConn(IConnection)
+	BindScheduler(IScheduler)   // 使用共用的调度器驱动心跳检测，不再为每个连接创建协程
+	BindMetrics(IMetrics)       // 记录心跳相关的指标
+	HandlePong(data []byte)     // 收到pong消息时调用，计算RTT
+	SetInterval(time.Duration)  // 修改心跳间隔，运行时修改立即生效
+	GetInterval() time.Duration // 获取心跳间隔
+	SetTimeout(time.Duration)   // 设置多长时间没有收到消息视为不存活，为0则使用配置文件中的 max_heartbeat_time
+	Stats() ConnStats           // 获取连接质量统计
 	Clone() IHeartBeatChecker
 }
 
+// HeartbeatMode 心跳模式
+type HeartbeatMode string
+
+const (
+	HeartbeatModeDefault  HeartbeatMode = ""          // 发送心跳消息，对端不回复
+	HeartbeatModePingPong HeartbeatMode = "ping_pong" // 发送带序号和时间戳的ping消息，对端原样回复pong消息，用于计算RTT、抖动和丢包率
+)
+
+// ConnStats 连接质量统计，只有ping/pong心跳模式下才有数据
+type ConnStats struct {
+	RTT          time.Duration // 最近一次的往返时间
+	SmoothedRTT  time.Duration // 平滑之后的往返时间
+	Jitter       time.Duration // 往返时间的抖动
+	Loss         float64       // 最近的ping消息中没有收到pong的比例
+	PingSent     uint64        // 发送的ping消息数
+	PongReceived uint64        // 收到的pong消息数
+	LastPongTime time.Time     // 上一次收到pong消息的时间
+}
+
 const DefaultHeartbeatMsgID = uint32(11111)
 
 // CheckerOption 用户可以自定义的心跳检测机制选项
@@ -33,4 +59,6 @@ type CheckerOption struct {
 	HeartBeatFunc    HeartBeatFunc    // 用户一定义的心跳函数
 	MsgID            uint32           // 心跳消息的消息id
 	Handler          IHandler
+	Mode             HeartbeatMode // 心跳模式
+	Negotiate        bool          // 连接建立时向对端通告心跳间隔和超时时间，对端的心跳检测器会自动调整
 }
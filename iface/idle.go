@@ -0,0 +1,26 @@
+package iface
+
+// IdleKind 连接空闲的类型
+type IdleKind int
+
+const (
+	ReaderIdle IdleKind = iota // 一段时间内没有读到数据
+	WriterIdle                 // 一段时间内没有写出数据
+	AllIdle                    // 一段时间内既没有读到数据也没有写出数据
+)
+
+func (kind IdleKind) String() string {
+	switch kind {
+	case ReaderIdle:
+		return "reader_idle"
+	case WriterIdle:
+		return "writer_idle"
+	case AllIdle:
+		return "all_idle"
+	default:
+		return "unknown_idle"
+	}
+}
+
+// OnIdle 连接空闲时的Hook函数，连接持续空闲时每隔一个空闲时间调用一次
+type OnIdle func(conn IConnection, kind IdleKind)
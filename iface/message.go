@@ -9,3 +9,38 @@ type IMessage interface {
 	SetData(data []byte)      // 设置数据包数据
 	SetDataLen(length uint32) // 设置数据长度
 }
+
+// 框架保留的消息ID
+const (
+	ConnRejectMsgID  = uint32(11112) // 拒绝连接时发送给客户端的消息，数据为拒绝原因
+	RateLimitedMsgID = uint32(11113) // 消息超过限流时回复的消息，数据为被限流的MsgID（4字节大端）+原因
+	PingMsgID        = uint32(11114) // ping/pong心跳中的ping消息，数据为序号（4字节大端）+发送时间（8字节大端UnixNano）
+	PongMsgID        = uint32(11115) // ping/pong心跳中的pong消息，原样返回ping消息的数据
+
+	HeartbeatConfigMsgID = uint32(11116) // 通告的心跳参数，数据为心跳间隔（4字节大端，毫秒）+超时时间（4字节大端，毫秒）
+
+	AuthHelloMsgID  = uint32(11117) // 服务器开启认证时，连接建立后发送给客户端的消息，数据为Authenticator生成的hello
+	AuthMsgID       = uint32(11118) // 客户端发送的认证消息，数据为凭证
+	AuthResultMsgID = uint32(11119) // 认证结果，数据为状态（1字节，0表示成功）+身份的唯一标识或者拒绝的原因
+
+	SessionMsgID       = uint32(11120) // 服务器开启会话时发送给客户端的会话令牌，数据为类型（1字节，0新建/1恢复/2恢复失败）+令牌
+	SessionResumeMsgID = uint32(11121) // 客户端重连之后恢复会话，数据为已经收到的最大序号（8字节大端）+令牌
+	ReliableMsgID      = uint32(11122) // 需要确认的消息，数据为序号（8字节大端）+MsgID（4字节大端）+原始数据
+	ReliableAckMsgID   = uint32(11123) // 累计确认，数据为已经收到的最大序号（8字节大端）
+
+	SubscribeMsgID       = uint32(11124) // 订阅主题，数据为主题模式，以/分隔层级，+匹配一个层级，#匹配之后的所有层级
+	UnsubscribeMsgID     = uint32(11125) // 取消订阅，数据为订阅时的主题模式
+	PublishMsgID         = uint32(11126) // 发布到主题的消息，数据为主题长度（2字节大端）+主题+原始数据
+	SubscribeResultMsgID = uint32(11127) // 订阅结果，数据为状态（1字节，0表示成功）+主题模式长度（2字节大端）+主题模式+拒绝的原因
+
+	GatewayMsgID      = uint32(11128) // 网关与后端之间转发的消息，数据为客户端连接ID（8字节大端）+MsgID（4字节大端）+原始数据，连接ID为0时为健康检查
+	GatewayCloseMsgID = uint32(11129) // 网关通知后端客户端连接已经关闭，或者后端要求网关关闭客户端连接，数据为客户端连接ID（8字节大端）
+
+	CallMsgID  = uint32(11130) // 需要回复的请求，数据为请求ID（8字节大端）+MsgID（4字节大端）+原始数据
+	ReplyMsgID = uint32(11131) // 请求的回复，数据为请求ID（8字节大端）+MsgID（4字节大端）+原始数据
+
+	GatewayAuthMsgID = uint32(11132) // 网关与后端之间的认证握手，数据为步骤（1字节）+随机数和HMAC，认证通过之前不处理转发的消息
+
+	ReservedMsgIDMin = ConnRejectMsgID  // 框架保留的消息ID的下界，用户定义的MsgID不能在[ReservedMsgIDMin, ReservedMsgIDMax]内
+	ReservedMsgIDMax = GatewayAuthMsgID // 框架保留的消息ID的上界
+)
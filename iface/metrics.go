@@ -0,0 +1,51 @@
+package iface
+
+// IMetrics 运行指标的抽象表示，以名称区分不同的计数器
+type IMetrics interface {
+	Inc(name string)               // 计数器加一
+	Add(name string, delta uint64) // 计数器加delta
+	Get(name string) uint64        // 获取计数器的值
+	Snapshot() map[string]uint64   // 获取所有计数器的快照
+}
+
+// 内置的指标名称
+const (
+	MetricConnAccepted   = "conn_accepted"   // 接受的连接数
+	MetricConnRejected   = "conn_rejected"   // 拒绝的连接数，按原因细分的指标为 conn_rejected_<reason>
+	MetricRateLimited    = "rate_limited"    // 超过限流的消息数，按原因细分的指标为 rate_limited_<reason>
+	MetricSendDropped    = "send_dropped"    // 发送队列满时丢弃的消息数
+	MetricTaskDropped    = "task_dropped"    // Worker任务队列满或者Worker池关闭时丢弃的请求数
+	MetricSlowConsumer   = "slow_consumer"   // 因为队列满而断开的连接数
+	MetricPingSent       = "ping_sent"       // 发送的ping消息数
+	MetricPongReceived   = "pong_received"   // 收到的pong消息数
+	MetricRTTMicros      = "rtt_us"          // 所有pong消息的往返时间之和（微秒），除以pong_received得到平均值
+	MetricPingLost       = "ping_lost"       // 没有收到pong的ping消息数
+	MetricAuthSuccess    = "auth_success"    // 通过认证的连接数
+	MetricAuthFailed     = "auth_failed"     // 认证失败的连接数
+	MetricAuthTimeout    = "auth_timeout"    // 认证超时的连接数
+	MetricUnauthMsg      = "unauth_msg"      // 认证之前收到的不允许处理的消息数
+	MetricSessionNew     = "session_new"     // 新建的会话数
+	MetricSessionResumed = "session_resumed" // 恢复的会话数
+	MetricSessionExpired = "session_expired" // 超过宽限期被删除的会话数
+
+	MetricHeartbeatMissed = "heartbeat_missed" // 发送队列满时没有发送的心跳和ping消息数
+
+	MetricRetransmit   = "reliable_retransmit" // 超时重发的可靠消息数
+	MetricReliableFail = "reliable_failed"     // 发送失败的可靠消息数
+	MetricDuplicateMsg = "reliable_duplicate"  // 收到的重复的可靠消息数
+
+	MetricOutboxStored    = "outbox_stored"    // 保存到离线消息中的消息数
+	MetricOutboxDelivered = "outbox_delivered" // 投递的离线消息数
+
+	MetricTopicPublished = "topic_published" // 发布到主题的消息数
+	MetricTopicDropped   = "topic_dropped"   // 订阅者队列满时丢弃的消息数
+	MetricTopicDenied    = "topic_denied"    // 没有通过授权的订阅和发布数
+
+	MetricClusterForwarded = "cluster_forwarded" // 转发给其他节点的消息数
+	MetricClusterReceived  = "cluster_received"  // 收到其他节点转发的消息数
+	MetricClusterDropped   = "cluster_dropped"   // 节点间连接的发送队列满时丢弃的消息数
+
+	MetricGatewayForwarded = "gateway_forwarded" // 网关转发给后端的消息数
+	MetricGatewayReplied   = "gateway_replied"   // 网关转发给客户端的后端回复数
+	MetricGatewayDropped   = "gateway_dropped"   // 没有健康的后端实例时网关丢弃的消息数
+)
@@ -0,0 +1,26 @@
+package iface
+
+import "time"
+
+// OutboxMsg 等待投递给离线客户端的消息
+type OutboxMsg struct {
+	ID       uint64 // 存储分配的唯一标识，同一个客户端的消息按保存顺序递增
+	MsgID    uint32
+	Data     []byte
+	ExpireAt time.Time // 过期时间，零值表示不过期
+}
+
+// OutboxOption 离线消息存储的选项，为0的字段表示不限制
+type OutboxOption struct {
+	TTL      time.Duration // 消息保存的最长时间
+	MaxMsgs  int           // 每个客户端最多保存的消息数
+	MaxBytes int           // 每个客户端最多保存的数据字节数
+}
+
+// OutboxStore 离线消息的存储，客户端以身份的唯一标识区分。超过容量时删除最早的消息
+type OutboxStore interface {
+	Put(identity string, msgID uint32, data []byte) (uint64, error) // 保存消息，返回消息的唯一标识
+	Load(identity string) ([]OutboxMsg, error)                      // 按保存顺序获取所有未过期的消息
+	Remove(identity string, ids ...uint64) error                    // 删除已经投递的消息
+	Close() error                                                   // 关闭存储
+}
@@ -0,0 +1,25 @@
+package iface
+
+import "time"
+
+// ReliableMsg 需要对端确认的消息
+type ReliableMsg struct {
+	Seq   uint64 // 序号，同一个连接（开启会话时同一个会话）中从1开始递增
+	MsgID uint32
+	Data  []byte
+
+	OutboxID uint64 // 从离线消息存储投递的消息在存储中的ID，其他消息为0
+}
+
+// ReliableOption 可靠消息的选项，为0的字段使用配置文件中的值
+type ReliableOption struct {
+	AckTimeout time.Duration // 超过此时间没有收到确认时重发
+	MaxRetries int           // 超时重发的最大次数，超过之后视为发送失败
+	MaxPending int           // 每个连接最多等待确认的消息数
+}
+
+// OnDelivered 可靠消息被对端确认时的Hook函数
+type OnDelivered func(conn IConnection, msg ReliableMsg)
+
+// OnSendFailed 可靠消息发送失败时的Hook函数，会话过期导致的失败conn为nil
+type OnSendFailed func(conn IConnection, msg ReliableMsg, err error)
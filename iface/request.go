@@ -5,4 +5,8 @@ type IRequest interface {
 	GetConnection() IConnection
 	GetData() []byte
 	GetMsgID() uint32
+	Release() // 归还请求数据所在的缓冲区，调用之后不能再使用请求数据
+
+	GetCallID() uint64                     // 请求ID，不是由Call发送的请求为0
+	Reply(msgID uint32, data []byte) error // 回复请求，由Call发送的请求回复给对端的Call，否则直接发送消息
 }
@@ -0,0 +1,14 @@
+package iface
+
+import "context"
+
+// Endpoint 服务的一个地址
+type Endpoint struct {
+	Addr string // host:port
+}
+
+// Resolver 服务发现，获取服务的所有地址并监听地址的变化
+type Resolver interface {
+	Resolve(ctx context.Context) ([]Endpoint, error)                      // 获取服务当前的所有地址
+	Watch(ctx context.Context, onChange func(endpoints []Endpoint)) error // 在新的协程中监听地址，先以当前的地址调用一次onChange，之后地址变化时调用，ctx结束时停止
+}
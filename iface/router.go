@@ -1,9 +1,14 @@
 package iface
 
 type IRouter interface {
-	AddRouter(id uint32, handler IHandler) // 注册路由
-	GetHandler(id uint32) IHandler         // 根据id获取handler
+	AddRouter(id uint32, handler IHandler)            // 注册路由
+	AddRangeRouter(min, max uint32, handler IHandler) // 为[min, max]范围内的所有id注册路由，优先使用AddRouter注册的路由
+	GetHandler(id uint32) IHandler                    // 根据id获取handler
 	DoHandler(request IRequest)
 	StartWorkerPool()
-	SendMsgToTaskQueue(request IRequest)
+	StopWorkerPool()         // 停止所有Worker，之后的请求在新的协程中处理
+	WorkerPoolStarted() bool // Worker池是否已经启动，未启动时每个请求在新的协程中处理
+	SendMsgToTaskQueue(request IRequest) error
+
+	AddRouters(handlers map[uint32]IHandler) error // 一次注册多个路由，任意id已经注册时都不注册并返回错误
 }
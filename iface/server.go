@@ -1,6 +1,22 @@
 package iface
 
-import "time"
+import (
+	"net"
+	"time"
+)
+
+// OnConnReject 拒绝连接时的Hook函数，reason为拒绝的原因
+type OnConnReject func(conn net.Conn, reason string)
+
+// OnAccept 连接准入的Hook函数，在TLS握手和计入最大连接数之前调用，返回false时拒绝连接。
+// 在每个连接单独的协程中调用，耗时的检查不会阻塞接受其他连接
+type OnAccept func(conn net.Conn) (allow bool, reason string)
+
+// IIPFilter 黑白名单
+type IIPFilter interface {
+	Reload(allowList, denyList []string) error // 重新加载黑白名单
+	Allowed(ip net.IP) bool                    // 判断ip是否允许建立连接
+}
 
 // IServer TCP 服务器
 type IServer interface {
@@ -11,4 +27,27 @@ type IServer interface {
 	RegisterHandler(id uint32, handler IHandler) // 注册Handler
 	StartHeartbeat(interval time.Duration)       // 开始心跳检测
 	StartHeartbeatWithOption(CheckerOption)      // 开始心跳检测，使用CheckerOption
+	SetOnConnReject(OnConnReject)                // 设置拒绝连接时的Hook函数
+	SetOnAccept(OnAccept)                        // 设置连接准入的Hook函数
+	GetIPFilter() IIPFilter                      // 获取黑白名单
+
+	AdviseHeartbeat(conn IConnection, interval time.Duration) error // 要求客户端调整心跳间隔
+
+	EnableSession(option SessionOption)   // 开启会话，客户端可以在断线重连之后恢复会话
+	GetSession(token string) ISession     // 根据令牌获取会话，会话不存在或已过期时为nil
+	SetOnSessionResumed(OnSessionResumed) // 设置客户端恢复会话时的Hook函数
+	SetOnSessionExpired(OnSessionExpired) // 设置会话过期时的Hook函数
+
+	SetOutboxStore(store OutboxStore)                        // 设置离线消息的存储
+	SendTo(identity string, msgID uint32, data []byte) error // 向客户端发送可靠消息，客户端不在线时保存到离线消息中
+	DeliverOutbox(conn IConnection, identity string) error   // 将连接绑定到客户端身份，并投递保存的离线消息
+
+	SetTopicAuthorizer(TopicAuthorizer)                 // 设置主题的授权Hook函数，未设置时允许所有操作
+	Subscribe(conn IConnection, pattern string) error   // 为连接订阅主题，不经过授权
+	Unsubscribe(conn IConnection, pattern string) error // 为连接取消订阅
+	Publish(topic string, data []byte) int              // 发布消息到主题，返回匹配的订阅者数
+
+	EnableGateway(secret string) // 作为网关的后端，处理通过密钥认证的网关转发的消息，需要在Start之前调用
+
+	RegisterService(service interface{}) error // 注册服务的所有形如 func(ctx, *Req) (*Resp, error) 的方法
 }
@@ -0,0 +1,17 @@
+package iface
+
+// ICodec 服务请求和回复的编码方式
+type ICodec interface {
+	Marshal(v interface{}) ([]byte, error)      // 编码
+	Unmarshal(data []byte, v interface{}) error // 解码
+}
+
+// ServiceNamer 服务可以实现此接口指定服务名，未实现时使用类型名
+type ServiceNamer interface {
+	ServiceName() string
+}
+
+// ServiceMsgIDs 服务可以实现此接口为方法指定MsgID，key为方法名，未指定的方法根据服务名和方法名计算MsgID
+type ServiceMsgIDs interface {
+	MsgIDs() map[string]uint32
+}
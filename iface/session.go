@@ -0,0 +1,28 @@
+package iface
+
+import "time"
+
+// ISession 可以跨连接恢复的会话，连接断开之后在宽限期内保留会话的属性和未确认的消息，
+// 客户端使用会话令牌重连时重新绑定到新的连接
+type ISession interface {
+	GetToken() string                     // 获取会话令牌
+	GetConnection() IConnection           // 获取会话当前绑定的连接，连接断开时为nil
+	Send(msgID uint32, data []byte) error // 发送需要客户端确认的可靠消息，未确认的消息在恢复会话时按顺序重放
+	Pending() int                         // 获取未确认的消息数
+
+	SetProperty(key string, value interface{}) // 设置会话属性
+	GetProperty(key string) interface{}        // 获取会话属性
+	RemoveProperty(key string)                 // 移除会话属性
+}
+
+// SessionOption 会话的选项，为0的字段使用配置文件中的值
+type SessionOption struct {
+	GracePeriod time.Duration // 连接断开之后保留会话的时间
+	MaxPending  int           // 每个会话最多保留的未确认消息数
+}
+
+// OnSessionResumed 客户端恢复会话时的Hook函数，此时未确认的消息已经开始重放
+type OnSessionResumed func(conn IConnection, session ISession)
+
+// OnSessionExpired 会话超过宽限期没有恢复，被删除时的Hook函数
+type OnSessionExpired func(session ISession)
@@ -0,0 +1,15 @@
+package iface
+
+import "time"
+
+// ITimer 定时任务
+type ITimer interface {
+	Stop() bool // 取消定时任务，不会阻塞，返回定时任务是否仍在等待执行
+}
+
+// IScheduler 定时任务调度器，一个服务器或者客户端的所有连接共用一个调度器
+type IScheduler interface {
+	AfterFunc(d time.Duration, f func()) ITimer    // d之后执行一次f
+	Every(interval time.Duration, f func()) ITimer // 每隔interval执行一次f
+	Stop()                                         // 停止调度器，未执行的定时任务不再执行
+}
@@ -0,0 +1,29 @@
+package iface
+
+// TopicAction 对主题的操作
+type TopicAction int
+
+const (
+	TopicSubscribe TopicAction = iota // 订阅，topic为主题模式，可以包含通配符
+	TopicPublish                      // 客户端发布消息
+)
+
+func (action TopicAction) String() string {
+	switch action {
+	case TopicSubscribe:
+		return "subscribe"
+	case TopicPublish:
+		return "publish"
+	default:
+		return "unknown"
+	}
+}
+
+// TopicAuthorizer 主题的授权Hook函数，返回error时拒绝操作，error为拒绝的原因
+type TopicAuthorizer func(conn IConnection, action TopicAction, topic string) error
+
+// OnTopicMsg 客户端收到订阅的主题消息时的Hook函数
+type OnTopicMsg func(conn IConnection, topic string, data []byte)
+
+// OnSubscribeResult 客户端收到订阅结果时的Hook函数，订阅失败时reason为拒绝的原因
+type OnSubscribeResult func(conn IConnection, pattern string, ok bool, reason string)
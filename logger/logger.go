@@ -4,58 +4,60 @@ import (
 	"github.com/sirupsen/logrus"
 	"io"
 	"os"
+	"sync/atomic"
 )
 
-var (
-	logger = logrus.New()
-	entry  = logrus.NewEntry(logger)
-)
+var logger = logrus.New()
+
+// entry 带有服务器字段的日志，同一个进程中启动多个服务器时会被并发替换
+var entry atomic.Pointer[logrus.Entry]
 
-var entryFields logrus.Fields
+func init() {
+	entry.Store(logrus.NewEntry(logger))
+}
 
 func Debug(args ...interface{}) {
-	entry.Info(args...)
+	entry.Load().Debug(args...)
 }
 
 func Info(args ...interface{}) {
-	entry.Info(args...)
+	entry.Load().Info(args...)
 }
 
 func Warn(args ...interface{}) {
-	entry.Info(args...)
+	entry.Load().Warn(args...)
 }
 
 func Error(args ...interface{}) {
-	entry.Error(args...)
+	entry.Load().Error(args...)
 }
 
 func Fatal(args ...interface{}) {
-	entry.Fatal(args...)
+	entry.Load().Fatal(args...)
 }
 
 func Debugf(format string, args ...interface{}) {
-	entry.Debugf(format, args...)
+	entry.Load().Debugf(format, args...)
 }
 
 func Infof(format string, args ...interface{}) {
-	entry.Infof(format, args...)
+	entry.Load().Infof(format, args...)
 }
 
 func Warnf(format string, args ...interface{}) {
-	entry.Warnf(format, args...)
+	entry.Load().Warnf(format, args...)
 }
 
 func Errorf(format string, args ...interface{}) {
-	entry.Errorf(format, args...)
+	entry.Load().Errorf(format, args...)
 }
 
 func Fatalf(format string, args ...interface{}) {
-	entry.Fatalf(format, args...)
+	entry.Load().Fatalf(format, args...)
 }
 
 func WithFields(fields logrus.Fields) {
-	entryFields = fields
-	entry = logger.WithFields(fields)
+	entry.Store(logger.WithFields(fields))
 }
 
 func SetMultiOutPut(writers ...io.Writer) {
@@ -76,5 +78,16 @@ func SetMultiOutPut(writers ...io.Writer) {
 
 	// 设置output
 	logger.SetOutput(multiWriter)
-	entry = logger.WithFields(entryFields)
+}
+
+// SetLevel 设置日志级别 debug/info/warn/error
+func SetLevel(level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	logger.SetLevel(lvl)
+
+	return nil
 }
@@ -0,0 +1,337 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupTimeFormat = "20060102T150405.000"
+	compressSuffix   = ".gz"
+	megabyte         = 1024 * 1024
+)
+
+// RotateOption 日志文件切割选项
+type RotateOption struct {
+	MaxSize    int           // 单个日志文件的最大大小（MB），为0则不按大小切割
+	Interval   time.Duration // 按时间切割的时间间隔，为0则不按时间切割。切割的时间点按本地时间对齐，例如24小时在每天零点切割
+	MaxBackups int           // 最多保留的历史日志文件个数，为0则全部保留
+	Compress   bool          // 是否使用gzip压缩历史日志文件
+}
+
+// RotateWriter 支持按大小、按时间切割的日志文件，实现了io.WriteCloser接口
+type RotateWriter struct {
+	fileName string
+	option   RotateOption
+
+	file        *os.File
+	size        int64     // 当前日志文件大小
+	periodStart time.Time // 当前日志文件所属的切割周期的开始时间
+	mu          sync.Mutex
+
+	millMu sync.Mutex // 保证压缩和清理历史日志文件串行执行
+}
+
+func NewRotateWriter(fileName string, option RotateOption) (*RotateWriter, error) {
+	w := &RotateWriter{
+		fileName: fileName,
+		option:   option,
+	}
+
+	if err := w.openFile(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Write 写入日志，必要时进行切割
+func (w *RotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		if err := w.openFile(); err != nil {
+			return 0, err
+		}
+	}
+
+	if w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+
+	return n, err
+}
+
+// Rotate 立即切割日志文件
+func (w *RotateWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.rotate()
+}
+
+// Reopen 关闭并重新打开日志文件，配合外部的logrotate使用
+func (w *RotateWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+
+	return w.openFile()
+}
+
+func (w *RotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.closeFile()
+}
+
+func (w *RotateWriter) shouldRotate(writeLen int64) bool {
+	if w.option.MaxSize > 0 && w.size+writeLen > int64(w.option.MaxSize)*megabyte {
+		return true
+	}
+
+	if w.option.Interval > 0 && !time.Now().Before(w.periodStart.Add(w.option.Interval)) {
+		return true
+	}
+
+	return false
+}
+
+func (w *RotateWriter) openFile() error {
+	if dir := filepath.Dir(w.fileName); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(w.fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+
+	// 重启或者Reopen时日志文件已经有内容，按最后一次写入的时间计算所属的周期，之前的周期已经结束时在下一次写入时切割
+	lastWrite := time.Now()
+	if w.size > 0 {
+		lastWrite = info.ModTime()
+	}
+	w.periodStart = periodStart(lastWrite, w.option.Interval)
+
+	return nil
+}
+
+// periodStart 计算t所属的切割周期的开始时间，周期按本地时间对齐
+func periodStart(t time.Time, interval time.Duration) time.Time {
+	if interval <= 0 {
+		return t
+	}
+
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+
+	return t.Add(shift).Truncate(interval).Add(-shift)
+}
+
+func (w *RotateWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
+
+// rotate 将当前日志文件重命名为历史日志文件，并打开新的日志文件
+func (w *RotateWriter) rotate() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+
+	backupName := w.backupName(time.Now())
+	if err := os.Rename(w.fileName, backupName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := w.openFile(); err != nil {
+		return err
+	}
+
+	// 压缩和清理历史日志文件比较耗时，放到后台进行
+	go w.mill(backupName)
+
+	return nil
+}
+
+// backupName 历史日志文件的文件名，同一毫秒内切割多次时加上序号，避免覆盖之前的历史日志文件
+func (w *RotateWriter) backupName(t time.Time) string {
+	dir := filepath.Dir(w.fileName)
+	ext := filepath.Ext(w.fileName)
+	prefix := strings.TrimSuffix(filepath.Base(w.fileName), ext)
+	timestamp := t.Format(backupTimeFormat)
+
+	name := filepath.Join(dir, fmt.Sprintf("%s-%s%s", prefix, timestamp, ext))
+	for i := 1; exists(name) || exists(name+compressSuffix); i++ {
+		name = filepath.Join(dir, fmt.Sprintf("%s-%s-%d%s", prefix, timestamp, i, ext))
+	}
+
+	return name
+}
+
+func exists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+// mill 压缩新产生的历史日志文件，并删除超出数量的历史日志文件
+func (w *RotateWriter) mill(backupName string) {
+	w.millMu.Lock()
+	defer w.millMu.Unlock()
+
+	if w.option.Compress {
+		if err := compressFile(backupName); err != nil {
+			Errorf("compress log file [%s] err: %v", backupName, err)
+		}
+	}
+
+	if w.option.MaxBackups <= 0 {
+		return
+	}
+
+	backups, err := w.backups()
+	if err != nil {
+		Errorf("list log backups err: %v", err)
+		return
+	}
+
+	for i := w.option.MaxBackups; i < len(backups); i++ {
+		if err := os.Remove(backups[i]); err != nil {
+			Errorf("remove log backup [%s] err: %v", backups[i], err)
+		}
+	}
+}
+
+// backups 获取所有的历史日志文件，按照时间从新到旧排列
+func (w *RotateWriter) backups() ([]string, error) {
+	dir := filepath.Dir(w.fileName)
+	ext := filepath.Ext(w.fileName)
+	prefix := strings.TrimSuffix(filepath.Base(w.fileName), ext) + "-"
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type backup struct {
+		name      string
+		timestamp string // 时间戳格式固定，可以直接按字符串比较
+		seq       int    // 同一毫秒内切割的序号
+	}
+
+	found := make([]backup, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		timestamp := strings.TrimSuffix(strings.TrimSuffix(name, compressSuffix), ext)
+		timestamp = strings.TrimPrefix(timestamp, prefix)
+		seq := 0
+		if i := strings.LastIndex(timestamp, "-"); i >= 0 {
+			if seq, err = strconv.Atoi(timestamp[i+1:]); err != nil || seq <= 0 {
+				continue
+			}
+			timestamp = timestamp[:i]
+		}
+		if _, err := time.Parse(backupTimeFormat, timestamp); err != nil {
+			continue
+		}
+
+		found = append(found, backup{name: filepath.Join(dir, name), timestamp: timestamp, seq: seq})
+	}
+
+	// 按照时间从新到旧排列，同一时间的序号大的更新
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].timestamp != found[j].timestamp {
+			return found[i].timestamp > found[j].timestamp
+		}
+		return found[i].seq > found[j].seq
+	})
+
+	backups := make([]string, len(found))
+	for i, b := range found {
+		backups[i] = b.name
+	}
+
+	return backups, nil
+}
+
+func compressFile(fileName string) (err error) {
+	src, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dstName := fileName + compressSuffix
+	dst, err := os.OpenFile(dstName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// 压缩失败，删除不完整的压缩文件
+			_ = os.Remove(dstName)
+		}
+	}()
+
+	gzWriter := gzip.NewWriter(dst)
+	if _, err = io.Copy(gzWriter, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+
+	if err = gzWriter.Close(); err != nil {
+		_ = dst.Close()
+		return err
+	}
+
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	_ = src.Close()
+
+	return os.Remove(fileName)
+}